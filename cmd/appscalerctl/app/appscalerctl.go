@@ -0,0 +1,271 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/accounting"
+	"github.com/v3io/app-resource-scaler/pkg/management"
+	"github.com/v3io/app-resource-scaler/pkg/resourcescaler"
+
+	"github.com/nuclio/errors"
+)
+
+const requestTimeout = 30 * time.Second
+
+// Run runs a single appscalerctl command against the management server at address, writing its output to out
+func Run(address string, args []string, out io.Writer) error {
+	client := &client{
+		address:    strings.TrimSuffix(address, "/"),
+		httpClient: &http.Client{Timeout: requestTimeout},
+	}
+
+	command, commandArgs := args[0], args[1:]
+	switch command {
+	case "pins":
+		return runPins(client, commandArgs, out)
+	case "pin":
+		return runPin(client, commandArgs, out)
+	case "unpin":
+		return runUnpin(client, commandArgs, out)
+	case "report":
+		return runReport(client, commandArgs, out)
+	default:
+		return errors.Errorf("Unknown command: %s", command)
+	}
+}
+
+func runPins(client *client, args []string, out io.Writer) error {
+	if len(args) != 0 {
+		return errors.New("pins takes no arguments")
+	}
+
+	var servicePins []resourcescaler.ServicePin
+	if err := client.do(http.MethodGet, management.PinsPath, nil, &servicePins); err != nil {
+		return errors.Wrap(err, "Failed to list pins")
+	}
+
+	tabWriter := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tabWriter, "SERVICE\tSTATE\tPINNED UNTIL\tEXPIRED")
+	for _, servicePin := range servicePins {
+		fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%t\n",
+			servicePin.Service,
+			servicePin.State,
+			servicePin.PinnedUntil.Format(time.RFC3339),
+			servicePin.Expired)
+	}
+
+	return tabWriter.Flush()
+}
+
+func runPin(client *client, args []string, out io.Writer) error {
+	flagSet := flag.NewFlagSet("pin", flag.ContinueOnError)
+	duration := flagSet.String("for", "", "How long to keep the service awake (e.g. 8h)")
+	until := flagSet.String("until", "", "When to stop keeping the service awake, in RFC3339")
+
+	serviceName, err := parseServiceName(flagSet, args)
+	if err != nil {
+		return err
+	}
+
+	var servicePin resourcescaler.ServicePin
+	if err := client.do(http.MethodPut,
+		management.PinsPath+"/"+url.PathEscape(serviceName),
+		&management.PinRequest{Until: *until, Duration: *duration},
+		&servicePin); err != nil {
+		return errors.Wrapf(err, "Failed to pin service %s", serviceName)
+	}
+
+	fmt.Fprintf(out, "Service %s is pinned until %s\n", servicePin.Service, servicePin.PinnedUntil.Format(time.RFC3339))
+	return nil
+}
+
+func runUnpin(client *client, args []string, out io.Writer) error {
+	flagSet := flag.NewFlagSet("unpin", flag.ContinueOnError)
+
+	serviceName, err := parseServiceName(flagSet, args)
+	if err != nil {
+		return err
+	}
+
+	if err := client.do(http.MethodDelete,
+		management.PinsPath+"/"+url.PathEscape(serviceName),
+		nil,
+		nil); err != nil {
+		return errors.Wrapf(err, "Failed to unpin service %s", serviceName)
+	}
+
+	fmt.Fprintf(out, "Service %s is unpinned\n", serviceName)
+	return nil
+}
+
+func runReport(client *client, args []string, out io.Writer) error {
+	flagSet := flag.NewFlagSet("report", flag.ContinueOnError)
+	from := flagSet.String("from", "", "First day of the report, in YYYY-MM-DD (defaults to a week before to)")
+	to := flagSet.String("to", "", "Last day of the report, in YYYY-MM-DD (defaults to today)")
+	serviceName := flagSet.String("service", "", "Only report the given service")
+	byDay := flagSet.Bool("by-day", false, "Report each day separately")
+
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+
+	if flagSet.NArg() != 0 {
+		return errors.New("report takes no arguments")
+	}
+
+	query := url.Values{}
+	for name, value := range map[string]string{"from": *from, "to": *to, "service": *serviceName} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+
+	report := accounting.Report{}
+	if err := client.do(http.MethodGet, management.ReportPath+"?"+query.Encode(), nil, &report); err != nil {
+		return errors.Wrap(err, "Failed to get report")
+	}
+
+	fmt.Fprintf(out, "Namespace %s, %s to %s\n\n", report.Namespace, report.From, report.To)
+
+	tabWriter := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if *byDay {
+		fmt.Fprintln(tabWriter, "DATE\tSERVICE\tSLEEP HOURS\tCPU CORE HOURS\tMEMORY GIB HOURS\tGPU HOURS")
+		for _, dayReport := range report.Days {
+			for _, reportedServiceName := range sortedServiceNames(dayReport.Services) {
+				writeUsage(tabWriter, dayReport.Date+"\t"+reportedServiceName, dayReport.Services[reportedServiceName])
+			}
+		}
+	} else {
+		fmt.Fprintln(tabWriter, "SERVICE\tSLEEP HOURS\tCPU CORE HOURS\tMEMORY GIB HOURS\tGPU HOURS")
+		for _, reportedServiceName := range sortedServiceNames(report.Services) {
+			writeUsage(tabWriter, reportedServiceName, report.Services[reportedServiceName])
+		}
+	}
+
+	totalLabel := "TOTAL"
+	if *byDay {
+		totalLabel = "TOTAL\t"
+	}
+	writeUsage(tabWriter, totalLabel, report.Total)
+
+	return tabWriter.Flush()
+}
+
+func writeUsage(out io.Writer, label string, usage accounting.Usage) {
+	fmt.Fprintf(out, "%s\t%.2f\t%.2f\t%.2f\t%.2f\n",
+		label,
+		usage.SleepHours,
+		usage.CPUCoreHours,
+		usage.MemoryGiBHours,
+		usage.GPUHours)
+}
+
+func sortedServiceNames(usageByService map[string]accounting.Usage) []string {
+	serviceNames := make([]string, 0, len(usageByService))
+	for serviceName := range usageByService {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+
+	return serviceNames
+}
+
+// parseServiceName parses the command's flags, which may come before or after the service name
+func parseServiceName(flagSet *flag.FlagSet, args []string) (string, error) {
+	var positionalArgs []string
+	for {
+		if err := flagSet.Parse(args); err != nil {
+			return "", err
+		}
+
+		if flagSet.NArg() == 0 {
+			break
+		}
+
+		positionalArgs = append(positionalArgs, flagSet.Arg(0))
+		args = flagSet.Args()[1:]
+	}
+
+	if len(positionalArgs) != 1 {
+		return "", errors.Errorf("%s takes exactly one service name", flagSet.Name())
+	}
+
+	return positionalArgs[0], nil
+}
+
+type client struct {
+	address    string
+	httpClient *http.Client
+}
+
+// do sends a request with a JSON body to the management server and decodes its JSON response into responseBody
+func (c *client) do(method string, path string, requestBody interface{}, responseBody interface{}) error {
+	var bodyReader io.Reader
+	if requestBody != nil {
+		body, err := json.Marshal(requestBody)
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal request")
+		}
+		bodyReader = bytes.NewReader(body)
+	}
+
+	request, err := http.NewRequest(method, c.address+path, bodyReader)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create request")
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return errors.Wrap(err, "Failed to send request")
+	}
+	defer response.Body.Close() // nolint: errcheck
+
+	if response.StatusCode >= http.StatusMultipleChoices {
+		errorResponse := management.ErrorResponse{}
+		if err := json.NewDecoder(response.Body).Decode(&errorResponse); err != nil || errorResponse.Error == "" {
+			return errors.Errorf("Request failed with status %d", response.StatusCode)
+		}
+		return errors.Errorf("Request failed with status %d: %s", response.StatusCode, errorResponse.Error)
+	}
+
+	if responseBody == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(responseBody); err != nil {
+		return errors.Wrap(err, "Failed to decode response")
+	}
+
+	return nil
+}
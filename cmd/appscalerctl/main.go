@@ -0,0 +1,61 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/v3io/app-resource-scaler/cmd/appscalerctl/app"
+
+	"github.com/nuclio/errors"
+)
+
+func main() {
+	address := flag.String("address", "http://localhost:8091", "Address of the autoscaler or dlx management server (the pins listener to pin or unpin)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] <command> [args]
+
+Commands:
+  pins                                           List the pinned services
+  pin <service> --for <duration>|--until <time>  Keep a service awake until the pin expires
+  unpin <service>                                Remove the pin of a service
+  report [--from <day>] [--to <day>] [--service <service>] [--by-day]
+                                                 Report the time services spent scaled to zero
+
+Flags:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := app.Run(*address, flag.Args(), os.Stdout); err != nil {
+		errors.PrintErrorStack(os.Stderr, err, 5)
+
+		os.Exit(1)
+	}
+}
@@ -17,77 +17,219 @@ limitations under the License.
 package app
 
 import (
-	"os"
-	"time"
+	"context"
+	"reflect"
 
+	"github.com/v3io/app-resource-scaler/pkg/accounting"
+	"github.com/v3io/app-resource-scaler/pkg/audit"
 	"github.com/v3io/app-resource-scaler/pkg/common"
+	"github.com/v3io/app-resource-scaler/pkg/config"
+	"github.com/v3io/app-resource-scaler/pkg/management"
+	"github.com/v3io/app-resource-scaler/pkg/metricsource"
+	"github.com/v3io/app-resource-scaler/pkg/notification"
+	"github.com/v3io/app-resource-scaler/pkg/prewarm"
 	"github.com/v3io/app-resource-scaler/pkg/resourcescaler"
 
 	"github.com/nuclio/errors"
 	"github.com/nuclio/logger"
 	nucliozap "github.com/nuclio/zap"
-	"github.com/v3io/scaler/pkg/autoscaler"
 	"github.com/v3io/scaler/pkg/scalertypes"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/discovery/cached/memory"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/restmapper"
+	metricsclientset "k8s.io/metrics/pkg/client/clientset/versioned"
 	"k8s.io/metrics/pkg/client/custom_metrics"
 )
 
-func Run(kubeconfigPath string,
-	namespace string,
-	scaleInterval time.Duration,
-	metricsResourceKind string,
-	metricsResourceGroup string) error {
+// Run runs the autoscaler with the configuration returned by loadConfig. If configPath is set, the configuration
+// is reloaded and applied whenever the file changes
+func Run(configPath string, loadConfig func() (*config.Config, error)) error {
+	autoScalerConfig, err := loadConfig()
+	if err != nil {
+		return errors.Wrap(err, "Failed to load configuration")
+	}
 
 	// create root logger
-	rootLogger, err := nucliozap.NewNuclioZap("app-resource-scaler",
-		"console",
-		nil,
-		os.Stdout,
-		os.Stderr,
-		nucliozap.DebugLevel)
+	rootLogger, err := common.NewLogger("app-resource-scaler", autoScalerConfig.LogLevel, autoScalerConfig.LogFormat)
 	if err != nil {
 		return errors.Wrap(err, "Failed creating a new logger")
 	}
 
+	rootLogger.DebugWith("Loaded configuration", "config", autoScalerConfig)
+
+	// create resource scaler
+	resourceScaler, err := createResourceScaler(rootLogger, autoScalerConfig)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create resource scaler")
+	}
+
+	if autoScalerConfig.AuditLog != "" {
+		auditLog, err := audit.NewLog(autoScalerConfig.AuditLog)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create audit log")
+		}
+
+		resourceScaler.SetAuditLog(auditLog)
+	}
+
+	if len(autoScalerConfig.Notifications.Sinks) != 0 {
+		notifier, err := notification.NewNotifier(rootLogger, autoScalerConfig.Notifications)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create notifier")
+		}
+		notifier.Start(context.Background())
+
+		resourceScaler.SetNotifier(notifier)
+	}
+
+	var resourceMetricsClient *metricsource.ResourceMetricsClient
+	if autoScalerConfig.AutoScaler.ResourceMetrics.PodLabel != "" {
+		resourceMetricsClient, err = newResourceMetricsClient(rootLogger, autoScalerConfig)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create resource metrics client")
+		}
+		resourceMetricsClient.Start(context.Background())
+	}
+
 	// create autoscaler
-	autoScaler, err := createAutoScaler(
-		rootLogger,
-		namespace,
-		kubeconfigPath,
-		scaleInterval,
-		metricsResourceKind,
-		metricsResourceGroup)
+	autoScalerRunner, metricsClient, err := createAutoScalerRunner(rootLogger,
+		resourceScaler,
+		resourceMetricsClient,
+		autoScalerConfig)
 	if err != nil {
 		return errors.Wrap(err, "Failed to create autoscaler")
 	}
 
+	// get resource scaler configuration
+	resourceScalerConfig, err := resourceScaler.GetConfig()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get resource scaler config")
+	}
+
 	// start autoscaler and run forever
-	if err := autoScaler.Start(); err != nil {
+	if err := autoScalerRunner.start(resourceScalerConfig.AutoScalerOptions); err != nil {
 		return errors.Wrap(err, "Failed to start autoscaler")
 	}
+
+	if autoScalerConfig.AutoScaler.Prewarm.Enabled || autoScalerConfig.AutoScaler.Prewarm.Predictor.Enabled {
+		prewarmer, err := prewarm.NewPrewarmer(rootLogger,
+			resourceScaler,
+			autoScalerConfig.AutoScaler.Prewarm,
+			autoScalerConfig.ResourceScaler.SetScaleTimeout.Duration)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create prewarmer")
+		}
+		prewarmer.Start(context.Background())
+	}
+
+	if autoScalerConfig.MetricsListenAddress != "" {
+		managementServer := management.NewServer(rootLogger, autoScalerConfig.MetricsListenAddress)
+		managementServer.HandlePins(resourceScaler, false)
+		managementServer.HandleReport(resourceScaler)
+		if err := managementServer.Start(); err != nil {
+			return errors.Wrap(err, "Failed to start management server")
+		}
+	}
+
+	if autoScalerConfig.PinsListenAddress != "" {
+		pinsServer := management.NewAPIServer(rootLogger, autoScalerConfig.PinsListenAddress)
+		pinsServer.HandlePins(resourceScaler, true)
+		if err := pinsServer.Start(); err != nil {
+			return errors.Wrap(err, "Failed to start pins server")
+		}
+	}
+
+	if configPath != "" && autoScalerConfig.ReloadInterval.Duration > 0 {
+		configWatcher, err := config.NewWatcher(rootLogger,
+			configPath,
+			autoScalerConfig.ReloadInterval.Duration,
+			loadConfig)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create configuration watcher")
+		}
+
+		currentConfig := autoScalerConfig
+		configWatcher.OnChange(func(reloadedConfig *config.Config) {
+			if applyConfig(rootLogger, resourceScaler, autoScalerRunner, metricsClient, currentConfig, reloadedConfig) {
+				currentConfig = reloadedConfig
+			}
+		})
+		configWatcher.Start(context.Background())
+	}
+
 	select {}
 }
 
-func createAutoScaler(logger logger.Logger,
-	namespace string,
-	kubeconfigPath string,
-	scaleInterval time.Duration,
-	metricsResourceKind string,
-	metricsResourceGroup string) (*autoscaler.Autoscaler, error) {
+// applyConfig applies a reloaded configuration, returning whether it was applied.
+//
+// The metrics source is replaced in place, while a changed scale interval or metrics resource kind restarts the
+// autoscaler (but not the process) with them
+func applyConfig(rootLogger *nucliozap.NuclioZap,
+	resourceScaler *resourcescaler.AppResourceScaler,
+	autoScalerRunner *autoScalerRunner,
+	metricsClient *metricsource.ReloadableMetricsClient,
+	currentConfig *config.Config,
+	reloadedConfig *config.Config) bool {
 
-	// create k8s rest config
-	customMetricsClient, err := newMetricsCustomClient(kubeconfigPath)
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to create new metric custom client")
+	// create the new metrics client first, so a bad configuration leaves the current one in use
+	var reloadedMetricsClient custom_metrics.CustomMetricsClient
+	if currentConfig.AutoScaler.MetricsSource != reloadedConfig.AutoScaler.MetricsSource ||
+		!reflect.DeepEqual(currentConfig.AutoScaler.Prometheus, reloadedConfig.AutoScaler.Prometheus) {
+
+		var err error
+		reloadedMetricsClient, err = newMetricsClient(rootLogger,
+			reloadedConfig.KubeconfigPath,
+			reloadedConfig.AutoScaler.MetricsSource,
+			reloadedConfig.AutoScaler.Prometheus)
+		if err != nil {
+			rootLogger.WarnWith("Failed to create metrics client with the reloaded configuration",
+				"err", errors.GetErrorStackString(err, 10))
+			return false
+		}
+	}
+
+	if err := resourceScaler.SetConfig(scalertypes.DLXOptions{},
+		reloadedConfig.AutoScalerOptions(),
+		reloadedConfig.ResourceScaler); err != nil {
+		rootLogger.WarnWith("Failed to apply resource scaler configuration",
+			"err", errors.GetErrorStackString(err, 10))
+		return false
 	}
 
+	rootLogger.SetLevel(nucliozap.GetLevelByName(reloadedConfig.LogLevel))
+
+	if reloadedMetricsClient != nil {
+		rootLogger.InfoWith("Metrics source changed, replacing metrics client",
+			"metricsSource", reloadedConfig.AutoScaler.MetricsSource)
+		metricsClient.SetDelegate(reloadedMetricsClient)
+	}
+
+	if currentConfig.AutoScalerOptions() != reloadedConfig.AutoScalerOptions() {
+		rootLogger.InfoWith("Autoscaler options changed, restarting autoscaler",
+			"current", currentConfig.AutoScalerOptions(),
+			"reloaded", reloadedConfig.AutoScalerOptions())
+
+		if err := autoScalerRunner.start(reloadedConfig.AutoScalerOptions()); err != nil {
+			rootLogger.WarnWith("Failed to restart autoscaler, keeping current autoscaler options",
+				"err", errors.GetErrorStackString(err, 10))
+
+			// keep reporting the options the autoscaler is running with, so the next reload tries again
+			reloadedConfig.AutoScaler.ScaleInterval = currentConfig.AutoScaler.ScaleInterval
+			reloadedConfig.AutoScaler.MetricsResourceKind = currentConfig.AutoScaler.MetricsResourceKind
+			reloadedConfig.AutoScaler.MetricsResourceGroup = currentConfig.AutoScaler.MetricsResourceGroup
+		}
+	}
+
+	return true
+}
+
+func createResourceScaler(logger logger.Logger,
+	autoScalerConfig *config.Config) (*resourcescaler.AppResourceScaler, error) {
+
 	// create k8s client
-	kubeconfig, err := common.GetClientConfig(kubeconfigPath)
+	kubeconfig, err := common.GetClientConfig(autoScalerConfig.KubeconfigPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed parsing cluster's kubeconfig from path")
 	}
@@ -98,41 +240,87 @@ func createAutoScaler(logger logger.Logger,
 		return nil, errors.Wrap(err, "Failed creating kubeclient from kubeconfig")
 	}
 
-	// create resource scaler
+	rest.SetDefaultWarningHandler(common.NewKubernetesClientWarningHandler(logger.GetChild("kube_warnings")))
+
 	resourceScaler, err := resourcescaler.New(logger,
 		kubeClientSet,
-		namespace,
+		autoScalerConfig.Namespace,
 		scalertypes.DLXOptions{},
-		scalertypes.AutoScalerOptions{
-			Namespace:     namespace,
-			ScaleInterval: scalertypes.Duration{Duration: scaleInterval},
-			GroupKind: schema.GroupKind{
-				Kind:  metricsResourceKind,
-				Group: metricsResourceGroup,
-			},
-		})
+		autoScalerConfig.AutoScalerOptions(),
+		autoScalerConfig.ResourceScaler)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to create resource scaler")
 	}
 
-	// get resource scaler configuration
-	resourceScalerConfig, err := resourceScaler.GetConfig()
+	resourceScaler.SetEventRecorder(common.NewEventRecorder(logger, kubeClientSet, "app-resource-scaler-autoscaler"))
+
+	if autoScalerConfig.Accounting.Enabled {
+		resourceScaler.SetLedger(accounting.NewLedger(logger,
+			kubeClientSet,
+			autoScalerConfig.Namespace,
+			autoScalerConfig.Accounting))
+	}
+
+	return resourceScaler, nil
+}
+
+// createAutoScalerRunner creates the runner of autoscalers reading metrics from the configured source, returning it
+// along with the client of that source, which can be replaced while the autoscaler runs. If resourceMetricsClient is
+// set, the cpu and memory metrics are read from it instead
+func createAutoScalerRunner(logger logger.Logger,
+	resourceScaler scalertypes.ResourceScaler,
+	resourceMetricsClient *metricsource.ResourceMetricsClient,
+	autoScalerConfig *config.Config) (*autoScalerRunner, *metricsource.ReloadableMetricsClient, error) {
+
+	// create the client the autoscaler reads scale resources metrics from
+	sourceMetricsClient, err := newMetricsClient(logger,
+		autoScalerConfig.KubeconfigPath,
+		autoScalerConfig.AutoScaler.MetricsSource,
+		autoScalerConfig.AutoScaler.Prometheus)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to get resource scaler config")
+		return nil, nil, errors.Wrap(err, "Failed to create metrics client")
 	}
 
-	// create autoscaler
-	autoScaler, err := autoscaler.NewAutoScaler(logger,
-		resourceScaler,
-		customMetricsClient,
-		resourceScalerConfig.AutoScalerOptions)
+	metricsClient := metricsource.NewReloadableMetricsClient(sourceMetricsClient)
+
+	var customMetricsClient custom_metrics.CustomMetricsClient = metricsClient
+	if resourceMetricsClient != nil {
+		customMetricsClient = resourceMetricsClient.WithDelegate(metricsClient)
+	}
+
+	return newAutoScalerRunner(logger, resourceScaler, customMetricsClient), metricsClient, nil
+}
+
+func newMetricsClient(logger logger.Logger,
+	kubeconfigPath string,
+	metricsSource string,
+	prometheusOptions metricsource.PrometheusOptions) (custom_metrics.CustomMetricsClient, error) {
+	switch metricsSource {
+	case metricsource.CustomMetricsSource:
+		return newMetricsCustomClient(kubeconfigPath)
+	case metricsource.PrometheusSource:
+		return metricsource.NewPrometheusMetricsClient(logger, prometheusOptions)
+	default:
+		return nil, errors.Errorf("Unknown metrics source: %s", metricsSource)
+	}
+}
+
+func newResourceMetricsClient(logger logger.Logger,
+	autoScalerConfig *config.Config) (*metricsource.ResourceMetricsClient, error) {
+	restConfig, err := common.GetClientConfig(autoScalerConfig.KubeconfigPath)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to create autoscaler")
+		return nil, errors.Wrap(err, "Failed to get rest config")
 	}
 
-	rest.SetDefaultWarningHandler(common.NewKubernetesClientWarningHandler(logger.GetChild("kube_warnings")))
+	metricsClientSet, err := metricsclientset.NewForConfig(restConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create metrics clientset")
+	}
 
-	return autoScaler, nil
+	return metricsource.NewResourceMetricsClient(logger,
+		metricsClientSet,
+		autoScalerConfig.Namespace,
+		autoScalerConfig.AutoScaler.ResourceMetrics)
 }
 
 func newMetricsCustomClient(kubeconfigPath string) (custom_metrics.CustomMetricsClient, error) {
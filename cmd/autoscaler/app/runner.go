@@ -0,0 +1,153 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package app
+
+import (
+	"sync"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	"github.com/v3io/scaler/pkg/autoscaler"
+	"github.com/v3io/scaler/pkg/scalertypes"
+	"k8s.io/metrics/pkg/client/custom_metrics"
+)
+
+// autoScalerRunner runs an autoscaler that can be replaced by one with other options, e.g. another scale interval,
+// without restarting the process
+type autoScalerRunner struct {
+	logger         logger.Logger
+	resourceScaler *scaleToZeroGuard
+	metricsClient  custom_metrics.CustomMetricsClient
+	autoScaler     *autoscaler.Autoscaler
+}
+
+func newAutoScalerRunner(logger logger.Logger,
+	resourceScaler scalertypes.ResourceScaler,
+	metricsClient custom_metrics.CustomMetricsClient) *autoScalerRunner {
+	return &autoScalerRunner{
+		logger:         logger,
+		resourceScaler: newScaleToZeroGuard(resourceScaler),
+		metricsClient:  metricsClient,
+	}
+}
+
+// start starts an autoscaler with the given options, stopping the one running before it if any.
+//
+// A stopped autoscaler's goroutine stays parked on its stopped ticker, and the scale to zero operations it started
+// complete on their own. Those services are kept from the new autoscaler by the guard until they do
+func (r *autoScalerRunner) start(options scalertypes.AutoScalerOptions) error {
+	autoScaler, err := autoscaler.NewAutoScaler(r.logger, r.resourceScaler, r.metricsClient, options)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create autoscaler")
+	}
+
+	if r.autoScaler != nil {
+		if err := r.autoScaler.Stop(); err != nil {
+			return errors.Wrap(err, "Failed to stop autoscaler")
+		}
+	}
+
+	if err := autoScaler.Start(); err != nil {
+		return errors.Wrap(err, "Failed to start autoscaler")
+	}
+
+	r.autoScaler = autoScaler
+
+	return nil
+}
+
+// scaleToZeroGuard keeps the services being scaled to zero from being offered for scale to zero again. Every
+// autoscaler only skips the services it's scaling itself, so without it an autoscaler started while another one's
+// operations are still running would scale their services again
+type scaleToZeroGuard struct {
+	scalertypes.ResourceScaler
+
+	lock       sync.Mutex
+	inProgress map[string]bool
+}
+
+func newScaleToZeroGuard(resourceScaler scalertypes.ResourceScaler) *scaleToZeroGuard {
+	return &scaleToZeroGuard{
+		ResourceScaler: resourceScaler,
+		inProgress:     map[string]bool{},
+	}
+}
+
+func (g *scaleToZeroGuard) GetResources() ([]scalertypes.Resource, error) {
+	resources, err := g.ResourceScaler.GetResources()
+	if err != nil {
+		return nil, err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	offeredResources := make([]scalertypes.Resource, 0, len(resources))
+	for _, resource := range resources {
+		if !g.inProgress[resource.Name] {
+			offeredResources = append(offeredResources, resource)
+		}
+	}
+
+	return offeredResources, nil
+}
+
+func (g *scaleToZeroGuard) SetScale(resources []scalertypes.Resource, scale int) error {
+	if scale != 0 {
+		return g.ResourceScaler.SetScale(resources, scale)
+	}
+
+	// a stopped autoscaler may still have offered them before the new one was started
+	resources = g.acquire(resources)
+	if len(resources) == 0 {
+		return nil
+	}
+	defer g.release(resources)
+
+	return g.ResourceScaler.SetScale(resources, scale)
+}
+
+// acquire marks the resources not already being scaled to zero as being scaled, returning them
+func (g *scaleToZeroGuard) acquire(resources []scalertypes.Resource) []scalertypes.Resource {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	acquiredResources := make([]scalertypes.Resource, 0, len(resources))
+	for _, resource := range resources {
+		if g.inProgress[resource.Name] {
+			continue
+		}
+
+		g.inProgress[resource.Name] = true
+		acquiredResources = append(acquiredResources, resource)
+	}
+
+	return acquiredResources
+}
+
+func (g *scaleToZeroGuard) release(resources []scalertypes.Resource) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for _, resource := range resources {
+		delete(g.inProgress, resource.Name)
+	}
+}
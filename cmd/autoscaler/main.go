@@ -23,29 +23,32 @@ package main
 import (
 	"flag"
 	"os"
-	"time"
 
 	"github.com/v3io/app-resource-scaler/cmd/autoscaler/app"
-	"github.com/v3io/app-resource-scaler/pkg/common"
+	"github.com/v3io/app-resource-scaler/pkg/config"
 
 	"github.com/nuclio/errors"
 )
 
 func main() {
-	kubeconfigPath := flag.String("kubeconfig-path", os.Getenv("KUBECONFIG"), "Path of kubeconfig file")
-	namespace := flag.String("namespace", "", "Namespace to listen on, or * for all")
-	scaleInterval := flag.Duration("scale-interval", time.Minute, "Interval to call check scale function")
-	metricsResourceKind := flag.String("metrics-resource-kind", "", "Resource kind (e.g. NuclioFunction)")
-	metricsResourceGroup := flag.String("metrics-resource-group", "", "Resource group (e.g. nuclio.io)")
+	configPath := flag.String("config", os.Getenv("SCALER_CONFIG"), "Path of a YAML / JSON configuration file")
+	config.NewDefault().RegisterAutoScalerFlags(flag.CommandLine)
 	flag.Parse()
 
-	*namespace = common.GetNamespace(*namespace)
+	loadConfig := func() (*config.Config, error) {
+		autoScalerConfig, err := config.Load(*configPath, flag.CommandLine, (*config.Config).RegisterAutoScalerFlags)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to load configuration")
+		}
 
-	if err := app.Run(*kubeconfigPath,
-		*namespace,
-		*scaleInterval,
-		*metricsResourceKind,
-		*metricsResourceGroup); err != nil {
+		if err := autoScalerConfig.ValidateAutoScaler(); err != nil {
+			return nil, errors.Wrap(err, "Invalid configuration")
+		}
+
+		return autoScalerConfig, nil
+	}
+
+	if err := app.Run(*configPath, loadConfig); err != nil {
 		errors.PrintErrorStack(os.Stderr, err, 5)
 
 		os.Exit(1)
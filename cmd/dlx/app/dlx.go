@@ -21,57 +21,43 @@ such restriction.
 package app
 
 import (
-	"os"
-	"time"
+	"context"
 
+	"github.com/v3io/app-resource-scaler/pkg/accounting"
+	"github.com/v3io/app-resource-scaler/pkg/audit"
 	"github.com/v3io/app-resource-scaler/pkg/common"
+	"github.com/v3io/app-resource-scaler/pkg/config"
+	"github.com/v3io/app-resource-scaler/pkg/dlxserver"
+	"github.com/v3io/app-resource-scaler/pkg/management"
+	"github.com/v3io/app-resource-scaler/pkg/notification"
 	"github.com/v3io/app-resource-scaler/pkg/resourcescaler"
 
 	"github.com/nuclio/errors"
-	"github.com/nuclio/logger"
 	"github.com/nuclio/zap"
-	"github.com/v3io/scaler/pkg/dlx"
 	"github.com/v3io/scaler/pkg/scalertypes"
 	"k8s.io/client-go/kubernetes"
 )
 
-func Run(kubeconfigPath string,
-	namespace string,
-	targetNameHeader string,
-	targetPathHeader string,
-	targetPort int,
-	listenAddress string,
-	resourceReadinessTimeout string,
-	multiTargetStrategy string) error {
+// Run runs the dlx with the configuration returned by loadConfig. If configPath is set, the configuration is
+// reloaded and applied whenever the file changes
+func Run(configPath string, loadConfig func() (*config.Config, error)) error {
+	dlxConfig, err := loadConfig()
+	if err != nil {
+		return errors.Wrap(err, "Failed to load configuration")
+	}
 
 	// create root logger
-	rootLogger, err := nucliozap.NewNuclioZap("app-resource-scaler",
-		"console",
-		nil,
-		os.Stdout,
-		os.Stderr,
-		nucliozap.DebugLevel)
+	rootLogger, err := common.NewLogger("app-resource-scaler", dlxConfig.LogLevel, dlxConfig.LogFormat)
 	if err != nil {
 		return errors.Wrap(err, "Failed creating a new logger")
 	}
 
-	resourceReadinessTimeoutDuration, err := time.ParseDuration(resourceReadinessTimeout)
-	if err != nil {
-		return errors.Wrap(err, "Failed to parse resource readiness timeout")
-	}
+	rootLogger.DebugWith("Loaded configuration", "config", dlxConfig)
 
-	dlxOptions := scalertypes.DLXOptions{
-		TargetNameHeader:         targetNameHeader,
-		TargetPathHeader:         targetPathHeader,
-		TargetPort:               targetPort,
-		ListenAddress:            listenAddress,
-		Namespace:                namespace,
-		ResourceReadinessTimeout: scalertypes.Duration{Duration: resourceReadinessTimeoutDuration},
-		MultiTargetStrategy:      scalertypes.MultiTargetStrategy(multiTargetStrategy),
-	}
+	dlxOptions := dlxConfig.DLXOptions()
 
 	// create k8s client
-	kubeconfig, err := common.GetClientConfig(kubeconfigPath)
+	kubeconfig, err := common.GetClientConfig(dlxConfig.KubeconfigPath)
 	if err != nil {
 		return errors.Wrap(err, "Failed parsing cluster's kubeconfig from path")
 	}
@@ -85,13 +71,39 @@ func Run(kubeconfigPath string,
 	// create resource scaler
 	resourceScaler, err := resourcescaler.New(rootLogger,
 		kubeClientSet,
-		namespace,
+		dlxConfig.Namespace,
 		dlxOptions,
-		scalertypes.AutoScalerOptions{})
+		scalertypes.AutoScalerOptions{},
+		dlxConfig.ResourceScaler)
 	if err != nil {
 		return errors.Wrap(err, "Failed to create resource scaler")
 	}
 
+	if dlxConfig.AuditLog != "" {
+		auditLog, err := audit.NewLog(dlxConfig.AuditLog)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create audit log")
+		}
+
+		resourceScaler.SetAuditLog(auditLog)
+	}
+
+	if len(dlxConfig.Notifications.Sinks) != 0 {
+		notifier, err := notification.NewNotifier(rootLogger, dlxConfig.Notifications)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create notifier")
+		}
+		notifier.Start(context.Background())
+
+		resourceScaler.SetNotifier(notifier)
+	}
+
+	resourceScaler.SetEventRecorder(common.NewEventRecorder(rootLogger, kubeClientSet, "app-resource-scaler-dlx"))
+
+	if dlxConfig.Accounting.Enabled {
+		resourceScaler.SetLedger(accounting.NewLedger(rootLogger, kubeClientSet, dlxConfig.Namespace, dlxConfig.Accounting))
+	}
+
 	// see if resource scaler wants to override the arguments
 	resourceScalerConfig, err := resourceScaler.GetConfig()
 	if err != nil {
@@ -102,28 +114,64 @@ func Run(kubeconfigPath string,
 		dlxOptions = resourceScalerConfig.DLXOptions
 	}
 
-	newDLX, err := createDLX(rootLogger, resourceScaler, dlxOptions)
+	dlxServer, err := dlxserver.NewServer(rootLogger, resourceScaler, dlxOptions)
 	if err != nil {
 		return errors.Wrap(err, "Failed to create dlx")
 	}
 
 	// start the scaler
-	if err := newDLX.Start(); err != nil {
+	if err := dlxServer.Start(); err != nil {
 		return errors.Wrap(err, "Failed to start dlx")
 	}
 
-	select {}
-}
+	if dlxConfig.MetricsListenAddress != "" {
+		managementServer := management.NewServer(rootLogger, dlxConfig.MetricsListenAddress)
+		managementServer.HandlePins(resourceScaler, false)
+		managementServer.HandleReport(resourceScaler)
+		if err := managementServer.Start(); err != nil {
+			return errors.Wrap(err, "Failed to start management server")
+		}
+	}
 
-func createDLX(loggerInstance logger.Logger,
-	resourceScaler scalertypes.ResourceScaler,
-	options scalertypes.DLXOptions) (*dlx.DLX, error) {
+	if dlxConfig.PinsListenAddress != "" {
+		pinsServer := management.NewAPIServer(rootLogger, dlxConfig.PinsListenAddress)
+		pinsServer.HandlePins(resourceScaler, true)
+		if err := pinsServer.Start(); err != nil {
+			return errors.Wrap(err, "Failed to start pins server")
+		}
+	}
 
-	newScaler, err := dlx.NewDLX(loggerInstance, resourceScaler, options)
+	if configPath != "" && dlxConfig.ReloadInterval.Duration > 0 {
+		configWatcher, err := config.NewWatcher(rootLogger, configPath, dlxConfig.ReloadInterval.Duration, loadConfig)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create configuration watcher")
+		}
 
-	if err != nil {
-		return nil, err
+		configWatcher.OnChange(func(reloadedConfig *config.Config) {
+			applyConfig(rootLogger, resourceScaler, dlxServer, reloadedConfig)
+		})
+		configWatcher.Start(context.Background())
 	}
 
-	return newScaler, nil
+	select {}
+}
+
+func applyConfig(rootLogger *nucliozap.NuclioZap,
+	resourceScaler *resourcescaler.AppResourceScaler,
+	dlxServer *dlxserver.Server,
+	dlxConfig *config.Config) {
+	rootLogger.SetLevel(nucliozap.GetLevelByName(dlxConfig.LogLevel))
+
+	if err := resourceScaler.SetConfig(dlxConfig.DLXOptions(),
+		scalertypes.AutoScalerOptions{},
+		dlxConfig.ResourceScaler); err != nil {
+		rootLogger.WarnWith("Failed to apply resource scaler configuration",
+			"err", errors.GetErrorStackString(err, 10))
+		return
+	}
+
+	if err := dlxServer.SetOptions(dlxConfig.DLXOptions()); err != nil {
+		rootLogger.WarnWith("Failed to apply dlx configuration",
+			"err", errors.GetErrorStackString(err, 10))
+	}
 }
@@ -25,32 +25,30 @@ import (
 	"os"
 
 	"github.com/v3io/app-resource-scaler/cmd/dlx/app"
-	"github.com/v3io/app-resource-scaler/pkg/common"
+	"github.com/v3io/app-resource-scaler/pkg/config"
 
 	"github.com/nuclio/errors"
 )
 
 func main() {
-	kubeconfigPath := flag.String("kubeconfig-path", os.Getenv("KUBECONFIG"), "Path of kubeconfig file")
-	namespace := flag.String("namespace", "", "Kubernetes namespace")
-	targetNameHeader := flag.String("target-name-header", "", "Name of the header that holds information on target name")
-	targetPathHeader := flag.String("target-path-header", "", "Name of the header that holds information on target path")
-	targetPort := flag.Int("target-port", 0, "Name of the header that holds information on target port")
-	listenAddress := flag.String("listen-address", ":8090", "Address to listen upon for http proxy")
-	resourceReadinessTimeout := flag.String("resource-readiness-timeout", "5m", "maximum wait time for the resource to be ready")
-	multiTargetStrategy := flag.String("multi-target-strategy", "random", "Strategy for selecting to which target to send the request")
+	configPath := flag.String("config", os.Getenv("SCALER_CONFIG"), "Path of a YAML / JSON configuration file")
+	config.NewDefault().RegisterDLXFlags(flag.CommandLine)
 	flag.Parse()
 
-	*namespace = common.GetNamespace(*namespace)
+	loadConfig := func() (*config.Config, error) {
+		dlxConfig, err := config.Load(*configPath, flag.CommandLine, (*config.Config).RegisterDLXFlags)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to load configuration")
+		}
 
-	if err := app.Run(*kubeconfigPath,
-		*namespace,
-		*targetNameHeader,
-		*targetPathHeader,
-		*targetPort,
-		*listenAddress,
-		*resourceReadinessTimeout,
-		*multiTargetStrategy); err != nil {
+		if err := dlxConfig.ValidateDLX(); err != nil {
+			return nil, errors.Wrap(err, "Invalid configuration")
+		}
+
+		return dlxConfig, nil
+	}
+
+	if err := app.Run(*configPath, loadConfig); err != nil {
 		errors.PrintErrorStack(os.Stderr, err, 5)
 
 		os.Exit(1)
@@ -0,0 +1,63 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package app
+
+import (
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/common"
+	"github.com/v3io/app-resource-scaler/pkg/webhook"
+
+	"github.com/nuclio/errors"
+)
+
+func Run(listenAddress string,
+	tlsCertFile string,
+	tlsKeyFile string,
+	defaultMissingFields bool,
+	defaultWindowSize time.Duration,
+	logLevel string,
+	logFormat string) error {
+
+	// create root logger
+	rootLogger, err := common.NewLogger("app-resource-scaler", logLevel, logFormat)
+	if err != nil {
+		return errors.Wrap(err, "Failed creating a new logger")
+	}
+
+	webhookServer, err := webhook.NewServer(rootLogger, webhook.Options{
+		ListenAddress:        listenAddress,
+		TLSCertFile:          tlsCertFile,
+		TLSKeyFile:           tlsKeyFile,
+		DefaultMissingFields: defaultMissingFields,
+		DefaultWindowSize:    defaultWindowSize,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to create webhook server")
+	}
+
+	// start the webhook server and run forever
+	if err := webhookServer.Start(); err != nil {
+		return errors.Wrap(err, "Failed to start webhook server")
+	}
+
+	select {}
+}
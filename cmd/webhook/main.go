@@ -0,0 +1,54 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/cmd/webhook/app"
+
+	"github.com/nuclio/errors"
+)
+
+func main() {
+	listenAddress := flag.String("listen-address", ":8443", "Address to listen upon for admission reviews")
+	tlsCertFile := flag.String("tls-cert-file", "", "Path of the TLS certificate (serves plain http when empty)")
+	tlsKeyFile := flag.String("tls-key-file", "", "Path of the TLS private key")
+	defaultMissingFields := flag.Bool("default-missing-fields", false, "Fill missing scale_to_zero fields on the mutate endpoint")
+	defaultWindowSize := flag.Duration("default-window-size", 10*time.Minute, "Window size to default missing scale resource window sizes to")
+	logLevel := flag.String("log-level", "info", "Log level (debug, info, warn or error)")
+	logFormat := flag.String("log-format", "console", "Log format (console or json)")
+	flag.Parse()
+
+	if err := app.Run(*listenAddress,
+		*tlsCertFile,
+		*tlsKeyFile,
+		*defaultMissingFields,
+		*defaultWindowSize,
+		*logLevel,
+		*logFormat); err != nil {
+		errors.PrintErrorStack(os.Stderr, err, 5)
+
+		os.Exit(1)
+	}
+}
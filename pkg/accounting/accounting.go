@@ -0,0 +1,162 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package accounting
+
+import (
+	"time"
+
+	"github.com/nuclio/errors"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+const bytesPerGiB = 1024 * 1024 * 1024
+
+// Options configure the accounting of the time services spend scaled to zero
+type Options struct {
+	Enabled bool `json:"enabled,omitempty"`
+
+	// how long daily records are kept for
+	Retention scalertypes.Duration `json:"retention,omitempty"`
+}
+
+func NewDefaultOptions() Options {
+	return Options{
+		Retention: scalertypes.Duration{Duration: 90 * 24 * time.Hour},
+	}
+}
+
+func (o *Options) Validate() error {
+	if o.Enabled && o.Retention.Duration < 24*time.Hour {
+		return errors.New("Accounting retention must be at least a day")
+	}
+
+	return nil
+}
+
+// Resources are the resources a service requests while running, which are freed while it's scaled to zero
+type Resources struct {
+
+	// in cores
+	CPU         float64 `json:"cpu,omitempty"`
+	MemoryBytes int64   `json:"memoryBytes,omitempty"`
+	GPU         float64 `json:"gpu,omitempty"`
+}
+
+// Usage is how long services spent scaled to zero, and the resources freed meanwhile
+type Usage struct {
+	SleepHours     float64 `json:"sleepHours"`
+	CPUCoreHours   float64 `json:"cpuCoreHours"`
+	MemoryGiBHours float64 `json:"memoryGiBHours"`
+	GPUHours       float64 `json:"gpuHours"`
+}
+
+func newUsage(resources Resources, duration time.Duration) Usage {
+	hours := duration.Hours()
+	return Usage{
+		SleepHours:     hours,
+		CPUCoreHours:   resources.CPU * hours,
+		MemoryGiBHours: float64(resources.MemoryBytes) / bytesPerGiB * hours,
+		GPUHours:       resources.GPU * hours,
+	}
+}
+
+func (u *Usage) add(other Usage) {
+	u.SleepHours += other.SleepHours
+	u.CPUCoreHours += other.CPUCoreHours
+	u.MemoryGiBHours += other.MemoryGiBHours
+	u.GPUHours += other.GPUHours
+}
+
+// DayReport is the usage of a single day, in UTC
+type DayReport struct {
+	Date     string           `json:"date"`
+	Total    Usage            `json:"total"`
+	Services map[string]Usage `json:"services"`
+}
+
+// Report is the usage of a tenant's services over a range of days. Services that are still scaled to zero are
+// accounted for up to the time of the report
+type Report struct {
+	Namespace string           `json:"namespace"`
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Total     Usage            `json:"total"`
+	Services  map[string]Usage `json:"services"`
+	Days      []DayReport      `json:"days"`
+}
+
+const (
+	ScaledToZeroEventType   = "scaledToZero"
+	ScaledFromZeroEventType = "scaledFromZero"
+)
+
+// ScaleEvent is a recorded scale transition of a service
+type ScaleEvent struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+
+	// what triggered the transition, e.g. the autoscaler or a dlx request
+	Trigger string `json:"trigger,omitempty"`
+}
+
+// sleep is a service that is currently scaled to zero
+type sleep struct {
+	Since     time.Time `json:"since"`
+	Resources Resources `json:"resources"`
+}
+
+// usageByDay splits the usage of a sleep until the given time across the UTC days it spans
+func (s *sleep) usageByDay(until time.Time) map[string]Usage {
+	usageByDay := map[string]Usage{}
+	start := s.Since.UTC()
+	until = until.UTC()
+	for start.Before(until) {
+		dayStart := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+		end := dayStart.AddDate(0, 0, 1)
+		if end.After(until) {
+			end = until
+		}
+
+		usage := usageByDay[formatDay(start)]
+		usage.add(newUsage(s.Resources, end.Sub(start)))
+		usageByDay[formatDay(start)] = usage
+
+		start = end
+	}
+
+	return usageByDay
+}
+
+const dayLayout = "2006-01-02"
+
+func formatDay(day time.Time) string {
+	return day.UTC().Format(dayLayout)
+}
+
+// ParseDay parses a UTC day in the YYYY-MM-DD format
+func ParseDay(day string) (time.Time, error) {
+	parsedDay, err := time.Parse(dayLayout, day)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "Failed to parse day %q", day)
+	}
+
+	return parsedDay, nil
+}
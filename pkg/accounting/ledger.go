@@ -0,0 +1,481 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package accounting
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+
+	// holds the services that are currently scaled to zero
+	stateConfigMapName = "app-resource-scaler-accounting"
+
+	// followed by the day, holds the usage and scale events of that day per service
+	dayConfigMapNamePrefix = "app-resource-scaler-accounting-"
+
+	ledgerLabel      = "app-resource-scaler/accounting"
+	stateLedgerLabel = "state"
+	dayLedgerLabel   = "day"
+
+	sleepingKey = "sleeping"
+	servicesKey = "services"
+	eventsKey   = "events"
+
+	cleanupInterval = time.Hour
+)
+
+// Ledger records the time services spend scaled to zero in ConfigMaps of the tenant's namespace, so that the dlx
+// and the autoscaler (and their restarts) share it. The services currently scaled to zero are kept in one ConfigMap,
+// and the usage of each day, added once a service is scaled from zero, in a ConfigMap per day along the scale events
+// of the day. A nil ledger records nothing
+type Ledger struct {
+	logger        logger.Logger
+	kubeClientSet kubernetes.Interface
+	namespace     string
+	options       Options
+
+	cleanupLock sync.Mutex
+	lastCleanup time.Time
+}
+
+func NewLedger(parentLogger logger.Logger,
+	kubeClientSet kubernetes.Interface,
+	namespace string,
+	options Options) *Ledger {
+	return &Ledger{
+		logger:        parentLogger.GetChild("accounting"),
+		kubeClientSet: kubeClientSet,
+		namespace:     namespace,
+		options:       options,
+	}
+}
+
+// RecordSleep records services scaled to zero at the given time by trigger. Services already recorded as scaled to
+// zero keep the time they were first scaled to zero
+func (l *Ledger) RecordSleep(ctx context.Context, services map[string]Resources, at time.Time, trigger string) error {
+	if l == nil {
+		return nil
+	}
+
+	serviceNames := make([]string, 0, len(services))
+	for serviceName := range services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+
+	if err := l.recordScaleEvents(ctx, serviceNames, ScaleEvent{
+		Time:    at,
+		Type:    ScaledToZeroEventType,
+		Trigger: trigger,
+	}); err != nil {
+		return errors.Wrap(err, "Failed to record scale events")
+	}
+
+	if err := l.updateConfigMap(ctx, stateConfigMapName, stateLedgerLabel, func(data map[string]string) error {
+		sleeping, err := decodeSleeping(data)
+		if err != nil {
+			return err
+		}
+
+		for serviceName, resources := range services {
+			if _, found := sleeping[serviceName]; !found {
+				sleeping[serviceName] = sleep{Since: at, Resources: resources}
+			}
+		}
+
+		return encode(data, sleepingKey, sleeping)
+	}); err != nil {
+		return errors.Wrap(err, "Failed to record services scaled to zero")
+	}
+
+	return nil
+}
+
+// RecordWake records services scaled from zero at the given time by trigger, adding the time they were scaled to
+// zero to the usage of the days it spans
+func (l *Ledger) RecordWake(ctx context.Context, serviceNames []string, at time.Time, trigger string) error {
+	if l == nil {
+		return nil
+	}
+
+	if err := l.recordScaleEvents(ctx, serviceNames, ScaleEvent{
+		Time:    at,
+		Type:    ScaledFromZeroEventType,
+		Trigger: trigger,
+	}); err != nil {
+		return errors.Wrap(err, "Failed to record scale events")
+	}
+
+	// removing the services from the state first means a concurrent wake of the same service can't account for
+	// it twice. If this process dies before updating the days, the sleep is lost rather than double counted
+	var woken map[string]sleep
+	if err := l.updateConfigMap(ctx, stateConfigMapName, stateLedgerLabel, func(data map[string]string) error {
+		sleeping, err := decodeSleeping(data)
+		if err != nil {
+			return err
+		}
+
+		woken = map[string]sleep{}
+		for _, serviceName := range serviceNames {
+			if serviceSleep, found := sleeping[serviceName]; found {
+				woken[serviceName] = serviceSleep
+				delete(sleeping, serviceName)
+			}
+		}
+
+		return encode(data, sleepingKey, sleeping)
+	}); err != nil {
+		return errors.Wrap(err, "Failed to record services scaled from zero")
+	}
+
+	usageByDayByService := map[string]map[string]Usage{}
+	for serviceName, serviceSleep := range woken {
+		for day, usage := range serviceSleep.usageByDay(at) {
+			if _, found := usageByDayByService[day]; !found {
+				usageByDayByService[day] = map[string]Usage{}
+			}
+			usageByDayByService[day][serviceName] = usage
+		}
+	}
+
+	for day, usageByService := range usageByDayByService {
+		if err := l.updateConfigMap(ctx, dayConfigMapNamePrefix+day, dayLedgerLabel, func(data map[string]string) error {
+			services := map[string]Usage{}
+			if err := decode(data, servicesKey, &services); err != nil {
+				return err
+			}
+
+			for serviceName, usage := range usageByService {
+				serviceUsage := services[serviceName]
+				serviceUsage.add(usage)
+				services[serviceName] = serviceUsage
+			}
+
+			return encode(data, servicesKey, services)
+		}); err != nil {
+			return errors.Wrapf(err, "Failed to record usage of %s", day)
+		}
+	}
+
+	l.cleanup(ctx)
+
+	return nil
+}
+
+// Report returns the usage of the days between from and to, inclusive. If serviceName is set, only that service's
+// usage is reported
+func (l *Ledger) Report(ctx context.Context, from time.Time, to time.Time, serviceName string) (*Report, error) {
+	fromDay, toDay := formatDay(from), formatDay(to)
+	if fromDay > toDay {
+		return nil, errors.New("Report must start before it ends")
+	}
+
+	usageByDay := map[string]map[string]Usage{}
+	addUsage := func(day string, reportedServiceName string, usage Usage) {
+		if day < fromDay || day > toDay || (serviceName != "" && reportedServiceName != serviceName) {
+			return
+		}
+
+		if _, found := usageByDay[day]; !found {
+			usageByDay[day] = map[string]Usage{}
+		}
+
+		serviceUsage := usageByDay[day][reportedServiceName]
+		serviceUsage.add(usage)
+		usageByDay[day][reportedServiceName] = serviceUsage
+	}
+
+	dayConfigMaps, err := l.listDayConfigMaps(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list daily usage")
+	}
+
+	for day, dayConfigMap := range dayConfigMaps {
+		services := map[string]Usage{}
+		if err := decode(dayConfigMap.Data, servicesKey, &services); err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode usage of %s", day)
+		}
+
+		for reportedServiceName, usage := range services {
+			addUsage(day, reportedServiceName, usage)
+		}
+	}
+
+	stateConfigMap, err := l.kubeClientSet.CoreV1().ConfigMaps(l.namespace).Get(ctx, stateConfigMapName, metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, errors.Wrap(err, "Failed to get services scaled to zero")
+	}
+
+	if err == nil {
+		sleeping, err := decodeSleeping(stateConfigMap.Data)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to decode services scaled to zero")
+		}
+
+		now := time.Now()
+		for sleepingServiceName, serviceSleep := range sleeping {
+			for day, usage := range serviceSleep.usageByDay(now) {
+				addUsage(day, sleepingServiceName, usage)
+			}
+		}
+	}
+
+	report := &Report{
+		Namespace: l.namespace,
+		From:      fromDay,
+		To:        toDay,
+		Services:  map[string]Usage{},
+		Days:      []DayReport{},
+	}
+
+	for day, usageByService := range usageByDay {
+		dayReport := DayReport{
+			Date:     day,
+			Services: usageByService,
+		}
+
+		for reportedServiceName, usage := range usageByService {
+			dayReport.Total.add(usage)
+
+			serviceUsage := report.Services[reportedServiceName]
+			serviceUsage.add(usage)
+			report.Services[reportedServiceName] = serviceUsage
+		}
+
+		report.Total.add(dayReport.Total)
+		report.Days = append(report.Days, dayReport)
+	}
+
+	sort.Slice(report.Days, func(i, j int) bool {
+		return report.Days[i].Date < report.Days[j].Date
+	})
+
+	return report, nil
+}
+
+// ScaleEvents returns the scale events recorded between from and to, by service, oldest first
+func (l *Ledger) ScaleEvents(ctx context.Context, from time.Time, to time.Time) (map[string][]ScaleEvent, error) {
+	dayConfigMaps, err := l.listDayConfigMaps(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list daily scale events")
+	}
+
+	fromDay, toDay := formatDay(from), formatDay(to)
+	scaleEventsByService := map[string][]ScaleEvent{}
+	for day, dayConfigMap := range dayConfigMaps {
+		if day < fromDay || day > toDay {
+			continue
+		}
+
+		events := map[string][]ScaleEvent{}
+		if err := decode(dayConfigMap.Data, eventsKey, &events); err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode scale events of %s", day)
+		}
+
+		for serviceName, serviceEvents := range events {
+			for _, event := range serviceEvents {
+				if event.Time.Before(from) || event.Time.After(to) {
+					continue
+				}
+				scaleEventsByService[serviceName] = append(scaleEventsByService[serviceName], event)
+			}
+		}
+	}
+
+	for _, serviceEvents := range scaleEventsByService {
+		sort.Slice(serviceEvents, func(i, j int) bool {
+			return serviceEvents[i].Time.Before(serviceEvents[j].Time)
+		})
+	}
+
+	return scaleEventsByService, nil
+}
+
+// recordScaleEvents appends the event of each service to the events of the event's day
+func (l *Ledger) recordScaleEvents(ctx context.Context, serviceNames []string, event ScaleEvent) error {
+	return l.updateConfigMap(ctx, dayConfigMapNamePrefix+formatDay(event.Time), dayLedgerLabel, func(data map[string]string) error {
+		events := map[string][]ScaleEvent{}
+		if err := decode(data, eventsKey, &events); err != nil {
+			return err
+		}
+
+		for _, serviceName := range serviceNames {
+			events[serviceName] = append(events[serviceName], event)
+		}
+
+		return encode(data, eventsKey, events)
+	})
+}
+
+// cleanup deletes the usage of days past the retention, at most once per cleanup interval
+func (l *Ledger) cleanup(ctx context.Context) {
+	l.cleanupLock.Lock()
+	defer l.cleanupLock.Unlock()
+
+	if time.Since(l.lastCleanup) < cleanupInterval {
+		return
+	}
+	l.lastCleanup = time.Now()
+
+	dayConfigMaps, err := l.listDayConfigMaps(ctx)
+	if err != nil {
+		l.logger.WarnWithCtx(ctx, "Failed to list daily usage for cleanup",
+			"namespace", l.namespace,
+			"err", errors.GetErrorStackString(err, 10))
+		return
+	}
+
+	oldestDay := formatDay(time.Now().Add(-l.options.Retention.Duration))
+	for day, dayConfigMap := range dayConfigMaps {
+		if day >= oldestDay {
+			continue
+		}
+
+		l.logger.DebugWithCtx(ctx, "Deleting usage past retention", "namespace", l.namespace, "day", day)
+		if err := l.kubeClientSet.
+			CoreV1().
+			ConfigMaps(l.namespace).
+			Delete(ctx, dayConfigMap.Name, metav1.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+			l.logger.WarnWithCtx(ctx, "Failed to delete usage past retention",
+				"namespace", l.namespace,
+				"day", day,
+				"err", err.Error())
+		}
+	}
+}
+
+// listDayConfigMaps returns the ConfigMaps holding the usage of each day, by day
+func (l *Ledger) listDayConfigMaps(ctx context.Context) (map[string]v1.ConfigMap, error) {
+	configMapList, err := l.kubeClientSet.CoreV1().ConfigMaps(l.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: ledgerLabel + "=" + dayLedgerLabel,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list ConfigMaps")
+	}
+
+	dayConfigMaps := map[string]v1.ConfigMap{}
+	for _, configMap := range configMapList.Items {
+		day := strings.TrimPrefix(configMap.Name, dayConfigMapNamePrefix)
+		if _, err := ParseDay(day); err != nil {
+			continue
+		}
+
+		dayConfigMaps[day] = configMap
+	}
+
+	return dayConfigMaps, nil
+}
+
+// updateConfigMap applies mutate to the data of the ConfigMap, creating it if missing, and retries on conflicts
+// with other writers. mutate may be called more than once
+func (l *Ledger) updateConfigMap(ctx context.Context,
+	name string,
+	ledgerLabelValue string,
+	mutate func(map[string]string) error) error {
+
+	configMaps := l.kubeClientSet.CoreV1().ConfigMaps(l.namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			configMap = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: l.namespace,
+					Labels:    map[string]string{ledgerLabel: ledgerLabelValue},
+				},
+				Data: map[string]string{},
+			}
+
+			if err := mutate(configMap.Data); err != nil {
+				return err
+			}
+
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+			if k8serrors.IsAlreadyExists(err) {
+
+				// created by another writer meanwhile, retry as an update
+				return k8serrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, name, err)
+			}
+			return err
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+
+		if err := mutate(configMap.Data); err != nil {
+			return err
+		}
+
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func decodeSleeping(data map[string]string) (map[string]sleep, error) {
+	sleeping := map[string]sleep{}
+	if err := decode(data, sleepingKey, &sleeping); err != nil {
+		return nil, err
+	}
+
+	return sleeping, nil
+}
+
+func decode(data map[string]string, key string, value interface{}) error {
+	encodedValue, found := data[key]
+	if !found {
+		return nil
+	}
+
+	if err := json.Unmarshal([]byte(encodedValue), value); err != nil {
+		return errors.Wrapf(err, "Failed to decode %s", key)
+	}
+
+	return nil
+}
+
+func encode(data map[string]string, key string, value interface{}) error {
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to encode %s", key)
+	}
+
+	data[key] = string(encodedValue)
+	return nil
+}
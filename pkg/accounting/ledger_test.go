@@ -0,0 +1,295 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package accounting
+
+import (
+	"context"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	nucliozap "github.com/nuclio/zap"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNamespace = "default-tenant"
+
+func newTestLedger(t *testing.T) (*Ledger, *fake.Clientset) {
+	loggerInstance, err := nucliozap.NewNuclioZap("test", "console", nil, os.Stdout, os.Stderr, nucliozap.DebugLevel)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	kubeClientSet := fake.NewSimpleClientset()
+	return NewLedger(loggerInstance, kubeClientSet, testNamespace, NewDefaultOptions()), kubeClientSet
+}
+
+func getConfigMapData(t *testing.T, kubeClientSet *fake.Clientset, name string, key string, value interface{}) {
+	configMap, err := kubeClientSet.CoreV1().ConfigMaps(testNamespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get ConfigMap %s: %v", name, err)
+	}
+
+	if err := decode(configMap.Data, key, value); err != nil {
+		t.Fatalf("Failed to decode %s of ConfigMap %s: %v", key, name, err)
+	}
+}
+
+func expectUsage(t *testing.T, description string, usage Usage, expectedUsage Usage) {
+	t.Helper()
+
+	for _, pair := range [][2]float64{
+		{usage.SleepHours, expectedUsage.SleepHours},
+		{usage.CPUCoreHours, expectedUsage.CPUCoreHours},
+		{usage.MemoryGiBHours, expectedUsage.MemoryGiBHours},
+		{usage.GPUHours, expectedUsage.GPUHours},
+	} {
+		if math.Abs(pair[0]-pair[1]) > 1e-9 {
+			t.Fatalf("Expected %s usage %+v, got %+v", description, expectedUsage, usage)
+		}
+	}
+}
+
+func TestSleepUsageByDay(t *testing.T) {
+	since := time.Date(2026, 3, 1, 21, 0, 0, 0, time.UTC)
+	serviceSleep := sleep{
+		Since:     since,
+		Resources: Resources{CPU: 2, MemoryBytes: 4 * bytesPerGiB, GPU: 1},
+	}
+
+	usageByDay := serviceSleep.usageByDay(since.Add(4 * time.Hour))
+	if len(usageByDay) != 2 {
+		t.Fatalf("Expected usage of 2 days, got %v", usageByDay)
+	}
+
+	expectUsage(t, "first day", usageByDay["2026-03-01"], Usage{
+		SleepHours:     3,
+		CPUCoreHours:   6,
+		MemoryGiBHours: 12,
+		GPUHours:       3,
+	})
+	expectUsage(t, "second day", usageByDay["2026-03-02"], Usage{
+		SleepHours:     1,
+		CPUCoreHours:   2,
+		MemoryGiBHours: 4,
+		GPUHours:       1,
+	})
+
+	// times in other zones are split by UTC days
+	serviceSleep.Since = time.Date(2026, 3, 2, 1, 0, 0, 0, time.FixedZone("UTC+3", 3*60*60))
+	usageByDay = serviceSleep.usageByDay(serviceSleep.Since.Add(time.Hour))
+	if _, found := usageByDay["2026-03-01"]; !found || len(usageByDay) != 1 {
+		t.Fatalf("Expected the usage on the UTC day, got %v", usageByDay)
+	}
+}
+
+func TestLedgerRecordAndReport(t *testing.T) {
+	ledger, kubeClientSet := newTestLedger(t)
+	ctx := context.Background()
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	firstDay := today.AddDate(0, 0, -3)
+	secondDay := firstDay.AddDate(0, 0, 1)
+	sleptAt := firstDay.Add(22 * time.Hour)
+	wokenAt := secondDay.Add(2 * time.Hour)
+
+	jupyterResources := Resources{CPU: 2, MemoryBytes: 4 * bytesPerGiB}
+	if err := ledger.RecordSleep(ctx, map[string]Resources{"jupyter": jupyterResources}, sleptAt, "autoscaler"); err != nil {
+		t.Fatalf("Failed to record sleep: %v", err)
+	}
+
+	// scaling a service that is already scaled to zero keeps the time it was first scaled to zero
+	if err := ledger.RecordSleep(ctx,
+		map[string]Resources{"jupyter": jupyterResources},
+		sleptAt.Add(time.Hour),
+		"api"); err != nil {
+		t.Fatalf("Failed to record sleep: %v", err)
+	}
+
+	sleeping := map[string]sleep{}
+	getConfigMapData(t, kubeClientSet, stateConfigMapName, sleepingKey, &sleeping)
+	if !sleeping["jupyter"].Since.Equal(sleptAt) {
+		t.Fatalf("Expected jupyter to be sleeping since %s, got %v", sleptAt, sleeping)
+	}
+
+	if err := ledger.RecordWake(ctx, []string{"jupyter", "spark"}, wokenAt, "dlx"); err != nil {
+		t.Fatalf("Failed to record wake: %v", err)
+	}
+
+	sleeping = map[string]sleep{}
+	getConfigMapData(t, kubeClientSet, stateConfigMapName, sleepingKey, &sleeping)
+	if len(sleeping) != 0 {
+		t.Fatalf("Expected no sleeping services, got %v", sleeping)
+	}
+
+	for _, expectedDay := range []struct {
+		day            time.Time
+		expectedUsage  Usage
+		expectedEvents []string
+	}{
+		{
+			day:            firstDay,
+			expectedUsage:  Usage{SleepHours: 2, CPUCoreHours: 4, MemoryGiBHours: 8},
+			expectedEvents: []string{ScaledToZeroEventType, ScaledToZeroEventType},
+		},
+		{
+			day:            secondDay,
+			expectedUsage:  Usage{SleepHours: 2, CPUCoreHours: 4, MemoryGiBHours: 8},
+			expectedEvents: []string{ScaledFromZeroEventType},
+		},
+	} {
+		dayConfigMapName := dayConfigMapNamePrefix + formatDay(expectedDay.day)
+
+		services := map[string]Usage{}
+		getConfigMapData(t, kubeClientSet, dayConfigMapName, servicesKey, &services)
+		if _, found := services["spark"]; found || len(services) != 1 {
+			t.Fatalf("Expected only the usage of jupyter in %s, got %v", dayConfigMapName, services)
+		}
+		expectUsage(t, dayConfigMapName, services["jupyter"], expectedDay.expectedUsage)
+
+		events := map[string][]ScaleEvent{}
+		getConfigMapData(t, kubeClientSet, dayConfigMapName, eventsKey, &events)
+		if len(events["jupyter"]) != len(expectedDay.expectedEvents) {
+			t.Fatalf("Expected events %v in %s, got %v", expectedDay.expectedEvents, dayConfigMapName, events)
+		}
+		for eventIndex, eventType := range expectedDay.expectedEvents {
+			if events["jupyter"][eventIndex].Type != eventType {
+				t.Fatalf("Expected events %v in %s, got %v", expectedDay.expectedEvents, dayConfigMapName, events)
+			}
+		}
+
+		// a service woken without having been recorded asleep has the event, but no usage
+		if expectedDay.day.Equal(secondDay) && len(events["spark"]) != 1 {
+			t.Fatalf("Expected the wake event of spark in %s, got %v", dayConfigMapName, events)
+		}
+	}
+
+	// spark is still scaled to zero, and is accounted for until the report
+	if err := ledger.RecordSleep(ctx,
+		map[string]Resources{"spark": {GPU: 1}},
+		today.Add(-2*time.Hour),
+		"autoscaler"); err != nil {
+		t.Fatalf("Failed to record sleep: %v", err)
+	}
+
+	report, err := ledger.Report(ctx, firstDay, today, "")
+	if err != nil {
+		t.Fatalf("Failed to report: %v", err)
+	}
+
+	if report.Namespace != testNamespace || report.From != formatDay(firstDay) || report.To != formatDay(today) {
+		t.Fatalf("Unexpected report range %+v", report)
+	}
+	expectUsage(t, "jupyter", report.Services["jupyter"], Usage{SleepHours: 4, CPUCoreHours: 8, MemoryGiBHours: 16})
+
+	sparkUsage := report.Services["spark"]
+	sinceSpark := time.Since(today.Add(-2 * time.Hour)).Hours()
+	if sparkUsage.GPUHours != sparkUsage.SleepHours || sparkUsage.SleepHours < 2 || sparkUsage.SleepHours > sinceSpark {
+		t.Fatalf("Expected spark to be accounted for until the report, got %+v", sparkUsage)
+	}
+	if report.Total.SleepHours != report.Services["jupyter"].SleepHours+sparkUsage.SleepHours {
+		t.Fatalf("Expected the total to sum the services, got %+v", report)
+	}
+
+	var reportedDays []string
+	for _, dayReport := range report.Days {
+		reportedDays = append(reportedDays, dayReport.Date)
+	}
+	if len(reportedDays) < 3 ||
+		reportedDays[0] != formatDay(firstDay) ||
+		reportedDays[1] != formatDay(secondDay) ||
+		reportedDays[2] != formatDay(today.AddDate(0, 0, -1)) {
+		t.Fatalf("Expected the days in order, got %v", reportedDays)
+	}
+
+	// filtered by service and by range
+	report, err = ledger.Report(ctx, secondDay, secondDay, "jupyter")
+	if err != nil {
+		t.Fatalf("Failed to report: %v", err)
+	}
+	if len(report.Days) != 1 || len(report.Services) != 1 {
+		t.Fatalf("Expected only the second day of jupyter, got %+v", report)
+	}
+	expectUsage(t, "filtered", report.Total, Usage{SleepHours: 2, CPUCoreHours: 4, MemoryGiBHours: 8})
+
+	if _, err := ledger.Report(ctx, secondDay, firstDay, ""); err == nil {
+		t.Fatalf("Expected a report ending before it starts to fail")
+	}
+
+	scaleEvents, err := ledger.ScaleEvents(ctx, firstDay, wokenAt)
+	if err != nil {
+		t.Fatalf("Failed to get scale events: %v", err)
+	}
+	if len(scaleEvents["jupyter"]) != 3 || scaleEvents["jupyter"][2].Trigger != "dlx" {
+		t.Fatalf("Expected the scale events of jupyter in order, got %v", scaleEvents)
+	}
+}
+
+func TestLedgerCleanup(t *testing.T) {
+	ledger, kubeClientSet := newTestLedger(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	for _, day := range []time.Time{
+		now.Add(-ledger.options.Retention.Duration - 48*time.Hour),
+		now.Add(-ledger.options.Retention.Duration + 48*time.Hour),
+	} {
+		if _, err := kubeClientSet.CoreV1().ConfigMaps(testNamespace).Create(ctx, &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      dayConfigMapNamePrefix + formatDay(day),
+				Namespace: testNamespace,
+				Labels:    map[string]string{ledgerLabel: dayLedgerLabel},
+			},
+		}, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("Failed to create ConfigMap: %v", err)
+		}
+	}
+
+	if err := ledger.RecordWake(ctx, []string{"jupyter"}, now, "dlx"); err != nil {
+		t.Fatalf("Failed to record wake: %v", err)
+	}
+
+	dayConfigMaps, err := ledger.listDayConfigMaps(ctx)
+	if err != nil {
+		t.Fatalf("Failed to list ConfigMaps: %v", err)
+	}
+
+	if len(dayConfigMaps) != 2 {
+		t.Fatalf("Expected only the day past the retention to be deleted, got %v", dayConfigMaps)
+	}
+	if _, found := dayConfigMaps[formatDay(now)]; !found {
+		t.Fatalf("Expected the day of the wake to be kept, got %v", dayConfigMaps)
+	}
+}
+
+func TestNilLedger(t *testing.T) {
+	var ledger *Ledger
+	if err := ledger.RecordSleep(context.Background(), map[string]Resources{"jupyter": {}}, time.Now(), ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := ledger.RecordWake(context.Background(), []string{"jupyter"}, time.Now(), ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nuclio/errors"
+)
+
+const (
+	SucceededOutcome = "succeeded"
+	FailedOutcome    = "failed"
+
+	// the mutation was not attempted, e.g. a veto hook declared the service busy
+	VetoedOutcome = "vetoed"
+)
+
+// ServiceChange is the state of a single service before and after a mutation. The status state is the one
+// reported by the controller, so right after the patch it is usually still the state before it
+type ServiceChange struct {
+	DesiredStateBefore string `json:"desiredStateBefore,omitempty"`
+	DesiredStateAfter  string `json:"desiredStateAfter,omitempty"`
+	StatusStateBefore  string `json:"statusStateBefore,omitempty"`
+	StatusStateAfter   string `json:"statusStateAfter,omitempty"`
+}
+
+// Entry records a single mutation of a service set
+type Entry struct {
+	Time        time.Time `json:"time"`
+	OperationID string    `json:"operationID,omitempty"`
+	Namespace   string    `json:"namespace"`
+
+	// what triggered the mutation, e.g. the autoscaler or a dlx request
+	Trigger    string   `json:"trigger"`
+	Services   []string `json:"services"`
+	ScaleEvent string   `json:"scaleEvent,omitempty"`
+
+	// the operation whose patch this mutation was coalesced into, if any. The patch is the coalesced one
+	CoalescedInto string `json:"coalescedInto,omitempty"`
+
+	// the json patch, as sent
+	Patch json.RawMessage `json:"patch,omitempty"`
+
+	ResourceVersionBefore string                   `json:"resourceVersionBefore,omitempty"`
+	ResourceVersionAfter  string                   `json:"resourceVersionAfter,omitempty"`
+	Changes               map[string]ServiceChange `json:"changes,omitempty"`
+
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Log is an append only audit log, writing an entry per line. A nil log discards entries
+type Log struct {
+	lock   sync.Mutex
+	writer io.Writer
+	closer io.Closer
+}
+
+// NewLog creates an audit log writing to the file at path, or to stdout if path is "-"
+func NewLog(path string) (*Log, error) {
+	if path == "-" {
+		return NewLogWithWriter(os.Stdout), nil
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open audit log")
+	}
+
+	return &Log{
+		writer: file,
+		closer: file,
+	}, nil
+}
+
+func NewLogWithWriter(writer io.Writer) *Log {
+	return &Log{
+		writer: writer,
+	}
+}
+
+// Write appends an entry. Each entry is written with a single write, so entries of concurrent writers to the
+// same file aren't interleaved
+func (l *Log) Write(entry *Entry) error {
+	if l == nil {
+		return nil
+	}
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal audit log entry")
+	}
+	line = append(line, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, err := l.writer.Write(line); err != nil {
+		return errors.Wrap(err, "Failed to write audit log entry")
+	}
+
+	return nil
+}
+
+func (l *Log) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+
+	return l.closer.Close()
+}
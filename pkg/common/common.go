@@ -4,9 +4,16 @@ import (
 	"os"
 	"strings"
 
+	"github.com/nuclio/errors"
 	"github.com/nuclio/logger"
+	nucliozap "github.com/nuclio/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 )
 
 // GetNamespace returns the namespace to use
@@ -30,6 +37,29 @@ func GetNamespace(namespaceArgument string) string {
 	return "default"
 }
 
+// NewLogger creates the root logger with the given level (debug, info, warn or error) and format. The json
+// format writes one object per line with the log vars as top level fields, for log pipelines to index
+func NewLogger(name string, level string, format string) (*nucliozap.NuclioZap, error) {
+	var encoderConfig *nucliozap.EncoderConfig
+
+	switch format {
+	case "console":
+	case "json":
+		encoderConfig = nucliozap.NewEncoderConfig()
+		encoderConfig.JSON.LineEnding = "\n"
+		encoderConfig.JSON.TimeFieldEncoding = "iso8601"
+	default:
+		return nil, errors.Errorf("Unknown log format: %s", format)
+	}
+
+	return nucliozap.NewNuclioZap(name,
+		format,
+		encoderConfig,
+		os.Stdout,
+		os.Stderr,
+		nucliozap.GetLevelByName(level))
+}
+
 // GetClientConfig returns a client config based on the kubeconfig path
 func GetClientConfig(kubeconfigPath string) (*rest.Config, error) {
 	if kubeconfigPath != "" {
@@ -39,6 +69,22 @@ func GetClientConfig(kubeconfigPath string) (*rest.Config, error) {
 	return rest.InClusterConfig()
 }
 
+// NewEventRecorder creates a recorder of Kubernetes events, reported by component
+func NewEventRecorder(logger logger.Logger, kubeClientSet kubernetes.Interface, component string) record.EventRecorder {
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: kubeClientSet.CoreV1().Events(""),
+	})
+	eventBroadcaster.StartEventWatcher(func(event *v1.Event) {
+		logger.DebugWith("Recorded event",
+			"reason", event.Reason,
+			"type", event.Type,
+			"message", event.Message)
+	})
+
+	return eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component})
+}
+
 type KubernetesClientWarningHandler struct {
 	logger logger.Logger
 }
@@ -0,0 +1,423 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package config
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/accounting"
+	"github.com/v3io/app-resource-scaler/pkg/common"
+	"github.com/v3io/app-resource-scaler/pkg/metricsource"
+	"github.com/v3io/app-resource-scaler/pkg/notification"
+	"github.com/v3io/app-resource-scaler/pkg/prewarm"
+	"github.com/v3io/app-resource-scaler/pkg/resourcescaler"
+
+	"github.com/nuclio/errors"
+	"github.com/v3io/scaler/pkg/scalertypes"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// every flag can also be set through an environment variable named after it, e.g. --scale-interval can be set
+// through SCALER_SCALE_INTERVAL
+const envPrefix = "SCALER_"
+
+type DLX struct {
+	TargetNameHeader         string                          `json:"targetNameHeader,omitempty"`
+	TargetPathHeader         string                          `json:"targetPathHeader,omitempty"`
+	TargetPort               int                             `json:"targetPort,omitempty"`
+	ListenAddress            string                          `json:"listenAddress,omitempty"`
+	ResourceReadinessTimeout scalertypes.Duration            `json:"resourceReadinessTimeout,omitempty"`
+	MultiTargetStrategy      scalertypes.MultiTargetStrategy `json:"multiTargetStrategy,omitempty"`
+}
+
+type AutoScaler struct {
+
+	// changing these restarts the autoscaler
+	ScaleInterval        scalertypes.Duration `json:"scaleInterval,omitempty"`
+	MetricsResourceKind  string               `json:"metricsResourceKind,omitempty"`
+	MetricsResourceGroup string               `json:"metricsResourceGroup,omitempty"`
+
+	MetricsSource string                         `json:"metricsSource,omitempty"`
+	Prometheus    metricsource.PrometheusOptions `json:"prometheus,omitempty"`
+
+	// only applied on startup
+	ResourceMetrics metricsource.ResourceMetricsOptions `json:"resourceMetrics,omitempty"`
+
+	// only applied on startup
+	Prewarm prewarm.Options `json:"prewarm,omitempty"`
+}
+
+// Config is the configuration of both the dlx and the autoscaler, each reading the sections relevant to it.
+// Values are merged in the following order, later ones taking precedence:
+// defaults, the configuration file, environment variables, command line flags
+type Config struct {
+	KubeconfigPath string `json:"kubeconfigPath,omitempty"`
+	Namespace      string `json:"namespace,omitempty"`
+	LogLevel       string `json:"logLevel,omitempty"`
+
+	// console or json, only applied on startup
+	LogFormat string `json:"logFormat,omitempty"`
+
+	// path of the audit log of service set mutations, "-" for stdout. Only applied on startup
+	AuditLog string `json:"auditLog,omitempty"`
+
+	// address of the health and metrics endpoints, empty disables them. Only applied on startup
+	MetricsListenAddress string `json:"metricsListenAddress,omitempty"`
+
+	// address of the unauthenticated pins API that can change pins, empty disables it. Only applied on startup
+	PinsListenAddress string `json:"pinsListenAddress,omitempty"`
+
+	// how often to check the configuration file for changes, 0 disables reloading
+	ReloadInterval scalertypes.Duration `json:"reloadInterval,omitempty"`
+
+	DLX            DLX                    `json:"dlx,omitempty"`
+	AutoScaler     AutoScaler             `json:"autoscaler,omitempty"`
+	ResourceScaler resourcescaler.Options `json:"resourceScaler,omitempty"`
+
+	// only applied on startup
+	Notifications notification.Options `json:"notifications,omitempty"`
+
+	// only applied on startup
+	Accounting accounting.Options `json:"accounting,omitempty"`
+}
+
+func NewDefault() *Config {
+	return &Config{
+		KubeconfigPath:       os.Getenv("KUBECONFIG"),
+		LogLevel:             "info",
+		LogFormat:            "console",
+		MetricsListenAddress: ":8091",
+		ReloadInterval:       scalertypes.Duration{Duration: 10 * time.Second},
+		DLX: DLX{
+			ListenAddress:            ":8090",
+			ResourceReadinessTimeout: scalertypes.Duration{Duration: 5 * time.Minute},
+			MultiTargetStrategy:      scalertypes.MultiTargetStrategyRandom,
+		},
+		AutoScaler: AutoScaler{
+			ScaleInterval: scalertypes.Duration{Duration: time.Minute},
+			MetricsSource: metricsource.CustomMetricsSource,
+			Prometheus: metricsource.PrometheusOptions{
+				QueryTemplate: metricsource.DefaultPrometheusQueryTemplate,
+				ResourceLabel: "service_name",
+				QueryTimeout:  scalertypes.Duration{Duration: 30 * time.Second},
+			},
+			ResourceMetrics: metricsource.ResourceMetricsOptions{
+				SampleInterval: scalertypes.Duration{Duration: 30 * time.Second},
+				Retention:      scalertypes.Duration{Duration: time.Hour},
+			},
+			Prewarm: prewarm.NewDefaultOptions(),
+		},
+		ResourceScaler: resourcescaler.NewDefaultOptions(),
+		Notifications:  notification.NewDefaultOptions(),
+		Accounting:     accounting.NewDefaultOptions(),
+	}
+}
+
+// RegisterCommonFlags binds the flags shared by all binaries to the configuration
+func (c *Config) RegisterCommonFlags(flagSet *flag.FlagSet) {
+	flagSet.StringVar(&c.KubeconfigPath, "kubeconfig-path", c.KubeconfigPath, "Path of kubeconfig file")
+	flagSet.StringVar(&c.Namespace, "namespace", c.Namespace, "Kubernetes namespace")
+	flagSet.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Log level (debug, info, warn or error)")
+	flagSet.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Log format (console or json)")
+	flagSet.StringVar(&c.AuditLog, "audit-log", c.AuditLog, "Path of the audit log of service set mutations (- for stdout, empty to disable)")
+	flagSet.StringVar(&c.MetricsListenAddress, "metrics-listen-address", c.MetricsListenAddress, "Address to serve health and Prometheus metrics on (empty to disable)")
+	flagSet.StringVar(&c.PinsListenAddress, "pins-listen-address", c.PinsListenAddress, "Address to serve the pins API that can pin and unpin services on (empty to disable)")
+	flagSet.DurationVar(&c.ReloadInterval.Duration, "config-reload-interval", c.ReloadInterval.Duration, "Interval to check the configuration file for changes (0 to disable)")
+	flagSet.Var(newStringSliceValue(&c.ResourceScaler.ExcludedServices), "excluded-services", "Comma delimited services to never scale to zero")
+	flagSet.DurationVar(&c.ResourceScaler.ProvisioningPollInterval.Duration, "provisioning-poll-interval", c.ResourceScaler.ProvisioningPollInterval.Duration, "Interval to check whether the service set finished provisioning")
+	flagSet.DurationVar(&c.ResourceScaler.ServiceStatePollInterval.Duration, "service-state-poll-interval", c.ResourceScaler.ServiceStatePollInterval.Duration, "Interval to check whether services reached their desired state")
+	flagSet.DurationVar(&c.ResourceScaler.SetScaleTimeout.Duration, "set-scale-timeout", c.ResourceScaler.SetScaleTimeout.Duration, "Maximum time of a scale operation without a deadline of its own")
+	flagSet.DurationVar(&c.ResourceScaler.StuckProvisioningTimeout.Duration, "stuck-provisioning-timeout", c.ResourceScaler.StuckProvisioningTimeout.Duration, "Time in the same provisioning state after which the service set is considered stuck (0 to disable)")
+	flagSet.BoolVar(&c.ResourceScaler.RecoverStuckProvisioning, "recover-stuck-provisioning", c.ResourceScaler.RecoverStuckProvisioning, "Reset a service set stuck in a provisioning state written by the scaler")
+	flagSet.DurationVar(&c.ResourceScaler.ManualChangeWindow.Duration, "manual-change-window", c.ResourceScaler.ManualChangeWindow.Duration, "How long services changed outside the scaler are left alone (0 to only record changes)")
+	flagSet.IntVar(&c.ResourceScaler.ErrorRecoveryAttempts, "error-recovery-attempts", c.ResourceScaler.ErrorRecoveryAttempts, "Times to restart services that land in error after scaling from zero (0 to disable)")
+	flagSet.DurationVar(&c.ResourceScaler.ErrorRecoveryBackoff.Duration, "error-recovery-backoff", c.ResourceScaler.ErrorRecoveryBackoff.Duration, "Wait before the first restart of services in error, doubled before every next one")
+	flagSet.Var(newStringSliceValue(&c.Notifications.Sinks), "notification-sinks", "Comma delimited urls of sinks to publish scale events to as CloudEvents")
+	flagSet.IntVar(&c.Notifications.BufferSize, "notification-buffer-size", c.Notifications.BufferSize, "Scale events buffered per sink, beyond which new events are dropped")
+	flagSet.IntVar(&c.Notifications.MaxRetries, "notification-max-retries", c.Notifications.MaxRetries, "Attempts to deliver a scale event after the first one fails")
+	flagSet.DurationVar(&c.Notifications.RetryInterval.Duration, "notification-retry-interval", c.Notifications.RetryInterval.Duration, "Interval between scale event delivery attempts, growing with each retry")
+	flagSet.DurationVar(&c.Notifications.Timeout.Duration, "notification-timeout", c.Notifications.Timeout.Duration, "Timeout of a single scale event delivery attempt")
+	flagSet.BoolVar(&c.Accounting.Enabled, "accounting", c.Accounting.Enabled, "Account for the time services spend scaled to zero and the resources freed")
+	flagSet.DurationVar(&c.Accounting.Retention.Duration, "accounting-retention", c.Accounting.Retention.Duration, "How long to keep daily accounting records")
+	flagSet.StringVar(&c.ResourceScaler.ServiceLabel, "service-label", c.ResourceScaler.ServiceLabel, "Label holding the app service name on its Kubernetes service (empty to not resolve services by label)")
+	flagSet.DurationVar(&c.ResourceScaler.ServiceEndpointCacheTTL.Duration, "service-endpoint-cache-ttl", c.ResourceScaler.ServiceEndpointCacheTTL.Duration, "How long resolved service endpoints are cached")
+	flagSet.DurationVar(&c.ResourceScaler.ServiceSetCacheTTL.Duration, "service-set-cache-ttl", c.ResourceScaler.ServiceSetCacheTTL.Duration, "How long a read service set is shared by all callers (0 to disable)")
+	flagSet.IntVar(&c.ResourceScaler.MutationsPerMinute, "mutations-per-minute", c.ResourceScaler.MutationsPerMinute, "Most patches of the service set sent per minute, beyond which mutations are queued (0 for no limit)")
+	flagSet.StringVar(&c.ResourceScaler.ScaleFromZeroTimeoutPolicy, "scale-from-zero-timeout-policy", c.ResourceScaler.ScaleFromZeroTimeoutPolicy, "What to do with services not ready when scaling from zero times out (none, revert, resetState or markFailed)")
+}
+
+// RegisterDLXFlags binds the dlx flags to the configuration
+func (c *Config) RegisterDLXFlags(flagSet *flag.FlagSet) {
+	c.RegisterCommonFlags(flagSet)
+	flagSet.StringVar(&c.DLX.TargetNameHeader, "target-name-header", c.DLX.TargetNameHeader, "Name of the header that holds information on target name")
+	flagSet.StringVar(&c.DLX.TargetPathHeader, "target-path-header", c.DLX.TargetPathHeader, "Name of the header that holds information on target path")
+	flagSet.IntVar(&c.DLX.TargetPort, "target-port", c.DLX.TargetPort, "Name of the header that holds information on target port")
+	flagSet.StringVar(&c.DLX.ListenAddress, "listen-address", c.DLX.ListenAddress, "Address to listen upon for http proxy")
+	flagSet.DurationVar(&c.DLX.ResourceReadinessTimeout.Duration, "resource-readiness-timeout", c.DLX.ResourceReadinessTimeout.Duration, "maximum wait time for the resource to be ready")
+	flagSet.StringVar((*string)(&c.DLX.MultiTargetStrategy), "multi-target-strategy", string(c.DLX.MultiTargetStrategy), "Strategy for selecting to which target to send the request")
+}
+
+// RegisterAutoScalerFlags binds the autoscaler flags to the configuration
+func (c *Config) RegisterAutoScalerFlags(flagSet *flag.FlagSet) {
+	c.RegisterCommonFlags(flagSet)
+	flagSet.DurationVar(&c.AutoScaler.ScaleInterval.Duration, "scale-interval", c.AutoScaler.ScaleInterval.Duration, "Interval to call check scale function")
+	flagSet.StringVar(&c.AutoScaler.MetricsResourceKind, "metrics-resource-kind", c.AutoScaler.MetricsResourceKind, "Resource kind (e.g. NuclioFunction)")
+	flagSet.StringVar(&c.AutoScaler.MetricsResourceGroup, "metrics-resource-group", c.AutoScaler.MetricsResourceGroup, "Resource group (e.g. nuclio.io)")
+	flagSet.StringVar(&c.AutoScaler.MetricsSource, "metrics-source", c.AutoScaler.MetricsSource, "Source of scale resources metrics (custom-metrics or prometheus)")
+	flagSet.StringVar(&c.AutoScaler.Prometheus.URL, "prometheus-url", c.AutoScaler.Prometheus.URL, "URL of the Prometheus compatible query API (e.g. http://prometheus:9090)")
+	flagSet.StringVar(&c.AutoScaler.Prometheus.QueryTemplate, "prometheus-query-template", c.AutoScaler.Prometheus.QueryTemplate, "Query template rendered per scale resource metric name and window size")
+	flagSet.StringVar(&c.AutoScaler.Prometheus.ResourceLabel, "prometheus-resource-label", c.AutoScaler.Prometheus.ResourceLabel, "Label of the query result holding the app service name")
+	flagSet.DurationVar(&c.AutoScaler.Prometheus.QueryTimeout.Duration, "prometheus-query-timeout", c.AutoScaler.Prometheus.QueryTimeout.Duration, "Timeout of a single Prometheus query")
+	flagSet.StringVar(&c.AutoScaler.ResourceMetrics.PodLabel, "resource-metrics-pod-label", c.AutoScaler.ResourceMetrics.PodLabel, "Label of the app service pods holding the app service name (enables the cpu and memory metrics)")
+	flagSet.DurationVar(&c.AutoScaler.ResourceMetrics.SampleInterval.Duration, "resource-metrics-sample-interval", c.AutoScaler.ResourceMetrics.SampleInterval.Duration, "Interval to sample the usage of app service pods")
+	flagSet.DurationVar(&c.AutoScaler.ResourceMetrics.Retention.Duration, "resource-metrics-retention", c.AutoScaler.ResourceMetrics.Retention.Duration, "How long to keep pod usage samples (the longest cpu and memory window size)")
+	flagSet.BoolVar(&c.AutoScaler.Prewarm.Enabled, "prewarm", c.AutoScaler.Prewarm.Enabled, "Pre-warm services ahead of the scheduled times they are usually used at (requires accounting)")
+	flagSet.Var(newStringSliceValue(&c.AutoScaler.Prewarm.Schedule), "prewarm-schedule", "Comma delimited times of day (HH:MM) to pre-warm services for")
+	flagSet.StringVar(&c.AutoScaler.Prewarm.Timezone, "prewarm-timezone", c.AutoScaler.Prewarm.Timezone, "Timezone of the pre-warm schedule (e.g. Europe/Berlin)")
+	flagSet.DurationVar(&c.AutoScaler.Prewarm.LeadTime.Duration, "prewarm-lead-time", c.AutoScaler.Prewarm.LeadTime.Duration, "How long before a scheduled time services are pre-warmed")
+	flagSet.DurationVar(&c.AutoScaler.Prewarm.SlotDuration.Duration, "prewarm-slot-duration", c.AutoScaler.Prewarm.SlotDuration.Duration, "How long after a scheduled time a service must have been used on previous days to be pre-warmed")
+	flagSet.IntVar(&c.AutoScaler.Prewarm.LookbackDays, "prewarm-lookback-days", c.AutoScaler.Prewarm.LookbackDays, "Previous days checked for usage in the same slot")
+	flagSet.IntVar(&c.AutoScaler.Prewarm.MinUsedDays, "prewarm-min-used-days", c.AutoScaler.Prewarm.MinUsedDays, "Previous days a service must have been used on in the same slot to be pre-warmed")
+	flagSet.DurationVar(&c.AutoScaler.Prewarm.GracePeriod.Duration, "prewarm-grace-period", c.AutoScaler.Prewarm.GracePeriod.Duration, "How long a pre-warmed service is kept from being scaled back to zero")
+	flagSet.BoolVar(&c.AutoScaler.Prewarm.Predictor.Enabled, "prewarm-predict", c.AutoScaler.Prewarm.Predictor.Enabled, "Pre-warm services predicted to be used from the times they were woken up at before (requires accounting)")
+	flagSet.Float64Var(&c.AutoScaler.Prewarm.Predictor.Threshold, "prewarm-predict-threshold", c.AutoScaler.Prewarm.Predictor.Threshold, "Probability of a service being used at or above which it's pre-warmed")
+	flagSet.DurationVar(&c.AutoScaler.Prewarm.Predictor.BucketDuration.Duration, "prewarm-predict-bucket-duration", c.AutoScaler.Prewarm.Predictor.BucketDuration.Duration, "Length of the buckets the day is split into for predictions (must divide a day)")
+	flagSet.IntVar(&c.AutoScaler.Prewarm.Predictor.LookbackDays, "prewarm-predict-lookback-days", c.AutoScaler.Prewarm.Predictor.LookbackDays, "Previous days predictions are learned from")
+	flagSet.Float64Var(&c.AutoScaler.Prewarm.Predictor.Decay, "prewarm-predict-decay", c.AutoScaler.Prewarm.Predictor.Decay, "Weight of each previous day (or week) relative to the one after it")
+	flagSet.StringVar(&c.AutoScaler.Prewarm.Predictor.Seasonality, "prewarm-predict-seasonality", c.AutoScaler.Prewarm.Predictor.Seasonality, "Learn from every previous day (daily) or only the same weekday (weekly)")
+	flagSet.DurationVar(&c.AutoScaler.Prewarm.Predictor.IdleTolerance.Duration, "prewarm-predict-idle-tolerance", c.AutoScaler.Prewarm.Predictor.IdleTolerance.Duration, "How soon after its bucket ends an unused predicted pre-warm is scaled back to zero")
+	flagSet.DurationVar(&c.AutoScaler.Prewarm.Predictor.AccuracyLogInterval.Duration, "prewarm-predict-accuracy-log-interval", c.AutoScaler.Prewarm.Predictor.AccuracyLogInterval.Duration, "How often the prediction accuracy is logged")
+}
+
+// Load merges the defaults, the configuration file (if given), the environment and the command line flags that
+// were explicitly set on parsedFlagSet. registerFlags must be the function the flags were registered with
+func Load(configPath string,
+	parsedFlagSet *flag.FlagSet,
+	registerFlags func(*Config, *flag.FlagSet)) (*Config, error) {
+
+	config := NewDefault()
+
+	if configPath != "" {
+		if err := config.readFile(configPath); err != nil {
+			return nil, errors.Wrapf(err, "Failed to read configuration file %s", configPath)
+		}
+	}
+
+	// bind a fresh flag set to the loaded configuration, so that env and flags are set on top of it
+	overridesFlagSet := flag.NewFlagSet("overrides", flag.ContinueOnError)
+	registerFlags(config, overridesFlagSet)
+
+	var overrideErr error
+	overridesFlagSet.VisitAll(func(overrideFlag *flag.Flag) {
+		envName := envPrefix + strings.ToUpper(strings.ReplaceAll(overrideFlag.Name, "-", "_"))
+		envValue, found := os.LookupEnv(envName)
+		if !found || overrideErr != nil {
+			return
+		}
+
+		if err := overrideFlag.Value.Set(envValue); err != nil {
+			overrideErr = errors.Wrapf(err, "Invalid value of environment variable %s", envName)
+		}
+	})
+
+	parsedFlagSet.Visit(func(parsedFlag *flag.Flag) {
+		if overrideErr != nil || overridesFlagSet.Lookup(parsedFlag.Name) == nil {
+			return
+		}
+
+		if err := overridesFlagSet.Set(parsedFlag.Name, parsedFlag.Value.String()); err != nil {
+			overrideErr = errors.Wrapf(err, "Invalid value of flag --%s", parsedFlag.Name)
+		}
+	})
+
+	if overrideErr != nil {
+		return nil, overrideErr
+	}
+
+	config.Namespace = common.GetNamespace(config.Namespace)
+
+	return config, nil
+}
+
+// ValidateDLX validates the sections used by the dlx
+func (c *Config) ValidateDLX() error {
+	if err := c.validateCommon(); err != nil {
+		return errors.Wrap(err, "Invalid configuration")
+	}
+
+	if c.DLX.ListenAddress == "" {
+		return errors.New("DLX listen address must be set")
+	}
+
+	if c.DLX.TargetPort < 0 {
+		return errors.New("DLX target port must not be negative")
+	}
+
+	if c.DLX.ResourceReadinessTimeout.Duration <= 0 {
+		return errors.New("DLX resource readiness timeout must be positive")
+	}
+
+	switch c.DLX.MultiTargetStrategy {
+	case scalertypes.MultiTargetStrategyRandom,
+		scalertypes.MultiTargetStrategyPrimary,
+		scalertypes.MultiTargetStrategyCanary:
+	default:
+		return errors.Errorf("Unknown DLX multi target strategy: %s", c.DLX.MultiTargetStrategy)
+	}
+
+	return nil
+}
+
+// ValidateAutoScaler validates the sections used by the autoscaler
+func (c *Config) ValidateAutoScaler() error {
+	if err := c.validateCommon(); err != nil {
+		return errors.Wrap(err, "Invalid configuration")
+	}
+
+	if c.AutoScaler.ScaleInterval.Duration <= 0 {
+		return errors.New("Autoscaler scale interval must be positive")
+	}
+
+	switch c.AutoScaler.MetricsSource {
+	case metricsource.CustomMetricsSource:
+	case metricsource.PrometheusSource:
+		if c.AutoScaler.Prometheus.URL == "" {
+			return errors.New("Prometheus URL must be set when using the prometheus metrics source")
+		}
+	default:
+		return errors.Errorf("Unknown autoscaler metrics source: %s", c.AutoScaler.MetricsSource)
+	}
+
+	if err := c.AutoScaler.ResourceMetrics.Validate(); err != nil {
+		return errors.Wrap(err, "Invalid resource metrics configuration")
+	}
+
+	if err := c.AutoScaler.Prewarm.Validate(); err != nil {
+		return errors.Wrap(err, "Invalid prewarm configuration")
+	}
+
+	if (c.AutoScaler.Prewarm.Enabled || c.AutoScaler.Prewarm.Predictor.Enabled) && !c.Accounting.Enabled {
+		return errors.New("Prewarm requires accounting, which records the usage services are pre-warmed by")
+	}
+
+	return nil
+}
+
+func (c *Config) validateCommon() error {
+	if err := c.ResourceScaler.Validate(); err != nil {
+		return errors.Wrap(err, "Invalid resource scaler configuration")
+	}
+
+	if err := c.Notifications.Validate(); err != nil {
+		return errors.Wrap(err, "Invalid notifications configuration")
+	}
+
+	if err := c.Accounting.Validate(); err != nil {
+		return errors.Wrap(err, "Invalid accounting configuration")
+	}
+
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		return errors.Errorf("Unknown log level: %s", c.LogLevel)
+	}
+
+	switch c.LogFormat {
+	case "console", "json":
+	default:
+		return errors.Errorf("Unknown log format: %s", c.LogFormat)
+	}
+
+	if c.ReloadInterval.Duration < 0 {
+		return errors.New("Reload interval must not be negative")
+	}
+
+	return nil
+}
+
+// DLXOptions returns the scaler's dlx options
+func (c *Config) DLXOptions() scalertypes.DLXOptions {
+	return scalertypes.DLXOptions{
+		Namespace:                c.Namespace,
+		TargetNameHeader:         c.DLX.TargetNameHeader,
+		TargetPathHeader:         c.DLX.TargetPathHeader,
+		TargetPort:               c.DLX.TargetPort,
+		ListenAddress:            c.DLX.ListenAddress,
+		ResourceReadinessTimeout: c.DLX.ResourceReadinessTimeout,
+		MultiTargetStrategy:      c.DLX.MultiTargetStrategy,
+	}
+}
+
+// AutoScalerOptions returns the scaler's autoscaler options
+func (c *Config) AutoScalerOptions() scalertypes.AutoScalerOptions {
+	return scalertypes.AutoScalerOptions{
+		Namespace:     c.Namespace,
+		ScaleInterval: c.AutoScaler.ScaleInterval,
+		GroupKind: schema.GroupKind{
+			Kind:  c.AutoScaler.MetricsResourceKind,
+			Group: c.AutoScaler.MetricsResourceGroup,
+		},
+	}
+}
+
+// readFile overlays a YAML or JSON configuration file on the configuration
+func (c *Config) readFile(configPath string) error {
+	configContents, err := os.ReadFile(configPath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read file")
+	}
+
+	if err := yaml.UnmarshalStrict(configContents, c); err != nil {
+		return errors.Wrap(err, "Failed to parse file")
+	}
+
+	return nil
+}
+
+// stringSliceValue is a flag.Value of a comma delimited list
+type stringSliceValue struct {
+	slice *[]string
+}
+
+func newStringSliceValue(slice *[]string) *stringSliceValue {
+	return &stringSliceValue{slice: slice}
+}
+
+func (v *stringSliceValue) String() string {
+	if v.slice == nil {
+		return ""
+	}
+	return strings.Join(*v.slice, ",")
+}
+
+func (v *stringSliceValue) Set(value string) error {
+	*v.slice = []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v.slice = append(*v.slice, item)
+		}
+	}
+	return nil
+}
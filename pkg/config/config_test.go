@@ -0,0 +1,149 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a configuration file to a temporary directory, returning its path
+func writeConfigFile(tb testing.TB, contents string) string {
+	configPath := filepath.Join(tb.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(contents), 0600); err != nil {
+		tb.Fatalf("Failed to write configuration file: %v", err)
+	}
+
+	return configPath
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	for _, testCase := range []struct {
+		name                  string
+		fileContents          string
+		env                   map[string]string
+		args                  []string
+		expectedScaleInterval time.Duration
+		expectedLogLevel      string
+	}{
+		{
+			name:                  "defaults",
+			expectedScaleInterval: time.Minute,
+			expectedLogLevel:      "info",
+		},
+		{
+			name:                  "file over defaults",
+			fileContents:          "logLevel: warn\nautoscaler:\n  scaleInterval: 2m\n",
+			expectedScaleInterval: 2 * time.Minute,
+			expectedLogLevel:      "warn",
+		},
+		{
+			name:                  "env over file",
+			fileContents:          "logLevel: warn\nautoscaler:\n  scaleInterval: 2m\n",
+			env:                   map[string]string{"SCALER_SCALE_INTERVAL": "3m"},
+			expectedScaleInterval: 3 * time.Minute,
+			expectedLogLevel:      "warn",
+		},
+		{
+			name:                  "env over defaults",
+			env:                   map[string]string{"SCALER_LOG_LEVEL": "error"},
+			expectedScaleInterval: time.Minute,
+			expectedLogLevel:      "error",
+		},
+		{
+			name:                  "flags over env",
+			fileContents:          "logLevel: warn\nautoscaler:\n  scaleInterval: 2m\n",
+			env:                   map[string]string{"SCALER_SCALE_INTERVAL": "3m", "SCALER_LOG_LEVEL": "error"},
+			args:                  []string{"--scale-interval", "4m"},
+			expectedScaleInterval: 4 * time.Minute,
+			expectedLogLevel:      "error",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			for envName, envValue := range testCase.env {
+				t.Setenv(envName, envValue)
+			}
+
+			configPath := ""
+			if testCase.fileContents != "" {
+				configPath = writeConfigFile(t, "namespace: default-tenant\n"+testCase.fileContents)
+			}
+
+			flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+			NewDefault().RegisterAutoScalerFlags(flagSet)
+			if err := flagSet.Parse(append([]string{"--namespace", "default-tenant"}, testCase.args...)); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+
+			loadedConfig, err := Load(configPath, flagSet, (*Config).RegisterAutoScalerFlags)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if loadedConfig.AutoScaler.ScaleInterval.Duration != testCase.expectedScaleInterval {
+				t.Fatalf("Expected scale interval %s, got %s",
+					testCase.expectedScaleInterval,
+					loadedConfig.AutoScaler.ScaleInterval.Duration)
+			}
+
+			if loadedConfig.LogLevel != testCase.expectedLogLevel {
+				t.Fatalf("Expected log level %s, got %s", testCase.expectedLogLevel, loadedConfig.LogLevel)
+			}
+
+			if err := loadedConfig.ValidateAutoScaler(); err != nil {
+				t.Fatalf("Expected the loaded configuration to be valid: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, testCase := range []struct {
+		name         string
+		fileContents string
+		env          map[string]string
+	}{
+		{name: "unknown file key", fileContents: "autoscaler:\n  scaleIntervalz: 2m\n"},
+		{name: "malformed file", fileContents: "autoscaler: [\n"},
+		{name: "invalid env value", env: map[string]string{"SCALER_SCALE_INTERVAL": "soon"}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			for envName, envValue := range testCase.env {
+				t.Setenv(envName, envValue)
+			}
+
+			configPath := ""
+			if testCase.fileContents != "" {
+				configPath = writeConfigFile(t, testCase.fileContents)
+			}
+
+			flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+			NewDefault().RegisterAutoScalerFlags(flagSet)
+
+			if _, err := Load(configPath, flagSet, (*Config).RegisterAutoScalerFlags); err == nil {
+				t.Fatalf("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"time"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+)
+
+// Watcher reloads the configuration when the configuration file changes and hands it to its listeners.
+// The file contents are polled rather than watched for events, since a mounted ConfigMap is updated by
+// swapping symlinks, which file event watchers don't reliably report
+type Watcher struct {
+	logger       logger.Logger
+	configPath   string
+	interval     time.Duration
+	loadFunc     func() (*Config, error)
+	listeners    []func(*Config)
+	lastContents []byte
+}
+
+// NewWatcher creates a watcher of configPath. loadFunc must load and validate the configuration the same way
+// it was loaded on startup, so that environment variables and flags keep taking precedence over the file
+func NewWatcher(parentLogger logger.Logger,
+	configPath string,
+	interval time.Duration,
+	loadFunc func() (*Config, error)) (*Watcher, error) {
+
+	if interval <= 0 {
+		return nil, errors.New("Watch interval must be positive")
+	}
+
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read configuration file")
+	}
+
+	return &Watcher{
+		logger:       parentLogger.GetChild("config-watcher"),
+		configPath:   configPath,
+		interval:     interval,
+		loadFunc:     loadFunc,
+		lastContents: contents,
+	}, nil
+}
+
+// OnChange registers a listener, called with the reloaded configuration. Must be called before Start
+func (w *Watcher) OnChange(listener func(*Config)) {
+	w.listeners = append(w.listeners, listener)
+}
+
+func (w *Watcher) Start(ctx context.Context) {
+	w.logger.DebugWith("Watching configuration file", "configPath", w.configPath, "interval", w.interval)
+
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				w.checkForChanges()
+			}
+		}
+	}()
+}
+
+func (w *Watcher) checkForChanges() {
+	contents, err := os.ReadFile(w.configPath)
+	if err != nil {
+		w.logger.WarnWith("Failed to read configuration file, keeping current configuration",
+			"configPath", w.configPath,
+			"err", err.Error())
+		return
+	}
+
+	if bytes.Equal(contents, w.lastContents) {
+		return
+	}
+
+	// don't retry the same broken contents on every tick
+	w.lastContents = contents
+
+	reloadedConfig, err := w.loadFunc()
+	if err != nil {
+		w.logger.WarnWith("Failed to reload configuration, keeping current configuration",
+			"configPath", w.configPath,
+			"err", errors.GetErrorStackString(err, 10))
+		return
+	}
+
+	w.logger.InfoWith("Configuration file changed, applying", "configPath", w.configPath)
+	for _, listener := range w.listeners {
+		listener(reloadedConfig)
+	}
+}
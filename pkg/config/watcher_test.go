@@ -0,0 +1,116 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package config
+
+import (
+	"flag"
+	"os"
+	"testing"
+	"time"
+
+	nucliozap "github.com/nuclio/zap"
+)
+
+func TestWatcherReload(t *testing.T) {
+	loggerInstance, err := nucliozap.NewNuclioZap("test", "console", nil, os.Stdout, os.Stderr, nucliozap.DebugLevel)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	configPath := writeConfigFile(t, "namespace: default-tenant\nautoscaler:\n  scaleInterval: 2m\n")
+
+	// the flags keep taking precedence over the reloaded file
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	NewDefault().RegisterAutoScalerFlags(flagSet)
+	if err := flagSet.Parse([]string{"--log-level", "warn"}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	loadConfig := func() (*Config, error) {
+		loadedConfig, err := Load(configPath, flagSet, (*Config).RegisterAutoScalerFlags)
+		if err != nil {
+			return nil, err
+		}
+
+		return loadedConfig, loadedConfig.ValidateAutoScaler()
+	}
+
+	watcher, err := NewWatcher(loggerInstance, configPath, time.Second, loadConfig)
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+
+	var reloadedConfigs []*Config
+	watcher.OnChange(func(reloadedConfig *Config) {
+		reloadedConfigs = append(reloadedConfigs, reloadedConfig)
+	})
+
+	writeContents := func(contents string) {
+		if err := os.WriteFile(configPath, []byte(contents), 0600); err != nil {
+			t.Fatalf("Failed to write configuration file: %v", err)
+		}
+	}
+
+	// unchanged
+	watcher.checkForChanges()
+	if len(reloadedConfigs) != 0 {
+		t.Fatalf("Expected no reload of an unchanged file, got %d", len(reloadedConfigs))
+	}
+
+	// changed
+	writeContents("namespace: default-tenant\nautoscaler:\n  scaleInterval: 5m\n")
+	watcher.checkForChanges()
+	if len(reloadedConfigs) != 1 {
+		t.Fatalf("Expected a reload of the changed file, got %d", len(reloadedConfigs))
+	}
+
+	if scaleInterval := reloadedConfigs[0].AutoScaler.ScaleInterval.Duration; scaleInterval != 5*time.Minute {
+		t.Fatalf("Expected the reloaded scale interval, got %s", scaleInterval)
+	}
+
+	if logLevel := reloadedConfigs[0].LogLevel; logLevel != "warn" {
+		t.Fatalf("Expected the flag to take precedence over the reloaded file, got log level %s", logLevel)
+	}
+
+	// invalid, neither applied nor retried
+	writeContents("namespace: default-tenant\nautoscaler:\n  scaleInterval: -5m\n")
+	watcher.checkForChanges()
+	watcher.checkForChanges()
+	if len(reloadedConfigs) != 1 {
+		t.Fatalf("Expected an invalid file not to be applied, got %d reloads", len(reloadedConfigs))
+	}
+
+	// fixed
+	writeContents("namespace: default-tenant\nautoscaler:\n  scaleInterval: 10m\n")
+	watcher.checkForChanges()
+	if len(reloadedConfigs) != 2 {
+		t.Fatalf("Expected the fixed file to be applied, got %d reloads", len(reloadedConfigs))
+	}
+
+	// removed, keeping the current configuration
+	if err := os.Remove(configPath); err != nil {
+		t.Fatalf("Failed to remove configuration file: %v", err)
+	}
+	watcher.checkForChanges()
+	if len(reloadedConfigs) != 2 {
+		t.Fatalf("Expected a removed file not to be applied, got %d reloads", len(reloadedConfigs))
+	}
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package dlxserver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/resourcescaler"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	"github.com/v3io/scaler/pkg/dlx"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// ServiceEndpointResolver is implemented by resource scalers that know the port of each resource's service
+type ServiceEndpointResolver interface {
+	ResolveServiceEndpoint(scalertypes.Resource) (resourcescaler.ServiceEndpoint, error)
+}
+
+// ServiceRouteResolver is implemented by resource scalers that can map a request's host and path to a resource
+type ServiceRouteResolver interface {
+	ResolveServiceRoute(host string, path string) (string, bool, error)
+}
+
+// Server is the scaler's DLX, with a handler that can be replaced while running. Requests in flight keep being
+// served (and their resources keep being woken up) by the handler they started with
+type Server struct {
+	logger         logger.Logger
+	resourceScaler scalertypes.ResourceScaler
+	server         *http.Server
+
+	lock            sync.RWMutex
+	options         scalertypes.DLXOptions
+	resourceStarter *dlx.ResourceStarter
+	handler         *dlx.Handler
+
+	// handlers of services resolved to a port other than the target port, sharing the resource starter
+	portHandlers map[int]*dlx.Handler
+}
+
+func NewServer(parentLogger logger.Logger,
+	resourceScaler scalertypes.ResourceScaler,
+	options scalertypes.DLXOptions) (*Server, error) {
+	childLogger := parentLogger.GetChild("dlx")
+	childLogger.InfoWith("Creating DLX", "options", options)
+
+	s := &Server{
+		logger:         childLogger,
+		resourceScaler: resourceScaler,
+	}
+
+	s.server = &http.Server{
+		Addr:              options.ListenAddress,
+		Handler:           s,
+		ReadHeaderTimeout: time.Minute,
+	}
+
+	if err := s.SetOptions(options); err != nil {
+		return nil, errors.Wrap(err, "Failed to create handler")
+	}
+
+	return s, nil
+}
+
+func (s *Server) Start() error {
+	s.logger.DebugWith("Starting", "server", s.server.Addr)
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			s.logger.ErrorWith("DLX server stopped unexpectedly", "err", err.Error())
+		}
+	}()
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	s.logger.DebugWith("Stopping", "server", s.server.Addr)
+	return s.server.Shutdown(ctx)
+}
+
+// SetOptions rebuilds the handler with the given options. The listen address can't change while running
+func (s *Server) SetOptions(options scalertypes.DLXOptions) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.handler != nil && options.ListenAddress != s.options.ListenAddress {
+		s.logger.WarnWith("Listen address can't be changed while running, restart to apply",
+			"currentListenAddress", s.options.ListenAddress,
+			"listenAddress", options.ListenAddress)
+		options.ListenAddress = s.options.ListenAddress
+	}
+
+	// keep the resource starter when possible, so that requests coming in after the change join
+	// wake-ups that are already in progress instead of starting new ones
+	resourceStarter := s.resourceStarter
+	if resourceStarter == nil ||
+		options.Namespace != s.options.Namespace ||
+		options.ResourceReadinessTimeout != s.options.ResourceReadinessTimeout {
+
+		var err error
+		resourceStarter, err = dlx.NewResourceStarter(s.logger,
+			&declaredReplicasResourceScaler{ResourceScaler: s.resourceScaler},
+			options.Namespace,
+			options.ResourceReadinessTimeout.Duration)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create resource starter")
+		}
+	}
+
+	handler, err := s.createHandler(resourceStarter, options, options.TargetPort)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create handler")
+	}
+
+	if s.handler != nil {
+		s.logger.InfoWith("Replacing handler", "options", options)
+	}
+
+	s.options = options
+	s.resourceStarter = resourceStarter
+	s.handler = handler
+	s.portHandlers = map[int]*dlx.Handler{}
+
+	return nil
+}
+
+func (s *Server) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if err := s.routeRequest(request); err != nil {
+		s.logger.WarnWith("Failed to route request", "err", errors.GetErrorStackString(err, 10))
+		responseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	handler, err := s.getHandler(request)
+	if err != nil {
+		s.logger.WarnWith("Failed to get handler", "err", errors.GetErrorStackString(err, 10))
+		responseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	handler.HandleFunc(responseWriter, request)
+}
+
+// routeRequest sets the target name header of requests that have none by their host and path, so the dlx can be
+// put behind a catch-all ingress. The path header is removed, as the request's path is the app service's path
+func (s *Server) routeRequest(request *http.Request) error {
+	s.lock.RLock()
+	options := s.options
+	s.lock.RUnlock()
+
+	serviceRouteResolver, ok := s.resourceScaler.(ServiceRouteResolver)
+	if !ok || isIngressRequest(request) || request.Header.Get(options.TargetNameHeader) != "" {
+		return nil
+	}
+
+	serviceName, found, err := serviceRouteResolver.ResolveServiceRoute(request.Host, request.URL.Path)
+	if err != nil {
+		return errors.Wrap(err, "Failed to resolve service route")
+	}
+
+	if !found {
+		s.logger.DebugWith("No service route matches request", "host", request.Host, "path", request.URL.Path)
+		return nil
+	}
+
+	request.Header.Set(options.TargetNameHeader, serviceName)
+	request.Header.Del(options.TargetPathHeader)
+
+	return nil
+}
+
+// getHandler returns the handler proxying to the port of the request's target. Requests from an ingress (which
+// carry the port), to multiple targets or to targets whose port isn't known go to the target port
+func (s *Server) getHandler(request *http.Request) (*dlx.Handler, error) {
+	s.lock.RLock()
+	handler := s.handler
+	options := s.options
+	s.lock.RUnlock()
+
+	serviceEndpointResolver, ok := s.resourceScaler.(ServiceEndpointResolver)
+	if !ok || isIngressRequest(request) {
+		return handler, nil
+	}
+
+	targetName := request.Header.Get(options.TargetNameHeader)
+	if targetName == "" || strings.Contains(targetName, ",") {
+		return handler, nil
+	}
+
+	serviceEndpoint, err := serviceEndpointResolver.ResolveServiceEndpoint(scalertypes.Resource{Name: targetName})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to resolve service endpoint")
+	}
+
+	if serviceEndpoint.Port == 0 || serviceEndpoint.Port == options.TargetPort {
+		return handler, nil
+	}
+
+	return s.getPortHandler(serviceEndpoint.Port)
+}
+
+func (s *Server) getPortHandler(port int) (*dlx.Handler, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if portHandler, found := s.portHandlers[port]; found {
+		return portHandler, nil
+	}
+
+	portHandler, err := s.createHandler(s.resourceStarter, s.options, port)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create handler of port %d", port)
+	}
+
+	s.portHandlers[port] = portHandler
+	return portHandler, nil
+}
+
+func (s *Server) createHandler(resourceStarter *dlx.ResourceStarter,
+	options scalertypes.DLXOptions,
+	targetPort int) (*dlx.Handler, error) {
+	handler, err := dlx.NewHandler(s.logger,
+		resourceStarter,
+		s.resourceScaler,
+		options.TargetNameHeader,
+		options.TargetPathHeader,
+		targetPort,
+		options.MultiTargetStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &handler, nil
+}
+
+// isIngressRequest returns whether the dlx handler takes the request's target from the ingress headers
+func isIngressRequest(request *http.Request) bool {
+	return request.Header.Get("X-Forwarded-Host") != "" &&
+		request.Header.Get("X-Forwarded-Port") != "" &&
+		request.Header.Get("X-Resource-Name") != ""
+}
+
+// declaredReplicasResourceScaler wakes resources up keeping the replica count they declare, as the dlx requests a
+// scale of 1 to mean awake
+type declaredReplicasResourceScaler struct {
+	scalertypes.ResourceScaler
+}
+
+func (r *declaredReplicasResourceScaler) SetScaleCtx(ctx context.Context,
+	resources []scalertypes.Resource,
+	scale int) error {
+	return r.ResourceScaler.SetScaleCtx(resourcescaler.WithDeclaredReplicas(ctx), resources, scale)
+}
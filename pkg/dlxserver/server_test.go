@@ -0,0 +1,186 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package dlxserver
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/v3io/app-resource-scaler/pkg/resourcescaler"
+
+	nucliozap "github.com/nuclio/zap"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// fakeResourceScaler resolves the endpoints of services by name, counting the resolutions
+type fakeResourceScaler struct {
+	scalertypes.ResourceScaler
+
+	lock        sync.Mutex
+	endpoints   map[string]resourcescaler.ServiceEndpoint
+	resolutions int
+}
+
+func (s *fakeResourceScaler) ResolveServiceEndpoint(resource scalertypes.Resource) (resourcescaler.ServiceEndpoint, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.resolutions++
+	serviceEndpoint, found := s.endpoints[resource.Name]
+	if !found {
+		return resourcescaler.ServiceEndpoint{}, errors.New("Service not found")
+	}
+
+	return serviceEndpoint, nil
+}
+
+func newTestServer(t *testing.T, resourceScaler scalertypes.ResourceScaler) *Server {
+	loggerInstance, err := nucliozap.NewNuclioZap("test", "console", nil, os.Stdout, os.Stderr, nucliozap.InfoLevel)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	server, err := NewServer(loggerInstance, resourceScaler, scalertypes.DLXOptions{
+		Namespace:        "default-tenant",
+		TargetNameHeader: "X-Resource-Name",
+		TargetPathHeader: "X-Resource-Path",
+		TargetPort:       8080,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	return server
+}
+
+func newTargetRequest(targetName string) *http.Request {
+	request := httptest.NewRequest(http.MethodGet, "http://dlx/lab", nil)
+	if targetName != "" {
+		request.Header.Set("X-Resource-Name", targetName)
+	}
+
+	return request
+}
+
+func TestGetHandler(t *testing.T) {
+	resourceScaler := &fakeResourceScaler{endpoints: map[string]resourcescaler.ServiceEndpoint{
+		"jupyter":   {Host: "jupyter", Port: 8888},
+		"jupyter-2": {Host: "jupyter-2", Port: 8888},
+		"spark":     {Host: "spark", Port: 8080},
+		"presto":    {Host: "presto"},
+	}}
+	server := newTestServer(t, resourceScaler)
+
+	ingressRequest := newTargetRequest("jupyter")
+	ingressRequest.Header.Set("X-Forwarded-Host", "jupyter.apps.example.com")
+	ingressRequest.Header.Set("X-Forwarded-Port", "80")
+
+	for _, testCase := range []struct {
+		name                string
+		request             *http.Request
+		expectedPort        int
+		expectedResolutions int
+	}{
+		{name: "no target", request: newTargetRequest("")},
+		{name: "multiple targets", request: newTargetRequest("jupyter,spark")},
+		{name: "ingress request", request: ingressRequest},
+		{name: "target port", request: newTargetRequest("spark"), expectedResolutions: 1},
+		{name: "unknown port", request: newTargetRequest("presto"), expectedResolutions: 1},
+		{name: "other port", request: newTargetRequest("jupyter"), expectedPort: 8888, expectedResolutions: 1},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			resourceScaler.resolutions = 0
+
+			handler, err := server.getHandler(testCase.request)
+			if err != nil {
+				t.Fatalf("Failed to get handler: %v", err)
+			}
+
+			expectedHandler := server.handler
+			if testCase.expectedPort != 0 {
+				expectedHandler = server.portHandlers[testCase.expectedPort]
+			}
+
+			if expectedHandler == nil || handler != expectedHandler {
+				t.Fatalf("Expected the handler of port %d", testCase.expectedPort)
+			}
+
+			if resourceScaler.resolutions != testCase.expectedResolutions {
+				t.Fatalf("Expected %d resolutions, got %d", testCase.expectedResolutions, resourceScaler.resolutions)
+			}
+		})
+	}
+
+	// services on the same port share its handler
+	handler, err := server.getHandler(newTargetRequest("jupyter-2"))
+	if err != nil || handler != server.portHandlers[8888] || len(server.portHandlers) != 1 {
+		t.Fatalf("Expected the handler of port 8888 to be shared, got %d port handlers (%v)", len(server.portHandlers), err)
+	}
+
+	if _, err := server.getHandler(newTargetRequest("nuclio")); err == nil {
+		t.Fatalf("Expected failing to resolve an unknown service")
+	}
+}
+
+func TestGetHandlerWithoutEndpointResolver(t *testing.T) {
+	server := newTestServer(t, &struct{ scalertypes.ResourceScaler }{})
+
+	handler, err := server.getHandler(newTargetRequest("jupyter"))
+	if err != nil || handler != server.handler {
+		t.Fatalf("Expected the target port handler, got %v", err)
+	}
+}
+
+func TestSetOptionsResetsPortHandlers(t *testing.T) {
+	server := newTestServer(t, &fakeResourceScaler{endpoints: map[string]resourcescaler.ServiceEndpoint{
+		"jupyter": {Host: "jupyter", Port: 8888},
+	}})
+
+	portHandler, err := server.getPortHandler(8888)
+	if err != nil {
+		t.Fatalf("Failed to get port handler: %v", err)
+	}
+
+	resourceStarter := server.resourceStarter
+	options := server.options
+	options.TargetPathHeader = "X-Path"
+	if err := server.SetOptions(options); err != nil {
+		t.Fatalf("Failed to set options: %v", err)
+	}
+
+	// port handlers are recreated with the new options, still sharing the resource starter
+	newPortHandler, err := server.getPortHandler(8888)
+	if err != nil {
+		t.Fatalf("Failed to get port handler: %v", err)
+	}
+
+	if newPortHandler == portHandler {
+		t.Fatalf("Expected the port handler to be recreated")
+	}
+
+	if server.resourceStarter != resourceStarter {
+		t.Fatalf("Expected the resource starter to be kept")
+	}
+}
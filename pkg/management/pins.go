@@ -0,0 +1,193 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package management
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/resourcescaler"
+
+	nuclioerrors "github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+)
+
+// PinsPath is the path pins are served under. A pin of a single service is at PinsPath/<service>
+const PinsPath = "/api/v1/pins"
+
+// ServicePinner is implemented by resource scalers that can keep services from being scaled to zero
+type ServicePinner interface {
+	GetServicePins(ctx context.Context) ([]resourcescaler.ServicePin, error)
+	PinService(ctx context.Context, serviceName string, pinnedUntil time.Time) error
+	UnpinService(ctx context.Context, serviceName string) error
+}
+
+// PinRequest is the JSON body of a pin request. Exactly one of Until (RFC3339) or Duration must be set
+type PinRequest struct {
+	Until    string `json:"until,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// ErrorResponse is the JSON body of failed requests
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type pinsHandler struct {
+	logger        logger.Logger
+	servicePinner ServicePinner
+	allowWrites   bool
+}
+
+// HandlePins serves the pins API on the server:
+//
+//	GET    /api/v1/pins            lists the pinned services
+//	PUT    /api/v1/pins/<service>  pins a service, with a PinRequest body
+//	DELETE /api/v1/pins/<service>  unpins a service
+//
+// PUT and DELETE are rejected unless allowWrites is set, so pins can be listed but not changed on the metrics listener
+func (s *Server) HandlePins(servicePinner ServicePinner, allowWrites bool) {
+	handler := &pinsHandler{
+		logger:        s.logger.GetChild("pins"),
+		servicePinner: servicePinner,
+		allowWrites:   allowWrites,
+	}
+
+	s.Handle(PinsPath, handler)
+	s.Handle(PinsPath+"/", handler)
+}
+
+func (h *pinsHandler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	serviceName := strings.Trim(strings.TrimPrefix(request.URL.Path, PinsPath), "/")
+
+	switch {
+	case serviceName == "" && request.Method == http.MethodGet:
+		h.getPins(responseWriter, request)
+	case serviceName != "" && !h.allowWrites && (request.Method == http.MethodPut || request.Method == http.MethodDelete):
+		writeError(responseWriter, http.StatusMethodNotAllowed, "Pins are read-only on this address")
+	case serviceName != "" && request.Method == http.MethodPut:
+		h.pinService(responseWriter, request, serviceName)
+	case serviceName != "" && request.Method == http.MethodDelete:
+		h.unpinService(responseWriter, request, serviceName)
+	default:
+		writeError(responseWriter, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (h *pinsHandler) getPins(responseWriter http.ResponseWriter, request *http.Request) {
+	servicePins, err := h.servicePinner.GetServicePins(request.Context())
+	if err != nil {
+		h.writeServicePinnerError(responseWriter, err)
+		return
+	}
+
+	writeJSON(responseWriter, http.StatusOK, servicePins)
+}
+
+func (h *pinsHandler) pinService(responseWriter http.ResponseWriter, request *http.Request, serviceName string) {
+	pinRequest := PinRequest{}
+	if err := json.NewDecoder(request.Body).Decode(&pinRequest); err != nil {
+		writeError(responseWriter, http.StatusBadRequest, "Failed to decode pin request: "+err.Error())
+		return
+	}
+
+	pinnedUntil, err := pinRequest.pinnedUntil(time.Now())
+	if err != nil {
+		writeError(responseWriter, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.servicePinner.PinService(request.Context(), serviceName, pinnedUntil); err != nil {
+		h.writeServicePinnerError(responseWriter, err)
+		return
+	}
+
+	writeJSON(responseWriter, http.StatusOK, resourcescaler.ServicePin{
+		Service:     serviceName,
+		PinnedUntil: pinnedUntil.UTC().Truncate(time.Second),
+	})
+}
+
+func (h *pinsHandler) unpinService(responseWriter http.ResponseWriter, request *http.Request, serviceName string) {
+	if err := h.servicePinner.UnpinService(request.Context(), serviceName); err != nil {
+		h.writeServicePinnerError(responseWriter, err)
+		return
+	}
+
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+func (h *pinsHandler) writeServicePinnerError(responseWriter http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, resourcescaler.ErrServiceNotFound):
+		writeError(responseWriter, http.StatusNotFound, nuclioerrors.RootCause(err).Error())
+	case errors.Is(err, resourcescaler.ErrServiceNotScalable), errors.Is(err, resourcescaler.ErrPinConflict):
+		writeError(responseWriter, http.StatusConflict, nuclioerrors.RootCause(err).Error())
+	default:
+		h.logger.WarnWith("Pins request failed", "err", nuclioerrors.GetErrorStackString(err, 10))
+		writeError(responseWriter, http.StatusInternalServerError, nuclioerrors.RootCause(err).Error())
+	}
+}
+
+// pinnedUntil returns when the requested pin expires
+func (r *PinRequest) pinnedUntil(now time.Time) (time.Time, error) {
+	if (r.Until == "") == (r.Duration == "") {
+		return time.Time{}, nuclioerrors.New("Exactly one of until or duration must be set")
+	}
+
+	if r.Duration != "" {
+		duration, err := time.ParseDuration(r.Duration)
+		if err != nil {
+			return time.Time{}, nuclioerrors.Wrapf(err, "Failed to parse duration %q", r.Duration)
+		}
+
+		if duration <= 0 {
+			return time.Time{}, nuclioerrors.New("Duration must be positive")
+		}
+
+		return now.Add(duration), nil
+	}
+
+	until, err := time.Parse(time.RFC3339, r.Until)
+	if err != nil {
+		return time.Time{}, nuclioerrors.Wrapf(err, "Failed to parse until %q", r.Until)
+	}
+
+	if !until.After(now) {
+		return time.Time{}, nuclioerrors.New("Until must be in the future")
+	}
+
+	return until, nil
+}
+
+func writeJSON(responseWriter http.ResponseWriter, statusCode int, body interface{}) {
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(statusCode)
+	json.NewEncoder(responseWriter).Encode(body) // nolint: errcheck
+}
+
+func writeError(responseWriter http.ResponseWriter, statusCode int, message string) {
+	writeJSON(responseWriter, statusCode, ErrorResponse{Error: message})
+}
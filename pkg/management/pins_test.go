@@ -0,0 +1,162 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package management
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/resourcescaler"
+
+	nuclioerrors "github.com/nuclio/errors"
+	nucliozap "github.com/nuclio/zap"
+)
+
+type fakeServicePinner struct {
+	pinned   map[string]time.Time
+	unpinned []string
+	err      error
+}
+
+func (p *fakeServicePinner) GetServicePins(ctx context.Context) ([]resourcescaler.ServicePin, error) {
+	servicePins := []resourcescaler.ServicePin{}
+	for serviceName, pinnedUntil := range p.pinned {
+		servicePins = append(servicePins, resourcescaler.ServicePin{Service: serviceName, PinnedUntil: pinnedUntil})
+	}
+
+	return servicePins, nil
+}
+
+func (p *fakeServicePinner) PinService(ctx context.Context, serviceName string, pinnedUntil time.Time) error {
+	if p.err != nil {
+		return p.err
+	}
+
+	p.pinned[serviceName] = pinnedUntil
+	return nil
+}
+
+func (p *fakeServicePinner) UnpinService(ctx context.Context, serviceName string) error {
+	p.unpinned = append(p.unpinned, serviceName)
+	return nil
+}
+
+func TestPinsHandlerAllowWrites(t *testing.T) {
+	for _, testCase := range []struct {
+		name               string
+		allowWrites        bool
+		method             string
+		path               string
+		body               string
+		expectedStatusCode int
+		expectedPinned     int
+		expectedUnpinned   int
+	}{
+		{name: "list read-only", method: http.MethodGet, path: PinsPath, expectedStatusCode: http.StatusOK},
+		{name: "pin read-only", method: http.MethodPut, path: PinsPath + "/jupyter", body: `{"duration": "1h"}`,
+			expectedStatusCode: http.StatusMethodNotAllowed},
+		{name: "unpin read-only", method: http.MethodDelete, path: PinsPath + "/jupyter",
+			expectedStatusCode: http.StatusMethodNotAllowed},
+		{name: "list", allowWrites: true, method: http.MethodGet, path: PinsPath, expectedStatusCode: http.StatusOK},
+		{name: "pin", allowWrites: true, method: http.MethodPut, path: PinsPath + "/jupyter", body: `{"duration": "1h"}`,
+			expectedStatusCode: http.StatusOK, expectedPinned: 1},
+		{name: "unpin", allowWrites: true, method: http.MethodDelete, path: PinsPath + "/jupyter",
+			expectedStatusCode: http.StatusNoContent, expectedUnpinned: 1},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			loggerInstance, err := nucliozap.NewNuclioZap("test", "console", nil, os.Stdout, os.Stderr, nucliozap.DebugLevel)
+			if err != nil {
+				t.Fatalf("Failed to create logger: %v", err)
+			}
+
+			servicePinner := &fakeServicePinner{pinned: map[string]time.Time{}}
+			server := NewAPIServer(loggerInstance, "")
+			server.HandlePins(servicePinner, testCase.allowWrites)
+
+			request := httptest.NewRequest(testCase.method, testCase.path, strings.NewReader(testCase.body))
+			responseRecorder := httptest.NewRecorder()
+			server.serveMux.ServeHTTP(responseRecorder, request)
+
+			if responseRecorder.Code != testCase.expectedStatusCode {
+				t.Fatalf("Expected status %d, got %d: %s",
+					testCase.expectedStatusCode,
+					responseRecorder.Code,
+					responseRecorder.Body.String())
+			}
+
+			if len(servicePinner.pinned) != testCase.expectedPinned {
+				t.Fatalf("Expected %d pins, got %d", testCase.expectedPinned, len(servicePinner.pinned))
+			}
+
+			if len(servicePinner.unpinned) != testCase.expectedUnpinned {
+				t.Fatalf("Expected %d unpins, got %d", testCase.expectedUnpinned, len(servicePinner.unpinned))
+			}
+		})
+	}
+}
+
+func TestPinsHandlerErrors(t *testing.T) {
+	for _, testCase := range []struct {
+		name               string
+		err                error
+		expectedStatusCode int
+	}{
+		{name: "not found",
+			err:                nuclioerrors.Wrap(resourcescaler.ErrServiceNotFound, "Failed to pin service jupyter"),
+			expectedStatusCode: http.StatusNotFound},
+		{name: "not scalable",
+			err:                nuclioerrors.Wrap(resourcescaler.ErrServiceNotScalable, "Failed to pin service jupyter"),
+			expectedStatusCode: http.StatusConflict},
+		{name: "conflict",
+			err:                nuclioerrors.Wrap(resourcescaler.ErrPinConflict, "Service set kept changing"),
+			expectedStatusCode: http.StatusConflict},
+		{name: "other",
+			err:                nuclioerrors.New("Failed to patch iguazio tenant app service sets"),
+			expectedStatusCode: http.StatusInternalServerError},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			loggerInstance, err := nucliozap.NewNuclioZap("test", "console", nil, os.Stdout, os.Stderr, nucliozap.DebugLevel)
+			if err != nil {
+				t.Fatalf("Failed to create logger: %v", err)
+			}
+
+			servicePinner := &fakeServicePinner{pinned: map[string]time.Time{}, err: testCase.err}
+			server := NewAPIServer(loggerInstance, "")
+			server.HandlePins(servicePinner, true)
+
+			request := httptest.NewRequest(http.MethodPut, PinsPath+"/jupyter", strings.NewReader(`{"duration": "1h"}`))
+			responseRecorder := httptest.NewRecorder()
+			server.serveMux.ServeHTTP(responseRecorder, request)
+
+			if responseRecorder.Code != testCase.expectedStatusCode {
+				t.Fatalf("Expected status %d, got %d: %s",
+					testCase.expectedStatusCode,
+					responseRecorder.Code,
+					responseRecorder.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package management
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/accounting"
+	"github.com/v3io/app-resource-scaler/pkg/resourcescaler"
+
+	nuclioerrors "github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+)
+
+// ReportPath is the path the accounting report is served on
+const ReportPath = "/api/v1/report"
+
+// the days reported when the request doesn't set a range - the last week, including today
+const defaultReportDays = 7
+
+// Reporter is implemented by resource scalers that account for the time services spend scaled to zero
+type Reporter interface {
+	Report(ctx context.Context, from time.Time, to time.Time, serviceName string) (*accounting.Report, error)
+}
+
+type reportHandler struct {
+	logger   logger.Logger
+	reporter Reporter
+}
+
+// HandleReport serves the accounting report on the server:
+//
+//	GET /api/v1/report?from=<YYYY-MM-DD>&to=<YYYY-MM-DD>&service=<service>
+//
+// All parameters are optional. The range is inclusive, in UTC, and defaults to the last week
+func (s *Server) HandleReport(reporter Reporter) {
+	s.Handle(ReportPath, &reportHandler{
+		logger:   s.logger.GetChild("report"),
+		reporter: reporter,
+	})
+}
+
+func (h *reportHandler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writeError(responseWriter, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	to := time.Now().UTC()
+	if toParameter := request.URL.Query().Get("to"); toParameter != "" {
+		parsedTo, err := accounting.ParseDay(toParameter)
+		if err != nil {
+			writeError(responseWriter, http.StatusBadRequest, nuclioerrors.RootCause(err).Error())
+			return
+		}
+		to = parsedTo
+	}
+
+	from := to.AddDate(0, 0, -(defaultReportDays - 1))
+	if fromParameter := request.URL.Query().Get("from"); fromParameter != "" {
+		parsedFrom, err := accounting.ParseDay(fromParameter)
+		if err != nil {
+			writeError(responseWriter, http.StatusBadRequest, nuclioerrors.RootCause(err).Error())
+			return
+		}
+		from = parsedFrom
+	}
+
+	if from.After(to) {
+		writeError(responseWriter, http.StatusBadRequest, "From must not be after to")
+		return
+	}
+
+	report, err := h.reporter.Report(request.Context(), from, to, request.URL.Query().Get("service"))
+	if err != nil {
+		if errors.Is(err, resourcescaler.ErrAccountingDisabled) {
+			writeError(responseWriter, http.StatusNotFound, nuclioerrors.RootCause(err).Error())
+			return
+		}
+
+		h.logger.WarnWith("Report request failed", "err", nuclioerrors.GetErrorStackString(err, 10))
+		writeError(responseWriter, http.StatusInternalServerError, nuclioerrors.RootCause(err).Error())
+		return
+	}
+
+	writeJSON(responseWriter, http.StatusOK, report)
+}
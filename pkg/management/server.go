@@ -0,0 +1,89 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package management
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/nuclio/logger"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Server serves the scaler's operational endpoints - health, Prometheus metrics and any handler registered on it
+type Server struct {
+	logger   logger.Logger
+	serveMux *http.ServeMux
+	server   *http.Server
+}
+
+func NewServer(parentLogger logger.Logger, listenAddress string) *Server {
+	s := newServer(parentLogger.GetChild("management"), listenAddress)
+	s.serveMux.Handle("/metrics", promhttp.Handler())
+
+	return s
+}
+
+// NewAPIServer creates a server of the health check and any handler registered on it, without metrics. It is meant
+// for endpoints that change state, which are kept off the metrics listener
+func NewAPIServer(parentLogger logger.Logger, listenAddress string) *Server {
+	return newServer(parentLogger.GetChild("api"), listenAddress)
+}
+
+func newServer(serverLogger logger.Logger, listenAddress string) *Server {
+	s := &Server{
+		logger:   serverLogger,
+		serveMux: http.NewServeMux(),
+	}
+
+	s.serveMux.HandleFunc("/healthz", func(responseWriter http.ResponseWriter, request *http.Request) {
+		responseWriter.WriteHeader(http.StatusOK)
+	})
+
+	s.server = &http.Server{
+		Addr:              listenAddress,
+		Handler:           s.serveMux,
+		ReadHeaderTimeout: time.Minute,
+	}
+
+	return s
+}
+
+// Handle registers a handler for the given pattern. Must be called before Start
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.serveMux.Handle(pattern, handler)
+}
+
+func (s *Server) Start() error {
+	s.logger.DebugWith("Starting", "server", s.server.Addr)
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			s.logger.ErrorWith("Management server stopped unexpectedly", "err", err.Error())
+		}
+	}()
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	s.logger.DebugWith("Stopping", "server", s.server.Addr)
+	return s.server.Shutdown(ctx)
+}
@@ -0,0 +1,336 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package metricsource
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	"github.com/v3io/scaler/pkg/scalertypes"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/metrics/pkg/apis/custom_metrics/v1beta2"
+	"k8s.io/metrics/pkg/client/custom_metrics"
+)
+
+const (
+
+	// the kubernetes custom metrics API, served by a custom metrics adapter
+	CustomMetricsSource = "custom-metrics"
+
+	// a Prometheus compatible query API
+	PrometheusSource = "prometheus"
+)
+
+// DefaultPrometheusQueryTemplate sums the increase of the metric over the window, per app service
+const DefaultPrometheusQueryTemplate = `sum by ({{ .ResourceLabel }}) ` +
+	`(increase({{ .MetricName }}{namespace="{{ .Namespace }}"}[{{ .WindowSize }}]))`
+
+type PrometheusOptions struct {
+	URL string `json:"url,omitempty"`
+
+	// go template rendered with MetricName, WindowSize, Namespace and ResourceLabel
+	QueryTemplate string `json:"queryTemplate,omitempty"`
+
+	// per metric_name query templates, overriding QueryTemplate
+	MetricQueryTemplates map[string]string `json:"metricQueryTemplates,omitempty"`
+
+	// the label of the query result holding the app service name
+	ResourceLabel string               `json:"resourceLabel,omitempty"`
+	QueryTimeout  scalertypes.Duration `json:"queryTimeout,omitempty"`
+}
+
+type prometheusQueryTemplateData struct {
+	MetricName    string
+	WindowSize    string
+	Namespace     string
+	ResourceLabel string
+}
+
+type prometheusQueryResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Value  []interface{}     `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// PrometheusMetricsClient implements custom_metrics.CustomMetricsClient by evaluating scale resources against a
+// Prometheus compatible query API, so that no custom metrics adapter is needed in the cluster
+type PrometheusMetricsClient struct {
+	logger               logger.Logger
+	options              PrometheusOptions
+	httpClient           *http.Client
+	queryTemplate        *template.Template
+	metricQueryTemplates map[string]*template.Template
+}
+
+func NewPrometheusMetricsClient(parentLogger logger.Logger,
+	options PrometheusOptions) (*PrometheusMetricsClient, error) {
+
+	if options.URL == "" {
+		return nil, errors.New("Prometheus URL must be set")
+	}
+
+	if options.ResourceLabel == "" {
+		return nil, errors.New("Prometheus resource label must be set")
+	}
+
+	if options.QueryTemplate == "" {
+		options.QueryTemplate = DefaultPrometheusQueryTemplate
+	}
+
+	if options.QueryTimeout.Duration == 0 {
+		options.QueryTimeout = scalertypes.Duration{Duration: 30 * time.Second}
+	}
+
+	queryTemplate, err := template.New("query").Parse(options.QueryTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse query template")
+	}
+
+	metricQueryTemplates := map[string]*template.Template{}
+	for metricName, metricQueryTemplate := range options.MetricQueryTemplates {
+		metricQueryTemplates[metricName], err = template.New(metricName).Parse(metricQueryTemplate)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse query template of metric %s", metricName)
+		}
+	}
+
+	return &PrometheusMetricsClient{
+		logger:               parentLogger.GetChild("prometheus"),
+		options:              options,
+		httpClient:           &http.Client{},
+		queryTemplate:        queryTemplate,
+		metricQueryTemplates: metricQueryTemplates,
+	}, nil
+}
+
+func (c *PrometheusMetricsClient) RootScopedMetrics() custom_metrics.MetricsInterface {
+	return &prometheusMetrics{client: c}
+}
+
+func (c *PrometheusMetricsClient) NamespacedMetrics(namespace string) custom_metrics.MetricsInterface {
+	return &prometheusMetrics{client: c, namespace: namespace}
+}
+
+func (c *PrometheusMetricsClient) renderQuery(namespace string, kubernetesMetricName string) (string, error) {
+	metricName, windowSize, err := ParseKubernetesMetricName(kubernetesMetricName)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to parse metric name")
+	}
+
+	queryTemplate, found := c.metricQueryTemplates[metricName]
+	if !found {
+		queryTemplate = c.queryTemplate
+	}
+
+	query := bytes.Buffer{}
+	if err := queryTemplate.Execute(&query, prometheusQueryTemplateData{
+		MetricName:    metricName,
+		WindowSize:    windowSize,
+		Namespace:     namespace,
+		ResourceLabel: c.options.ResourceLabel,
+	}); err != nil {
+		return "", errors.Wrap(err, "Failed to render query template")
+	}
+
+	return query.String(), nil
+}
+
+// query evaluates an instant query and returns the sample value per app service
+func (c *PrometheusMetricsClient) query(query string) (map[string]float64, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.QueryTimeout.Duration)
+	defer cancel()
+
+	queryURL := strings.TrimSuffix(c.options.URL, "/") + "/api/v1/query?" + url.Values{"query": {query}}.Encode()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, queryURL, nil)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "Failed to create query request")
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "Failed to send query request")
+	}
+	defer response.Body.Close() // nolint: errcheck
+
+	queryResponse := prometheusQueryResponse{}
+	if err := json.NewDecoder(response.Body).Decode(&queryResponse); err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "Failed to decode query response (status code %d)", response.StatusCode)
+	}
+
+	if queryResponse.Status != "success" {
+		return nil, time.Time{}, errors.Errorf("Query failed (%s): %s", queryResponse.ErrorType, queryResponse.Error)
+	}
+
+	if queryResponse.Data.ResultType != "vector" {
+		return nil, time.Time{}, errors.Errorf("Unexpected query result type: %s", queryResponse.Data.ResultType)
+	}
+
+	samples := map[string]float64{}
+	sampleTime := time.Now()
+	for _, result := range queryResponse.Data.Result {
+		resourceName, found := result.Metric[c.options.ResourceLabel]
+		if !found {
+			c.logger.DebugWith("Query result is missing the resource label, skipping",
+				"resourceLabel", c.options.ResourceLabel,
+				"metric", result.Metric)
+			continue
+		}
+
+		if len(result.Value) != 2 {
+			return nil, time.Time{}, errors.Errorf("Malformed sample of resource %s", resourceName)
+		}
+
+		timestamp, ok := result.Value[0].(float64)
+		if !ok {
+			return nil, time.Time{}, errors.Errorf("Malformed sample timestamp of resource %s", resourceName)
+		}
+
+		valueString, ok := result.Value[1].(string)
+		if !ok {
+			return nil, time.Time{}, errors.Errorf("Malformed sample value of resource %s", resourceName)
+		}
+
+		value, err := strconv.ParseFloat(valueString, 64)
+		if err != nil {
+			return nil, time.Time{}, errors.Wrapf(err, "Failed to parse sample value of resource %s", resourceName)
+		}
+
+		// NaN and Inf can't be compared against a threshold, treat the resource as having no data
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+
+		if _, found := samples[resourceName]; found {
+			return nil, time.Time{}, errors.Errorf("Query returned more than one sample for resource %s", resourceName)
+		}
+
+		samples[resourceName] = value
+		sampleTime = time.Unix(0, int64(timestamp*float64(time.Second)))
+	}
+
+	return samples, sampleTime, nil
+}
+
+type prometheusMetrics struct {
+	client    *PrometheusMetricsClient
+	namespace string
+}
+
+func (m *prometheusMetrics) GetForObject(groupKind schema.GroupKind,
+	name string,
+	metricName string,
+	metricSelector labels.Selector) (*v1beta2.MetricValue, error) {
+
+	metricValueList, err := m.GetForObjects(groupKind, labels.Everything(), metricName, metricSelector)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get metric values")
+	}
+
+	for metricValueIndex := range metricValueList.Items {
+		if metricValueList.Items[metricValueIndex].DescribedObject.Name == name {
+			return &metricValueList.Items[metricValueIndex], nil
+		}
+	}
+
+	// same as the custom metrics API, so callers can tell "no data yet" apart from failures
+	return nil, k8serrors.NewNotFound(schema.GroupResource{Group: groupKind.Group, Resource: groupKind.Kind}, name)
+}
+
+func (m *prometheusMetrics) GetForObjects(groupKind schema.GroupKind,
+	selector labels.Selector,
+	metricName string,
+	metricSelector labels.Selector) (*v1beta2.MetricValueList, error) {
+
+	query, err := m.client.renderQuery(m.namespace, metricName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to render query")
+	}
+
+	samples, sampleTime, err := m.client.query(query)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to query metric %s", metricName)
+	}
+
+	m.client.logger.DebugWith("Queried metric",
+		"metricName", metricName,
+		"query", query,
+		"samples", len(samples))
+
+	metricValueList := &v1beta2.MetricValueList{}
+	for resourceName, value := range samples {
+		metricValueList.Items = append(metricValueList.Items, v1beta2.MetricValue{
+			DescribedObject: v1.ObjectReference{
+				Kind:       groupKind.Kind,
+				APIVersion: groupKind.Group,
+				Name:       resourceName,
+				Namespace:  m.namespace,
+			},
+			Metric: v1beta2.MetricIdentifier{
+				Name: metricName,
+			},
+			Timestamp: metav1.NewTime(sampleTime),
+
+			// the autoscaler compares the milli value against the threshold, same as with the custom metrics API
+			Value: *resource.NewMilliQuantity(int64(math.Round(value*1000)), resource.DecimalSI),
+		})
+	}
+
+	return metricValueList, nil
+}
+
+// ParseKubernetesMetricName splits a scale resource's kubernetes metric name (e.g. num_of_requests_per_1h)
+// back into its metric name and window size
+func ParseKubernetesMetricName(kubernetesMetricName string) (string, string, error) {
+	separatorIndex := strings.LastIndex(kubernetesMetricName, "_per_")
+	if separatorIndex <= 0 {
+		return "", "", errors.Errorf("Metric name %s does not have a window size suffix", kubernetesMetricName)
+	}
+
+	metricName := kubernetesMetricName[:separatorIndex]
+	windowSize := kubernetesMetricName[separatorIndex+len("_per_"):]
+	if _, err := time.ParseDuration(windowSize); err != nil {
+		return "", "", errors.Wrapf(err, "Metric name %s has an invalid window size", kubernetesMetricName)
+	}
+
+	return metricName, windowSize, nil
+}
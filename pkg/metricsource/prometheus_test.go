@@ -0,0 +1,318 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package metricsource
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/nuclio/logger"
+	nucliozap "github.com/nuclio/zap"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var serviceGroupKind = schema.GroupKind{Group: "", Kind: "Service"}
+
+// fakePrometheus serves a fixed query API response, recording the queries it's sent
+type fakePrometheus struct {
+	lock       sync.Mutex
+	queries    []string
+	statusCode int
+	body       string
+}
+
+func (p *fakePrometheus) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if request.URL.Path != "/api/v1/query" {
+		responseWriter.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	p.queries = append(p.queries, request.URL.Query().Get("query"))
+	if p.statusCode != 0 {
+		responseWriter.WriteHeader(p.statusCode)
+	}
+	responseWriter.Write([]byte(p.body)) // nolint: errcheck
+}
+
+func newTestLogger(t *testing.T) logger.Logger {
+	loggerInstance, err := nucliozap.NewNuclioZap("test", "console", nil, os.Stdout, os.Stderr, nucliozap.DebugLevel)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	return loggerInstance
+}
+
+func newTestPrometheusClient(t *testing.T,
+	prometheus *fakePrometheus,
+	options PrometheusOptions) *PrometheusMetricsClient {
+
+	server := httptest.NewServer(prometheus)
+	t.Cleanup(server.Close)
+
+	options.URL = server.URL + "/"
+	if options.ResourceLabel == "" {
+		options.ResourceLabel = "service"
+	}
+
+	client, err := NewPrometheusMetricsClient(newTestLogger(t), options)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	return client
+}
+
+func TestParseKubernetesMetricName(t *testing.T) {
+	for _, testCase := range []struct {
+		kubernetesMetricName string
+		expectedMetricName   string
+		expectedWindowSize   string
+		expectedError        bool
+	}{
+		{kubernetesMetricName: "num_of_requests_per_1h", expectedMetricName: "num_of_requests", expectedWindowSize: "1h"},
+		{kubernetesMetricName: "jupyter_kernel_busyness_per_30m", expectedMetricName: "jupyter_kernel_busyness", expectedWindowSize: "30m"},
+
+		// only the last separator splits off the window size
+		{kubernetesMetricName: "bytes_per_second_per_5m", expectedMetricName: "bytes_per_second", expectedWindowSize: "5m"},
+		{kubernetesMetricName: "num_of_requests", expectedError: true},
+		{kubernetesMetricName: "_per_1h", expectedError: true},
+		{kubernetesMetricName: "num_of_requests_per_hour", expectedError: true},
+	} {
+		t.Run(testCase.kubernetesMetricName, func(t *testing.T) {
+			metricName, windowSize, err := ParseKubernetesMetricName(testCase.kubernetesMetricName)
+			if testCase.expectedError {
+				if err == nil {
+					t.Fatalf("Expected an error, got %s and %s", metricName, windowSize)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if metricName != testCase.expectedMetricName || windowSize != testCase.expectedWindowSize {
+				t.Fatalf("Expected %s and %s, got %s and %s",
+					testCase.expectedMetricName,
+					testCase.expectedWindowSize,
+					metricName,
+					windowSize)
+			}
+		})
+	}
+}
+
+func TestPrometheusQueryTemplating(t *testing.T) {
+	prometheus := &fakePrometheus{body: `{"status": "success", "data": {"resultType": "vector", "result": []}}`}
+	client := newTestPrometheusClient(t, prometheus, PrometheusOptions{
+		ResourceLabel: "app_service",
+		MetricQueryTemplates: map[string]string{
+			"jupyter_kernel_busyness": `max by ({{ .ResourceLabel }}) ` +
+				`(max_over_time(jupyter_kernel_busyness{namespace="{{ .Namespace }}"}[{{ .WindowSize }}]))`,
+		},
+	})
+
+	metrics := client.NamespacedMetrics("default-tenant")
+	for _, kubernetesMetricName := range []string{"num_of_requests_per_1h", "jupyter_kernel_busyness_per_30m"} {
+		if _, err := metrics.GetForObjects(serviceGroupKind,
+			labels.Everything(),
+			kubernetesMetricName,
+			labels.Everything()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	expectedQueries := []string{
+		`sum by (app_service) (increase(num_of_requests{namespace="default-tenant"}[1h]))`,
+		`max by (app_service) (max_over_time(jupyter_kernel_busyness{namespace="default-tenant"}[30m]))`,
+	}
+	if len(prometheus.queries) != len(expectedQueries) {
+		t.Fatalf("Expected queries %v, got %v", expectedQueries, prometheus.queries)
+	}
+
+	for queryIndex, expectedQuery := range expectedQueries {
+		if prometheus.queries[queryIndex] != expectedQuery {
+			t.Fatalf("Expected query %s, got %s", expectedQuery, prometheus.queries[queryIndex])
+		}
+	}
+}
+
+func TestPrometheusGetForObjects(t *testing.T) {
+	prometheus := &fakePrometheus{body: `{"status": "success", "data": {"resultType": "vector", "result": [
+		{"metric": {"service": "jupyter"}, "value": [1700000000.5, "12.3456"]},
+		{"metric": {"service": "spark"}, "value": [1700000000.5, "0"]},
+		{"metric": {"service": "presto"}, "value": [1700000000.5, "NaN"]},
+		{"metric": {"pod": "unlabeled"}, "value": [1700000000.5, "1"]}
+	]}}`}
+	client := newTestPrometheusClient(t, prometheus, PrometheusOptions{})
+
+	metricValueList, err := client.NamespacedMetrics("default-tenant").GetForObjects(serviceGroupKind,
+		labels.Everything(),
+		"num_of_requests_per_1h",
+		labels.Everything())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expectedMilliValues := map[string]int64{
+		"jupyter": 12346,
+		"spark":   0,
+	}
+	if len(metricValueList.Items) != len(expectedMilliValues) {
+		t.Fatalf("Expected %d metric values, got %v", len(expectedMilliValues), metricValueList.Items)
+	}
+
+	for _, metricValue := range metricValueList.Items {
+		expectedMilliValue, found := expectedMilliValues[metricValue.DescribedObject.Name]
+		if !found {
+			t.Fatalf("Unexpected metric value of %s", metricValue.DescribedObject.Name)
+		}
+
+		if metricValue.Value.MilliValue() != expectedMilliValue {
+			t.Fatalf("Expected milli value %d of %s, got %d",
+				expectedMilliValue,
+				metricValue.DescribedObject.Name,
+				metricValue.Value.MilliValue())
+		}
+
+		if metricValue.DescribedObject.Namespace != "default-tenant" ||
+			metricValue.Metric.Name != "num_of_requests_per_1h" ||
+			metricValue.Timestamp.UnixMilli() != 1700000000500 {
+			t.Fatalf("Unexpected metric value %v", metricValue)
+		}
+	}
+
+	metricValue, err := client.NamespacedMetrics("default-tenant").GetForObject(serviceGroupKind,
+		"jupyter",
+		"num_of_requests_per_1h",
+		labels.Everything())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if metricValue.Value.MilliValue() != 12346 {
+		t.Fatalf("Expected milli value 12346, got %d", metricValue.Value.MilliValue())
+	}
+
+	// no data is reported as not found, same as by the custom metrics API
+	if _, err := client.NamespacedMetrics("default-tenant").GetForObject(serviceGroupKind,
+		"presto",
+		"num_of_requests_per_1h",
+		labels.Everything()); !k8serrors.IsNotFound(err) {
+		t.Fatalf("Expected a not found error, got %v", err)
+	}
+}
+
+func TestPrometheusQueryErrors(t *testing.T) {
+	for _, testCase := range []struct {
+		name       string
+		statusCode int
+		body       string
+	}{
+		{
+			name:       "api error",
+			statusCode: http.StatusBadRequest,
+			body:       `{"status": "error", "errorType": "bad_data", "error": "parse error"}`,
+		},
+		{
+			name:       "not json",
+			statusCode: http.StatusBadGateway,
+			body:       `<html>bad gateway</html>`,
+		},
+		{
+			name: "matrix result",
+			body: `{"status": "success", "data": {"resultType": "matrix", "result": []}}`,
+		},
+		{
+			name: "malformed value",
+			body: `{"status": "success", "data": {"resultType": "vector", "result": [
+				{"metric": {"service": "jupyter"}, "value": [1700000000, 12]}]}}`,
+		},
+		{
+			name: "duplicate resource",
+			body: `{"status": "success", "data": {"resultType": "vector", "result": [
+				{"metric": {"service": "jupyter"}, "value": [1700000000, "1"]},
+				{"metric": {"service": "jupyter"}, "value": [1700000000, "2"]}]}}`,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			prometheus := &fakePrometheus{statusCode: testCase.statusCode, body: testCase.body}
+			client := newTestPrometheusClient(t, prometheus, PrometheusOptions{})
+
+			_, err := client.NamespacedMetrics("default-tenant").GetForObjects(serviceGroupKind,
+				labels.Everything(),
+				"num_of_requests_per_1h",
+				labels.Everything())
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+		})
+	}
+
+	t.Run("empty vector", func(t *testing.T) {
+		prometheus := &fakePrometheus{body: `{"status": "success", "data": {"resultType": "vector", "result": []}}`}
+		client := newTestPrometheusClient(t, prometheus, PrometheusOptions{})
+
+		metricValueList, err := client.NamespacedMetrics("default-tenant").GetForObjects(serviceGroupKind,
+			labels.Everything(),
+			"num_of_requests_per_1h",
+			labels.Everything())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if len(metricValueList.Items) != 0 {
+			t.Fatalf("Expected no metric values, got %v", metricValueList.Items)
+		}
+
+		if _, err := client.NamespacedMetrics("default-tenant").GetForObject(serviceGroupKind,
+			"jupyter",
+			"num_of_requests_per_1h",
+			labels.Everything()); !k8serrors.IsNotFound(err) {
+			t.Fatalf("Expected a not found error, got %v", err)
+		}
+	})
+
+	t.Run("invalid metric name", func(t *testing.T) {
+		prometheus := &fakePrometheus{}
+		client := newTestPrometheusClient(t, prometheus, PrometheusOptions{})
+
+		if _, err := client.NamespacedMetrics("default-tenant").GetForObjects(serviceGroupKind,
+			labels.Everything(),
+			"num_of_requests",
+			labels.Everything()); err == nil {
+			t.Fatal("Expected an error")
+		}
+
+		if len(prometheus.queries) != 0 {
+			t.Fatalf("Expected no queries, got %v", prometheus.queries)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package metricsource
+
+import (
+	"sync"
+
+	"k8s.io/metrics/pkg/client/custom_metrics"
+)
+
+// ReloadableMetricsClient delegates to a metrics client that can be replaced while in use, so the metrics source of
+// a running autoscaler can be changed without recreating it
+type ReloadableMetricsClient struct {
+	lock     sync.RWMutex
+	delegate custom_metrics.CustomMetricsClient
+}
+
+func NewReloadableMetricsClient(delegate custom_metrics.CustomMetricsClient) *ReloadableMetricsClient {
+	return &ReloadableMetricsClient{
+		delegate: delegate,
+	}
+}
+
+// SetDelegate replaces the metrics client. Metrics read after it returns are read from the new one
+func (c *ReloadableMetricsClient) SetDelegate(delegate custom_metrics.CustomMetricsClient) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.delegate = delegate
+}
+
+func (c *ReloadableMetricsClient) RootScopedMetrics() custom_metrics.MetricsInterface {
+	return c.getDelegate().RootScopedMetrics()
+}
+
+func (c *ReloadableMetricsClient) NamespacedMetrics(namespace string) custom_metrics.MetricsInterface {
+	return c.getDelegate().NamespacedMetrics(namespace)
+}
+
+func (c *ReloadableMetricsClient) getDelegate() custom_metrics.CustomMetricsClient {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.delegate
+}
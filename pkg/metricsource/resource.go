@@ -0,0 +1,423 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package metricsource
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	"github.com/v3io/scaler/pkg/scalertypes"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/metrics/pkg/apis/custom_metrics/v1beta2"
+	"k8s.io/metrics/pkg/client/clientset/versioned"
+	"k8s.io/metrics/pkg/client/custom_metrics"
+)
+
+const (
+
+	// the CPU usage of the app service's pods, compared against the threshold in millicores
+	CPUMetricName = "cpu"
+
+	// the memory usage of the app service's pods, compared against the threshold in MiB
+	MemoryMetricName = "memory"
+)
+
+type ResourceMetricsOptions struct {
+
+	// the label of the app service's pods holding the app service name, empty disables the cpu and memory metrics
+	PodLabel string `json:"podLabel,omitempty"`
+
+	// how often to sample the pods' usage
+	SampleInterval scalertypes.Duration `json:"sampleInterval,omitempty"`
+
+	// how long to keep samples for, bounding the window size of cpu and memory scale resources
+	Retention scalertypes.Duration `json:"retention,omitempty"`
+}
+
+func (o *ResourceMetricsOptions) Validate() error {
+	if o.PodLabel == "" {
+		return nil
+	}
+
+	if o.SampleInterval.Duration <= 0 {
+		return errors.New("Resource metrics sample interval must be positive")
+	}
+
+	if o.Retention.Duration < o.SampleInterval.Duration {
+		return errors.New("Resource metrics retention must be at least the sample interval")
+	}
+
+	return nil
+}
+
+// resourceSample is the usage of all the pods of an app service at a point in time
+type resourceSample struct {
+	time        time.Time
+	cpuMilli    int64
+	memoryBytes int64
+}
+
+// resourceSampleRing holds an app service's latest samples, overwriting the oldest once full
+type resourceSampleRing struct {
+	samples []resourceSample
+	next    int
+	count   int
+}
+
+func newResourceSampleRing(capacity int) *resourceSampleRing {
+	return &resourceSampleRing{samples: make([]resourceSample, capacity)}
+}
+
+func (r *resourceSampleRing) add(sample resourceSample) {
+	r.samples[r.next] = sample
+	r.next = (r.next + 1) % len(r.samples)
+	if r.count < len(r.samples) {
+		r.count++
+	}
+}
+
+// oldest returns the oldest sample in the ring. Must not be called on an empty ring
+func (r *resourceSampleRing) oldest() resourceSample {
+	return r.samples[(r.next-r.count+len(r.samples))%len(r.samples)]
+}
+
+// newest returns the newest sample in the ring. Must not be called on an empty ring
+func (r *resourceSampleRing) newest() resourceSample {
+	return r.samples[(r.next-1+len(r.samples))%len(r.samples)]
+}
+
+// average returns the average of the samples taken since the given time
+func (r *resourceSampleRing) average(since time.Time, value func(resourceSample) int64) (float64, int) {
+	var sum float64
+	var count int
+	for sampleIndex := 0; sampleIndex < r.count; sampleIndex++ {
+		sample := r.samples[(r.next-1-sampleIndex+len(r.samples))%len(r.samples)]
+		if sample.time.Before(since) {
+			break
+		}
+
+		sum += float64(value(sample))
+		count++
+	}
+
+	if count == 0 {
+		return 0, 0
+	}
+
+	return sum / float64(count), count
+}
+
+// ResourceMetricsClient serves the cpu and memory metrics of app services by sampling the usage of their pods from
+// the metrics.k8s.io API and averaging it over the scale resource's window, so that scale to zero can be driven by
+// usage without a custom metrics adapter. All other metrics are read from the delegate client
+type ResourceMetricsClient struct {
+	logger           logger.Logger
+	options          ResourceMetricsOptions
+	metricsClientSet versioned.Interface
+	namespace        string
+
+	lock    sync.Mutex
+	samples map[string]*resourceSampleRing
+}
+
+func NewResourceMetricsClient(parentLogger logger.Logger,
+	metricsClientSet versioned.Interface,
+	namespace string,
+	options ResourceMetricsOptions) (*ResourceMetricsClient, error) {
+
+	if options.PodLabel == "" {
+		return nil, errors.New("Resource metrics pod label must be set")
+	}
+
+	if err := options.Validate(); err != nil {
+		return nil, errors.Wrap(err, "Invalid resource metrics options")
+	}
+
+	return &ResourceMetricsClient{
+		logger:           parentLogger.GetChild("resource-metrics"),
+		options:          options,
+		metricsClientSet: metricsClientSet,
+		namespace:        namespace,
+		samples:          map[string]*resourceSampleRing{},
+	}, nil
+}
+
+// Start samples the pods' usage every sample interval until the context is done
+func (c *ResourceMetricsClient) Start(ctx context.Context) {
+	c.logger.DebugWith("Sampling pod resource usage",
+		"namespace", c.namespace,
+		"podLabel", c.options.PodLabel,
+		"sampleInterval", c.options.SampleInterval.Duration)
+
+	go func() {
+		ticker := time.NewTicker(c.options.SampleInterval.Duration)
+		defer ticker.Stop()
+
+		for {
+			if err := c.Sample(ctx); err != nil {
+				c.logger.WarnWith("Failed to sample pod resource usage",
+					"namespace", c.namespace,
+					"err", errors.GetErrorStackString(err, 10))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Sample records the current usage of every app service with running pods. App services without pods have their
+// samples dropped, so that a window never spans the time a service was scaled to zero
+func (c *ResourceMetricsClient) Sample(ctx context.Context) error {
+	podMetricsList, err := c.metricsClientSet.
+		MetricsV1beta1().
+		PodMetricses(c.namespace).
+		List(ctx, metav1.ListOptions{LabelSelector: c.options.PodLabel})
+	if err != nil {
+		return errors.Wrap(err, "Failed to list pod metrics")
+	}
+
+	samples := map[string]resourceSample{}
+	for _, podMetrics := range podMetricsList.Items {
+		serviceName := podMetrics.Labels[c.options.PodLabel]
+		if serviceName == "" {
+			continue
+		}
+
+		sample := samples[serviceName]
+		if sample.time.IsZero() || podMetrics.Timestamp.Time.Before(sample.time) {
+			sample.time = podMetrics.Timestamp.Time
+		}
+
+		for _, container := range podMetrics.Containers {
+			sample.cpuMilli += container.Usage.Cpu().MilliValue()
+			sample.memoryBytes += container.Usage.Memory().Value()
+		}
+
+		samples[serviceName] = sample
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for serviceName := range c.samples {
+		if _, found := samples[serviceName]; !found {
+			delete(c.samples, serviceName)
+		}
+	}
+
+	for serviceName, sample := range samples {
+		sampleRing, found := c.samples[serviceName]
+		if !found {
+			sampleRing = newResourceSampleRing(c.ringCapacity())
+			c.samples[serviceName] = sampleRing
+		}
+
+		// the metrics API may return the same sample again if its resolution is coarser than the interval
+		if sampleRing.count != 0 && !sample.time.After(sampleRing.newest().time) {
+			continue
+		}
+
+		sampleRing.add(sample)
+	}
+
+	return nil
+}
+
+// WithDelegate returns a metrics client serving the cpu and memory metrics from the sampled usage, and all other
+// metrics from the delegate. Clients returned by the same resource metrics client share its samples
+func (c *ResourceMetricsClient) WithDelegate(delegate custom_metrics.CustomMetricsClient) custom_metrics.CustomMetricsClient {
+	return &resourceMetricsClientWithDelegate{
+		client:   c,
+		delegate: delegate,
+	}
+}
+
+// averages returns the average usage of every app service whose samples cover the window
+func (c *ResourceMetricsClient) averages(metricName string, windowSize time.Duration) (map[string]float64, error) {
+	var value func(resourceSample) int64
+	switch metricName {
+	case CPUMetricName:
+		value = func(sample resourceSample) int64 { return sample.cpuMilli }
+	case MemoryMetricName:
+		value = func(sample resourceSample) int64 { return sample.memoryBytes }
+	default:
+		return nil, errors.Errorf("Unknown resource metric: %s", metricName)
+	}
+
+	if windowSize > c.options.Retention.Duration {
+		return nil, errors.Errorf("Window size %s is longer than the resource metrics retention %s",
+			windowSize,
+			c.options.Retention.Duration)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	averages := map[string]float64{}
+	for serviceName, sampleRing := range c.samples {
+
+		// a service whose samples don't go back a whole window yet (i.e. it just woke up) has no data
+		if sampleRing.oldest().time.After(now.Add(-windowSize + c.options.SampleInterval.Duration)) {
+			continue
+		}
+
+		average, count := sampleRing.average(now.Add(-windowSize), value)
+		if count == 0 {
+			continue
+		}
+
+		averages[serviceName] = average
+	}
+
+	return averages, nil
+}
+
+func (c *ResourceMetricsClient) ringCapacity() int {
+	return int(c.options.Retention.Duration/c.options.SampleInterval.Duration) + 1
+}
+
+// IsResourceMetric returns whether the metric name of a scale resource is served from the pods' usage
+func IsResourceMetric(metricName string) bool {
+	return metricName == CPUMetricName || metricName == MemoryMetricName
+}
+
+type resourceMetricsClientWithDelegate struct {
+	client   *ResourceMetricsClient
+	delegate custom_metrics.CustomMetricsClient
+}
+
+func (c *resourceMetricsClientWithDelegate) RootScopedMetrics() custom_metrics.MetricsInterface {
+	return &resourceMetrics{client: c.client, delegate: c.delegate.RootScopedMetrics()}
+}
+
+func (c *resourceMetricsClientWithDelegate) NamespacedMetrics(namespace string) custom_metrics.MetricsInterface {
+	return &resourceMetrics{client: c.client, namespace: namespace, delegate: c.delegate.NamespacedMetrics(namespace)}
+}
+
+type resourceMetrics struct {
+	client    *ResourceMetricsClient
+	namespace string
+	delegate  custom_metrics.MetricsInterface
+}
+
+func (m *resourceMetrics) GetForObject(groupKind schema.GroupKind,
+	name string,
+	metricName string,
+	metricSelector labels.Selector) (*v1beta2.MetricValue, error) {
+
+	if !m.isResourceMetric(metricName) {
+		return m.delegate.GetForObject(groupKind, name, metricName, metricSelector)
+	}
+
+	metricValueList, err := m.GetForObjects(groupKind, labels.Everything(), metricName, metricSelector)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get metric values")
+	}
+
+	for metricValueIndex := range metricValueList.Items {
+		if metricValueList.Items[metricValueIndex].DescribedObject.Name == name {
+			return &metricValueList.Items[metricValueIndex], nil
+		}
+	}
+
+	return nil, k8serrors.NewNotFound(schema.GroupResource{Group: groupKind.Group, Resource: groupKind.Kind}, name)
+}
+
+func (m *resourceMetrics) GetForObjects(groupKind schema.GroupKind,
+	selector labels.Selector,
+	metricName string,
+	metricSelector labels.Selector) (*v1beta2.MetricValueList, error) {
+
+	if !m.isResourceMetric(metricName) {
+		return m.delegate.GetForObjects(groupKind, selector, metricName, metricSelector)
+	}
+
+	resourceMetricName, windowSizeString, err := ParseKubernetesMetricName(metricName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse metric name")
+	}
+
+	windowSize, err := time.ParseDuration(windowSizeString)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse window size")
+	}
+
+	averages, err := m.client.averages(resourceMetricName, windowSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to average metric %s", metricName)
+	}
+
+	m.client.logger.DebugWith("Averaged resource metric",
+		"metricName", metricName,
+		"numServices", len(averages))
+
+	metricValueList := &v1beta2.MetricValueList{}
+	sampleTime := metav1.Now()
+	for serviceName, average := range averages {
+
+		// the autoscaler compares the milli value against the threshold - millicores for cpu, MiB for memory
+		milliValue := average
+		if resourceMetricName == MemoryMetricName {
+			milliValue = average / (1024 * 1024)
+		}
+
+		metricValueList.Items = append(metricValueList.Items, v1beta2.MetricValue{
+			DescribedObject: v1.ObjectReference{
+				Kind:       groupKind.Kind,
+				APIVersion: groupKind.Group,
+				Name:       serviceName,
+				Namespace:  m.namespace,
+			},
+			Metric: v1beta2.MetricIdentifier{
+				Name: metricName,
+			},
+			Timestamp: sampleTime,
+			Value:     *resource.NewMilliQuantity(int64(math.Round(milliValue)), resource.DecimalSI),
+		})
+	}
+
+	return metricValueList, nil
+}
+
+// isResourceMetric returns whether the metric is served from the sampled usage, which only covers the sampled
+// namespace
+func (m *resourceMetrics) isResourceMetric(kubernetesMetricName string) bool {
+	if m.namespace != m.client.namespace {
+		return false
+	}
+
+	metricName, _, err := ParseKubernetesMetricName(kubernetesMetricName)
+	return err == nil && IsResourceMetric(metricName)
+}
@@ -0,0 +1,394 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package metricsource
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/v3io/scaler/pkg/scalertypes"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	metricsfake "k8s.io/metrics/pkg/client/clientset/versioned/fake"
+	"k8s.io/metrics/pkg/client/custom_metrics"
+)
+
+const resourceTestNamespace = "default-tenant"
+
+// the fake clientset lists pod metrics under the "pods" resource, not the one guessed from the kind
+var podMetricsResource = schema.GroupVersionResource{Group: "metrics.k8s.io", Version: "v1beta1", Resource: "pods"}
+
+// fakePodMetrics holds the pod metrics served by a fake metrics clientset
+type fakePodMetrics struct {
+	t         *testing.T
+	clientSet *metricsfake.Clientset
+}
+
+func newFakePodMetrics(t *testing.T) *fakePodMetrics {
+	return &fakePodMetrics{
+		t:         t,
+		clientSet: metricsfake.NewSimpleClientset(),
+	}
+}
+
+// set creates or updates the metrics of a pod of the given service, with a container per cpu and memory pair
+func (f *fakePodMetrics) set(podName string, serviceName string, timestamp time.Time, usages ...string) {
+	podMetrics := &metricsv1beta1.PodMetrics{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      podName,
+			Namespace: resourceTestNamespace,
+			Labels:    map[string]string{},
+		},
+		Timestamp: metav1.NewTime(timestamp),
+		Window:    metav1.Duration{Duration: 30 * time.Second},
+	}
+
+	if serviceName != "" {
+		podMetrics.Labels["app.iguazio.com/name"] = serviceName
+	}
+
+	for usageIndex := 0; usageIndex+1 < len(usages); usageIndex += 2 {
+		podMetrics.Containers = append(podMetrics.Containers, metricsv1beta1.ContainerMetrics{
+			Name: "container",
+			Usage: v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse(usages[usageIndex]),
+				v1.ResourceMemory: resource.MustParse(usages[usageIndex+1]),
+			},
+		})
+	}
+
+	tracker := f.clientSet.Tracker()
+	if _, err := tracker.Get(podMetricsResource, resourceTestNamespace, podName); err != nil {
+		if err := tracker.Create(podMetricsResource, podMetrics, resourceTestNamespace); err != nil {
+			f.t.Fatalf("Failed to create pod metrics: %v", err)
+		}
+		return
+	}
+
+	if err := tracker.Update(podMetricsResource, podMetrics, resourceTestNamespace); err != nil {
+		f.t.Fatalf("Failed to update pod metrics: %v", err)
+	}
+}
+
+func (f *fakePodMetrics) delete(podName string) {
+	if err := f.clientSet.Tracker().Delete(podMetricsResource, resourceTestNamespace, podName); err != nil {
+		f.t.Fatalf("Failed to delete pod metrics: %v", err)
+	}
+}
+
+func newTestResourceMetricsClient(t *testing.T,
+	podMetrics *fakePodMetrics,
+	sampleInterval time.Duration,
+	retention time.Duration) *ResourceMetricsClient {
+
+	client, err := NewResourceMetricsClient(newTestLogger(t),
+		podMetrics.clientSet,
+		resourceTestNamespace,
+		ResourceMetricsOptions{
+			PodLabel:       "app.iguazio.com/name",
+			SampleInterval: scalertypes.Duration{Duration: sampleInterval},
+			Retention:      scalertypes.Duration{Duration: retention},
+		})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	return client
+}
+
+// withUnusedDelegate returns a metrics client of the sampled usage, whose delegate fails every query
+func withUnusedDelegate(t *testing.T, client *ResourceMetricsClient) custom_metrics.CustomMetricsClient {
+	delegate := newTestPrometheusClient(t, &fakePrometheus{statusCode: http.StatusInternalServerError}, PrometheusOptions{})
+	return client.WithDelegate(delegate)
+}
+
+func sampleResourceMetrics(t *testing.T, client *ResourceMetricsClient) {
+	if err := client.Sample(context.Background()); err != nil {
+		t.Fatalf("Failed to sample: %v", err)
+	}
+}
+
+func TestResourceMetricsSample(t *testing.T) {
+	podMetrics := newFakePodMetrics(t)
+	client := newTestResourceMetricsClient(t, podMetrics, 30*time.Second, 10*time.Minute)
+	now := time.Now().Truncate(time.Second)
+
+	// the usage of all the pods and containers of a service is summed, and timed by the oldest pod
+	podMetrics.set("jupyter-0", "jupyter", now, "100m", "64Mi", "50m", "32Mi")
+	podMetrics.set("jupyter-1", "jupyter", now.Add(-5*time.Second), "250m", "128Mi")
+	podMetrics.set("spark-0", "spark", now, "1", "1Gi")
+	podMetrics.set("unlabeled-0", "", now, "2", "2Gi")
+	sampleResourceMetrics(t, client)
+
+	expectedSamples := map[string]resourceSample{
+		"jupyter": {time: now.Add(-5 * time.Second), cpuMilli: 400, memoryBytes: 224 * 1024 * 1024},
+		"spark":   {time: now, cpuMilli: 1000, memoryBytes: 1024 * 1024 * 1024},
+	}
+	if len(client.samples) != len(expectedSamples) {
+		t.Fatalf("Expected samples of %d services, got %d", len(expectedSamples), len(client.samples))
+	}
+
+	for serviceName, expectedSample := range expectedSamples {
+		sampleRing, found := client.samples[serviceName]
+		if !found {
+			t.Fatalf("Expected samples of %s", serviceName)
+		}
+
+		if sampleRing.count != 1 {
+			t.Fatalf("Expected a single sample of %s, got %d", serviceName, sampleRing.count)
+		}
+
+		sample := sampleRing.newest()
+		if !sample.time.Equal(expectedSample.time) ||
+			sample.cpuMilli != expectedSample.cpuMilli ||
+			sample.memoryBytes != expectedSample.memoryBytes {
+			t.Fatalf("Expected sample %+v of %s, got %+v", expectedSample, serviceName, sample)
+		}
+	}
+
+	// the same metrics returned again aren't sampled twice
+	sampleResourceMetrics(t, client)
+	if client.samples["jupyter"].count != 1 {
+		t.Fatalf("Expected a repeated sample to be skipped, got %d samples", client.samples["jupyter"].count)
+	}
+
+	// a service without pods has its samples dropped
+	podMetrics.delete("spark-0")
+	podMetrics.set("jupyter-0", "jupyter", now.Add(30*time.Second), "100m", "64Mi")
+	podMetrics.set("jupyter-1", "jupyter", now.Add(30*time.Second), "100m", "64Mi")
+	sampleResourceMetrics(t, client)
+
+	if _, found := client.samples["spark"]; found {
+		t.Fatalf("Expected the samples of spark to be dropped")
+	}
+
+	if client.samples["jupyter"].count != 2 {
+		t.Fatalf("Expected 2 samples of jupyter, got %d", client.samples["jupyter"].count)
+	}
+}
+
+func TestResourceMetricsAverages(t *testing.T) {
+	podMetrics := newFakePodMetrics(t)
+	client := newTestResourceMetricsClient(t, podMetrics, 30*time.Second, 10*time.Minute)
+	now := time.Now()
+
+	// jupyter was sampled for longer than the window, only the samples within it are averaged
+	for _, sample := range []struct {
+		age    time.Duration
+		cpu    string
+		memory string
+	}{
+		{age: 3*time.Minute + 50*time.Second, cpu: "1", memory: "1Gi"},
+		{age: 2*time.Minute + 50*time.Second, cpu: "1", memory: "1Gi"},
+		{age: time.Minute + 50*time.Second, cpu: "100m", memory: "100Mi"},
+		{age: 50 * time.Second, cpu: "200m", memory: "200Mi"},
+		{age: 10 * time.Second, cpu: "300m", memory: "300Mi"},
+	} {
+		podMetrics.set("jupyter-0", "jupyter", now.Add(-sample.age), sample.cpu, sample.memory)
+
+		// spark only woke up a minute ago, so its samples don't cover the window yet
+		if sample.age < time.Minute {
+			podMetrics.set("spark-0", "spark", now.Add(-sample.age), "500m", "500Mi")
+		}
+
+		sampleResourceMetrics(t, client)
+	}
+
+	for _, testCase := range []struct {
+		name               string
+		metricName         string
+		expectedMilliValue int64
+	}{
+		{name: "cpu", metricName: "cpu_per_2m", expectedMilliValue: 200},
+
+		// the milli value of memory is in MiB, so that it's compared against a threshold in MiB
+		{name: "memory", metricName: "memory_per_2m", expectedMilliValue: 200},
+
+		// a window covering all the samples
+		{name: "cpu longer window", metricName: "cpu_per_4m", expectedMilliValue: int64(math.Round(2600.0 / 5))},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			metricValueList, err := withUnusedDelegate(t, client).
+				NamespacedMetrics(resourceTestNamespace).
+				GetForObjects(serviceGroupKind, labels.Everything(), testCase.metricName, labels.Everything())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if len(metricValueList.Items) != 1 || metricValueList.Items[0].DescribedObject.Name != "jupyter" {
+				t.Fatalf("Expected a single metric value of jupyter, got %v", metricValueList.Items)
+			}
+
+			if metricValue := metricValueList.Items[0]; metricValue.Value.MilliValue() != testCase.expectedMilliValue ||
+				metricValue.DescribedObject.Namespace != resourceTestNamespace ||
+				metricValue.Metric.Name != testCase.metricName {
+				t.Fatalf("Expected milli value %d, got %v", testCase.expectedMilliValue, metricValue)
+			}
+		})
+	}
+
+	// a window shorter than spark's samples covers it too
+	averages, err := client.averages(CPUMetricName, time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if averages["spark"] != 500 || averages["jupyter"] != 250 {
+		t.Fatalf("Expected averages of 500 and 250, got %v", averages)
+	}
+}
+
+func TestResourceMetricsWindowNotCovered(t *testing.T) {
+	podMetrics := newFakePodMetrics(t)
+	client := newTestResourceMetricsClient(t, podMetrics, 30*time.Second, 10*time.Minute)
+	now := time.Now()
+
+	// no samples at all
+	averages, err := client.averages(CPUMetricName, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(averages) != 0 {
+		t.Fatalf("Expected no averages, got %v", averages)
+	}
+
+	// samples going back less than a window, minus the sample interval
+	for _, age := range []time.Duration{4 * time.Minute, 3 * time.Minute, 2 * time.Minute, time.Minute} {
+		podMetrics.set("jupyter-0", "jupyter", now.Add(-age), "1", "1Gi")
+		sampleResourceMetrics(t, client)
+	}
+
+	if averages, err = client.averages(CPUMetricName, 5*time.Minute); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(averages) != 0 {
+		t.Fatalf("Expected a window that isn't covered to have no averages, got %v", averages)
+	}
+
+	// the oldest sample is within a sample interval of the window's start
+	if averages, err = client.averages(CPUMetricName, 4*time.Minute+20*time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if averages["jupyter"] != 1000 {
+		t.Fatalf("Expected an average of 1000, got %v", averages)
+	}
+
+	// a service scaled to zero and woken up again starts over
+	podMetrics.delete("jupyter-0")
+	sampleResourceMetrics(t, client)
+	podMetrics.set("jupyter-0", "jupyter", now, "1", "1Gi")
+	sampleResourceMetrics(t, client)
+
+	if averages, err = client.averages(CPUMetricName, 4*time.Minute+20*time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(averages) != 0 {
+		t.Fatalf("Expected a woken up service to have no averages, got %v", averages)
+	}
+}
+
+func TestResourceMetricsRetention(t *testing.T) {
+	podMetrics := newFakePodMetrics(t)
+	client := newTestResourceMetricsClient(t, podMetrics, 30*time.Second, 2*time.Minute)
+	now := time.Now()
+
+	// a window longer than the retention can never be covered
+	if _, err := client.averages(CPUMetricName, 3*time.Minute); err == nil {
+		t.Fatalf("Expected a window longer than the retention to fail")
+	}
+
+	if _, err := withUnusedDelegate(t, client).
+		NamespacedMetrics(resourceTestNamespace).
+		GetForObjects(serviceGroupKind, labels.Everything(), "memory_per_3m", labels.Everything()); err == nil {
+		t.Fatalf("Expected a window longer than the retention to fail")
+	}
+
+	// samples older than the retention are overwritten
+	for sampleIndex := 8; sampleIndex > 0; sampleIndex-- {
+		podMetrics.set("jupyter-0", "jupyter", now.Add(-time.Duration(sampleIndex)*30*time.Second), "1", "1Gi")
+		sampleResourceMetrics(t, client)
+	}
+
+	sampleRing := client.samples["jupyter"]
+	if sampleRing.count != client.ringCapacity() || sampleRing.count != 5 {
+		t.Fatalf("Expected 5 samples, got %d", sampleRing.count)
+	}
+
+	if expectedOldest := now.Add(-5 * 30 * time.Second); !sampleRing.oldest().time.Equal(expectedOldest) {
+		t.Fatalf("Expected the oldest sample at %s, got %s", expectedOldest, sampleRing.oldest().time)
+	}
+
+	// the retention itself can still be averaged over
+	averages, err := client.averages(MemoryMetricName, 2*time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if averages["jupyter"] != 1024*1024*1024 {
+		t.Fatalf("Expected an average of 1Gi, got %v", averages)
+	}
+}
+
+func TestResourceMetricsDelegation(t *testing.T) {
+	prometheus := &fakePrometheus{body: `{"status": "success", "data": {"resultType": "vector", "result": [
+		{"metric": {"service": "jupyter"}, "value": [1700000000.5, "3"]}
+	]}}`}
+	delegate := newTestPrometheusClient(t, prometheus, PrometheusOptions{})
+	podMetrics := newFakePodMetrics(t)
+	client := newTestResourceMetricsClient(t, podMetrics, 30*time.Second, 10*time.Minute)
+	metricsClient := client.WithDelegate(delegate)
+
+	// metrics other than cpu and memory, and the cpu of other namespaces, are read from the delegate
+	for _, testCase := range []struct {
+		namespace  string
+		metricName string
+	}{
+		{namespace: resourceTestNamespace, metricName: "num_of_requests_per_1h"},
+		{namespace: "other-tenant", metricName: "cpu_per_1h"},
+	} {
+		metricValue, err := metricsClient.NamespacedMetrics(testCase.namespace).GetForObject(serviceGroupKind,
+			"jupyter",
+			testCase.metricName,
+			labels.Everything())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if metricValue.Value.MilliValue() != 3000 {
+			t.Fatalf("Expected milli value 3000, got %d", metricValue.Value.MilliValue())
+		}
+	}
+
+	if len(prometheus.queries) != 2 {
+		t.Fatalf("Expected 2 delegated queries, got %v", prometheus.queries)
+	}
+}
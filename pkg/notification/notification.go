@@ -0,0 +1,303 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package notification
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// CloudEvents types of scale transitions, published once per service
+const (
+	ScaleToZeroStartedEventType     = "io.iguazio.appresourcescaler.scaletozero.started"
+	ScaleToZeroSucceededEventType   = "io.iguazio.appresourcescaler.scaletozero.succeeded"
+	ScaleToZeroFailedEventType      = "io.iguazio.appresourcescaler.scaletozero.failed"
+	ScaleFromZeroStartedEventType   = "io.iguazio.appresourcescaler.scalefromzero.started"
+	ScaleFromZeroSucceededEventType = "io.iguazio.appresourcescaler.scalefromzero.succeeded"
+	ScaleFromZeroFailedEventType    = "io.iguazio.appresourcescaler.scalefromzero.failed"
+
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsSource      = "app-resource-scaler"
+)
+
+var droppedEventsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "app_resource_scaler",
+	Name:      "notification_dropped_events_total",
+	Help:      "Number of scale events not delivered to a sink, by the sink's index in the sinks and reason",
+}, []string{"sink", "reason"})
+
+// Options configure the sinks scale events are published to
+type Options struct {
+
+	// http(s) urls of the sinks, each sent every event
+	Sinks []string `json:"sinks,omitempty"`
+
+	// events buffered per sink while it's slow or down, beyond which new events are dropped
+	BufferSize int `json:"bufferSize,omitempty"`
+
+	// attempts to deliver an event after the first one fails
+	MaxRetries    int                  `json:"maxRetries,omitempty"`
+	RetryInterval scalertypes.Duration `json:"retryInterval,omitempty"`
+	Timeout       scalertypes.Duration `json:"timeout,omitempty"`
+}
+
+func NewDefaultOptions() Options {
+	return Options{
+		Sinks:         []string{},
+		BufferSize:    1000,
+		MaxRetries:    3,
+		RetryInterval: scalertypes.Duration{Duration: time.Second},
+		Timeout:       scalertypes.Duration{Duration: 10 * time.Second},
+	}
+}
+
+func (o *Options) Validate() error {
+	for _, sink := range o.Sinks {
+		parsedURL, err := url.Parse(sink)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to parse sink url %s", sink)
+		}
+
+		if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+			return errors.Errorf("Sink url must be http or https: %s", sink)
+		}
+	}
+
+	if o.BufferSize <= 0 {
+		return errors.New("Buffer size must be positive")
+	}
+
+	if o.MaxRetries < 0 {
+		return errors.New("Max retries must not be negative")
+	}
+
+	if o.RetryInterval.Duration <= 0 {
+		return errors.New("Retry interval must be positive")
+	}
+
+	if o.Timeout.Duration <= 0 {
+		return errors.New("Timeout must be positive")
+	}
+
+	return nil
+}
+
+// Event is a scale transition of a single service, the data of the published CloudEvent
+type Event struct {
+	Type        string    `json:"-"`
+	Time        time.Time `json:"-"`
+	Namespace   string    `json:"namespace"`
+	Service     string    `json:"service"`
+	Trigger     string    `json:"trigger,omitempty"`
+	OperationID string    `json:"operationID,omitempty"`
+
+	// for succeeded and failed events, since the transition started
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// Notifier publishes scale events to sinks as CloudEvents, in binary content mode. Each sink has its own buffer
+// and goroutine, so a slow sink doesn't hold back the others or the scaler. A nil notifier discards events
+type Notifier struct {
+	logger  logger.Logger
+	options Options
+	client  *http.Client
+	sinks   []*sink
+}
+
+// sink is a sink url and its buffer of events. It's logged by host and counted by index, as the url may carry
+// credentials
+type sink struct {
+	index  string
+	url    string
+	host   string
+	events chan *Event
+}
+
+func NewNotifier(parentLogger logger.Logger, options Options) (*Notifier, error) {
+	if err := options.Validate(); err != nil {
+		return nil, errors.Wrap(err, "Invalid notification options")
+	}
+
+	n := &Notifier{
+		logger:  parentLogger.GetChild("notifier"),
+		options: options,
+		client:  &http.Client{},
+	}
+
+	for sinkIndex, sinkURL := range options.Sinks {
+
+		// validated along with the options
+		parsedURL, _ := url.Parse(sinkURL)
+		n.sinks = append(n.sinks, &sink{
+			index:  strconv.Itoa(sinkIndex),
+			url:    sinkURL,
+			host:   parsedURL.Host,
+			events: make(chan *Event, options.BufferSize),
+		})
+	}
+
+	return n, nil
+}
+
+// Start delivers buffered events until ctx is done
+func (n *Notifier) Start(ctx context.Context) {
+	for _, sink := range n.sinks {
+		go n.deliver(ctx, sink)
+	}
+}
+
+// Publish buffers the event for every sink, dropping it for sinks whose buffer is full
+func (n *Notifier) Publish(event *Event) {
+	if n == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	for _, sink := range n.sinks {
+		select {
+		case sink.events <- event:
+		default:
+			n.logger.WarnWith("Sink buffer is full, dropping event",
+				"sink", sink.index,
+				"host", sink.host,
+				"type", event.Type,
+				"services", []string{event.Service})
+			droppedEventsCounter.WithLabelValues(sink.index, "buffer_full").Inc()
+		}
+	}
+}
+
+func (n *Notifier) deliver(ctx context.Context, sink *sink) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-sink.events:
+			if err := n.send(ctx, sink, event); err != nil {
+				n.logger.WarnWith("Failed to deliver event, dropping it",
+					"sink", sink.index,
+					"host", sink.host,
+					"type", event.Type,
+					"services", []string{event.Service},
+					"err", errors.GetErrorStackString(err, 10))
+				droppedEventsCounter.WithLabelValues(sink.index, "delivery_failed").Inc()
+			}
+		}
+	}
+}
+
+// send posts the event to the sink, retrying transport errors and responses the sink may recover from (5xx and
+// 429) with a growing interval. Other responses won't change on retry, so they fail right away
+func (n *Notifier) send(ctx context.Context, sink *sink, event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal event")
+	}
+
+	eventID := newEventID()
+
+	var lastErr error
+	for attempt := 0; attempt <= n.options.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * n.options.RetryInterval.Duration):
+			}
+		}
+
+		var retryable bool
+		retryable, lastErr = n.post(ctx, sink.url, eventID, event, data)
+		if lastErr == nil {
+			return nil
+		}
+
+		if !retryable {
+			return errors.Wrap(lastErr, "Failed to deliver event")
+		}
+	}
+
+	return errors.Wrapf(lastErr, "Failed to deliver event after %d attempts", n.options.MaxRetries+1)
+}
+
+// post posts the event to the sink once, returning whether a failure may be retried
+func (n *Notifier) post(ctx context.Context,
+	sinkURL string,
+	eventID string,
+	event *Event,
+	data []byte) (bool, error) {
+	postCtx, cancelFunc := context.WithTimeout(ctx, n.options.Timeout.Duration)
+	defer cancelFunc()
+
+	request, err := http.NewRequestWithContext(postCtx, http.MethodPost, sinkURL, bytes.NewReader(data))
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to create request")
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("ce-specversion", cloudEventsSpecVersion)
+	request.Header.Set("ce-id", eventID)
+	request.Header.Set("ce-source", cloudEventsSource+"/"+event.Namespace)
+	request.Header.Set("ce-type", event.Type)
+	request.Header.Set("ce-subject", event.Service)
+	request.Header.Set("ce-time", event.Time.UTC().Format(time.RFC3339Nano))
+
+	response, err := n.client.Do(request)
+	if err != nil {
+		return true, errors.Wrap(err, "Failed to send request")
+	}
+	defer response.Body.Close() // nolint: errcheck
+
+	io.Copy(io.Discard, response.Body) // nolint: errcheck
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		retryable := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+		return retryable, errors.Errorf("Sink responded with status %d", response.StatusCode)
+	}
+
+	return false, nil
+}
+
+func newEventID() string {
+	eventIDBytes := make([]byte, 16)
+	if _, err := rand.Read(eventIDBytes); err != nil {
+		return time.Now().Format(time.RFC3339Nano)
+	}
+	return hex.EncodeToString(eventIDBytes)
+}
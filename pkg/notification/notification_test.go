@@ -0,0 +1,268 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nuclio/logger"
+	nucliozap "github.com/nuclio/zap"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// fakeSink responds with the given status codes in turn, then with 200, recording the requests it's sent
+type fakeSink struct {
+	lock        sync.Mutex
+	statusCodes []int
+	requests    []*http.Request
+	bodies      [][]byte
+	received    chan struct{}
+}
+
+func newFakeSink(statusCodes ...int) *fakeSink {
+	return &fakeSink{statusCodes: statusCodes, received: make(chan struct{}, 100)}
+}
+
+func (s *fakeSink) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	body, _ := io.ReadAll(request.Body)
+
+	s.lock.Lock()
+	s.requests = append(s.requests, request)
+	s.bodies = append(s.bodies, body)
+	statusCode := http.StatusOK
+	if len(s.statusCodes) > 0 {
+		statusCode, s.statusCodes = s.statusCodes[0], s.statusCodes[1:]
+	}
+	s.lock.Unlock()
+
+	responseWriter.WriteHeader(statusCode)
+	s.received <- struct{}{}
+}
+
+func (s *fakeSink) requestCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.requests)
+}
+
+func newTestLogger(t *testing.T) logger.Logger {
+	loggerInstance, err := nucliozap.NewNuclioZap("test", "console", nil, os.Stdout, os.Stderr, nucliozap.InfoLevel)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	return loggerInstance
+}
+
+// newTestNotifier returns a notifier of the given sink handlers, retrying right away
+func newTestNotifier(t *testing.T, bufferSize int, sinks ...http.Handler) *Notifier {
+	options := NewDefaultOptions()
+	options.BufferSize = bufferSize
+	options.RetryInterval = scalertypes.Duration{Duration: time.Millisecond}
+	for _, sink := range sinks {
+		server := httptest.NewServer(sink)
+		t.Cleanup(server.Close)
+		options.Sinks = append(options.Sinks, server.URL+"/scale-events")
+	}
+
+	notifier, err := NewNotifier(newTestLogger(t), options)
+	if err != nil {
+		t.Fatalf("Failed to create notifier: %v", err)
+	}
+
+	return notifier
+}
+
+func newTestEvent() *Event {
+	return &Event{
+		Type:            ScaleFromZeroSucceededEventType,
+		Time:            time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC),
+		Namespace:       "default-tenant",
+		Service:         "jupyter",
+		Trigger:         "dlx",
+		OperationID:     "0123456789abcdef",
+		DurationSeconds: 1.5,
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	for _, testCase := range []struct {
+		name             string
+		statusCodes      []int
+		expectedAttempts int
+		expectedErr      bool
+	}{
+		{name: "delivered", expectedAttempts: 1},
+		{
+			name:             "delivered after server errors",
+			statusCodes:      []int{http.StatusServiceUnavailable, http.StatusInternalServerError},
+			expectedAttempts: 3,
+		},
+		{
+			name:             "delivered after too many requests",
+			statusCodes:      []int{http.StatusTooManyRequests},
+			expectedAttempts: 2,
+		},
+		{
+			name:             "given up after max retries",
+			statusCodes:      []int{502, 502, 502, 502, 502},
+			expectedAttempts: 4,
+			expectedErr:      true,
+		},
+		{
+			name:             "client error not retried",
+			statusCodes:      []int{http.StatusBadRequest},
+			expectedAttempts: 1,
+			expectedErr:      true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			sink := newFakeSink(testCase.statusCodes...)
+			notifier := newTestNotifier(t, 1, sink)
+
+			err := notifier.send(context.Background(), notifier.sinks[0], newTestEvent())
+			if (err != nil) != testCase.expectedErr {
+				t.Fatalf("Expected failure %t, got %v", testCase.expectedErr, err)
+			}
+
+			if attempts := sink.requestCount(); attempts != testCase.expectedAttempts {
+				t.Fatalf("Expected %d attempts, got %d", testCase.expectedAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestSendRetriesTransportErrors(t *testing.T) {
+	server := httptest.NewServer(newFakeSink())
+	server.Close()
+
+	options := NewDefaultOptions()
+	options.Sinks = []string{server.URL}
+	options.MaxRetries = 2
+	options.RetryInterval = scalertypes.Duration{Duration: 10 * time.Millisecond}
+	notifier, err := NewNotifier(newTestLogger(t), options)
+	if err != nil {
+		t.Fatalf("Failed to create notifier: %v", err)
+	}
+
+	// the retries wait 10ms and 20ms
+	startedAt := time.Now()
+	if err := notifier.send(context.Background(), notifier.sinks[0], newTestEvent()); err == nil {
+		t.Fatalf("Expected failing to deliver to a closed sink")
+	}
+
+	if elapsed := time.Since(startedAt); elapsed < 30*time.Millisecond {
+		t.Fatalf("Expected the connection failures to be retried, gave up after %s", elapsed)
+	}
+}
+
+func TestPublishDropsOnFullBuffer(t *testing.T) {
+	notifier := newTestNotifier(t, 1, newFakeSink(), newFakeSink())
+	bufferFull := testutil.ToFloat64(droppedEventsCounter.WithLabelValues("1", "buffer_full"))
+
+	// not started, so nothing is delivered
+	notifier.Publish(newTestEvent())
+	notifier.Publish(newTestEvent())
+
+	for _, sink := range notifier.sinks {
+		if bufferedEvents := len(sink.events); bufferedEvents != 1 {
+			t.Fatalf("Expected a single buffered event, got %d", bufferedEvents)
+		}
+	}
+
+	// counted by the sink's index rather than its url
+	if dropped := testutil.ToFloat64(droppedEventsCounter.WithLabelValues("1", "buffer_full")) - bufferFull; dropped != 1 {
+		t.Fatalf("Expected a single dropped event, got %v", dropped)
+	}
+}
+
+func TestPublishedCloudEvent(t *testing.T) {
+	sink := newFakeSink()
+	notifier := newTestNotifier(t, 10, sink)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	notifier.Start(ctx)
+	notifier.Publish(newTestEvent())
+
+	select {
+	case <-sink.received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the event to be delivered")
+	}
+
+	sink.lock.Lock()
+	request, body := sink.requests[0], sink.bodies[0]
+	sink.lock.Unlock()
+
+	if request.Method != http.MethodPost || request.URL.Path != "/scale-events" {
+		t.Fatalf("Expected a POST to /scale-events, got %s %s", request.Method, request.URL.Path)
+	}
+
+	for header, expectedValue := range map[string]string{
+		"Content-Type":   "application/json",
+		"ce-specversion": "1.0",
+		"ce-source":      "app-resource-scaler/default-tenant",
+		"ce-type":        ScaleFromZeroSucceededEventType,
+		"ce-subject":     "jupyter",
+		"ce-time":        "2024-05-01T08:00:00Z",
+	} {
+		if value := request.Header.Get(header); value != expectedValue {
+			t.Fatalf("Expected header %s to be %q, got %q", header, expectedValue, value)
+		}
+	}
+
+	if request.Header.Get("ce-id") == "" {
+		t.Fatalf("Expected an event id")
+	}
+
+	data := map[string]interface{}{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		t.Fatalf("Failed to unmarshal event data: %v", err)
+	}
+
+	expectedData := map[string]interface{}{
+		"namespace":       "default-tenant",
+		"service":         "jupyter",
+		"trigger":         "dlx",
+		"operationID":     "0123456789abcdef",
+		"durationSeconds": 1.5,
+	}
+	if len(data) != len(expectedData) {
+		t.Fatalf("Expected data %v, got %v", expectedData, data)
+	}
+
+	for key, expectedValue := range expectedData {
+		if data[key] != expectedValue {
+			t.Fatalf("Expected data %s to be %v, got %v", key, expectedValue, data[key])
+		}
+	}
+}
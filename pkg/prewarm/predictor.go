@@ -0,0 +1,295 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package prewarm
+
+import (
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/accounting"
+	"github.com/v3io/app-resource-scaler/pkg/resourcescaler"
+
+	"github.com/nuclio/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+const (
+
+	// every previous day is learned from
+	DailySeasonality = "daily"
+
+	// only the same weekday on previous weeks is learned from
+	WeeklySeasonality = "weekly"
+)
+
+// outcomes of a prediction, once its bucket is over
+const (
+	TruePositiveOutcome  = "true_positive"
+	FalsePositiveOutcome = "false_positive"
+	FalseNegativeOutcome = "false_negative"
+	TrueNegativeOutcome  = "true_negative"
+)
+
+var predictionOutcomesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "app_resource_scaler",
+	Name:      "prewarm_prediction_outcomes_total",
+	Help:      "Number of evaluated predictions of services being used, by outcome",
+}, []string{"outcome"})
+
+// PredictorOptions configure pre-warming services when they're likely to be used, as learned from the times they
+// were woken up at before
+type PredictorOptions struct {
+	Enabled bool `json:"enabled,omitempty"`
+
+	// the probability of a service being used in a bucket at or above which it's pre-warmed for it
+	Threshold float64 `json:"threshold,omitempty"`
+
+	// the length of the buckets the day is split into, starting at midnight
+	BucketDuration scalertypes.Duration `json:"bucketDuration,omitempty"`
+
+	// how many previous days are learned from
+	LookbackDays int `json:"lookbackDays,omitempty"`
+
+	// the weight of each previous day (or week) relative to the one after it, so recent usage counts more
+	Decay float64 `json:"decay,omitempty"`
+
+	// daily or weekly
+	Seasonality string `json:"seasonality,omitempty"`
+
+	// how soon after its pin expires an unused pre-warmed service is scaled back to zero by the autoscaler
+	IdleTolerance scalertypes.Duration `json:"idleTolerance,omitempty"`
+
+	// how often the prediction accuracy is logged
+	AccuracyLogInterval scalertypes.Duration `json:"accuracyLogInterval,omitempty"`
+}
+
+func NewDefaultPredictorOptions() PredictorOptions {
+	return PredictorOptions{
+		Threshold:           0.6,
+		BucketDuration:      scalertypes.Duration{Duration: 30 * time.Minute},
+		LookbackDays:        14,
+		Decay:               0.9,
+		Seasonality:         DailySeasonality,
+		IdleTolerance:       scalertypes.Duration{Duration: 5 * time.Minute},
+		AccuracyLogInterval: scalertypes.Duration{Duration: time.Hour},
+	}
+}
+
+func (o *PredictorOptions) Validate() error {
+	if !o.Enabled {
+		return nil
+	}
+
+	if o.Threshold <= 0 || o.Threshold > 1 {
+		return errors.New("Predictor threshold must be above 0 and at most 1")
+	}
+
+	if o.BucketDuration.Duration <= 0 || (24*time.Hour)%o.BucketDuration.Duration != 0 {
+		return errors.New("Predictor bucket duration must divide a day")
+	}
+
+	if o.Decay <= 0 || o.Decay > 1 {
+		return errors.New("Predictor decay must be above 0 and at most 1")
+	}
+
+	switch o.Seasonality {
+	case DailySeasonality:
+		if o.LookbackDays <= 0 {
+			return errors.New("Predictor lookback days must be positive")
+		}
+	case WeeklySeasonality:
+		if o.LookbackDays < 7 {
+			return errors.New("Predictor lookback days must be at least 7 for weekly seasonality")
+		}
+	default:
+		return errors.Errorf("Unknown predictor seasonality %q, expected daily or weekly", o.Seasonality)
+	}
+
+	if o.IdleTolerance.Duration <= 0 || o.AccuracyLogInterval.Duration <= 0 {
+		return errors.New("Predictor idle tolerance and accuracy log interval must be positive")
+	}
+
+	return nil
+}
+
+// likely returns whether a service with the given probability of being used in a bucket is pre-warmed for it
+func (o *PredictorOptions) likely(probability float64) bool {
+	return probability >= o.Threshold
+}
+
+// Accuracy counts the outcomes of evaluated predictions
+type Accuracy struct {
+	TruePositives  int
+	FalsePositives int
+	FalseNegatives int
+	TrueNegatives  int
+}
+
+// Add counts the outcome of a prediction and returns it
+func (a *Accuracy) Add(predicted bool, accessed bool) string {
+	switch {
+	case predicted && accessed:
+		a.TruePositives++
+		return TruePositiveOutcome
+	case predicted:
+		a.FalsePositives++
+		return FalsePositiveOutcome
+	case accessed:
+		a.FalseNegatives++
+		return FalseNegativeOutcome
+	default:
+		a.TrueNegatives++
+		return TrueNegativeOutcome
+	}
+}
+
+func (a *Accuracy) Total() int {
+	return a.TruePositives + a.FalsePositives + a.FalseNegatives + a.TrueNegatives
+}
+
+// Precision is the share of pre-warms that were used, or 0 if nothing was predicted
+func (a *Accuracy) Precision() float64 {
+	return ratio(a.TruePositives, a.TruePositives+a.FalsePositives)
+}
+
+// Recall is the share of uses that were predicted, or 0 if nothing was used
+func (a *Accuracy) Recall() float64 {
+	return ratio(a.TruePositives, a.TruePositives+a.FalseNegatives)
+}
+
+// prediction is a pending evaluation of whether a service was used in a bucket
+type prediction struct {
+	serviceName string
+	bucket      time.Time
+	probability float64
+	predicted   bool
+}
+
+// Predict returns the probability of a service being used in the bucket starting at bucketStart: the share of the
+// same bucket on previous days (or weeks) it was accessed in, the more recent weighted higher. It depends only on
+// its arguments, so a synthetic history always yields the same prediction. scaleEvents must be sorted oldest first
+func Predict(scaleEvents []accounting.ScaleEvent,
+	bucketStart time.Time,
+	options PredictorOptions,
+	leadTime time.Duration) float64 {
+
+	step := 1
+	if options.Seasonality == WeeklySeasonality {
+		step = 7
+	}
+
+	weight, weightSum, accessedWeightSum := 1.0, 0.0, 0.0
+	for day := step; day <= options.LookbackDays; day += step {
+		if Accessed(scaleEvents, bucketStart.AddDate(0, 0, -day), options, leadTime) {
+			accessedWeightSum += weight
+		}
+
+		weightSum += weight
+		weight *= options.Decay
+	}
+
+	if weightSum == 0 {
+		return 0
+	}
+
+	return accessedWeightSum / weightSum
+}
+
+// Accessed returns whether a service was used in the bucket starting at bucketStart: it was woken up during it other
+// than by a pre-warm, or it was pre-warmed for it by a prediction and not scaled back to zero within the idle
+// tolerance of the bucket's end, when the prediction's pin expired. Requests to an awake service aren't recorded,
+// so that's as close as the scale history gets. scaleEvents must be sorted oldest first
+func Accessed(scaleEvents []accounting.ScaleEvent,
+	bucketStart time.Time,
+	options PredictorOptions,
+	leadTime time.Duration) bool {
+
+	bucketEnd := bucketStart.Add(options.BucketDuration.Duration)
+	for scaleEventIndex, scaleEvent := range scaleEvents {
+		if scaleEvent.Type != accounting.ScaledFromZeroEventType || scaleEvent.Time.Before(bucketStart.Add(-leadTime)) {
+			continue
+		}
+
+		if !scaleEvent.Time.Before(bucketEnd) {
+			break
+		}
+
+		switch {
+		case !isPrewarm(scaleEvent.Trigger):
+			if !scaleEvent.Time.Before(bucketStart) {
+				return true
+			}
+
+		// scheduled pre-warms keep the service awake for their own grace period, which says nothing of the bucket
+		case scaleEvent.Trigger == resourcescaler.PredictionTrigger:
+			if keptAwake(scaleEvents[scaleEventIndex+1:], bucketEnd.Add(options.IdleTolerance.Duration)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// keptAwake returns whether none of the scale events before until scales the service to zero
+func keptAwake(scaleEvents []accounting.ScaleEvent, until time.Time) bool {
+	for _, scaleEvent := range scaleEvents {
+		if !scaleEvent.Time.Before(until) {
+			break
+		}
+
+		if scaleEvent.Type == accounting.ScaledToZeroEventType {
+			return false
+		}
+	}
+
+	return true
+}
+
+// nextBucket returns the bucket starting within the lead time from now, if any
+func nextBucket(location *time.Location,
+	now time.Time,
+	leadTime time.Duration,
+	bucketDuration time.Duration) (time.Time, bool) {
+
+	localNow := now.In(location)
+	midnight := time.Date(localNow.Year(), localNow.Month(), localNow.Day(), 0, 0, 0, 0, location)
+	bucket := midnight.Add((localNow.Sub(midnight)/bucketDuration + 1) * bucketDuration)
+
+	if bucket.Sub(now) > leadTime {
+		return time.Time{}, false
+	}
+
+	return bucket, true
+}
+
+func isPrewarm(trigger string) bool {
+	return trigger == resourcescaler.PrewarmTrigger || trigger == resourcescaler.PredictionTrigger
+}
+
+func ratio(numerator int, denominator int) float64 {
+	if denominator == 0 {
+		return 0
+	}
+
+	return float64(numerator) / float64(denominator)
+}
@@ -0,0 +1,362 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package prewarm
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/accounting"
+	"github.com/v3io/app-resource-scaler/pkg/resourcescaler"
+
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// a Wednesday, so a week back doesn't cross into another month
+var testBucketStart = time.Date(2024, 5, 15, 9, 0, 0, 0, time.UTC)
+
+func newTestPredictorOptions() PredictorOptions {
+	return PredictorOptions{
+		Enabled:        true,
+		Threshold:      0.6,
+		BucketDuration: scalertypes.Duration{Duration: 30 * time.Minute},
+		LookbackDays:   5,
+		Decay:          1,
+		Seasonality:    DailySeasonality,
+		IdleTolerance:  scalertypes.Duration{Duration: 5 * time.Minute},
+	}
+}
+
+// usedOnDaysBefore returns a history of the service being woken up by a request 10 minutes into the test bucket
+// on each of the given previous days, and scaled back to zero an hour later
+func usedOnDaysBefore(days ...int) []accounting.ScaleEvent {
+	var scaleEvents []accounting.ScaleEvent
+	for _, day := range days {
+		wokenUpAt := testBucketStart.AddDate(0, 0, -day).Add(10 * time.Minute)
+		scaleEvents = append(scaleEvents,
+			accounting.ScaleEvent{
+				Time:    wokenUpAt,
+				Type:    accounting.ScaledFromZeroEventType,
+				Trigger: resourcescaler.DLXTrigger,
+			},
+			accounting.ScaleEvent{
+				Time:    wokenUpAt.Add(time.Hour),
+				Type:    accounting.ScaledToZeroEventType,
+				Trigger: resourcescaler.AutoScalerTrigger,
+			})
+	}
+
+	sort.Slice(scaleEvents, func(i, j int) bool {
+		return scaleEvents[i].Time.Before(scaleEvents[j].Time)
+	})
+
+	return scaleEvents
+}
+
+func TestPredict(t *testing.T) {
+	for _, testCase := range []struct {
+		name                string
+		scaleEvents         []accounting.ScaleEvent
+		seasonality         string
+		lookbackDays        int
+		decay               float64
+		expectedProbability float64
+	}{
+		{name: "no history", expectedProbability: 0},
+		{name: "used every day", scaleEvents: usedOnDaysBefore(1, 2, 3, 4, 5), expectedProbability: 1},
+		{name: "used on some days", scaleEvents: usedOnDaysBefore(1, 3, 5), expectedProbability: 0.6},
+
+		// days beyond the lookback aren't learned from
+		{name: "used before the lookback", scaleEvents: usedOnDaysBefore(6, 7, 8), expectedProbability: 0},
+		{name: "longer lookback", scaleEvents: usedOnDaysBefore(6, 7, 8), lookbackDays: 10, expectedProbability: 0.3},
+
+		// only the same weekday is learned from
+		{name: "weekly used on the same weekday",
+			scaleEvents:         usedOnDaysBefore(7, 14),
+			seasonality:         WeeklySeasonality,
+			lookbackDays:        14,
+			expectedProbability: 1},
+		{name: "weekly used on other weekdays",
+			scaleEvents:         usedOnDaysBefore(1, 2, 3, 4, 5, 6, 8, 9, 10, 11, 12, 13),
+			seasonality:         WeeklySeasonality,
+			lookbackDays:        14,
+			expectedProbability: 0},
+		{name: "weekly used on some weeks",
+			scaleEvents:         usedOnDaysBefore(7, 21),
+			seasonality:         WeeklySeasonality,
+			lookbackDays:        28,
+			expectedProbability: 0.5},
+		{name: "daily used on the same weekday",
+			scaleEvents:         usedOnDaysBefore(7, 14),
+			lookbackDays:        14,
+			expectedProbability: 2.0 / 14},
+
+		// recent days weigh more, each previous day by decay times the one after it
+		{name: "decay used yesterday",
+			scaleEvents:         usedOnDaysBefore(1),
+			lookbackDays:        3,
+			decay:               0.5,
+			expectedProbability: 1 / 1.75},
+		{name: "decay used 3 days ago",
+			scaleEvents:         usedOnDaysBefore(3),
+			lookbackDays:        3,
+			decay:               0.5,
+			expectedProbability: 0.25 / 1.75},
+		{name: "decay used every day",
+			scaleEvents:         usedOnDaysBefore(1, 2, 3),
+			lookbackDays:        3,
+			decay:               0.5,
+			expectedProbability: 1},
+		{name: "weekly decay",
+			scaleEvents:         usedOnDaysBefore(14),
+			seasonality:         WeeklySeasonality,
+			lookbackDays:        14,
+			decay:               0.5,
+			expectedProbability: 0.5 / 1.5},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			options := newTestPredictorOptions()
+			if testCase.seasonality != "" {
+				options.Seasonality = testCase.seasonality
+			}
+			if testCase.lookbackDays != 0 {
+				options.LookbackDays = testCase.lookbackDays
+			}
+			if testCase.decay != 0 {
+				options.Decay = testCase.decay
+			}
+
+			probability := Predict(testCase.scaleEvents, testBucketStart, options, 10*time.Minute)
+			if math.Abs(probability-testCase.expectedProbability) > 1e-9 {
+				t.Fatalf("Expected probability %f, got %f", testCase.expectedProbability, probability)
+			}
+		})
+	}
+}
+
+func TestAccessed(t *testing.T) {
+	bucketEnd := testBucketStart.Add(30 * time.Minute)
+	wokenUp := func(at time.Time, trigger string) accounting.ScaleEvent {
+		return accounting.ScaleEvent{Time: at, Type: accounting.ScaledFromZeroEventType, Trigger: trigger}
+	}
+	scaledToZero := func(at time.Time) accounting.ScaleEvent {
+		return accounting.ScaleEvent{
+			Time:    at,
+			Type:    accounting.ScaledToZeroEventType,
+			Trigger: resourcescaler.AutoScalerTrigger,
+		}
+	}
+
+	for _, testCase := range []struct {
+		name             string
+		scaleEvents      []accounting.ScaleEvent
+		expectedAccessed bool
+	}{
+		{name: "no history"},
+		{name: "woken up at the bucket start",
+			scaleEvents:      []accounting.ScaleEvent{wokenUp(testBucketStart, resourcescaler.DLXTrigger)},
+			expectedAccessed: true},
+		{name: "woken up just before the bucket end",
+			scaleEvents:      []accounting.ScaleEvent{wokenUp(bucketEnd.Add(-time.Second), resourcescaler.DLXTrigger)},
+			expectedAccessed: true},
+		{name: "woken up at the bucket end",
+			scaleEvents: []accounting.ScaleEvent{wokenUp(bucketEnd, resourcescaler.DLXTrigger)}},
+
+		// a request within the lead time before the bucket doesn't count for it
+		{name: "woken up before the bucket",
+			scaleEvents: []accounting.ScaleEvent{wokenUp(testBucketStart.Add(-5*time.Minute), resourcescaler.DLXTrigger)}},
+		{name: "scaled to zero in the bucket",
+			scaleEvents: []accounting.ScaleEvent{scaledToZero(testBucketStart.Add(time.Minute))}},
+
+		// a predicted pre-warm counts if the service was kept awake past the bucket's end and the idle tolerance
+		{name: "predicted and kept awake",
+			scaleEvents: []accounting.ScaleEvent{
+				wokenUp(testBucketStart.Add(-5*time.Minute), resourcescaler.PredictionTrigger),
+				scaledToZero(bucketEnd.Add(5 * time.Minute)),
+			},
+			expectedAccessed: true},
+		{name: "predicted and scaled to zero within the idle tolerance",
+			scaleEvents: []accounting.ScaleEvent{
+				wokenUp(testBucketStart.Add(-5*time.Minute), resourcescaler.PredictionTrigger),
+				scaledToZero(bucketEnd.Add(4 * time.Minute)),
+			}},
+		{name: "predicted before the lead time",
+			scaleEvents: []accounting.ScaleEvent{
+				wokenUp(testBucketStart.Add(-15*time.Minute), resourcescaler.PredictionTrigger),
+			}},
+		{name: "scheduled pre-warm",
+			scaleEvents: []accounting.ScaleEvent{
+				wokenUp(testBucketStart.Add(-5*time.Minute), resourcescaler.PrewarmTrigger),
+			}},
+		{name: "scheduled pre-warm then woken up by a request",
+			scaleEvents: []accounting.ScaleEvent{
+				wokenUp(testBucketStart.Add(-5*time.Minute), resourcescaler.PrewarmTrigger),
+				scaledToZero(testBucketStart.Add(5 * time.Minute)),
+				wokenUp(testBucketStart.Add(10*time.Minute), resourcescaler.DLXTrigger),
+			},
+			expectedAccessed: true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			options := newTestPredictorOptions()
+			accessed := Accessed(testCase.scaleEvents, testBucketStart, options, 10*time.Minute)
+			if accessed != testCase.expectedAccessed {
+				t.Fatalf("Expected accessed %t, got %t", testCase.expectedAccessed, accessed)
+			}
+		})
+	}
+}
+
+func TestPredictorThreshold(t *testing.T) {
+	for _, testCase := range []struct {
+		name              string
+		scaleEvents       []accounting.ScaleEvent
+		threshold         float64
+		expectedPredicted bool
+	}{
+		{name: "at the threshold", scaleEvents: usedOnDaysBefore(1, 3, 5), threshold: 0.6, expectedPredicted: true},
+		{name: "below the threshold", scaleEvents: usedOnDaysBefore(1, 3), threshold: 0.6},
+		{name: "just above the probability", scaleEvents: usedOnDaysBefore(1, 3, 5), threshold: 0.6000001},
+		{name: "threshold of 1 used every day",
+			scaleEvents:       usedOnDaysBefore(1, 2, 3, 4, 5),
+			threshold:         1,
+			expectedPredicted: true},
+		{name: "threshold of 1 missed a day", scaleEvents: usedOnDaysBefore(1, 2, 3, 4), threshold: 1},
+		{name: "lowest threshold used once", scaleEvents: usedOnDaysBefore(5), threshold: 0.01, expectedPredicted: true},
+		{name: "lowest threshold never used", threshold: 0.01},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			options := newTestPredictorOptions()
+			options.Threshold = testCase.threshold
+
+			probability := Predict(testCase.scaleEvents, testBucketStart, options, 10*time.Minute)
+			if predicted := options.likely(probability); predicted != testCase.expectedPredicted {
+				t.Fatalf("Expected predicted %t with probability %f, got %t", testCase.expectedPredicted, probability, predicted)
+			}
+		})
+	}
+}
+
+func TestAccuracy(t *testing.T) {
+	for _, testCase := range []struct {
+		name              string
+		outcomes          [][2]bool
+		expectedAccuracy  Accuracy
+		expectedPrecision float64
+		expectedRecall    float64
+	}{
+		{name: "no predictions"},
+		{name: "all outcomes",
+			outcomes: [][2]bool{
+				{true, true}, {true, true}, {true, true},
+				{true, false},
+				{false, true},
+				{false, false}, {false, false},
+			},
+			expectedAccuracy:  Accuracy{TruePositives: 3, FalsePositives: 1, FalseNegatives: 1, TrueNegatives: 2},
+			expectedPrecision: 0.75,
+			expectedRecall:    0.75},
+		{name: "nothing predicted",
+			outcomes:         [][2]bool{{false, true}, {false, false}},
+			expectedAccuracy: Accuracy{FalseNegatives: 1, TrueNegatives: 1}},
+		{name: "nothing used",
+			outcomes:         [][2]bool{{true, false}, {false, false}},
+			expectedAccuracy: Accuracy{FalsePositives: 1, TrueNegatives: 1}},
+		{name: "all predicted and used",
+			outcomes:          [][2]bool{{true, true}, {true, true}},
+			expectedAccuracy:  Accuracy{TruePositives: 2},
+			expectedPrecision: 1,
+			expectedRecall:    1},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			accuracy := Accuracy{}
+			for _, outcome := range testCase.outcomes {
+				accuracy.Add(outcome[0], outcome[1])
+			}
+
+			if accuracy != testCase.expectedAccuracy {
+				t.Fatalf("Expected %+v, got %+v", testCase.expectedAccuracy, accuracy)
+			}
+
+			if accuracy.Total() != len(testCase.outcomes) {
+				t.Fatalf("Expected a total of %d, got %d", len(testCase.outcomes), accuracy.Total())
+			}
+
+			if accuracy.Precision() != testCase.expectedPrecision || accuracy.Recall() != testCase.expectedRecall {
+				t.Fatalf("Expected precision %f and recall %f, got %f and %f",
+					testCase.expectedPrecision,
+					testCase.expectedRecall,
+					accuracy.Precision(),
+					accuracy.Recall())
+			}
+		})
+	}
+
+	accuracy := Accuracy{}
+	for _, testCase := range []struct {
+		predicted       bool
+		accessed        bool
+		expectedOutcome string
+	}{
+		{predicted: true, accessed: true, expectedOutcome: TruePositiveOutcome},
+		{predicted: true, accessed: false, expectedOutcome: FalsePositiveOutcome},
+		{predicted: false, accessed: true, expectedOutcome: FalseNegativeOutcome},
+		{predicted: false, accessed: false, expectedOutcome: TrueNegativeOutcome},
+	} {
+		if outcome := accuracy.Add(testCase.predicted, testCase.accessed); outcome != testCase.expectedOutcome {
+			t.Fatalf("Expected outcome %s, got %s", testCase.expectedOutcome, outcome)
+		}
+	}
+}
+
+func TestNextBucket(t *testing.T) {
+	for _, testCase := range []struct {
+		name           string
+		now            time.Time
+		expectedBucket time.Time
+		expectedFound  bool
+	}{
+		{name: "within the lead time",
+			now:            testBucketStart.Add(-5 * time.Minute),
+			expectedBucket: testBucketStart,
+			expectedFound:  true},
+		{name: "at the lead time",
+			now:            testBucketStart.Add(-10 * time.Minute),
+			expectedBucket: testBucketStart,
+			expectedFound:  true},
+		{name: "before the lead time", now: testBucketStart.Add(-11 * time.Minute)},
+
+		// the bucket that already started isn't due again
+		{name: "at the bucket start", now: testBucketStart},
+		{name: "across midnight",
+			now:            time.Date(2024, 5, 15, 23, 55, 0, 0, time.UTC),
+			expectedBucket: time.Date(2024, 5, 16, 0, 0, 0, 0, time.UTC),
+			expectedFound:  true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			bucket, found := nextBucket(time.UTC, testCase.now, 10*time.Minute, 30*time.Minute)
+			if found != testCase.expectedFound || !bucket.Equal(testCase.expectedBucket) {
+				t.Fatalf("Expected %s and %t, got %s and %t", testCase.expectedBucket, testCase.expectedFound, bucket, found)
+			}
+		})
+	}
+}
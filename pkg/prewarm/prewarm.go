@@ -0,0 +1,516 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package prewarm
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/accounting"
+	"github.com/v3io/app-resource-scaler/pkg/resourcescaler"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// how often the schedule is checked for services due to be pre-warmed
+const checkInterval = 30 * time.Second
+
+// Options configure pre-warming services ahead of the times they are usually used
+type Options struct {
+	Enabled bool `json:"enabled,omitempty"`
+
+	// times of day (HH:MM) to pre-warm services for, unless a service declares its own schedule
+	Schedule []string `json:"schedule,omitempty"`
+
+	// the location of the schedule, e.g. Europe/Berlin
+	Timezone string `json:"timezone,omitempty"`
+
+	// how long before a scheduled time services are pre-warmed
+	LeadTime scalertypes.Duration `json:"leadTime,omitempty"`
+
+	// how long after a scheduled time a service must have been used on a previous day to be pre-warmed
+	SlotDuration scalertypes.Duration `json:"slotDuration,omitempty"`
+
+	// how many previous days are checked for usage, and on how many of them the service must have been used
+	LookbackDays int `json:"lookbackDays,omitempty"`
+	MinUsedDays  int `json:"minUsedDays,omitempty"`
+
+	// how long a pre-warmed service is kept from being scaled back to zero
+	GracePeriod scalertypes.Duration `json:"gracePeriod,omitempty"`
+
+	// pre-warming services when they're predicted to be used, regardless of the schedule
+	Predictor PredictorOptions `json:"predictor,omitempty"`
+}
+
+func NewDefaultOptions() Options {
+	return Options{
+		Schedule:     []string{},
+		Timezone:     "UTC",
+		LeadTime:     scalertypes.Duration{Duration: 10 * time.Minute},
+		SlotDuration: scalertypes.Duration{Duration: time.Hour},
+		LookbackDays: 7,
+		MinUsedDays:  1,
+		GracePeriod:  scalertypes.Duration{Duration: time.Hour},
+		Predictor:    NewDefaultPredictorOptions(),
+	}
+}
+
+func (o *Options) Validate() error {
+	if !o.Enabled && !o.Predictor.Enabled {
+		return nil
+	}
+
+	if _, err := time.LoadLocation(o.Timezone); err != nil {
+		return errors.Wrap(err, "Invalid prewarm timezone")
+	}
+
+	if o.LeadTime.Duration <= 0 {
+		return errors.New("Prewarm lead time must be positive")
+	}
+
+	if err := o.Predictor.Validate(); err != nil {
+		return errors.Wrap(err, "Invalid prewarm predictor")
+	}
+
+	if !o.Enabled {
+		return nil
+	}
+
+	for _, timeOfDay := range o.Schedule {
+		if _, err := resourcescaler.ParseTimeOfDay(timeOfDay); err != nil {
+			return errors.Wrap(err, "Invalid prewarm schedule")
+		}
+	}
+
+	if o.SlotDuration.Duration <= 0 || o.GracePeriod.Duration <= 0 {
+		return errors.New("Prewarm slot duration and grace period must be positive")
+	}
+
+	if o.LookbackDays <= 0 {
+		return errors.New("Prewarm lookback days must be positive")
+	}
+
+	if o.MinUsedDays <= 0 || o.MinUsedDays > o.LookbackDays {
+		return errors.New("Prewarm min used days must be between 1 and the lookback days")
+	}
+
+	return nil
+}
+
+// ServiceWaker is implemented by resource scalers that can pre-warm services and know their scale history
+type ServiceWaker interface {
+	GetScaledToZeroServices(ctx context.Context) ([]resourcescaler.ScaledToZeroService, error)
+	PrewarmService(ctx context.Context, serviceName string, gracePeriod time.Duration) error
+	ScaleEvents(ctx context.Context, from time.Time, to time.Time) (map[string][]accounting.ScaleEvent, error)
+}
+
+// Prewarmer scales services from zero some time before the scheduled times of day they were used at on previous
+// days, so their users don't wait for them to wake up
+type Prewarmer struct {
+	logger         logger.Logger
+	serviceWaker   ServiceWaker
+	options        Options
+	location       *time.Location
+	prewarmTimeout time.Duration
+
+	// the last slot and bucket each service was evaluated for, so each is evaluated once
+	lock             sync.Mutex
+	evaluatedSlots   map[string]time.Time
+	evaluatedBuckets map[string]time.Time
+
+	// predictions waiting for their bucket to be over, and the accuracy of those that were
+	predictions      []prediction
+	accuracy         Accuracy
+	accuracyLoggedAt time.Time
+}
+
+// NewPrewarmer creates a prewarmer. prewarmTimeout bounds each pre-warm, same as any other scale from zero
+func NewPrewarmer(parentLogger logger.Logger,
+	serviceWaker ServiceWaker,
+	options Options,
+	prewarmTimeout time.Duration) (*Prewarmer, error) {
+
+	if err := options.Validate(); err != nil {
+		return nil, errors.Wrap(err, "Invalid prewarm options")
+	}
+
+	location, err := time.LoadLocation(options.Timezone)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to load prewarm timezone")
+	}
+
+	return &Prewarmer{
+		logger:           parentLogger.GetChild("prewarm"),
+		serviceWaker:     serviceWaker,
+		options:          options,
+		location:         location,
+		prewarmTimeout:   prewarmTimeout,
+		evaluatedSlots:   map[string]time.Time{},
+		evaluatedBuckets: map[string]time.Time{},
+	}, nil
+}
+
+func (p *Prewarmer) Start(ctx context.Context) {
+	p.logger.DebugWith("Starting", "options", p.options)
+
+	go func() {
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := p.Check(ctx, time.Now()); err != nil {
+					p.logger.WarnWith("Failed to check prewarm schedule", "err", errors.GetErrorStackString(err, 10))
+				}
+			}
+		}
+	}()
+}
+
+// Check pre-warms the services scaled to zero whose scheduled slot starts within the lead time from now, if they
+// were used in the same slot on enough previous days, and, with the predictor enabled, those predicted to be used
+// in the bucket starting within the lead time. Pre-warms run in the background
+func (p *Prewarmer) Check(ctx context.Context, now time.Time) error {
+	scaledToZeroServices, err := p.serviceWaker.GetScaledToZeroServices(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get services scaled to zero")
+	}
+
+	dueSlots := map[string]time.Time{}
+	if p.options.Enabled {
+		dueSlots = p.dueSlots(scaledToZeroServices, now)
+	}
+
+	dueBuckets := map[string]time.Time{}
+	if p.options.Predictor.Enabled {
+		dueBuckets = p.dueBuckets(scaledToZeroServices, now)
+	}
+
+	if len(dueSlots) == 0 && len(dueBuckets) == 0 && !p.hasPendingPredictions() {
+		return nil
+	}
+
+	scaleEvents, err := p.serviceWaker.ScaleEvents(ctx, now.AddDate(0, 0, -(p.lookbackDays()+1)), now)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get scale events")
+	}
+
+	for serviceName, slot := range dueSlots {
+		usedDays := UsedDays(scaleEvents[serviceName], slot, p.options.SlotDuration.Duration, p.options.LookbackDays)
+		if usedDays < p.options.MinUsedDays {
+			p.logger.DebugWith("Service wasn't used in the slot on enough previous days, not prewarming",
+				"services", []string{serviceName},
+				"slot", slot,
+				"usedDays", usedDays)
+			continue
+		}
+
+		p.logger.InfoWith("Prewarming service",
+			"services", []string{serviceName},
+			"slot", slot,
+			"usedDays", usedDays)
+
+		// already awake for the bucket, so its prediction would say nothing
+		delete(dueBuckets, serviceName)
+
+		go p.prewarm(ctx, serviceName, resourcescaler.PrewarmTrigger, p.options.GracePeriod.Duration)
+	}
+
+	for serviceName, bucket := range dueBuckets {
+		p.predict(ctx, serviceName, bucket, scaleEvents[serviceName], now)
+	}
+
+	p.evaluatePredictions(scaleEvents, now)
+
+	return nil
+}
+
+// dueSlots returns the slot each service is due to be pre-warmed for, marking it as evaluated
+func (p *Prewarmer) dueSlots(scaledToZeroServices []resourcescaler.ScaledToZeroService,
+	now time.Time) map[string]time.Time {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for serviceName, slot := range p.evaluatedSlots {
+		if slot.Before(now.Add(-24 * time.Hour)) {
+			delete(p.evaluatedSlots, serviceName)
+		}
+	}
+
+	dueSlots := map[string]time.Time{}
+	for _, scaledToZeroService := range scaledToZeroServices {
+		schedule := p.options.Schedule
+		if scaledToZeroService.Prewarm != nil && scaledToZeroService.Prewarm.Schedule != nil {
+			schedule = scaledToZeroService.Prewarm.Schedule
+		}
+
+		slot, found := nextSlot(schedule, p.serviceLocation(scaledToZeroService), now, p.options.LeadTime.Duration)
+		if !found || p.evaluatedSlots[scaledToZeroService.Name].Equal(slot) {
+			continue
+		}
+
+		p.evaluatedSlots[scaledToZeroService.Name] = slot
+		dueSlots[scaledToZeroService.Name] = slot
+	}
+
+	return dueSlots
+}
+
+// dueBuckets returns the bucket each service is due to be predicted for, marking it as evaluated
+func (p *Prewarmer) dueBuckets(scaledToZeroServices []resourcescaler.ScaledToZeroService,
+	now time.Time) map[string]time.Time {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for serviceName, bucket := range p.evaluatedBuckets {
+		if bucket.Before(now.Add(-24 * time.Hour)) {
+			delete(p.evaluatedBuckets, serviceName)
+		}
+	}
+
+	dueBuckets := map[string]time.Time{}
+	for _, scaledToZeroService := range scaledToZeroServices {
+		if scaledToZeroService.Prewarm != nil && !scaledToZeroService.Prewarm.Predict {
+			continue
+		}
+
+		bucket, found := nextBucket(p.serviceLocation(scaledToZeroService),
+			now,
+			p.options.LeadTime.Duration,
+			p.options.Predictor.BucketDuration.Duration)
+		if !found || p.evaluatedBuckets[scaledToZeroService.Name].Equal(bucket) {
+			continue
+		}
+
+		p.evaluatedBuckets[scaledToZeroService.Name] = bucket
+		dueBuckets[scaledToZeroService.Name] = bucket
+	}
+
+	return dueBuckets
+}
+
+// predict pre-warms a service if it's likely to be used in the bucket, keeping it awake until the bucket ends, and
+// remembers the prediction to evaluate once the bucket is over
+func (p *Prewarmer) predict(ctx context.Context,
+	serviceName string,
+	bucket time.Time,
+	scaleEvents []accounting.ScaleEvent,
+	now time.Time) {
+
+	probability := Predict(scaleEvents, bucket, p.options.Predictor, p.options.LeadTime.Duration)
+	predicted := p.options.Predictor.likely(probability)
+
+	p.lock.Lock()
+	p.predictions = append(p.predictions, prediction{
+		serviceName: serviceName,
+		bucket:      bucket,
+		probability: probability,
+		predicted:   predicted,
+	})
+	p.lock.Unlock()
+
+	if !predicted {
+		p.logger.DebugWith("Service isn't likely to be used in the bucket, not prewarming",
+			"services", []string{serviceName},
+			"bucket", bucket,
+			"probability", probability)
+		return
+	}
+
+	p.logger.InfoWith("Prewarming service predicted to be used",
+		"services", []string{serviceName},
+		"bucket", bucket,
+		"probability", probability)
+
+	bucketEnd := bucket.Add(p.options.Predictor.BucketDuration.Duration)
+	go p.prewarm(ctx, serviceName, resourcescaler.PredictionTrigger, bucketEnd.Sub(now))
+}
+
+// evaluatePredictions counts the outcome of every prediction whose bucket is over, and logs the accuracy so far
+// every accuracy log interval
+func (p *Prewarmer) evaluatePredictions(scaleEvents map[string][]accounting.ScaleEvent, now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pendingPredictions := p.predictions[:0]
+	for _, pendingPrediction := range p.predictions {
+		bucketEnd := pendingPrediction.bucket.Add(p.options.Predictor.BucketDuration.Duration)
+		if now.Before(bucketEnd.Add(p.options.Predictor.IdleTolerance.Duration)) {
+			pendingPredictions = append(pendingPredictions, pendingPrediction)
+			continue
+		}
+
+		accessed := Accessed(scaleEvents[pendingPrediction.serviceName],
+			pendingPrediction.bucket,
+			p.options.Predictor,
+			p.options.LeadTime.Duration)
+		outcome := p.accuracy.Add(pendingPrediction.predicted, accessed)
+		predictionOutcomesCounter.WithLabelValues(outcome).Inc()
+
+		p.logger.DebugWith("Evaluated prediction",
+			"services", []string{pendingPrediction.serviceName},
+			"bucket", pendingPrediction.bucket,
+			"probability", pendingPrediction.probability,
+			"accessed", accessed,
+			"outcome", outcome)
+	}
+	p.predictions = pendingPredictions
+
+	if p.accuracy.Total() == 0 || now.Sub(p.accuracyLoggedAt) < p.options.Predictor.AccuracyLogInterval.Duration {
+		return
+	}
+
+	p.logger.InfoWith("Prediction accuracy",
+		"evaluated", p.accuracy.Total(),
+		"truePositives", p.accuracy.TruePositives,
+		"falsePositives", p.accuracy.FalsePositives,
+		"falseNegatives", p.accuracy.FalseNegatives,
+		"trueNegatives", p.accuracy.TrueNegatives,
+		"precision", p.accuracy.Precision(),
+		"recall", p.accuracy.Recall())
+	p.accuracyLoggedAt = now
+}
+
+func (p *Prewarmer) hasPendingPredictions() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.predictions) > 0
+}
+
+// lookbackDays returns how many previous days of scale events a check needs
+func (p *Prewarmer) lookbackDays() int {
+	lookbackDays := 0
+	if p.options.Enabled {
+		lookbackDays = p.options.LookbackDays
+	}
+
+	if p.options.Predictor.Enabled && p.options.Predictor.LookbackDays > lookbackDays {
+		lookbackDays = p.options.Predictor.LookbackDays
+	}
+
+	return lookbackDays
+}
+
+// serviceLocation returns the location of the service's own pre-warm timezone, or the global one
+func (p *Prewarmer) serviceLocation(scaledToZeroService resourcescaler.ScaledToZeroService) *time.Location {
+	if scaledToZeroService.Prewarm != nil && scaledToZeroService.Prewarm.Timezone != "" {
+
+		// validated when parsing the service spec
+		if location, err := time.LoadLocation(scaledToZeroService.Prewarm.Timezone); err == nil {
+			return location
+		}
+	}
+
+	return p.location
+}
+
+func (p *Prewarmer) prewarm(ctx context.Context, serviceName string, trigger string, gracePeriod time.Duration) {
+	prewarmCtx, cancel := context.WithTimeout(resourcescaler.WithTrigger(ctx, trigger), p.prewarmTimeout)
+	defer cancel()
+
+	if err := p.serviceWaker.PrewarmService(prewarmCtx, serviceName, gracePeriod); err != nil {
+		p.logger.WarnWith("Failed to prewarm service",
+			"services", []string{serviceName},
+			"trigger", trigger,
+			"err", errors.GetErrorStackString(err, 10))
+	}
+}
+
+// nextSlot returns the scheduled slot starting within the lead time from now, if any
+func nextSlot(schedule []string, location *time.Location, now time.Time, leadTime time.Duration) (time.Time, bool) {
+	localNow := now.In(location)
+	for _, dayOffset := range []int{0, 1} {
+		for _, timeOfDay := range schedule {
+			offset, err := resourcescaler.ParseTimeOfDay(timeOfDay)
+			if err != nil {
+				continue
+			}
+
+			slot := time.Date(localNow.Year(),
+				localNow.Month(),
+				localNow.Day()+dayOffset,
+				int(offset/time.Hour),
+				int(offset%time.Hour/time.Minute),
+				0,
+				0,
+				location)
+
+			if !now.Before(slot.Add(-leadTime)) && now.Before(slot) {
+				return slot, true
+			}
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// UsedDays returns on how many of the lookback days before the slot's day the service was used in the same slot.
+// A service was used in a slot if it was scaled from zero during it other than by a pre-warm, scheduled or
+// predicted, or was woken up other than by a pre-warm before it and wasn't scaled to zero before it ended. Being kept
+// awake by a pre-warm doesn't count, or pre-warming would keep a service's used days up on its own. scaleEvents must
+// be sorted oldest first
+func UsedDays(scaleEvents []accounting.ScaleEvent, slot time.Time, slotDuration time.Duration, lookbackDays int) int {
+	usedDays := 0
+	for day := 1; day <= lookbackDays; day++ {
+		slotStart := slot.AddDate(0, 0, -day)
+		if usedInSlot(scaleEvents, slotStart, slotStart.Add(slotDuration)) {
+			usedDays++
+		}
+	}
+
+	return usedDays
+}
+
+func usedInSlot(scaleEvents []accounting.ScaleEvent, slotStart time.Time, slotEnd time.Time) bool {
+
+	// whether the service is awake, woken up other than by a pre-warm
+	awake := false
+	for _, scaleEvent := range scaleEvents {
+		if scaleEvent.Time.Before(slotStart) {
+			awake = scaleEvent.Type == accounting.ScaledFromZeroEventType && !isPrewarm(scaleEvent.Trigger)
+			continue
+		}
+
+		if !scaleEvent.Time.Before(slotEnd) {
+			break
+		}
+
+		switch scaleEvent.Type {
+		case accounting.ScaledFromZeroEventType:
+			if !isPrewarm(scaleEvent.Trigger) {
+				return true
+			}
+		case accounting.ScaledToZeroEventType:
+			awake = false
+		}
+	}
+
+	return awake
+}
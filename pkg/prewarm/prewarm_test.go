@@ -0,0 +1,269 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package prewarm
+
+import (
+	"context"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/accounting"
+	"github.com/v3io/app-resource-scaler/pkg/resourcescaler"
+
+	nucliozap "github.com/nuclio/zap"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// fakeServiceWaker serves fixed services and scale events, recording the services it's asked to pre-warm
+type fakeServiceWaker struct {
+	scaledToZeroServices []resourcescaler.ScaledToZeroService
+	scaleEvents          map[string][]accounting.ScaleEvent
+	prewarming           chan string
+}
+
+func (w *fakeServiceWaker) GetScaledToZeroServices(ctx context.Context) ([]resourcescaler.ScaledToZeroService, error) {
+	return w.scaledToZeroServices, nil
+}
+
+func (w *fakeServiceWaker) PrewarmService(ctx context.Context, serviceName string, gracePeriod time.Duration) error {
+	w.prewarming <- serviceName
+	return nil
+}
+
+func (w *fakeServiceWaker) ScaleEvents(ctx context.Context,
+	from time.Time,
+	to time.Time) (map[string][]accounting.ScaleEvent, error) {
+	return w.scaleEvents, nil
+}
+
+func shiftScaleEvents(scaleEvents []accounting.ScaleEvent, offset time.Duration) []accounting.ScaleEvent {
+	for scaleEventIndex := range scaleEvents {
+		scaleEvents[scaleEventIndex].Time = scaleEvents[scaleEventIndex].Time.Add(offset)
+	}
+
+	return scaleEvents
+}
+
+// a slot starting at the test bucket, so the predictor tests' histories apply
+var testSlot = testBucketStart
+
+func TestNextSlot(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("Failed to load location: %v", err)
+	}
+
+	for _, testCase := range []struct {
+		name          string
+		schedule      []string
+		location      *time.Location
+		now           time.Time
+		expectedSlot  time.Time
+		expectedFound bool
+	}{
+		{name: "within the lead time",
+			schedule:      []string{"08:00", "09:00"},
+			location:      time.UTC,
+			now:           testSlot.Add(-5 * time.Minute),
+			expectedSlot:  testSlot,
+			expectedFound: true},
+		{name: "before the lead time",
+			schedule: []string{"09:00"},
+			location: time.UTC,
+			now:      testSlot.Add(-11 * time.Minute)},
+		{name: "at the slot start",
+			schedule: []string{"09:00"},
+			location: time.UTC,
+			now:      testSlot},
+		{name: "across midnight",
+			schedule:      []string{"00:05"},
+			location:      time.UTC,
+			now:           time.Date(2024, 5, 15, 23, 58, 0, 0, time.UTC),
+			expectedSlot:  time.Date(2024, 5, 16, 0, 5, 0, 0, time.UTC),
+			expectedFound: true},
+		{name: "in the schedule's location",
+			schedule:      []string{"11:00"},
+			location:      berlin,
+			now:           testSlot.Add(-5 * time.Minute),
+			expectedSlot:  time.Date(2024, 5, 15, 11, 0, 0, 0, berlin),
+			expectedFound: true},
+		{name: "invalid times are skipped",
+			schedule:      []string{"9am", "09:00"},
+			location:      time.UTC,
+			now:           testSlot.Add(-5 * time.Minute),
+			expectedSlot:  testSlot,
+			expectedFound: true},
+		{name: "empty schedule", location: time.UTC, now: testSlot.Add(-5 * time.Minute)},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			slot, found := nextSlot(testCase.schedule, testCase.location, testCase.now, 10*time.Minute)
+			if found != testCase.expectedFound || !slot.Equal(testCase.expectedSlot) {
+				t.Fatalf("Expected %s and %t, got %s and %t", testCase.expectedSlot, testCase.expectedFound, slot, found)
+			}
+		})
+	}
+}
+
+func TestUsedDays(t *testing.T) {
+	scaleEvent := func(day int, offset time.Duration, eventType string, trigger string) accounting.ScaleEvent {
+		return accounting.ScaleEvent{
+			Time:    testSlot.AddDate(0, 0, -day).Add(offset),
+			Type:    eventType,
+			Trigger: trigger,
+		}
+	}
+
+	for _, testCase := range []struct {
+		name             string
+		scaleEvents      []accounting.ScaleEvent
+		expectedUsedDays int
+	}{
+		{name: "used by requests", scaleEvents: usedOnDaysBefore(1, 2, 3), expectedUsedDays: 3},
+		{name: "used beyond the lookback days", scaleEvents: usedOnDaysBefore(1, 8), expectedUsedDays: 1},
+		{name: "used on the slot's day", scaleEvents: usedOnDaysBefore(0), expectedUsedDays: 0},
+		{name: "woken after the slot",
+			scaleEvents: []accounting.ScaleEvent{
+				scaleEvent(1, time.Hour, accounting.ScaledFromZeroEventType, resourcescaler.DLXTrigger),
+			}},
+		{name: "pre-warmed but not used",
+			scaleEvents: []accounting.ScaleEvent{
+				scaleEvent(1, -10*time.Minute, accounting.ScaledFromZeroEventType, resourcescaler.PrewarmTrigger),
+				scaleEvent(1, 50*time.Minute, accounting.ScaledToZeroEventType, resourcescaler.AutoScalerTrigger),
+				scaleEvent(2, 5*time.Minute, accounting.ScaledFromZeroEventType, resourcescaler.PredictionTrigger),
+				scaleEvent(2, 20*time.Minute, accounting.ScaledToZeroEventType, resourcescaler.AutoScalerTrigger),
+			}},
+		{name: "pre-warmed and kept awake through the slot",
+			scaleEvents: []accounting.ScaleEvent{
+				scaleEvent(1, -10*time.Minute, accounting.ScaledFromZeroEventType, resourcescaler.PrewarmTrigger),
+				scaleEvent(2, -10*time.Minute, accounting.ScaledFromZeroEventType, resourcescaler.PrewarmTrigger),
+				scaleEvent(2, 2*time.Hour, accounting.ScaledToZeroEventType, resourcescaler.AutoScalerTrigger),
+			}},
+		{name: "woken by a request and kept awake through the slot",
+			scaleEvents: []accounting.ScaleEvent{
+				scaleEvent(1, -2*time.Hour, accounting.ScaledFromZeroEventType, resourcescaler.DLXTrigger),
+			},
+			expectedUsedDays: 1},
+		{name: "awake before the slot and scaled to zero during it",
+			scaleEvents: []accounting.ScaleEvent{
+				scaleEvent(1, -2*time.Hour, accounting.ScaledFromZeroEventType, resourcescaler.DLXTrigger),
+				scaleEvent(1, 30*time.Minute, accounting.ScaledToZeroEventType, resourcescaler.AutoScalerTrigger),
+			}},
+		{name: "scaled to zero and woken by a request during the slot",
+			scaleEvents: []accounting.ScaleEvent{
+				scaleEvent(1, -2*time.Hour, accounting.ScaledFromZeroEventType, resourcescaler.DLXTrigger),
+				scaleEvent(1, 10*time.Minute, accounting.ScaledToZeroEventType, resourcescaler.AutoScalerTrigger),
+				scaleEvent(1, 20*time.Minute, accounting.ScaledFromZeroEventType, resourcescaler.DLXTrigger),
+				scaleEvent(1, 30*time.Minute, accounting.ScaledToZeroEventType, resourcescaler.AutoScalerTrigger),
+			},
+			expectedUsedDays: 1},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			sort.Slice(testCase.scaleEvents, func(i, j int) bool {
+				return testCase.scaleEvents[i].Time.Before(testCase.scaleEvents[j].Time)
+			})
+
+			if usedDays := UsedDays(testCase.scaleEvents, testSlot, time.Hour, 7); usedDays != testCase.expectedUsedDays {
+				t.Fatalf("Expected %d used days, got %d", testCase.expectedUsedDays, usedDays)
+			}
+		})
+	}
+}
+
+func TestCheckSchedule(t *testing.T) {
+	loggerInstance, err := nucliozap.NewNuclioZap("test", "console", nil, os.Stdout, os.Stderr, nucliozap.DebugLevel)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	serviceWaker := &fakeServiceWaker{
+		scaledToZeroServices: []resourcescaler.ScaledToZeroService{
+			{Name: "jupyter"},
+			{Name: "spark"},
+			{Name: "mlflow"},
+
+			// opted out of the global schedule
+			{Name: "zeppelin", Prewarm: &resourcescaler.PrewarmSpec{Schedule: []string{}}},
+
+			// scheduled an hour later than the global schedule
+			{Name: "presto", Prewarm: &resourcescaler.PrewarmSpec{Schedule: []string{"10:00"}}},
+		},
+		scaleEvents: map[string][]accounting.ScaleEvent{
+			"jupyter":  usedOnDaysBefore(1, 2),
+			"spark":    usedOnDaysBefore(3),
+			"zeppelin": usedOnDaysBefore(1, 2),
+			"presto":   shiftScaleEvents(usedOnDaysBefore(1, 2), time.Hour),
+		},
+		prewarming: make(chan string, 5),
+	}
+
+	options := NewDefaultOptions()
+	options.Enabled = true
+	options.Schedule = []string{"09:00"}
+	options.MinUsedDays = 2
+	options.GracePeriod = scalertypes.Duration{Duration: 30 * time.Minute}
+
+	prewarmer, err := NewPrewarmer(loggerInstance, serviceWaker, options, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create prewarmer: %v", err)
+	}
+
+	for _, now := range []time.Time{
+		testSlot.Add(-5 * time.Minute),
+
+		// each slot is evaluated once
+		testSlot.Add(-time.Minute),
+	} {
+		if err := prewarmer.Check(context.Background(), now); err != nil {
+			t.Fatalf("Failed to check: %v", err)
+		}
+	}
+
+	select {
+	case serviceName := <-serviceWaker.prewarming:
+		if serviceName != "jupyter" {
+			t.Fatalf("Expected jupyter to be prewarmed, got %s", serviceName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for jupyter to be prewarmed")
+	}
+
+	// presto's own slot is due an hour later
+	if err := prewarmer.Check(context.Background(), testSlot.Add(55*time.Minute)); err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+
+	select {
+	case serviceName := <-serviceWaker.prewarming:
+		if serviceName != "presto" {
+			t.Fatalf("Expected presto to be prewarmed, got %s", serviceName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for presto to be prewarmed")
+	}
+
+	select {
+	case serviceName := <-serviceWaker.prewarming:
+		t.Fatalf("Expected no other service to be prewarmed, got %s", serviceName)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
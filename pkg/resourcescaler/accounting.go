@@ -0,0 +1,161 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/accounting"
+
+	"github.com/nuclio/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// the time accounting writes get, past the deadline of the scale operation they follow
+const accountingTimeout = 30 * time.Second
+
+// ErrAccountingDisabled is returned by reports when no ledger was set
+var ErrAccountingDisabled = errors.New("Accounting is disabled")
+
+// SetLedger sets the ledger the time services spend scaled to zero is recorded in. Must be called before use
+func (s *AppResourceScaler) SetLedger(ledger *accounting.Ledger) {
+	s.ledger = ledger
+}
+
+// Report returns the time services spent scaled to zero and the resources freed meanwhile, between the given days
+func (s *AppResourceScaler) Report(ctx context.Context,
+	from time.Time,
+	to time.Time,
+	serviceName string) (*accounting.Report, error) {
+	if s.ledger == nil {
+		return nil, ErrAccountingDisabled
+	}
+
+	return s.ledger.Report(ctx, from, to, serviceName)
+}
+
+// recordSleep records services that were just scaled to zero, with the resources their spec requests
+func (s *AppResourceScaler) recordSleep(ctx context.Context,
+	serviceSet *iguazioTenantAppServiceSet,
+	serviceNames []string) {
+	if s.ledger == nil {
+		return
+	}
+
+	services := map[string]accounting.Resources{}
+	for _, serviceName := range serviceNames {
+		resources, err := parseServiceResources(serviceSet.specServices[serviceName])
+		if err != nil {
+			s.logger.WarnWithCtx(ctx, "Failed parsing the service resources, accounting for none", s.operationLogVars(ctx,
+				"services", []string{serviceName},
+				"err", errors.GetErrorStackString(err, 10))...)
+		}
+
+		services[serviceName] = resources
+	}
+
+	accountingCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), accountingTimeout)
+	defer cancel()
+
+	if err := s.ledger.RecordSleep(accountingCtx, services, time.Now(), GetTrigger(ctx)); err != nil {
+		s.logger.WarnWithCtx(ctx, "Failed to record services scaled to zero", s.operationLogVars(ctx,
+			"services", serviceNames,
+			"err", errors.GetErrorStackString(err, 10))...)
+	}
+}
+
+// recordWake records services that are being scaled from zero
+func (s *AppResourceScaler) recordWake(ctx context.Context, serviceNames []string) {
+	if s.ledger == nil {
+		return
+	}
+
+	accountingCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), accountingTimeout)
+	defer cancel()
+
+	if err := s.ledger.RecordWake(accountingCtx, serviceNames, time.Now(), GetTrigger(ctx)); err != nil {
+		s.logger.WarnWithCtx(ctx, "Failed to record services scaled from zero", s.operationLogVars(ctx,
+			"services", serviceNames,
+			"err", errors.GetErrorStackString(err, 10))...)
+	}
+}
+
+// parseServiceResources parses the resources a service spec requests, under resources.requests. GPUs, which are
+// only set as limits in Kubernetes, are read from resources.limits too
+func parseServiceResources(serviceSpecInterface interface{}) (accounting.Resources, error) {
+	resources := accounting.Resources{}
+
+	serviceSpec, ok := serviceSpecInterface.(map[string]interface{})
+	if !ok {
+		return resources, errors.New("Service spec type assertion failed")
+	}
+
+	resourcesSpec, ok := serviceSpec["resources"].(map[string]interface{})
+	if !ok {
+		return resources, nil
+	}
+
+	requests, _ := resourcesSpec["requests"].(map[string]interface{})
+	limits, _ := resourcesSpec["limits"].(map[string]interface{})
+
+	if cpu, err := parseResourceQuantity(requests, "cpu"); err != nil {
+		return resources, errors.Wrap(err, "Failed to parse cpu request")
+	} else if cpu != nil {
+		resources.CPU = float64(cpu.MilliValue()) / 1000
+	}
+
+	if memory, err := parseResourceQuantity(requests, "memory"); err != nil {
+		return resources, errors.Wrap(err, "Failed to parse memory request")
+	} else if memory != nil {
+		resources.MemoryBytes = memory.Value()
+	}
+
+	for _, gpuResources := range []map[string]interface{}{requests, limits} {
+		if gpu, err := parseResourceQuantity(gpuResources, "nvidia.com/gpu"); err != nil {
+			return resources, errors.Wrap(err, "Failed to parse gpu request")
+		} else if gpu != nil {
+			resources.GPU = float64(gpu.MilliValue()) / 1000
+			break
+		}
+	}
+
+	return resources, nil
+}
+
+// parseResourceQuantity parses a Kubernetes quantity, given as a string or a number. A nil result with no error
+// means the resource isn't set
+func parseResourceQuantity(resources map[string]interface{}, name string) (*resource.Quantity, error) {
+	switch value := resources[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, err
+		}
+		return &quantity, nil
+	case float64:
+		return resource.NewMilliQuantity(int64(value*1000), resource.DecimalSI), nil
+	default:
+		return nil, errors.Errorf("Unexpected %s quantity type: %T", name, value)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/v3io/app-resource-scaler/pkg/audit"
+
+	"github.com/nuclio/errors"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// auditPatch records a patch of the service set in the audit log. patchedServiceSetBody is the patched object
+// returned by the api server, and is ignored if the patch failed. Mutations coalesced into the patch are recorded
+// in entries of their own, under their own operations
+func (s *AppResourceScaler) auditPatch(ctx context.Context,
+	serviceNames []string,
+	scaleEvent scalertypes.ScaleEvent,
+	patch []byte,
+	serviceSetBefore *iguazioTenantAppServiceSet,
+	patchedServiceSetBody []byte,
+	patchErr error,
+	coalescedMutations []*mutation) {
+
+	if s.auditLog == nil {
+		return
+	}
+
+	serviceSetAfter := &iguazioTenantAppServiceSet{}
+	if patchErr == nil {
+		if parsedServiceSet, err := s.parseIguazioTenantAppServiceSet(patchedServiceSetBody); err != nil {
+			s.logger.WarnWithCtx(ctx, "Failed to parse patched service set for the audit log", s.operationLogVars(ctx,
+				"err", errors.GetErrorStackString(err, 10))...)
+		} else {
+			serviceSetAfter = parsedServiceSet
+		}
+	}
+
+	newEntry := func(operationID string, trigger string, serviceNames []string) *audit.Entry {
+		entry := &audit.Entry{
+			OperationID:           operationID,
+			Namespace:             s.namespace,
+			Trigger:               trigger,
+			Services:              serviceNames,
+			ScaleEvent:            string(scaleEvent),
+			Patch:                 json.RawMessage(patch),
+			ResourceVersionBefore: serviceSetBefore.resourceVersion,
+			ResourceVersionAfter:  serviceSetAfter.resourceVersion,
+			Changes:               map[string]audit.ServiceChange{},
+			Outcome:               audit.SucceededOutcome,
+		}
+
+		if patchErr != nil {
+			entry.Outcome = audit.FailedOutcome
+			entry.Error = errors.RootCause(patchErr).Error()
+		}
+
+		for _, serviceName := range serviceNames {
+			entry.Changes[serviceName] = audit.ServiceChange{
+				DesiredStateBefore: getServiceDesiredState(serviceSetBefore.specServices[serviceName]),
+				DesiredStateAfter:  getServiceDesiredState(serviceSetAfter.specServices[serviceName]),
+				StatusStateBefore:  getServiceStatusState(serviceSetBefore.statusServices[serviceName]),
+				StatusStateAfter:   getServiceStatusState(serviceSetAfter.statusServices[serviceName]),
+			}
+		}
+
+		return entry
+	}
+
+	entries := []*audit.Entry{newEntry(GetOperationID(ctx), GetTrigger(ctx), serviceNames)}
+	for _, coalescedMutation := range coalescedMutations {
+		entry := newEntry(coalescedMutation.operationID, coalescedMutation.trigger, coalescedMutation.serviceNames)
+		entry.CoalescedInto = GetOperationID(ctx)
+		entries = append(entries, entry)
+	}
+
+	for _, entry := range entries {
+		if err := s.auditLog.Write(entry); err != nil {
+			s.logger.ErrorWithCtx(ctx, "Failed to write audit log entry", s.operationLogVars(ctx,
+				"services", entry.Services,
+				"err", errors.GetErrorStackString(err, 10))...)
+		}
+	}
+}
+
+func getServiceDesiredState(serviceSpec interface{}) string {
+	serviceSpecMap, _ := serviceSpec.(map[string]interface{})
+	desiredState, _ := serviceSpecMap["desired_state"].(string)
+	return desiredState
+}
+
+func getServiceStatusState(serviceStatus interface{}) string {
+	serviceStatusMap, _ := serviceStatus.(map[string]interface{})
+	state, _ := serviceStatusMap["state"].(string)
+	return state
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/audit"
+
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+func TestAuditCoalescedMutations(t *testing.T) {
+	serviceSetAPI := newFakeServiceSetAPI(newServiceSetBody(map[string]interface{}{
+		"jupyter": map[string]interface{}{"desired_state": "ready"},
+		"spark":   map[string]interface{}{"desired_state": "ready"},
+	}, map[string]string{"jupyter": "ready", "spark": "ready"}))
+
+	// hold the first mutation's wait for provisioning until the second is queued behind it
+	reading := make(chan struct{})
+	queued := make(chan struct{})
+	var readOnce sync.Once
+	serviceSetAPI.beforeRead = func() {
+		readOnce.Do(func() {
+			close(reading)
+			<-queued
+		})
+	}
+
+	options := NewDefaultOptions()
+	options.ProvisioningPollInterval = scalertypes.Duration{Duration: time.Millisecond}
+	resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, options)
+	auditLogBuffer := &bytes.Buffer{}
+	resourceScaler.auditLog = audit.NewLogWithWriter(auditLogBuffer)
+
+	patch := func(ctx context.Context, serviceName string) error {
+		return resourceScaler.patchIguazioTenantAppServiceSets(ctx,
+			"default-tenant",
+			[]string{serviceName},
+			scalertypes.ScaleToZeroStartedScaleEvent,
+			[]map[string]interface{}{{
+				"op":    "add",
+				"path":  "/spec/spec/tenants/0/spec/services/" + serviceName + "/desired_state",
+				"value": "scaledToZero",
+			}},
+			scaleToZeroProvisioningState)
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- patch(WithTrigger(WithOperationID(context.Background(), "first"), AutoScalerTrigger), "jupyter")
+	}()
+	<-reading
+
+	go func() {
+		errs <- patch(WithTrigger(WithOperationID(context.Background(), "second"), APITrigger), "spark")
+	}()
+	for {
+		resourceScaler.mutationQueue.lock.Lock()
+		pending := len(resourceScaler.mutationQueue.pending)
+		resourceScaler.mutationQueue.lock.Unlock()
+		if pending == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(queued)
+
+	for range []int{0, 1} {
+		if err := <-errs; err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if len(serviceSetAPI.patches) != 1 {
+		t.Fatalf("Expected a single coalesced patch, got %d", len(serviceSetAPI.patches))
+	}
+
+	var entries []audit.Entry
+	for _, line := range strings.Split(strings.TrimSpace(auditLogBuffer.String()), "\n") {
+		entry := audit.Entry{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Failed to unmarshal audit log entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("Expected an audit log entry per mutation, got %d", len(entries))
+	}
+
+	for entryIndex, expectedEntry := range []audit.Entry{
+		{OperationID: "first", Trigger: AutoScalerTrigger, Services: []string{"jupyter"}},
+		{OperationID: "second", Trigger: APITrigger, Services: []string{"spark"}, CoalescedInto: "first"},
+	} {
+		entry := entries[entryIndex]
+		if entry.OperationID != expectedEntry.OperationID ||
+			entry.Trigger != expectedEntry.Trigger ||
+			entry.CoalescedInto != expectedEntry.CoalescedInto ||
+			len(entry.Services) != 1 ||
+			entry.Services[0] != expectedEntry.Services[0] ||
+			entry.Outcome != audit.SucceededOutcome {
+			t.Fatalf("Expected entry %+v, got %+v", expectedEntry, entry)
+		}
+
+		if _, found := entry.Changes[expectedEntry.Services[0]]; !found || len(entry.Changes) != 1 {
+			t.Fatalf("Expected only the changes of %s, got %v", expectedEntry.Services[0], entry.Changes)
+		}
+
+		if !bytes.Equal(entry.Patch, entries[0].Patch) {
+			t.Fatalf("Expected the coalesced patch in every entry")
+		}
+	}
+}
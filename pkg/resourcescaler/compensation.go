@@ -0,0 +1,224 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nuclio/errors"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// policies for services that didn't become ready before a scale from zero timed out
+const (
+
+	// leave the service set as is, waiting for the provisioning to finish
+	NoneTimeoutPolicy = "none"
+
+	// scale the services back to zero, so the next request starts a new scale from zero
+	RevertTimeoutPolicy = "revert"
+
+	// keep the services' desired state, but reset the service set's provisioning state so it isn't left
+	// waiting for the scale from zero
+	ResetStateTimeoutPolicy = "resetState"
+
+	// leave the services as they are, and record the failure in their scale to zero status
+	MarkFailedTimeoutPolicy = "markFailed"
+)
+
+// the timeout of compensating, since the operation's own deadline has already passed
+const compensationTimeout = time.Minute
+
+// scaleFromZeroStageDone reports whether a service completed the stage of a scale from zero that timed out, in the
+// service set read when compensating, e.g. whether it's ready by now
+type scaleFromZeroStageDone func(serviceSet *iguazioTenantAppServiceSet, serviceName string) bool
+
+// isServiceReady is the scaleFromZeroStageDone of waiting for services to be ready
+func isServiceReady(serviceSet *iguazioTenantAppServiceSet, serviceName string) bool {
+	return getServiceStatusState(serviceSet.statusServices[serviceName]) == "ready"
+}
+
+// compensateScaleFromZeroTimeout applies the scale from zero timeout policy to the services that didn't complete
+// the stage that timed out, if it's the operation's deadline that passed. A nil stageDone means none of them did.
+// Failing to compensate is logged, the caller already fails on the timeout
+func (s *AppResourceScaler) compensateScaleFromZeroTimeout(ctx context.Context,
+	serviceNames []string,
+	stageDone scaleFromZeroStageDone) {
+
+	policy := s.getOptions().ScaleFromZeroTimeoutPolicy
+	if policy == NoneTimeoutPolicy || ctx.Err() != context.DeadlineExceeded {
+		return
+	}
+
+	compensationCtx, cancelFunc := context.WithTimeout(context.WithoutCancel(ctx), compensationTimeout)
+	defer cancelFunc()
+
+	if err := s.compensate(compensationCtx, policy, serviceNames, stageDone); err != nil {
+		s.logger.ErrorWithCtx(ctx, "Failed to compensate scale from zero timeout", s.operationLogVars(ctx,
+			"services", serviceNames,
+			"policy", policy,
+			"err", errors.GetErrorStackString(err, 10))...)
+	}
+}
+
+func (s *AppResourceScaler) compensate(ctx context.Context,
+	policy string,
+	serviceNames []string,
+	stageDone scaleFromZeroStageDone) error {
+
+	// take a turn like any other mutation, as a scale from zero of the services
+	mutationCtx, mutation, err := s.mutationQueue.acquire(ctx,
+		scalertypes.ScaleFromZeroStartedScaleEvent,
+		serviceNames,
+		nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed waiting for turn to patch IguazioTenantAppServiceSet")
+	}
+	defer s.mutationQueue.release(mutation)
+	ctx = mutationCtx
+
+	serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get iguazio tenant app service sets")
+	}
+
+	var timedOutServiceNames []string
+	for _, serviceName := range serviceNames {
+		if stageDone == nil || !stageDone(serviceSet, serviceName) {
+			timedOutServiceNames = append(timedOutServiceNames, serviceName)
+		}
+	}
+
+	if len(timedOutServiceNames) == 0 {
+		return nil
+	}
+
+	s.logger.WarnWithCtx(ctx, "Compensating scale from zero timeout", s.operationLogVars(ctx,
+		"services", timedOutServiceNames,
+		"policy", policy)...)
+
+	marshaledTime, err := time.Now().MarshalText()
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal time")
+	}
+
+	var jsonPatchMapper []map[string]interface{}
+	var scaleEvent scalertypes.ScaleEvent
+
+	switch policy {
+	case RevertTimeoutPolicy:
+		scaleEvent = scalertypes.ScaleToZeroStartedScaleEvent
+		for _, serviceName := range timedOutServiceNames {
+			jsonPatchMapper, err = s.appendServiceStateChangeJSONPatchOperations(jsonPatchMapper,
+				serviceName,
+				"scaledToZero",
+				false,
+				scaleEvent,
+				marshaledTime)
+			if err != nil {
+				return errors.Wrap(err, "Failed appending service state change json patch operations")
+			}
+		}
+
+		// as with resetting the state below, only the scaler's own waiting state is replaced, and the provisioner
+		// picks the reverted desired state up once it's done with its own
+		if serviceSet.state == string(scaleFromZeroProvisioningState) {
+			jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
+				"op":    "test",
+				"path":  "/status/state",
+				"value": serviceSet.state,
+			})
+			jsonPatchMapper = appendProvisioningStateJSONPatchOperations(jsonPatchMapper,
+				scaleToZeroProvisioningState,
+				marshaledTime)
+			jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
+				"op":    "add",
+				"path":  "/spec/spec/tenants/0/spec/force_apply_all_mode",
+				"value": "disabled",
+			})
+		} else {
+			s.logger.InfoWithCtx(ctx, "Service set isn't waiting for the scale from zero, leaving its state",
+				s.operationLogVars(ctx, "state", serviceSet.state)...)
+		}
+
+	case ResetStateTimeoutPolicy:
+
+		// the services are still desired to be ready, so keep the autoscaler from scaling them right back to zero
+		scaleEvent = scalertypes.ResourceUpdatedScaleEvent
+		for _, serviceName := range timedOutServiceNames {
+			jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
+				"op":   "add",
+				"path": fmt.Sprintf("/status/services/%s/scale_to_zero", serviceName),
+				"value": map[string]interface{}{
+					"last_scale_event":      string(scaleEvent),
+					"last_scale_event_time": string(marshaledTime),
+				},
+			})
+		}
+
+		// only the scaler's own waiting state is reset. Any other state is either done or the provisioner's, which
+		// is mid-flight and sets the state itself when done. The test keeps the provisioner from having taken the
+		// state over since it was read
+		if serviceSet.state == string(scaleFromZeroProvisioningState) {
+			jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
+				"op":    "test",
+				"path":  "/status/state",
+				"value": serviceSet.state,
+			}, map[string]interface{}{
+				"op":    "add",
+				"path":  "/status/state",
+				"value": "ready",
+			})
+		} else {
+			s.logger.InfoWithCtx(ctx, "Service set isn't waiting for the scale from zero, leaving its state",
+				s.operationLogVars(ctx, "state", serviceSet.state)...)
+		}
+
+	case MarkFailedTimeoutPolicy:
+
+		// the last scale event stays scaleFromZeroStarted, the failure is recorded next to it
+		scaleEvent = scalertypes.ScaleFromZeroStartedScaleEvent
+		for _, serviceName := range timedOutServiceNames {
+			jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
+				"op":   "add",
+				"path": fmt.Sprintf("/status/services/%s/scale_to_zero/last_failure", serviceName),
+				"value": map[string]interface{}{
+					"scale_event": string(scaleEvent),
+					"time":        string(marshaledTime),
+					"reason":      "Timed out waiting for the service to become ready",
+				},
+			})
+		}
+
+	default:
+		return errors.Errorf("Unknown scale from zero timeout policy: %s", policy)
+	}
+
+	// the service set is most likely still provisioning the scale from zero, so don't wait for it
+	return s.sendUnqueuedPatch(ctx,
+		s.namespace,
+		timedOutServiceNames,
+		scaleEvent,
+		jsonPatchMapper,
+		serviceSet)
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// newCompensationServiceSetBody returns a service set in the given state, in which jupyter was left scaling from
+// zero and spark is ready
+func newCompensationServiceSetBody(tb testing.TB, state string) []byte {
+	body := newServiceSetBody(map[string]interface{}{
+		"jupyter": map[string]interface{}{"desired_state": "ready"},
+		"spark":   map[string]interface{}{"desired_state": "ready"},
+	}, map[string]string{"jupyter": "scaledToZero", "spark": "ready"})
+
+	body, err := applyJSONPatch(body, []byte(`[
+		{"op": "add", "path": "/status/state", "value": "`+state+`"},
+		{"op": "add", "path": "/status/services/jupyter/scale_to_zero", "value": {
+			"last_scale_event": "scaleFromZeroStarted", "last_scale_event_time": "2024-01-01T10:00:00Z"}}
+	]`))
+	if err != nil {
+		tb.Fatalf("Failed to patch service set body: %v", err)
+	}
+
+	return body
+}
+
+func TestCompensationPolicies(t *testing.T) {
+	for _, testCase := range []struct {
+		name           string
+		policy         string
+		state          string
+		expectedValues map[string]interface{}
+	}{
+		{
+			name:   "revert",
+			policy: RevertTimeoutPolicy,
+			state:  string(scaleFromZeroProvisioningState),
+			expectedValues: map[string]interface{}{
+				"/spec/spec/tenants/0/spec/services/jupyter/desired_state": "scaledToZero",
+				"/status/services/jupyter/scale_to_zero/last_scale_event":  "scaleToZeroStarted",
+				"/status/services/jupyter/last_change/changed_by":          ScalerChangedBy,
+				"/status/state": string(scaleToZeroProvisioningState),
+				"/spec/spec/tenants/0/spec/services/spark/desired_state": "ready",
+				"/status/services/spark/scale_to_zero":                   nil,
+			},
+		},
+		{
+			name:   "revert while provisioning",
+			policy: RevertTimeoutPolicy,
+			state:  "provisioning",
+			expectedValues: map[string]interface{}{
+				"/spec/spec/tenants/0/spec/services/jupyter/desired_state": "scaledToZero",
+				"/status/services/jupyter/scale_to_zero/last_scale_event":  "scaleToZeroStarted",
+				"/status/state": "provisioning",
+				"/spec/spec/tenants/0/spec/force_apply_all_mode": nil,
+			},
+		},
+		{
+			name:   "reset state waiting for the scale from zero",
+			policy: ResetStateTimeoutPolicy,
+			state:  string(scaleFromZeroProvisioningState),
+			expectedValues: map[string]interface{}{
+				"/spec/spec/tenants/0/spec/services/jupyter/desired_state": "ready",
+				"/status/services/jupyter/scale_to_zero/last_scale_event":  "resourceUpdated",
+				"/status/state":                        "ready",
+				"/status/services/spark/scale_to_zero": nil,
+			},
+		},
+		{
+			name:   "reset state while provisioning",
+			policy: ResetStateTimeoutPolicy,
+			state:  "provisioning",
+			expectedValues: map[string]interface{}{
+				"/spec/spec/tenants/0/spec/services/jupyter/desired_state": "ready",
+				"/status/services/jupyter/scale_to_zero/last_scale_event":  "resourceUpdated",
+				"/status/state": "provisioning",
+			},
+		},
+		{
+			name:   "mark failed",
+			policy: MarkFailedTimeoutPolicy,
+			state:  string(scaleFromZeroProvisioningState),
+			expectedValues: map[string]interface{}{
+				"/spec/spec/tenants/0/spec/services/jupyter/desired_state":        "ready",
+				"/status/services/jupyter/scale_to_zero/last_scale_event":         "scaleFromZeroStarted",
+				"/status/services/jupyter/scale_to_zero/last_failure/scale_event": "scaleFromZeroStarted",
+				"/status/state":                        string(scaleFromZeroProvisioningState),
+				"/status/services/spark/scale_to_zero": nil,
+			},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			serviceSetAPI := newFakeServiceSetAPI(newCompensationServiceSetBody(t, testCase.state))
+			serviceSetAPI.applyPatches = true
+			resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, NewDefaultOptions())
+
+			if err := resourceScaler.compensate(context.Background(),
+				testCase.policy,
+				[]string{"jupyter", "spark"},
+				isServiceReady); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if patches := serviceSetAPI.patchOperations(t); len(patches) != 1 {
+				t.Fatalf("Expected a single patch, got %d", len(patches))
+			}
+
+			serviceSet := serviceSetAPI.serviceSet(t)
+			for path, expectedValue := range testCase.expectedValues {
+				if value := getJSONPath(serviceSet, path); value != expectedValue {
+					t.Fatalf("Expected %s to be %v, got %v", path, expectedValue, value)
+				}
+			}
+		})
+	}
+}
+
+func TestCompensationOnlyOnDeadline(t *testing.T) {
+	deadlineCtx, cancelFunc := context.WithDeadline(context.Background(), time.Now())
+	defer cancelFunc()
+	cancelledCtx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+
+	for _, testCase := range []struct {
+		name            string
+		ctx             context.Context
+		policy          string
+		expectedPatches int
+	}{
+		{name: "deadline", ctx: deadlineCtx, policy: MarkFailedTimeoutPolicy, expectedPatches: 1},
+		{name: "cancelled", ctx: cancelledCtx, policy: MarkFailedTimeoutPolicy},
+		{name: "none", ctx: deadlineCtx, policy: NoneTimeoutPolicy},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			serviceSetAPI := newFakeServiceSetAPI(newCompensationServiceSetBody(t, "ready"))
+			serviceSetAPI.applyPatches = true
+			options := NewDefaultOptions()
+			options.ScaleFromZeroTimeoutPolicy = testCase.policy
+			resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, options)
+
+			resourceScaler.compensateScaleFromZeroTimeout(testCase.ctx, []string{"jupyter"}, isServiceReady)
+
+			if patches := serviceSetAPI.patchOperations(t); len(patches) != testCase.expectedPatches {
+				t.Fatalf("Expected %d patches, got %d", testCase.expectedPatches, len(patches))
+			}
+		})
+	}
+}
+
+func TestScaleFromZeroCompensatesReplicasTimeout(t *testing.T) {
+	body := newServiceSetBody(map[string]interface{}{
+		"jupyter": map[string]interface{}{"desired_state": "scaledToZero", "replicas": 1},
+	}, map[string]string{"jupyter": "ready"})
+	body, err := applyJSONPatch(body, []byte(`[{"op": "add", "path": "/status/services/jupyter/replicas", "value": 1}]`))
+	if err != nil {
+		t.Fatalf("Failed to patch service set body: %v", err)
+	}
+
+	serviceSetAPI := newFakeServiceSetAPI(body)
+	serviceSetAPI.applyPatches = true
+	options := NewDefaultOptions()
+	options.ProvisioningPollInterval = scalertypes.Duration{Duration: time.Millisecond}
+	options.ServiceStatePollInterval = scalertypes.Duration{Duration: time.Millisecond}
+	options.ScaleFromZeroTimeoutPolicy = MarkFailedTimeoutPolicy
+	resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, options)
+
+	// the service is reported ready, but never reaches the requested replicas
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelFunc()
+	if err := resourceScaler.SetScaleCtx(ctx, []scalertypes.Resource{{Name: "jupyter"}}, 3); err == nil {
+		t.Fatalf("Expected the scale from zero to time out")
+	}
+
+	patches := serviceSetAPI.patchOperations(t)
+	if len(patches) != 2 {
+		t.Fatalf("Expected the scale from zero and the compensation patches, got %d", len(patches))
+	}
+
+	if _, found := findPatchOperation(patches[1],
+		"add",
+		"/status/services/jupyter/scale_to_zero/last_failure"); !found {
+		t.Fatalf("Expected the replicas timeout to be marked as failed, got %v", patches[1])
+	}
+}
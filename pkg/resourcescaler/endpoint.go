@@ -0,0 +1,261 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nuclio/errors"
+	"github.com/v3io/scaler/pkg/scalertypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// the timeout of resolving a service endpoint, which isn't given a context by its callers
+const resolveServiceEndpointTimeout = 30 * time.Second
+
+// ServiceEndpoint is the in-cluster address of an app service. A zero port means the service's port is unknown
+type ServiceEndpoint struct {
+	Host string
+	Port int
+}
+
+// httpURL returns the http url of the endpoint's root, on the default http port if the port is unknown
+func (e ServiceEndpoint) httpURL() string {
+	if e.Port == 0 {
+		return "http://" + e.Host + "/"
+	}
+
+	return "http://" + net.JoinHostPort(e.Host, strconv.Itoa(e.Port)) + "/"
+}
+
+type serviceEndpointCacheEntry struct {
+	endpoint  ServiceEndpoint
+	specHash  [sha256.Size]byte
+	expiresAt time.Time
+}
+
+// serviceEndpointCache caches resolved endpoints until they expire, or the spec of their service changes
+type serviceEndpointCache struct {
+	lock    sync.Mutex
+	entries map[string]serviceEndpointCacheEntry
+}
+
+func (c *serviceEndpointCache) get(serviceName string) (ServiceEndpoint, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, found := c.entries[serviceName]
+	if !found || time.Now().After(entry.expiresAt) {
+		return ServiceEndpoint{}, false
+	}
+
+	return entry.endpoint, true
+}
+
+func (c *serviceEndpointCache) set(serviceName string,
+	serviceSpec interface{},
+	endpoint ServiceEndpoint,
+	ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[string]serviceEndpointCacheEntry{}
+	}
+
+	c.entries[serviceName] = serviceEndpointCacheEntry{
+		endpoint:  endpoint,
+		specHash:  hashServiceSpec(serviceSpec),
+		expiresAt: time.Now().Add(ttl),
+	}
+}
+
+// invalidateChanged drops the entries of services whose spec changed since they were resolved
+func (c *serviceEndpointCache) invalidateChanged(specServices map[string]interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for serviceName, entry := range c.entries {
+		if hashServiceSpec(specServices[serviceName]) != entry.specHash {
+			delete(c.entries, serviceName)
+		}
+	}
+}
+
+// the fields of a service spec its endpoint and routes are derived from. Ports are those of the urls
+var serviceAddressFields = []string{"urls", "ingresses"}
+
+// hashServiceSpec hashes the fields of a service spec its endpoint and routes are derived from, so the scaler's own
+// changes of the service, e.g. of its desired state, don't invalidate them
+func hashServiceSpec(serviceSpec interface{}) [sha256.Size]byte {
+
+	// maps are marshalled with sorted keys, so equal fields hash the same
+	marshalledAddressFields, _ := json.Marshal(getServiceAddressFields(serviceSpec))
+	return sha256.Sum256(marshalledAddressFields)
+}
+
+func getServiceAddressFields(serviceSpec interface{}) map[string]interface{} {
+	serviceSpecMap, _ := serviceSpec.(map[string]interface{})
+	addressFields := map[string]interface{}{}
+	for _, field := range serviceAddressFields {
+		if value, found := serviceSpecMap[field]; found {
+			addressFields[field] = value
+		}
+	}
+
+	return addressFields
+}
+
+// ResolveServiceName returns the host of the app service's Kubernetes service
+func (s *AppResourceScaler) ResolveServiceName(resource scalertypes.Resource) (string, error) {
+	serviceEndpoint, err := s.ResolveServiceEndpoint(resource)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to resolve service endpoint")
+	}
+
+	return serviceEndpoint.Host, nil
+}
+
+// ResolveServiceEndpoint returns the in-cluster endpoint of an app service. It's taken from the first in-cluster
+// http url of the service in the service set, then from the Kubernetes service labeled with the app service's name
+// (if a service label is configured). Otherwise, the app service's name is assumed to be its host
+func (s *AppResourceScaler) ResolveServiceEndpoint(resource scalertypes.Resource) (ServiceEndpoint, error) {
+	if serviceEndpoint, found := s.serviceEndpointCache.get(resource.Name); found {
+		return serviceEndpoint, nil
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), resolveServiceEndpointTimeout)
+	defer cancelFunc()
+
+	serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
+	if err != nil {
+		return ServiceEndpoint{}, errors.Wrap(err, "Failed to get iguazio tenant app service sets")
+	}
+
+	serviceSpec := serviceSet.specServices[resource.Name]
+	serviceEndpoint, found := s.resolveServiceEndpointFromURLs(serviceSpec, serviceSet.statusServices[resource.Name])
+	if !found {
+		serviceEndpoint, found, err = s.resolveServiceEndpointFromLabel(ctx, resource.Name)
+		if err != nil {
+			return ServiceEndpoint{}, errors.Wrap(err, "Failed to resolve service endpoint from label")
+		}
+	}
+
+	if !found {
+		serviceEndpoint = ServiceEndpoint{Host: resource.Name}
+	}
+
+	s.logger.DebugWith("Resolved service endpoint",
+		"namespace", s.namespace,
+		"services", []string{resource.Name},
+		"host", serviceEndpoint.Host,
+		"port", serviceEndpoint.Port)
+
+	s.serviceEndpointCache.set(resource.Name,
+		serviceSpec,
+		serviceEndpoint,
+		s.getOptions().ServiceEndpointCacheTTL.Duration)
+
+	return serviceEndpoint, nil
+}
+
+// resolveServiceEndpointFromURLs returns the endpoint of the first http url with an in-cluster host - a Kubernetes
+// service's DNS name, or a name without dots
+func (s *AppResourceScaler) resolveServiceEndpointFromURLs(serviceSpec interface{},
+	serviceStatus interface{}) (ServiceEndpoint, bool) {
+
+	for _, serviceURL := range parseServiceURLs(serviceSpec, serviceStatus) {
+		parsedURL, err := url.Parse(serviceURL)
+		if err != nil || parsedURL.Scheme != "http" {
+			continue
+		}
+
+		host := parsedURL.Hostname()
+		if net.ParseIP(host) == nil &&
+			strings.Contains(host, ".") &&
+			!strings.HasSuffix(host, ".svc") &&
+			!strings.HasSuffix(host, ".svc.cluster.local") {
+			continue
+		}
+
+		serviceEndpoint := ServiceEndpoint{Host: host, Port: 80}
+		if parsedURL.Port() != "" {
+			serviceEndpoint.Port, err = strconv.Atoi(parsedURL.Port())
+			if err != nil {
+				continue
+			}
+		}
+
+		return serviceEndpoint, true
+	}
+
+	return ServiceEndpoint{}, false
+}
+
+// resolveServiceEndpointFromLabel looks up the Kubernetes service whose service label is the app service's name,
+// preferring its port named http
+func (s *AppResourceScaler) resolveServiceEndpointFromLabel(ctx context.Context,
+	serviceName string) (ServiceEndpoint, bool, error) {
+
+	serviceLabel := s.getOptions().ServiceLabel
+	if serviceLabel == "" {
+		return ServiceEndpoint{}, false, nil
+	}
+
+	services, err := s.kubeClientSet.CoreV1().Services(s.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: serviceLabel + "=" + serviceName,
+	})
+	if err != nil {
+		return ServiceEndpoint{}, false, errors.Wrap(err, "Failed to list services")
+	}
+
+	if len(services.Items) == 0 {
+		return ServiceEndpoint{}, false, nil
+	}
+
+	if len(services.Items) > 1 {
+		s.logger.WarnWith("Found multiple services with the service label, using the first",
+			"namespace", s.namespace,
+			"services", []string{serviceName},
+			"serviceLabel", serviceLabel)
+	}
+
+	kubeService := services.Items[0]
+	serviceEndpoint := ServiceEndpoint{
+		Host: kubeService.Name + "." + kubeService.Namespace + ".svc",
+	}
+
+	for portIndex, servicePort := range kubeService.Spec.Ports {
+		if portIndex == 0 || servicePort.Name == "http" {
+			serviceEndpoint.Port = int(servicePort.Port)
+		}
+	}
+
+	return serviceEndpoint, true, nil
+}
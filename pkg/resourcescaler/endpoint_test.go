@@ -0,0 +1,311 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/v3io/scaler/pkg/scalertypes"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeKubeServicesAPI serves the Kubernetes services of the default-tenant namespace by a single label selector,
+// passing other requests on to the service set API
+type fakeKubeServicesAPI struct {
+	*fakeServiceSetAPI
+	services []v1.Service
+
+	lock           sync.Mutex
+	labelSelectors []string
+}
+
+func (a *fakeKubeServicesAPI) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.URL.Path != "/api/v1/namespaces/default-tenant/services" {
+		a.fakeServiceSetAPI.ServeHTTP(responseWriter, request)
+		return
+	}
+
+	labelSelector := request.URL.Query().Get("labelSelector")
+	a.lock.Lock()
+	a.labelSelectors = append(a.labelSelectors, labelSelector)
+	a.lock.Unlock()
+
+	serviceList := v1.ServiceList{}
+	labelKey, labelValue, _ := strings.Cut(labelSelector, "=")
+	for _, service := range a.services {
+		if service.Labels[labelKey] == labelValue {
+			serviceList.Items = append(serviceList.Items, service)
+		}
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(responseWriter).Encode(serviceList) // nolint: errcheck
+}
+
+func (a *fakeKubeServicesAPI) getLabelSelectors() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return append([]string(nil), a.labelSelectors...)
+}
+
+func newKubeService(name string, appServiceName string, ports ...v1.ServicePort) v1.Service {
+	return v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default-tenant",
+			Labels:    map[string]string{"app.iguazio.com/service": appServiceName},
+		},
+		Spec: v1.ServiceSpec{Ports: ports},
+	}
+}
+
+func TestResolveServiceEndpointFromURLs(t *testing.T) {
+	resourceScaler := newTestAppResourceScaler(t, newFakeServiceSetAPI(nil), NewDefaultOptions())
+
+	for _, testCase := range []struct {
+		name             string
+		spec             interface{}
+		status           interface{}
+		expectedEndpoint ServiceEndpoint
+		expectedFound    bool
+	}{
+		{name: "no urls", spec: map[string]interface{}{}},
+		{
+			name:             "in-cluster name with a port",
+			spec:             map[string]interface{}{"urls": []interface{}{"http://jupyter:8888/lab"}},
+			expectedEndpoint: ServiceEndpoint{Host: "jupyter", Port: 8888},
+			expectedFound:    true,
+		},
+		{
+			name:             "default port",
+			spec:             map[string]interface{}{"urls": []interface{}{"http://jupyter.default-tenant.svc/lab"}},
+			expectedEndpoint: ServiceEndpoint{Host: "jupyter.default-tenant.svc", Port: 80},
+			expectedFound:    true,
+		},
+		{
+			name: "external and https urls skipped",
+			spec: map[string]interface{}{"urls": []interface{}{
+				"http://jupyter.apps.example.com",
+				"https://jupyter:8443",
+				"http://jupyter.default-tenant.svc.cluster.local:8888",
+			}},
+			expectedEndpoint: ServiceEndpoint{Host: "jupyter.default-tenant.svc.cluster.local", Port: 8888},
+			expectedFound:    true,
+		},
+		{
+			name:             "ip",
+			spec:             map[string]interface{}{"urls": []interface{}{"http://10.0.0.1:8080"}},
+			expectedEndpoint: ServiceEndpoint{Host: "10.0.0.1", Port: 8080},
+			expectedFound:    true,
+		},
+		{
+			name:             "url object in the status",
+			spec:             map[string]interface{}{"urls": []interface{}{"http://jupyter.apps.example.com"}},
+			status:           map[string]interface{}{"urls": []interface{}{map[string]interface{}{"url": "http://jupyter:8888"}}},
+			expectedEndpoint: ServiceEndpoint{Host: "jupyter", Port: 8888},
+			expectedFound:    true,
+		},
+		{
+			name: "only external urls",
+			spec: map[string]interface{}{"urls": []interface{}{"http://jupyter.apps.example.com:8888"}},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			endpoint, found := resourceScaler.resolveServiceEndpointFromURLs(testCase.spec, testCase.status)
+			if found != testCase.expectedFound || endpoint != testCase.expectedEndpoint {
+				t.Fatalf("Expected endpoint %+v (found %t), got %+v (found %t)",
+					testCase.expectedEndpoint,
+					testCase.expectedFound,
+					endpoint,
+					found)
+			}
+		})
+	}
+}
+
+func TestResolveServiceEndpoint(t *testing.T) {
+	for _, testCase := range []struct {
+		name                   string
+		spec                   map[string]interface{}
+		serviceLabel           string
+		services               []v1.Service
+		expectedEndpoint       ServiceEndpoint
+		expectedLabelSelectors []string
+	}{
+		{
+			name:             "from the urls",
+			spec:             map[string]interface{}{"urls": []interface{}{"http://jupyter:8888"}},
+			serviceLabel:     "app.iguazio.com/service",
+			expectedEndpoint: ServiceEndpoint{Host: "jupyter", Port: 8888},
+		},
+		{
+			name:         "from the labeled service's http port",
+			spec:         map[string]interface{}{},
+			serviceLabel: "app.iguazio.com/service",
+			services: []v1.Service{
+				newKubeService("spark-ui", "spark", v1.ServicePort{Name: "http", Port: 4040}),
+				newKubeService("jupyter-svc", "jupyter",
+					v1.ServicePort{Name: "metrics", Port: 9090},
+					v1.ServicePort{Name: "http", Port: 8888}),
+			},
+			expectedEndpoint:       ServiceEndpoint{Host: "jupyter-svc.default-tenant.svc", Port: 8888},
+			expectedLabelSelectors: []string{"app.iguazio.com/service=jupyter"},
+		},
+		{
+			name:                   "from the labeled service's first port",
+			spec:                   map[string]interface{}{},
+			serviceLabel:           "app.iguazio.com/service",
+			services:               []v1.Service{newKubeService("jupyter-svc", "jupyter", v1.ServicePort{Name: "web", Port: 8080})},
+			expectedEndpoint:       ServiceEndpoint{Host: "jupyter-svc.default-tenant.svc", Port: 8080},
+			expectedLabelSelectors: []string{"app.iguazio.com/service=jupyter"},
+		},
+		{
+			name:                   "no labeled service",
+			spec:                   map[string]interface{}{},
+			serviceLabel:           "app.iguazio.com/service",
+			expectedEndpoint:       ServiceEndpoint{Host: "jupyter"},
+			expectedLabelSelectors: []string{"app.iguazio.com/service=jupyter"},
+		},
+		{
+			name:             "no service label",
+			spec:             map[string]interface{}{},
+			services:         []v1.Service{newKubeService("jupyter-svc", "jupyter", v1.ServicePort{Name: "http", Port: 8888})},
+			expectedEndpoint: ServiceEndpoint{Host: "jupyter"},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			kubeServicesAPI := &fakeKubeServicesAPI{
+				fakeServiceSetAPI: newFakeServiceSetAPI(newServiceSetBody(map[string]interface{}{
+					"jupyter": testCase.spec,
+				}, map[string]string{"jupyter": "ready"})),
+				services: testCase.services,
+			}
+			options := NewDefaultOptions()
+			options.ServiceLabel = testCase.serviceLabel
+			resourceScaler := newTestAppResourceScaler(t, kubeServicesAPI, options)
+
+			endpoint, err := resourceScaler.ResolveServiceEndpoint(scalertypes.Resource{Name: "jupyter"})
+			if err != nil {
+				t.Fatalf("Failed to resolve service endpoint: %v", err)
+			}
+
+			if endpoint != testCase.expectedEndpoint {
+				t.Fatalf("Expected endpoint %+v, got %+v", testCase.expectedEndpoint, endpoint)
+			}
+
+			if labelSelectors := kubeServicesAPI.getLabelSelectors(); !stringSlicesEqual(labelSelectors,
+				testCase.expectedLabelSelectors) {
+				t.Fatalf("Expected label selectors %v, got %v", testCase.expectedLabelSelectors, labelSelectors)
+			}
+		})
+	}
+}
+
+func TestResolveServiceEndpointCacheTTL(t *testing.T) {
+	for _, testCase := range []struct {
+		name          string
+		ttl           time.Duration
+		expectedReads int64
+	}{
+		{name: "cached", ttl: time.Hour, expectedReads: 1},
+		{name: "expired", ttl: time.Millisecond, expectedReads: 2},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			serviceSetAPI := newFakeServiceSetAPI(newServiceSetBody(map[string]interface{}{
+				"jupyter": map[string]interface{}{"urls": []interface{}{"http://jupyter:8888"}},
+			}, map[string]string{"jupyter": "ready"}))
+			options := NewDefaultOptions()
+			options.ServiceSetCacheTTL = scalertypes.Duration{}
+			options.ServiceEndpointCacheTTL = scalertypes.Duration{Duration: testCase.ttl}
+			resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, options)
+
+			for i := 0; i < 2; i++ {
+				if _, err := resourceScaler.ResolveServiceEndpoint(scalertypes.Resource{Name: "jupyter"}); err != nil {
+					t.Fatalf("Failed to resolve service endpoint: %v", err)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			if reads := serviceSetAPI.reads.Load(); reads != testCase.expectedReads {
+				t.Fatalf("Expected %d service set reads, got %d", testCase.expectedReads, reads)
+			}
+		})
+	}
+}
+
+func TestServiceEndpointCacheInvalidateChanged(t *testing.T) {
+	serviceSpec := map[string]interface{}{
+		"desired_state": "ready",
+		"urls":          []interface{}{"http://jupyter:8888"},
+	}
+
+	for _, testCase := range []struct {
+		name          string
+		specServices  map[string]interface{}
+		expectedFound bool
+	}{
+		{name: "unchanged", specServices: map[string]interface{}{"jupyter": serviceSpec}, expectedFound: true},
+		{
+			name: "scaled by the scaler",
+			specServices: map[string]interface{}{"jupyter": map[string]interface{}{
+				"desired_state":    "scaledToZero",
+				"mark_as_changed":  true,
+				"urls":             []interface{}{"http://jupyter:8888"},
+				"scale_to_zero":    map[string]interface{}{"pinned_until": "2024-05-01T08:00:00Z"},
+				"mark_for_restart": false,
+			}},
+			expectedFound: true,
+		},
+		{
+			name: "urls changed",
+			specServices: map[string]interface{}{"jupyter": map[string]interface{}{
+				"desired_state": "ready",
+				"urls":          []interface{}{"http://jupyter:9999"},
+			}},
+		},
+		{
+			name: "ingresses changed",
+			specServices: map[string]interface{}{"jupyter": map[string]interface{}{
+				"desired_state": "ready",
+				"urls":          []interface{}{"http://jupyter:8888"},
+				"ingresses":     []interface{}{map[string]interface{}{"host": "jupyter.apps.example.com"}},
+			}},
+		},
+		{name: "removed", specServices: map[string]interface{}{}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			cache := &serviceEndpointCache{}
+			cache.set("jupyter", serviceSpec, ServiceEndpoint{Host: "jupyter", Port: 8888}, time.Hour)
+
+			cache.invalidateChanged(testCase.specServices)
+			if _, found := cache.get("jupyter"); found != testCase.expectedFound {
+				t.Fatalf("Expected the endpoint to be cached %t, got %t", testCase.expectedFound, found)
+			}
+		})
+	}
+}
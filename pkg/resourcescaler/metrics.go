@@ -0,0 +1,103 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "app_resource_scaler"
+
+var (
+	stuckProvisioningGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "stuck_provisioning",
+		Help:      "Whether the service set is stuck in a provisioning state (1) or not (0)",
+	}, []string{"namespace"})
+
+	stuckProvisioningDetectionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stuck_provisioning_detections_total",
+		Help:      "Number of times the service set was found stuck in a provisioning state",
+	}, []string{"namespace", "state", "own_state"})
+
+	stuckProvisioningRecoveriesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stuck_provisioning_recoveries_total",
+		Help:      "Number of attempts to reset a service set stuck in a provisioning state, by outcome",
+	}, []string{"namespace", "outcome"})
+
+	mutationQueueDepthGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mutation_queue_depth",
+		Help:      "Number of service set mutations waiting for their turn",
+	}, []string{"namespace"})
+
+	mutationWaitSecondsHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mutation_wait_seconds",
+		Help:      "Time service set mutations waited from being requested until their patch was sent",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 4, 8),
+	}, []string{"namespace", "scale_event"})
+
+	mutationsCoalescedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mutations_coalesced_total",
+		Help:      "Number of service set mutations patched along with another of the same scale event",
+	}, []string{"namespace"})
+
+	serviceSetReadsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "service_set_reads_total",
+		Help:      "Number of service set reads, by whether they were served by the API, the cache, or a shared API read",
+	}, []string{"namespace", "source"})
+
+	monitoredDecisionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "monitored_scale_to_zero_decisions_total",
+		Help:      "Number of times a service in monitor mode would have been scaled to zero",
+	}, []string{"namespace"})
+
+	errorRecoveryAttemptsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "error_recovery_attempts_total",
+		Help:      "Number of restarts of services in error after scaling from zero",
+	}, []string{"namespace"})
+
+	errorRecoveriesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "error_recoveries_total",
+		Help:      "Number of services restarted after landing in error, by whether they recovered",
+	}, []string{"namespace", "outcome"})
+
+	manualChangesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "manual_changes_detected_total",
+		Help:      "Number of desired state changes made outside the scaler",
+	}, []string{"namespace"})
+
+	manuallyControlledSkipsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "manually_controlled_skips_total",
+		Help:      "Number of services not scaled since they are held or were changed manually",
+	}, []string{"namespace", "scale_event"})
+)
@@ -0,0 +1,164 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nuclio/errors"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+
+	// the service is scaled to zero when idle
+	EnabledScaleToZeroMode = "enabled"
+
+	// the service is evaluated as if enabled, but only the decision to scale it to zero is recorded
+	MonitorScaleToZeroMode = "monitor"
+
+	wouldScaleToZeroEventReason = "WouldScaleToZero"
+)
+
+// monitorDecisionTracker tracks when each monitored service was last decided to be scaled to zero, so that only
+// the first decision of every idle streak is recorded in the service set
+type monitorDecisionTracker struct {
+	lock          sync.Mutex
+	lastDecidedAt map[string]time.Time
+}
+
+// observe records a decision, returning whether it starts a streak - no decision was made within maxGap before it
+func (t *monitorDecisionTracker) observe(serviceName string, now time.Time, maxGap time.Duration) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.lastDecidedAt == nil {
+		t.lastDecidedAt = map[string]time.Time{}
+	}
+
+	lastDecidedAt, found := t.lastDecidedAt[serviceName]
+	t.lastDecidedAt[serviceName] = now
+
+	return !found || now.Sub(lastDecidedAt) > maxGap
+}
+
+func (t *monitorDecisionTracker) forget(serviceNames []string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, serviceName := range serviceNames {
+		delete(t.lastDecidedAt, serviceName)
+	}
+}
+
+// isScaleToZeroModeEvaluated returns whether services of the scale to zero mode are evaluated for scale to zero
+func isScaleToZeroModeEvaluated(mode interface{}) bool {
+	return mode == EnabledScaleToZeroMode || mode == MonitorScaleToZeroMode
+}
+
+// isMonitored returns whether the service spec's scale to zero mode is monitor
+func isMonitored(serviceSpecInterface interface{}) bool {
+	serviceSpec, _ := serviceSpecInterface.(map[string]interface{})
+	scaleToZeroSpec, _ := serviceSpec["scale_to_zero"].(map[string]interface{})
+
+	return scaleToZeroSpec["mode"] == MonitorScaleToZeroMode
+}
+
+// filterMonitoredServices returns the services that may be scaled to zero, recording the decision to scale the
+// monitored ones instead: every decision in metrics, and the first of every idle streak in the service's status,
+// under would_scale_to_zero_at, and in an event
+func (s *AppResourceScaler) filterMonitoredServices(ctx context.Context,
+	serviceSet *iguazioTenantAppServiceSet,
+	serviceNames []string) []string {
+
+	now := time.Now()
+	maxGap := 2 * s.getScaleInterval()
+
+	var allowedServiceNames, streakServiceNames []string
+	for _, serviceName := range serviceNames {
+		if !isMonitored(serviceSet.specServices[serviceName]) {
+			allowedServiceNames = append(allowedServiceNames, serviceName)
+			continue
+		}
+
+		monitoredDecisionsCounter.WithLabelValues(s.namespace).Inc()
+		if s.monitorDecisionTracker.observe(serviceName, now, maxGap) {
+			streakServiceNames = append(streakServiceNames, serviceName)
+		}
+	}
+
+	if len(streakServiceNames) == 0 {
+		return allowedServiceNames
+	}
+
+	s.logger.InfoWithCtx(ctx, "Monitored services would be scaled to zero", s.operationLogVars(ctx,
+		"services", streakServiceNames)...)
+
+	marshaledNow := now.UTC().Format(time.RFC3339)
+	var jsonPatchMapper []map[string]interface{}
+	for _, serviceName := range streakServiceNames {
+		if _, found := serviceSet.statusServices[serviceName]; found {
+			jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
+				"op":    "add",
+				"path":  fmt.Sprintf("/status/services/%s/would_scale_to_zero_at", serviceName),
+				"value": marshaledNow,
+			})
+		}
+
+		s.recordEvent(serviceSet,
+			v1.EventTypeNormal,
+			wouldScaleToZeroEventReason,
+			fmt.Sprintf("Service %s would be scaled to zero, but its scale to zero mode is monitor", serviceName))
+	}
+
+	if len(jsonPatchMapper) > 0 {
+		if err := s.sendUnqueuedPatch(ctx,
+			s.namespace,
+			streakServiceNames,
+			"",
+			jsonPatchMapper,
+			serviceSet); err != nil {
+			s.logger.WarnWithCtx(ctx, "Failed to record monitored scale to zero decision", s.operationLogVars(ctx,
+				"services", streakServiceNames,
+				"err", errors.GetErrorStackString(err, 10))...)
+
+			// so the next decision records it again
+			s.monitorDecisionTracker.forget(streakServiceNames)
+		}
+	}
+
+	return allowedServiceNames
+}
+
+// getScaleInterval returns how often the autoscaler evaluates services, or a minute if unknown
+func (s *AppResourceScaler) getScaleInterval() time.Duration {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	if s.autoScalerOptions.ScaleInterval.Duration <= 0 {
+		return time.Minute
+	}
+
+	return s.autoScalerOptions.ScaleInterval.Duration
+}
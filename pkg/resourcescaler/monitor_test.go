@@ -0,0 +1,135 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/v3io/scaler/pkg/scalertypes"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestMonitorDecisionTracker(t *testing.T) {
+	tracker := &monitorDecisionTracker{}
+	startedAt := time.Date(2024, 5, 15, 9, 0, 0, 0, time.UTC)
+	maxGap := 2 * time.Minute
+
+	for _, step := range []struct {
+		name                string
+		serviceName         string
+		at                  time.Duration
+		forget              bool
+		expectedStartStreak bool
+	}{
+		{name: "first decision", serviceName: "jupyter", expectedStartStreak: true},
+		{name: "next interval", serviceName: "jupyter", at: time.Minute},
+		{name: "other service", serviceName: "spark", at: time.Minute, expectedStartStreak: true},
+		{name: "at the max gap", serviceName: "jupyter", at: 3 * time.Minute},
+
+		// the service was busy for a while in between
+		{name: "past the max gap", serviceName: "jupyter", at: 5*time.Minute + time.Second, expectedStartStreak: true},
+		{name: "forgotten", serviceName: "jupyter", at: 6 * time.Minute, forget: true, expectedStartStreak: true},
+		{name: "after forgotten", serviceName: "jupyter", at: 7 * time.Minute},
+	} {
+		if step.forget {
+			tracker.forget([]string{step.serviceName})
+		}
+
+		if startsStreak := tracker.observe(step.serviceName, startedAt.Add(step.at), maxGap); startsStreak != step.expectedStartStreak {
+			t.Fatalf("%s: expected starting a streak %t, got %t", step.name, step.expectedStartStreak, startsStreak)
+		}
+	}
+}
+
+func TestFilterMonitoredServices(t *testing.T) {
+	monitoredScaleToZero := map[string]interface{}{
+		"mode": MonitorScaleToZeroMode,
+		"scale_resources": []interface{}{
+			map[string]interface{}{"metric_name": "num_of_requests", "threshold": 0, "window_size": "30m"},
+		},
+	}
+	serviceSetAPI := newFakeServiceSetAPI(newServiceSetBody(map[string]interface{}{
+		"jupyter": map[string]interface{}{"desired_state": "ready", "scale_to_zero": monitoredScaleToZero},
+		"spark": map[string]interface{}{
+			"desired_state": "ready",
+			"scale_to_zero": map[string]interface{}{"mode": EnabledScaleToZeroMode},
+		},
+	}, map[string]string{"jupyter": "ready", "spark": "ready"}))
+	serviceSetAPI.applyPatches = true
+
+	options := NewDefaultOptions()
+	options.ServiceSetCacheTTL = scalertypes.Duration{}
+	resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, options)
+	eventRecorder := record.NewFakeRecorder(10)
+	resourceScaler.SetEventRecorder(eventRecorder)
+
+	decisionsCounter := monitoredDecisionsCounter.WithLabelValues("default-tenant")
+	decisionsBefore := testutil.ToFloat64(decisionsCounter)
+
+	filter := func() []string {
+		serviceSet, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to get service set: %v", err)
+		}
+
+		return resourceScaler.filterMonitoredServices(context.Background(), serviceSet, []string{"jupyter", "spark"})
+	}
+
+	for decision := 1; decision <= 2; decision++ {
+		if allowedServiceNames := filter(); len(allowedServiceNames) != 1 || allowedServiceNames[0] != "spark" {
+			t.Fatalf("Expected only spark to be allowed, got %v", allowedServiceNames)
+		}
+	}
+
+	if decisions := testutil.ToFloat64(decisionsCounter) - decisionsBefore; decisions != 2 {
+		t.Fatalf("Expected every decision to be counted under the namespace, got %v", decisions)
+	}
+
+	// only the first decision of the streak is recorded in the service set
+	patches := serviceSetAPI.patchOperations(t)
+	if len(patches) != 1 {
+		t.Fatalf("Expected a single patch, got %d", len(patches))
+	}
+
+	wouldScaleToZeroAt, _ := getJSONPath(serviceSetAPI.serviceSet(t), "/status/services/jupyter/would_scale_to_zero_at").(string)
+	if _, err := time.Parse(time.RFC3339, wouldScaleToZeroAt); err != nil {
+		t.Fatalf("Expected the decision time in jupyter's status, got %q", wouldScaleToZeroAt)
+	}
+
+	select {
+	case event := <-eventRecorder.Events:
+		if !strings.Contains(event, wouldScaleToZeroEventReason) || !strings.Contains(event, "jupyter") {
+			t.Fatalf("Expected an event naming jupyter, got %s", event)
+		}
+	default:
+		t.Fatalf("Expected a %s event", wouldScaleToZeroEventReason)
+	}
+
+	select {
+	case event := <-eventRecorder.Events:
+		t.Fatalf("Expected a single event, got %s", event)
+	default:
+	}
+}
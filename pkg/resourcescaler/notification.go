@@ -0,0 +1,80 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/notification"
+
+	"github.com/nuclio/errors"
+)
+
+// SetNotifier sets the notifier scale transitions are published with. Must be called before use
+func (s *AppResourceScaler) SetNotifier(notifier *notification.Notifier) {
+	s.notifier = notifier
+}
+
+// publishScaleEvents publishes an event per service. For the events ending a transition, startedAt is when it
+// started and err is how it failed, if it did
+func (s *AppResourceScaler) publishScaleEvents(ctx context.Context,
+	eventType string,
+	serviceNames []string,
+	startedAt time.Time,
+	err error) {
+
+	for _, serviceName := range serviceNames {
+		event := &notification.Event{
+			Type:        eventType,
+			Namespace:   s.namespace,
+			Service:     serviceName,
+			Trigger:     GetTrigger(ctx),
+			OperationID: GetOperationID(ctx),
+		}
+
+		if !startedAt.IsZero() {
+			event.DurationSeconds = time.Since(startedAt).Seconds()
+		}
+
+		if err != nil {
+			event.Error = errors.RootCause(err).Error()
+		}
+
+		s.notifier.Publish(event)
+	}
+}
+
+// publishScaleResultEvents publishes the succeeded or failed event of a transition, depending on err
+func (s *AppResourceScaler) publishScaleResultEvents(ctx context.Context,
+	succeededEventType string,
+	failedEventType string,
+	serviceNames []string,
+	startedAt time.Time,
+	err error) {
+
+	if err != nil {
+		s.publishScaleEvents(ctx, failedEventType, serviceNames, startedAt, err)
+		return
+	}
+
+	s.publishScaleEvents(ctx, succeededEventType, serviceNames, startedAt, nil)
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+const (
+
+	// the autoscaler scaling idle services to zero
+	AutoScalerTrigger = "autoscaler"
+
+	// a request to the dlx waking up a service
+	DLXTrigger = "dlx"
+
+	// a user request to the management API
+	APITrigger = "api"
+
+	// a scheduled pre-warm ahead of expected usage
+	PrewarmTrigger = "prewarm"
+
+	// a pre-warm predicted from the times the service was woken up at before
+	PredictionTrigger = "prediction"
+
+	// a restart of services that landed in error after scaling from zero
+	RecoveryTrigger = "recovery"
+)
+
+type operationIDContextKey struct{}
+type triggerContextKey struct{}
+type declaredReplicasContextKey struct{}
+
+// WithOperationID returns a context for a scale operation with the given id, which is added to everything the
+// resource scaler logs about the operation. SetScaleCtx generates an id for contexts that don't have one
+func WithOperationID(ctx context.Context, operationID string) context.Context {
+	return context.WithValue(ctx, operationIDContextKey{}, operationID)
+}
+
+// GetOperationID returns the id of the scale operation of the context, if any
+func GetOperationID(ctx context.Context) string {
+	operationID, _ := ctx.Value(operationIDContextKey{}).(string)
+	return operationID
+}
+
+// WithTrigger returns a context for a scale operation triggered by trigger, which is recorded in the audit log.
+// Without one, SetScale is assumed to be called by the autoscaler and SetScaleCtx by the dlx
+func WithTrigger(ctx context.Context, trigger string) context.Context {
+	return context.WithValue(ctx, triggerContextKey{}, trigger)
+}
+
+// GetTrigger returns what triggered the scale operation of the context, if known
+func GetTrigger(ctx context.Context) string {
+	trigger, _ := ctx.Value(triggerContextKey{}).(string)
+	return trigger
+}
+
+// WithDeclaredReplicas returns a context for a scale from zero that keeps the replica count the services declare,
+// instead of setting it to the requested scale. The dlx and pre-warms wake services up with it, as their scale of 1
+// only means awake
+func WithDeclaredReplicas(ctx context.Context) context.Context {
+	return context.WithValue(ctx, declaredReplicasContextKey{}, true)
+}
+
+// KeepsDeclaredReplicas returns whether the scale operation of the context keeps the declared replica counts
+func KeepsDeclaredReplicas(ctx context.Context) bool {
+	keepsDeclaredReplicas, _ := ctx.Value(declaredReplicasContextKey{}).(bool)
+	return keepsDeclaredReplicas
+}
+
+func newOperationID() string {
+	operationIDBytes := make([]byte, 8)
+	if _, err := rand.Read(operationIDBytes); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(operationIDBytes)
+}
+
+// operationLogVars prefixes log vars with the fields every log line of a scale operation carries
+func (s *AppResourceScaler) operationLogVars(ctx context.Context, vars ...interface{}) []interface{} {
+	return append([]interface{}{
+		"namespace", s.namespace,
+		"operationID", GetOperationID(ctx),
+		"trigger", GetTrigger(ctx),
+	}, vars...)
+}
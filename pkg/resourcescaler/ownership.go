@@ -0,0 +1,404 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/audit"
+
+	"github.com/nuclio/errors"
+	"github.com/v3io/scaler/pkg/scalertypes"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+
+	// the desired state was last changed by the scaler
+	ScalerChangedBy = "scaler"
+
+	// the desired state was last changed outside the scaler, e.g. in the Iguazio UI
+	ManualChangedBy = "manual"
+
+	manualChangeDetectedEventReason = "ManualChangeDetected"
+)
+
+// ErrServiceManuallyControlled is the cause of scale from zero operations of services that are held or were
+// changed manually within the manual change window
+var ErrServiceManuallyControlled = errors.New("Service is manually controlled")
+
+// ServiceChange is the last change of a service's desired state, recorded in the service's status under last_change
+type ServiceChange struct {
+	ChangedBy    string
+	DesiredState string
+	ChangedAt    time.Time
+}
+
+// ParseHold parses whether a single service spec is held, under scale_to_zero.hold
+func ParseHold(serviceSpecInterface interface{}) (bool, error) {
+	serviceSpec, ok := serviceSpecInterface.(map[string]interface{})
+	if !ok {
+		return false, errors.New("Service spec type assertion failed")
+	}
+
+	scaleToZeroSpec, ok := serviceSpec["scale_to_zero"].(map[string]interface{})
+	if !ok {
+		return false, nil
+	}
+
+	holdInterface, found := scaleToZeroSpec["hold"]
+	if !found {
+		return false, nil
+	}
+
+	hold, ok := holdInterface.(bool)
+	if !ok {
+		return false, errors.New("Hold is not a boolean")
+	}
+
+	return hold, nil
+}
+
+// parseLastChange parses the last change of a single service status. A nil result with no error means the change
+// wasn't recorded
+func parseLastChange(serviceStatusInterface interface{}) (*ServiceChange, error) {
+	serviceStatus, _ := serviceStatusInterface.(map[string]interface{})
+	lastChange, ok := serviceStatus["last_change"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	changedBy, _ := lastChange["changed_by"].(string)
+	desiredState, _ := lastChange["desired_state"].(string)
+	changedAtString, _ := lastChange["changed_at"].(string)
+	changedAt, err := time.Parse(time.RFC3339Nano, changedAtString)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse last change time")
+	}
+
+	return &ServiceChange{
+		ChangedBy:    changedBy,
+		DesiredState: desiredState,
+		ChangedAt:    changedAt,
+	}, nil
+}
+
+// appendLastChangeJSONPatchOperations records the change of the service's desired state in its status
+func appendLastChangeJSONPatchOperations(jsonPatchMapper []map[string]interface{},
+	serviceName string,
+	changedBy string,
+	desiredState string,
+	changedAt string) []map[string]interface{} {
+
+	return append(jsonPatchMapper, map[string]interface{}{
+		"op":   "add",
+		"path": fmt.Sprintf("/status/services/%s/last_change", serviceName),
+		"value": map[string]interface{}{
+			"changed_by":    changedBy,
+			"desired_state": desiredState,
+			"changed_at":    changedAt,
+		},
+	})
+}
+
+// getExpectedDesiredState returns the desired state last written by the scaler, falling back to the one implied by
+// the last scale event for services the scaler changed before it recorded its changes
+func (s *AppResourceScaler) getExpectedDesiredState(serviceStatus interface{}, lastChange *ServiceChange) string {
+	if lastChange != nil {
+		return lastChange.DesiredState
+	}
+
+	lastScaleEvent, _, err := s.parseLastScaleEvent(serviceStatus)
+	if err != nil || lastScaleEvent == nil {
+		return ""
+	}
+
+	switch *lastScaleEvent {
+	case scalertypes.ScaleToZeroStartedScaleEvent, scalertypes.ScaleToZeroCompletedScaleEvent:
+		return "scaledToZero"
+	case scalertypes.ScaleFromZeroStartedScaleEvent, scalertypes.ScaleFromZeroCompletedScaleEvent:
+		return "ready"
+	}
+
+	return ""
+}
+
+// getManuallyControlledServices returns the reasons the services that are off limits to the scaler are - held
+// ones, and ones whose desired state was changed outside the scaler within the manual change window. Changes that
+// weren't recorded yet are handed to recordManualChanges, so the window starts when the change is first noticed
+func (s *AppResourceScaler) getManuallyControlledServices(ctx context.Context,
+	serviceSet *iguazioTenantAppServiceSet,
+	serviceNames []string) map[string]string {
+
+	now := time.Now()
+	manualChangeWindow := s.getOptions().ManualChangeWindow.Duration
+
+	controlledServices := map[string]string{}
+	detectedDesiredStates := map[string]string{}
+	for _, serviceName := range serviceNames {
+		serviceSpec, found := serviceSet.specServices[serviceName]
+		if !found {
+			continue
+		}
+
+		hold, err := ParseHold(serviceSpec)
+		if err != nil {
+			s.logger.WarnWithCtx(ctx, "Failed parsing the service hold", s.operationLogVars(ctx,
+				"services", []string{serviceName},
+				"err", errors.GetErrorStackString(err, 10))...)
+			controlledServices[serviceName] = "Invalid hold"
+			continue
+		}
+
+		if hold {
+			controlledServices[serviceName] = "Service is held"
+			continue
+		}
+
+		serviceStatus, found := serviceSet.statusServices[serviceName]
+		if !found {
+			continue
+		}
+
+		lastChange, err := parseLastChange(serviceStatus)
+		if err != nil {
+			s.logger.WarnWithCtx(ctx, "Failed parsing the service last change, continuing", s.operationLogVars(ctx,
+				"services", []string{serviceName},
+				"err", errors.GetErrorStackString(err, 10))...)
+			continue
+		}
+
+		serviceSpecMap, _ := serviceSpec.(map[string]interface{})
+		desiredState, _ := serviceSpecMap["desired_state"].(string)
+		expectedDesiredState := s.getExpectedDesiredState(serviceStatus, lastChange)
+
+		// the scaler never changed the service, so there's nothing to tell a manual change from
+		if expectedDesiredState == "" || desiredState == "" {
+			continue
+		}
+
+		if desiredState != expectedDesiredState {
+			detectedDesiredStates[serviceName] = desiredState
+			lastChange = &ServiceChange{
+				ChangedBy:    ManualChangedBy,
+				DesiredState: desiredState,
+				ChangedAt:    now,
+			}
+		}
+
+		if lastChange != nil &&
+			lastChange.ChangedBy == ManualChangedBy &&
+			now.Before(lastChange.ChangedAt.Add(manualChangeWindow)) {
+			controlledServices[serviceName] = fmt.Sprintf("Service was changed manually to %s at %s",
+				lastChange.DesiredState,
+				lastChange.ChangedAt.UTC().Format(time.RFC3339))
+		}
+	}
+
+	if len(detectedDesiredStates) > 0 {
+		s.recordManualChanges(ctx, serviceSet, detectedDesiredStates, now)
+	}
+
+	return controlledServices
+}
+
+// recordManualChanges records desired state changes made outside the scaler in the services' status. The record is
+// patched in the background through the mutation queue, so reading the service set never patches it, and changes
+// that are still being recorded aren't recorded again
+func (s *AppResourceScaler) recordManualChanges(ctx context.Context,
+	serviceSet *iguazioTenantAppServiceSet,
+	desiredStates map[string]string,
+	changedAt time.Time) {
+
+	serviceNames := s.manualChangeRecorder.start(desiredStates)
+	if len(serviceNames) == 0 {
+		return
+	}
+
+	s.logger.InfoWithCtx(ctx, "Detected manual changes of services", s.operationLogVars(ctx,
+		"services", serviceNames)...)
+	manualChangesCounter.WithLabelValues(s.namespace).Add(float64(len(serviceNames)))
+
+	marshaledChangedAt, _ := changedAt.MarshalText()
+	var jsonPatchMapper []map[string]interface{}
+	for _, serviceName := range serviceNames {
+		s.recordEvent(serviceSet,
+			v1.EventTypeNormal,
+			manualChangeDetectedEventReason,
+			fmt.Sprintf("Desired state of service %s was changed outside the scaler", serviceName))
+
+		// the patch fails rather than record a desired state that was changed again by the time it's sent
+		jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
+			"op":    "test",
+			"path":  fmt.Sprintf("/spec/spec/tenants/0/spec/services/%s/desired_state", serviceName),
+			"value": desiredStates[serviceName],
+		})
+		jsonPatchMapper = appendLastChangeJSONPatchOperations(jsonPatchMapper,
+			serviceName,
+			ManualChangedBy,
+			desiredStates[serviceName],
+			string(marshaledChangedAt))
+	}
+
+	// the operation detecting the changes doesn't wait for them to be recorded
+	recordCtx, cancelFunc := context.WithTimeout(context.WithoutCancel(ctx), s.getOptions().SetScaleTimeout.Duration)
+	go func() {
+		defer cancelFunc()
+		defer s.manualChangeRecorder.finish(serviceNames)
+
+		if err := s.patchIguazioTenantAppServiceSets(recordCtx,
+			s.namespace,
+			serviceNames,
+			"",
+			jsonPatchMapper,
+			""); err != nil {
+			s.logger.WarnWithCtx(recordCtx, "Failed to record manual changes", s.operationLogVars(recordCtx,
+				"services", serviceNames,
+				"err", errors.GetErrorStackString(err, 10))...)
+		}
+	}()
+}
+
+// manualChangeRecorder tracks the services whose manual changes are being recorded
+type manualChangeRecorder struct {
+	lock      sync.Mutex
+	recording map[string]bool
+}
+
+// start returns the services, sorted, whose changes aren't being recorded yet, marking them as being recorded
+func (r *manualChangeRecorder) start(desiredStates map[string]string) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.recording == nil {
+		r.recording = map[string]bool{}
+	}
+
+	var serviceNames []string
+	for serviceName := range desiredStates {
+		if r.recording[serviceName] {
+			continue
+		}
+
+		r.recording[serviceName] = true
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+
+	return serviceNames
+}
+
+func (r *manualChangeRecorder) finish(serviceNames []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, serviceName := range serviceNames {
+		delete(r.recording, serviceName)
+	}
+}
+
+// filterManuallyControlledServices returns the services that may be scaled to zero, skipping the manually
+// controlled ones
+func (s *AppResourceScaler) filterManuallyControlledServices(ctx context.Context,
+	serviceSet *iguazioTenantAppServiceSet,
+	serviceNames []string) []string {
+
+	controlledServices := s.getManuallyControlledServices(ctx, serviceSet, serviceNames)
+
+	var allowedServiceNames []string
+	for _, serviceName := range serviceNames {
+		reason, controlled := controlledServices[serviceName]
+		if !controlled {
+			allowedServiceNames = append(allowedServiceNames, serviceName)
+			continue
+		}
+
+		s.logger.InfoWithCtx(ctx, "Service is manually controlled, skipping scale to zero", s.operationLogVars(ctx,
+			"services", []string{serviceName},
+			"reason", reason)...)
+		manuallyControlledSkipsCounter.WithLabelValues(s.namespace,
+			string(scalertypes.ScaleToZeroStartedScaleEvent)).Inc()
+		s.writeManuallyControlledAuditEntry(ctx,
+			[]string{serviceName},
+			scalertypes.ScaleToZeroStartedScaleEvent,
+			reason)
+	}
+
+	return allowedServiceNames
+}
+
+// checkManuallyControlledServices returns an ErrServiceManuallyControlled if any of the services may not be scaled
+// from zero. Every trigger of a scale from zero is refused - the dlx, pre-warms and predictions alike - as none
+// of them is the one who set the service. Error recovery restarts are part of a scale from zero that was already
+// let through, so they aren't checked again
+func (s *AppResourceScaler) checkManuallyControlledServices(ctx context.Context,
+	serviceSet *iguazioTenantAppServiceSet,
+	serviceNames []string) error {
+
+	controlledServices := s.getManuallyControlledServices(ctx, serviceSet, serviceNames)
+	if len(controlledServices) == 0 {
+		return nil
+	}
+
+	var controlledServiceNames, reasons []string
+	for serviceName, reason := range controlledServices {
+		controlledServiceNames = append(controlledServiceNames, serviceName)
+		reasons = append(reasons, fmt.Sprintf("%s: %s", serviceName, reason))
+	}
+	sort.Strings(controlledServiceNames)
+	sort.Strings(reasons)
+
+	s.logger.InfoWithCtx(ctx, "Services are manually controlled, refusing scale from zero", s.operationLogVars(ctx,
+		"services", controlledServiceNames,
+		"reasons", reasons)...)
+	manuallyControlledSkipsCounter.WithLabelValues(s.namespace,
+		string(scalertypes.ScaleFromZeroStartedScaleEvent)).Add(float64(len(controlledServiceNames)))
+	s.writeManuallyControlledAuditEntry(ctx,
+		controlledServiceNames,
+		scalertypes.ScaleFromZeroStartedScaleEvent,
+		fmt.Sprint(reasons))
+
+	return errors.Wrapf(ErrServiceManuallyControlled, "Services %v are manually controlled", controlledServiceNames)
+}
+
+func (s *AppResourceScaler) writeManuallyControlledAuditEntry(ctx context.Context,
+	serviceNames []string,
+	scaleEvent scalertypes.ScaleEvent,
+	reason string) {
+
+	if err := s.auditLog.Write(&audit.Entry{
+		OperationID: GetOperationID(ctx),
+		Namespace:   s.namespace,
+		Trigger:     GetTrigger(ctx),
+		Services:    serviceNames,
+		ScaleEvent:  string(scaleEvent),
+		Outcome:     audit.VetoedOutcome,
+		Reason:      reason,
+	}); err != nil {
+		s.logger.ErrorWithCtx(ctx, "Failed to write audit log entry", s.operationLogVars(ctx,
+			"services", serviceNames,
+			"err", errors.GetErrorStackString(err, 10))...)
+	}
+}
@@ -0,0 +1,462 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// newOwnershipServiceSetBody returns a service set in the given state, whose services have the given specs and
+// statuses
+func newOwnershipServiceSetBody(tb testing.TB,
+	state string,
+	serviceSpecs map[string]interface{},
+	serviceStatuses map[string]interface{}) []byte {
+
+	serviceSet := map[string]interface{}{}
+	if err := json.Unmarshal(newServiceSetBody(serviceSpecs, nil), &serviceSet); err != nil {
+		tb.Fatalf("Failed to unmarshal service set: %v", err)
+	}
+	serviceSet["status"] = map[string]interface{}{"state": state, "services": serviceStatuses}
+
+	body, err := json.Marshal(serviceSet)
+	if err != nil {
+		tb.Fatalf("Failed to marshal service set: %v", err)
+	}
+
+	return body
+}
+
+func newLastChange(changedBy string, desiredState string, changedAt time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"changed_by":    changedBy,
+		"desired_state": desiredState,
+		"changed_at":    changedAt.Format(time.RFC3339Nano),
+	}
+}
+
+func newOwnershipTestOptions(manualChangeWindow time.Duration) Options {
+	options := NewDefaultOptions()
+	options.ProvisioningPollInterval = scalertypes.Duration{Duration: time.Millisecond}
+	options.ServiceSetCacheTTL = scalertypes.Duration{}
+	options.ManualChangeWindow = scalertypes.Duration{Duration: manualChangeWindow}
+	return options
+}
+
+// waitForPatches waits for the fake API to be sent the given number of patches, returning their operations
+func waitForPatches(tb testing.TB, serviceSetAPI *fakeServiceSetAPI, count int) [][]map[string]interface{} {
+	tb.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		patchOperations := serviceSetAPI.patchOperations(tb)
+		if len(patchOperations) >= count {
+			return patchOperations
+		}
+
+		if time.Now().After(deadline) {
+			tb.Fatalf("Expected %d patches, got %d", count, len(patchOperations))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitForManualChangesRecorded(tb testing.TB, resourceScaler *AppResourceScaler) {
+	tb.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resourceScaler.manualChangeRecorder.lock.Lock()
+		recordingCount := len(resourceScaler.manualChangeRecorder.recording)
+		resourceScaler.manualChangeRecorder.lock.Unlock()
+		if recordingCount == 0 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			tb.Fatalf("Expected manual changes to be recorded, %d are still being recorded", recordingCount)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestParseHold(t *testing.T) {
+	for _, testCase := range []struct {
+		name           string
+		service        interface{}
+		expectedHold   bool
+		expectedFailed bool
+	}{
+		{name: "no scale to zero spec", service: map[string]interface{}{}},
+		{name: "no hold", service: map[string]interface{}{"scale_to_zero": map[string]interface{}{"mode": "enabled"}}},
+		{name: "held", service: map[string]interface{}{"scale_to_zero": map[string]interface{}{"hold": true}}, expectedHold: true},
+		{name: "released", service: map[string]interface{}{"scale_to_zero": map[string]interface{}{"hold": false}}},
+		{name: "not a boolean", service: map[string]interface{}{"scale_to_zero": map[string]interface{}{"hold": "yes"}}, expectedFailed: true},
+		{name: "not an object", service: "jupyter", expectedFailed: true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			hold, err := ParseHold(testCase.service)
+			if (err != nil) != testCase.expectedFailed {
+				t.Fatalf("Expected failure %t, got %v", testCase.expectedFailed, err)
+			}
+
+			if hold != testCase.expectedHold {
+				t.Fatalf("Expected hold %t, got %t", testCase.expectedHold, hold)
+			}
+		})
+	}
+}
+
+func TestLastChangeRecording(t *testing.T) {
+	changedAt := time.Date(2024, 5, 1, 8, 0, 0, 123456789, time.UTC)
+	marshaledChangedAt, _ := changedAt.MarshalText()
+	jsonPatchMapper := appendLastChangeJSONPatchOperations(nil,
+		"jupyter",
+		ScalerChangedBy,
+		"scaledToZero",
+		string(marshaledChangedAt))
+
+	patch, _ := json.Marshal(jsonPatchMapper)
+	body, err := applyJSONPatch(newServiceSetBody(nil, map[string]string{"jupyter": "ready"}), patch)
+	if err != nil {
+		t.Fatalf("Failed to apply last change patch: %v", err)
+	}
+
+	serviceSet := map[string]interface{}{}
+	if err := json.Unmarshal(body, &serviceSet); err != nil {
+		t.Fatalf("Failed to unmarshal service set: %v", err)
+	}
+
+	lastChange, err := parseLastChange(getJSONPath(serviceSet, "/status/services/jupyter"))
+	if err != nil {
+		t.Fatalf("Failed to parse last change: %v", err)
+	}
+
+	expectedLastChange := &ServiceChange{
+		ChangedBy:    ScalerChangedBy,
+		DesiredState: "scaledToZero",
+		ChangedAt:    changedAt,
+	}
+	if lastChange == nil || !lastChange.ChangedAt.Equal(changedAt) ||
+		lastChange.ChangedBy != expectedLastChange.ChangedBy ||
+		lastChange.DesiredState != expectedLastChange.DesiredState {
+		t.Fatalf("Expected last change %+v, got %+v", expectedLastChange, lastChange)
+	}
+
+	// unrecorded changes parse as none, unparsable ones fail
+	if lastChange, err := parseLastChange(map[string]interface{}{"state": "ready"}); err != nil || lastChange != nil {
+		t.Fatalf("Expected no last change, got %+v, %v", lastChange, err)
+	}
+
+	if _, err := parseLastChange(map[string]interface{}{
+		"last_change": map[string]interface{}{"changed_by": ScalerChangedBy, "changed_at": "yesterday"},
+	}); err == nil {
+		t.Fatalf("Expected failing to parse an invalid change time")
+	}
+}
+
+func TestScaleRecordsLastChange(t *testing.T) {
+	scaleToZero := map[string]interface{}{
+		"mode": EnabledScaleToZeroMode,
+		"scale_resources": []interface{}{
+			map[string]interface{}{"metric_name": "num_of_requests", "threshold": 0, "window_size": "30m"},
+		},
+	}
+	serviceSetAPI := newFakeServiceSetAPI(newServiceSetBody(map[string]interface{}{
+		"jupyter": map[string]interface{}{"desired_state": "ready", "scale_to_zero": scaleToZero},
+	}, map[string]string{"jupyter": "ready"}))
+	serviceSetAPI.applyPatches = true
+	resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, newOwnershipTestOptions(time.Hour))
+
+	// the scale to zero patch is sent even though the fake API never completes it
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	resourceScaler.SetScaleCtx(ctx, []scalertypes.Resource{{Name: "jupyter"}}, 0) // nolint: errcheck
+
+	lastChange := getJSONPath(serviceSetAPI.serviceSet(t), "/status/services/jupyter/last_change")
+	lastChangeMap, _ := lastChange.(map[string]interface{})
+	if lastChangeMap["changed_by"] != ScalerChangedBy || lastChangeMap["desired_state"] != "scaledToZero" {
+		t.Fatalf("Expected last change by the scaler to scaledToZero, got %v", lastChange)
+	}
+
+	// the scaler's own change isn't taken for a manual one
+	serviceSet, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get service set: %v", err)
+	}
+
+	if controlledServices := resourceScaler.getManuallyControlledServices(context.Background(),
+		serviceSet,
+		[]string{"jupyter"}); len(controlledServices) != 0 {
+		t.Fatalf("Expected no manually controlled services, got %v", controlledServices)
+	}
+}
+
+func TestManualChangeWindow(t *testing.T) {
+	now := time.Now()
+	for _, testCase := range []struct {
+		name           string
+		spec           map[string]interface{}
+		status         map[string]interface{}
+		expectedReason string
+	}{
+		{
+			name:   "changed by the scaler",
+			spec:   map[string]interface{}{"desired_state": "scaledToZero"},
+			status: map[string]interface{}{"last_change": newLastChange(ScalerChangedBy, "scaledToZero", now)},
+		},
+		{
+			name:           "changed manually within the window",
+			spec:           map[string]interface{}{"desired_state": "ready"},
+			status:         map[string]interface{}{"last_change": newLastChange(ManualChangedBy, "ready", now.Add(-30*time.Minute))},
+			expectedReason: "Service was changed manually to ready",
+		},
+		{
+			name:   "changed manually past the window",
+			spec:   map[string]interface{}{"desired_state": "ready"},
+			status: map[string]interface{}{"last_change": newLastChange(ManualChangedBy, "ready", now.Add(-2*time.Hour))},
+		},
+		{
+			name: "held",
+			spec: map[string]interface{}{
+				"desired_state": "ready",
+				"scale_to_zero": map[string]interface{}{"hold": true},
+			},
+			status:         map[string]interface{}{"last_change": newLastChange(ScalerChangedBy, "ready", now)},
+			expectedReason: "Service is held",
+		},
+		{
+			name: "invalid hold",
+			spec: map[string]interface{}{
+				"desired_state": "ready",
+				"scale_to_zero": map[string]interface{}{"hold": "yes"},
+			},
+			expectedReason: "Invalid hold",
+		},
+		{
+			name:           "changed manually since the scaler's change",
+			spec:           map[string]interface{}{"desired_state": "ready"},
+			status:         map[string]interface{}{"last_change": newLastChange(ScalerChangedBy, "scaledToZero", now.Add(-2*time.Hour))},
+			expectedReason: "Service was changed manually to ready",
+		},
+		{
+			name: "changed manually since the scaler's last scale event",
+			spec: map[string]interface{}{"desired_state": "ready"},
+			status: map[string]interface{}{"scale_to_zero": map[string]interface{}{
+				"last_scale_event":      string(scalertypes.ScaleToZeroCompletedScaleEvent),
+				"last_scale_event_time": now.Add(-2 * time.Hour).Format(time.RFC3339),
+			}},
+			expectedReason: "Service was changed manually to ready",
+		},
+		{
+			name:   "never changed by the scaler",
+			spec:   map[string]interface{}{"desired_state": "ready"},
+			status: map[string]interface{}{},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			serviceSetAPI := newFakeServiceSetAPI(newOwnershipServiceSetBody(t,
+				"ready",
+				map[string]interface{}{"jupyter": testCase.spec},
+				map[string]interface{}{"jupyter": testCase.status}))
+			resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, newOwnershipTestOptions(time.Hour))
+
+			serviceSet, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background())
+			if err != nil {
+				t.Fatalf("Failed to get service set: %v", err)
+			}
+
+			controlledServices := resourceScaler.getManuallyControlledServices(context.Background(),
+				serviceSet,
+				[]string{"jupyter"})
+			reason, controlled := controlledServices["jupyter"]
+			if controlled != (testCase.expectedReason != "") || !strings.HasPrefix(reason, testCase.expectedReason) {
+				t.Fatalf("Expected reason %q, got %v", testCase.expectedReason, controlledServices)
+			}
+
+			// let changes being recorded in the background finish before the fake API is closed
+			waitForManualChangesRecorded(t, resourceScaler)
+		})
+	}
+}
+
+func TestRecordManualChanges(t *testing.T) {
+	serviceSpecs := map[string]interface{}{"jupyter": map[string]interface{}{
+		"desired_state": "ready",
+		"scale_to_zero": map[string]interface{}{
+			"mode": EnabledScaleToZeroMode,
+			"scale_resources": []interface{}{
+				map[string]interface{}{"metric_name": "num_of_requests", "threshold": 0, "window_size": "30m"},
+			},
+		},
+	}}
+	serviceStatuses := map[string]interface{}{"jupyter": map[string]interface{}{
+		"state":       "ready",
+		"last_change": newLastChange(ScalerChangedBy, "scaledToZero", time.Now().Add(-2*time.Hour)),
+	}}
+	serviceSetAPI := newFakeServiceSetAPI(newOwnershipServiceSetBody(t, "provisioning", serviceSpecs, serviceStatuses))
+	serviceSetAPI.applyPatches = true
+	resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, newOwnershipTestOptions(time.Hour))
+	manualChanges := testutil.ToFloat64(manualChangesCounter.WithLabelValues("default-tenant"))
+
+	// the getter skips the service and detects the change, but leaves recording it to a mutation that waits for
+	// provisioning to finish
+	for i := 0; i < 2; i++ {
+		resources, err := resourceScaler.GetResources()
+		if err != nil {
+			t.Fatalf("Failed to get resources: %v", err)
+		}
+
+		if len(resources) != 0 {
+			t.Fatalf("Expected no resources, got %v", resources)
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if patchOperations := serviceSetAPI.patchOperations(t); len(patchOperations) != 0 {
+		t.Fatalf("Expected no patches while provisioning, got %v", patchOperations)
+	}
+
+	if detected := testutil.ToFloat64(manualChangesCounter.WithLabelValues("default-tenant")) - manualChanges; detected != 1 {
+		t.Fatalf("Expected the change to be detected once, got %v", detected)
+	}
+
+	serviceSetAPI.lock.Lock()
+	serviceSetAPI.body = newOwnershipServiceSetBody(t, "ready", serviceSpecs, serviceStatuses)
+	serviceSetAPI.lock.Unlock()
+
+	patchOperations := waitForPatches(t, serviceSetAPI, 1)
+	if _, found := findPatchOperation(patchOperations[0],
+		"test",
+		"/spec/spec/tenants/0/spec/services/jupyter/desired_state"); !found {
+		t.Fatalf("Expected the desired state to be tested, got %v", patchOperations[0])
+	}
+
+	// only the status is recorded, there's nothing to provision
+	if _, found := findPatchOperation(patchOperations[0], "add", "/status/state"); found {
+		t.Fatalf("Expected the service set state to be left as is, got %v", patchOperations[0])
+	}
+
+	recordedLastChange := getJSONPath(serviceSetAPI.serviceSet(t), "/status/services/jupyter/last_change")
+	recordedLastChangeMap, _ := recordedLastChange.(map[string]interface{})
+	if recordedLastChangeMap["changed_by"] != ManualChangedBy || recordedLastChangeMap["desired_state"] != "ready" {
+		t.Fatalf("Expected a manual change to ready, got %v", recordedLastChange)
+	}
+
+	// once recorded the change is no longer detected, and the service stays controlled for the window
+	serviceSet, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get service set: %v", err)
+	}
+
+	controlledServices := resourceScaler.getManuallyControlledServices(context.Background(),
+		serviceSet,
+		[]string{"jupyter"})
+	if _, controlled := controlledServices["jupyter"]; !controlled {
+		t.Fatalf("Expected jupyter to be manually controlled, got %v", controlledServices)
+	}
+
+	waitForManualChangesRecorded(t, resourceScaler)
+	if patchOperations := serviceSetAPI.patchOperations(t); len(patchOperations) != 1 {
+		t.Fatalf("Expected a single patch, got %v", patchOperations)
+	}
+}
+
+func TestRecordManualChangesChangedAgain(t *testing.T) {
+	serviceSpecs := map[string]interface{}{"jupyter": map[string]interface{}{"desired_state": "ready"}}
+	serviceStatuses := map[string]interface{}{"jupyter": map[string]interface{}{
+		"state":       "ready",
+		"last_change": newLastChange(ScalerChangedBy, "scaledToZero", time.Now().Add(-2*time.Hour)),
+	}}
+	serviceSetAPI := newFakeServiceSetAPI(newOwnershipServiceSetBody(t, "provisioning", serviceSpecs, serviceStatuses))
+	serviceSetAPI.applyPatches = true
+	resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, newOwnershipTestOptions(0))
+
+	serviceSet, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get service set: %v", err)
+	}
+
+	// without a window the change is only recorded
+	if controlledServices := resourceScaler.getManuallyControlledServices(context.Background(),
+		serviceSet,
+		[]string{"jupyter"}); len(controlledServices) != 0 {
+		t.Fatalf("Expected no manually controlled services, got %v", controlledServices)
+	}
+
+	// the desired state is changed again before the change is recorded
+	serviceSpecs["jupyter"] = map[string]interface{}{"desired_state": "scaledToZero"}
+	serviceSetAPI.lock.Lock()
+	serviceSetAPI.body = newOwnershipServiceSetBody(t, "ready", serviceSpecs, serviceStatuses)
+	serviceSetAPI.lock.Unlock()
+
+	waitForPatches(t, serviceSetAPI, 1)
+	waitForManualChangesRecorded(t, resourceScaler)
+	lastChange := getJSONPath(serviceSetAPI.serviceSet(t), "/status/services/jupyter/last_change")
+	if !reflect.DeepEqual(lastChange, serviceStatuses["jupyter"].(map[string]interface{})["last_change"]) {
+		t.Fatalf("Expected the last change to be left as is, got %v", lastChange)
+	}
+}
+
+func TestManuallyControlledServicesRefusePrewarm(t *testing.T) {
+	serviceSetAPI := newFakeServiceSetAPI(newOwnershipServiceSetBody(t,
+		"ready",
+		map[string]interface{}{"jupyter": map[string]interface{}{
+			"desired_state": "scaledToZero",
+			"scale_to_zero": map[string]interface{}{
+				"mode": EnabledScaleToZeroMode,
+				"hold": true,
+				"scale_resources": []interface{}{
+					map[string]interface{}{"metric_name": "num_of_requests", "threshold": 0, "window_size": "30m"},
+				},
+			},
+		}},
+		map[string]interface{}{"jupyter": map[string]interface{}{"state": "scaledToZero"}}))
+	resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, newOwnershipTestOptions(time.Hour))
+
+	for _, trigger := range []string{DLXTrigger, PrewarmTrigger, PredictionTrigger} {
+		ctx := WithTrigger(context.Background(), trigger)
+		var err error
+		if trigger == DLXTrigger {
+			err = resourceScaler.SetScaleCtx(ctx, []scalertypes.Resource{{Name: "jupyter"}}, 1)
+		} else {
+			err = resourceScaler.PrewarmService(ctx, "jupyter", time.Hour)
+		}
+
+		if !errors.Is(err, ErrServiceManuallyControlled) {
+			t.Fatalf("Expected %s to be refused as manually controlled, got %v", trigger, err)
+		}
+	}
+
+	// nor was the service pinned for the pre-warm
+	if patchOperations := serviceSetAPI.patchOperations(t); len(patchOperations) != 0 {
+		t.Fatalf("Expected no patches, got %v", patchOperations)
+	}
+}
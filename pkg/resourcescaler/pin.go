@@ -0,0 +1,313 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nuclio/errors"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+var (
+
+	// ErrServiceNotFound is the cause of operations on services missing from the service set
+	ErrServiceNotFound = errors.New("Service not found")
+
+	// ErrServiceNotScalable is the cause of pinning services that don't take part in scale to zero
+	ErrServiceNotScalable = errors.New("Service does not take part in scale to zero")
+
+	// ErrPinConflict is the cause of pins that failed because the service set kept changing while they were written
+	ErrPinConflict = errors.New("Service set changed while pinning")
+)
+
+// the attempts to write a pin while the service set keeps changing
+const pinPatchAttempts = 3
+
+// ServicePin keeps a service from being scaled to zero until it expires
+type ServicePin struct {
+	Service     string    `json:"service"`
+	PinnedUntil time.Time `json:"pinnedUntil"`
+	State       string    `json:"state,omitempty"`
+	Expired     bool      `json:"expired"`
+}
+
+// ParsePinnedUntil parses the pin of a single service spec, under scale_to_zero.pinned_until. A zero result with
+// no error means the service isn't pinned
+func ParsePinnedUntil(serviceSpecInterface interface{}) (time.Time, error) {
+	serviceSpec, ok := serviceSpecInterface.(map[string]interface{})
+	if !ok {
+		return time.Time{}, errors.New("Service spec type assertion failed")
+	}
+
+	scaleToZeroSpec, ok := serviceSpec["scale_to_zero"].(map[string]interface{})
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	pinnedUntilInterface, found := scaleToZeroSpec["pinned_until"]
+	if !found {
+		return time.Time{}, nil
+	}
+
+	pinnedUntilString, ok := pinnedUntilInterface.(string)
+	if !ok {
+		return time.Time{}, errors.New("Pinned until is not a string")
+	}
+
+	pinnedUntil, err := time.Parse(time.RFC3339, pinnedUntilString)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "Failed to parse pinned until")
+	}
+
+	return pinnedUntil, nil
+}
+
+// GetServicePins returns the pins of all the pinned services, including expired ones, sorted by service name
+func (s *AppResourceScaler) GetServicePins(ctx context.Context) ([]ServicePin, error) {
+	serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get iguazio tenant app service sets")
+	}
+
+	servicePins := make([]ServicePin, 0)
+	for serviceName, serviceSpec := range serviceSet.specServices {
+		pinnedUntil, err := ParsePinnedUntil(serviceSpec)
+		if err != nil {
+			s.logger.WarnWithCtx(ctx, "Failed parsing the service pin, continuing", s.operationLogVars(ctx,
+				"services", []string{serviceName},
+				"err", errors.GetErrorStackString(err, 10))...)
+			continue
+		}
+
+		if pinnedUntil.IsZero() {
+			continue
+		}
+
+		servicePins = append(servicePins, ServicePin{
+			Service:     serviceName,
+			PinnedUntil: pinnedUntil,
+			State:       getServiceStatusState(serviceSet.statusServices[serviceName]),
+			Expired:     !time.Now().Before(pinnedUntil),
+		})
+	}
+
+	sort.Slice(servicePins, func(i, j int) bool {
+		return servicePins[i].Service < servicePins[j].Service
+	})
+
+	return servicePins, nil
+}
+
+// PinService keeps a service from being scaled to zero until the given time. The pin is set in the service's
+// scale_to_zero spec, and mirrored to its status so it's visible along the service's state
+func (s *AppResourceScaler) PinService(ctx context.Context, serviceName string, pinnedUntil time.Time) error {
+	ctx = s.pinOperationContext(ctx)
+
+	return s.patchPin(ctx, serviceName, func(serviceSet *iguazioTenantAppServiceSet) ([]map[string]interface{}, error) {
+		serviceSpec, found := serviceSet.specServices[serviceName]
+		if !found {
+			return nil, errors.Wrapf(ErrServiceNotFound, "Failed to pin service %s", serviceName)
+		}
+
+		scaleResources, err := ParseScaleResources(serviceSpec)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to parse scale resources")
+		}
+
+		if len(scaleResources) == 0 {
+			return nil, errors.Wrapf(ErrServiceNotScalable, "Failed to pin service %s", serviceName)
+		}
+
+		marshaledPinnedUntil := pinnedUntil.UTC().Format(time.RFC3339)
+		jsonPatchMapper := []map[string]interface{}{
+			{
+				"op":    "add",
+				"path":  fmt.Sprintf("/spec/spec/tenants/0/spec/services/%s/scale_to_zero/pinned_until", serviceName),
+				"value": marshaledPinnedUntil,
+			},
+		}
+
+		if _, found := serviceSet.statusServices[serviceName]; found {
+			jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
+				"op":    "add",
+				"path":  fmt.Sprintf("/status/services/%s/pinned_until", serviceName),
+				"value": marshaledPinnedUntil,
+			})
+		}
+
+		s.logger.InfoWithCtx(ctx, "Pinning service", s.operationLogVars(ctx,
+			"services", []string{serviceName},
+			"pinnedUntil", marshaledPinnedUntil)...)
+
+		return jsonPatchMapper, nil
+	})
+}
+
+// UnpinService removes the pin of a service, if it has one
+func (s *AppResourceScaler) UnpinService(ctx context.Context, serviceName string) error {
+	ctx = s.pinOperationContext(ctx)
+
+	return s.patchPin(ctx, serviceName, func(serviceSet *iguazioTenantAppServiceSet) ([]map[string]interface{}, error) {
+		serviceSpec, found := serviceSet.specServices[serviceName]
+		if !found {
+			return nil, errors.Wrapf(ErrServiceNotFound, "Failed to unpin service %s", serviceName)
+		}
+
+		var jsonPatchMapper []map[string]interface{}
+		serviceSpecMap, _ := serviceSpec.(map[string]interface{})
+		if scaleToZeroSpec, ok := serviceSpecMap["scale_to_zero"].(map[string]interface{}); ok {
+			if _, found := scaleToZeroSpec["pinned_until"]; found {
+				jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
+					"op":   "remove",
+					"path": fmt.Sprintf("/spec/spec/tenants/0/spec/services/%s/scale_to_zero/pinned_until", serviceName),
+				})
+			}
+		}
+
+		if serviceStatus, ok := serviceSet.statusServices[serviceName].(map[string]interface{}); ok {
+			if _, found := serviceStatus["pinned_until"]; found {
+				jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
+					"op":   "remove",
+					"path": fmt.Sprintf("/status/services/%s/pinned_until", serviceName),
+				})
+			}
+		}
+
+		if len(jsonPatchMapper) > 0 {
+			s.logger.InfoWithCtx(ctx, "Unpinning service", s.operationLogVars(ctx,
+				"services", []string{serviceName})...)
+		}
+
+		return jsonPatchMapper, nil
+	})
+}
+
+// patchPin patches the service set with the pin operations of a service, nothing if there are none. Pins don't go
+// through the mutation queue, so the service set is read uncached and the patch fails rather than overwrite a
+// service set that changed since it was read, e.g. by a queued scale patch. It's then read and patched again, up to
+// pinPatchAttempts times
+func (s *AppResourceScaler) patchPin(ctx context.Context,
+	serviceName string,
+	pinJSONPatchOperations func(*iguazioTenantAppServiceSet) ([]map[string]interface{}, error)) error {
+
+	for attempt := 1; ; attempt++ {
+		serviceSet, err := s.readIguazioTenantAppServiceSets(ctx)
+		if err != nil {
+			return errors.Wrap(err, "Failed to get iguazio tenant app service sets")
+		}
+
+		jsonPatchMapper, err := pinJSONPatchOperations(serviceSet)
+		if err != nil {
+			return err
+		}
+
+		if len(jsonPatchMapper) == 0 {
+			return nil
+		}
+
+		jsonPatchMapper = append([]map[string]interface{}{
+			{
+				"op":    "test",
+				"path":  "/metadata/resourceVersion",
+				"value": serviceSet.resourceVersion,
+			},
+		}, jsonPatchMapper...)
+
+		err = s.sendUnqueuedPatch(ctx,
+			s.namespace,
+			[]string{serviceName},
+			"",
+			jsonPatchMapper,
+			serviceSet)
+		if err == nil {
+			return nil
+		}
+
+		// the API server rejects patches whose test fails as invalid
+		if !k8serrors.IsInvalid(err) {
+			return errors.Wrap(err, "Failed to patch iguazio tenant app service sets")
+		}
+
+		if attempt == pinPatchAttempts {
+			return errors.Wrapf(ErrPinConflict, "Service set kept changing after %d attempts", pinPatchAttempts)
+		}
+
+		s.logger.DebugWithCtx(ctx, "Service set changed while pinning, retrying", s.operationLogVars(ctx,
+			"services", []string{serviceName},
+			"attempt", attempt)...)
+	}
+}
+
+func (s *AppResourceScaler) pinOperationContext(ctx context.Context) context.Context {
+	if GetOperationID(ctx) == "" {
+		ctx = WithOperationID(ctx, newOperationID())
+	}
+
+	if GetTrigger(ctx) == "" {
+		ctx = WithTrigger(ctx, APITrigger)
+	}
+
+	return ctx
+}
+
+// filterPinnedServices returns the services that aren't pinned, as services may have been pinned since they were
+// offered for scale to zero
+func (s *AppResourceScaler) filterPinnedServices(ctx context.Context,
+	serviceSet *iguazioTenantAppServiceSet,
+	serviceNames []string) []string {
+
+	now := time.Now()
+
+	var allowedServiceNames []string
+	for _, serviceName := range serviceNames {
+		pinned, err := isPinned(serviceSet.specServices[serviceName], now)
+		if err != nil {
+			s.logger.WarnWithCtx(ctx, "Failed parsing the service pin, skipping", s.operationLogVars(ctx,
+				"services", []string{serviceName},
+				"err", errors.GetErrorStackString(err, 10))...)
+			continue
+		}
+
+		if pinned {
+			s.logger.InfoWithCtx(ctx, "Service was pinned, not scaling to zero", s.operationLogVars(ctx,
+				"services", []string{serviceName})...)
+			continue
+		}
+
+		allowedServiceNames = append(allowedServiceNames, serviceName)
+	}
+
+	return allowedServiceNames
+}
+
+// isPinned returns whether the service spec has a pin that didn't expire yet
+func isPinned(serviceSpec interface{}, now time.Time) (bool, error) {
+	pinnedUntil, err := ParsePinnedUntil(serviceSpec)
+	if err != nil {
+		return false, err
+	}
+
+	return now.Before(pinnedUntil), nil
+}
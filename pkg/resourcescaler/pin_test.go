@@ -0,0 +1,234 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// newPinServiceSpec returns the spec of a service taking part in scale to zero, pinned until the given time if any
+func newPinServiceSpec(pinnedUntil string) map[string]interface{} {
+	scaleToZeroSpec := map[string]interface{}{
+		"mode": EnabledScaleToZeroMode,
+		"scale_resources": []interface{}{
+			map[string]interface{}{"metric_name": "num_of_requests", "threshold": 0, "window_size": "30m"},
+		},
+	}
+	if pinnedUntil != "" {
+		scaleToZeroSpec["pinned_until"] = pinnedUntil
+	}
+
+	return map[string]interface{}{"desired_state": "ready", "scale_to_zero": scaleToZeroSpec}
+}
+
+func newPinTestAppResourceScaler(tb testing.TB, handler http.Handler) *AppResourceScaler {
+	options := NewDefaultOptions()
+	options.ServiceSetCacheTTL = scalertypes.Duration{}
+	return newTestAppResourceScaler(tb, handler, options)
+}
+
+func TestGetResourcesSkipsPinnedServices(t *testing.T) {
+	now := time.Now()
+	serviceSetAPI := newFakeServiceSetAPI(newServiceSetBody(map[string]interface{}{
+		"jupyter": newPinServiceSpec(now.Add(time.Hour).UTC().Format(time.RFC3339)),
+		"spark":   newPinServiceSpec(now.Add(-time.Hour).UTC().Format(time.RFC3339)),
+		"presto":  newPinServiceSpec(""),
+	}, map[string]string{"jupyter": "ready", "spark": "ready", "presto": "ready"}))
+	resourceScaler := newPinTestAppResourceScaler(t, serviceSetAPI)
+
+	resources, err := resourceScaler.GetResources()
+	if err != nil {
+		t.Fatalf("Failed to get resources: %v", err)
+	}
+
+	var resourceNames []string
+	for _, resource := range resources {
+		resourceNames = append(resourceNames, resource.Name)
+	}
+	sort.Strings(resourceNames)
+
+	// spark's pin expired
+	if !stringSlicesEqual(resourceNames, []string{"presto", "spark"}) {
+		t.Fatalf("Expected presto and spark, got %v", resourceNames)
+	}
+}
+
+func TestPinService(t *testing.T) {
+	serviceSetAPI := newFakeServiceSetAPI(newServiceSetBody(map[string]interface{}{
+		"jupyter": newPinServiceSpec(""),
+		"presto":  map[string]interface{}{"desired_state": "ready"},
+	}, map[string]string{"jupyter": "ready", "presto": "ready"}))
+	serviceSetAPI.applyPatches = true
+	resourceScaler := newPinTestAppResourceScaler(t, serviceSetAPI)
+	pinnedUntil := time.Date(2030, 5, 15, 9, 0, 0, 0, time.UTC)
+
+	if err := resourceScaler.PinService(context.Background(), "jupyter", pinnedUntil); err != nil {
+		t.Fatalf("Failed to pin service: %v", err)
+	}
+
+	patchOperations := serviceSetAPI.patchOperations(t)
+	if len(patchOperations) != 1 {
+		t.Fatalf("Expected a single patch, got %v", patchOperations)
+	}
+
+	if _, found := findPatchOperation(patchOperations[0], "test", "/metadata/resourceVersion"); !found {
+		t.Fatalf("Expected the resource version to be tested, got %v", patchOperations[0])
+	}
+
+	serviceSet := serviceSetAPI.serviceSet(t)
+	for _, path := range []string{
+		"/spec/spec/tenants/0/spec/services/jupyter/scale_to_zero/pinned_until",
+		"/status/services/jupyter/pinned_until",
+	} {
+		if value := getJSONPath(serviceSet, path); value != "2030-05-15T09:00:00Z" {
+			t.Fatalf("Expected %s to be the pin time, got %v", path, value)
+		}
+	}
+
+	for _, testCase := range []struct {
+		serviceName string
+		expectedErr error
+	}{
+		{serviceName: "spark", expectedErr: ErrServiceNotFound},
+		{serviceName: "presto", expectedErr: ErrServiceNotScalable},
+	} {
+		if err := resourceScaler.PinService(context.Background(),
+			testCase.serviceName,
+			pinnedUntil); !errors.Is(err, testCase.expectedErr) {
+			t.Fatalf("Expected pinning %s to fail with %v, got %v", testCase.serviceName, testCase.expectedErr, err)
+		}
+	}
+
+	if patchOperations := serviceSetAPI.patchOperations(t); len(patchOperations) != 1 {
+		t.Fatalf("Expected failed pins not to patch, got %v", patchOperations)
+	}
+}
+
+func TestUnpinService(t *testing.T) {
+	pinnedUntil := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	serviceSetAPI := newFakeServiceSetAPI(newServiceSetBody(map[string]interface{}{
+		"jupyter": newPinServiceSpec(pinnedUntil),
+	}, map[string]string{"jupyter": "ready"}))
+	serviceSetAPI.applyPatches = true
+	resourceScaler := newPinTestAppResourceScaler(t, serviceSetAPI)
+
+	if err := resourceScaler.PinService(context.Background(), "jupyter", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to pin service: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := resourceScaler.UnpinService(context.Background(), "jupyter"); err != nil {
+			t.Fatalf("Failed to unpin service: %v", err)
+		}
+	}
+
+	// unpinning a service that isn't pinned doesn't patch
+	patchOperations := serviceSetAPI.patchOperations(t)
+	if len(patchOperations) != 2 {
+		t.Fatalf("Expected a pin and an unpin patch, got %v", patchOperations)
+	}
+
+	serviceSet := serviceSetAPI.serviceSet(t)
+	for _, path := range []string{
+		"/spec/spec/tenants/0/spec/services/jupyter/scale_to_zero/pinned_until",
+		"/status/services/jupyter/pinned_until",
+	} {
+		if value := getJSONPath(serviceSet, path); value != nil {
+			t.Fatalf("Expected %s to be removed, got %v", path, value)
+		}
+	}
+}
+
+func TestPinServiceConflicts(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		conflicts   int
+		expectedErr error
+	}{
+		{name: "retried", conflicts: pinPatchAttempts - 1},
+		{name: "kept changing", conflicts: pinPatchAttempts, expectedErr: ErrPinConflict},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			serviceSetAPI := newFakeServiceSetAPI(newServiceSetBody(map[string]interface{}{
+				"jupyter": newPinServiceSpec(""),
+			}, map[string]string{"jupyter": "ready"}))
+			serviceSetAPI.applyPatches = true
+
+			// the service set changes between each read and the pin patch
+			conflicts := testCase.conflicts
+			resourceScaler := newPinTestAppResourceScaler(t, http.HandlerFunc(func(responseWriter http.ResponseWriter,
+				request *http.Request) {
+				if request.Method == http.MethodPatch && conflicts > 0 {
+					conflicts--
+					serviceSetAPI.lock.Lock()
+					serviceSetAPI.body, _ = applyJSONPatch(serviceSetAPI.body, []byte(fmt.Sprintf(
+						`[{"op": "replace", "path": "/metadata/resourceVersion", "value": "changed-%d"}]`,
+						conflicts)))
+					serviceSetAPI.lock.Unlock()
+				}
+
+				serviceSetAPI.ServeHTTP(responseWriter, request)
+			}))
+
+			err := resourceScaler.PinService(context.Background(), "jupyter", time.Now().Add(time.Hour))
+			if !errors.Is(err, testCase.expectedErr) {
+				t.Fatalf("Expected %v, got %v", testCase.expectedErr, err)
+			}
+
+			if patchOperations := serviceSetAPI.patchOperations(t); len(patchOperations) != pinPatchAttempts {
+				t.Fatalf("Expected %d attempts, got %d", pinPatchAttempts, len(patchOperations))
+			}
+
+			pinned := getJSONPath(serviceSetAPI.serviceSet(t),
+				"/spec/spec/tenants/0/spec/services/jupyter/scale_to_zero/pinned_until") != nil
+			if pinned != (testCase.expectedErr == nil) {
+				t.Fatalf("Expected pinned %t, got %t", testCase.expectedErr == nil, pinned)
+			}
+		})
+	}
+}
+
+func TestScaleToZeroSkipsPinnedServices(t *testing.T) {
+
+	// jupyter was pinned after it was offered for scale to zero
+	serviceSetAPI := newFakeServiceSetAPI(newServiceSetBody(map[string]interface{}{
+		"jupyter": newPinServiceSpec(time.Now().Add(time.Hour).UTC().Format(time.RFC3339)),
+	}, map[string]string{"jupyter": "ready"}))
+	resourceScaler := newPinTestAppResourceScaler(t, serviceSetAPI)
+
+	if err := resourceScaler.scaleServicesToZero(context.Background(),
+		"default-tenant",
+		[]string{"jupyter"}); err != nil {
+		t.Fatalf("Failed to scale to zero: %v", err)
+	}
+
+	if patchOperations := serviceSetAPI.patchOperations(t); len(patchOperations) != 0 {
+		t.Fatalf("Expected no patches, got %v", patchOperations)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/accounting"
+
+	"github.com/nuclio/errors"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// PrewarmSpec is a service's own pre-warm settings, declared under scale_to_zero.prewarm, overriding the global ones
+type PrewarmSpec struct {
+
+	// times of day, as HH:MM. An empty schedule opts the service out of scheduled pre-warming, nil keeps the
+	// global schedule
+	Schedule []string
+
+	// the location the schedule is in, empty for the global one
+	Timezone string
+
+	// whether the service is pre-warmed when it's predicted to be used
+	Predict bool
+}
+
+// ScaledToZeroService is a service currently scaled to zero
+type ScaledToZeroService struct {
+	Name string
+
+	// nil if the service doesn't declare its own pre-warm schedule
+	Prewarm *PrewarmSpec
+}
+
+// ParsePrewarmSpec parses the pre-warm settings of a single service spec. A nil result with no error means the
+// service has no settings of its own, or doesn't take part in scale to zero
+func ParsePrewarmSpec(serviceSpecInterface interface{}) (*PrewarmSpec, error) {
+	serviceSpec, ok := serviceSpecInterface.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Service spec type assertion failed")
+	}
+
+	scaleToZeroSpec, ok := serviceSpec["scale_to_zero"].(map[string]interface{})
+	if !ok || scaleToZeroSpec["mode"] != EnabledScaleToZeroMode {
+		return nil, nil
+	}
+
+	prewarmInterface, found := scaleToZeroSpec["prewarm"]
+	if !found {
+		return nil, nil
+	}
+
+	prewarmSpec, ok := prewarmInterface.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Prewarm is not an object")
+	}
+
+	prewarm := &PrewarmSpec{Predict: true}
+
+	if scheduleInterface, found := prewarmSpec["schedule"]; found {
+		schedule, ok := scheduleInterface.([]interface{})
+		if !ok {
+			return nil, errors.New("Prewarm schedule is not a list")
+		}
+
+		prewarm.Schedule = []string{}
+
+		for _, timeOfDayInterface := range schedule {
+			timeOfDay, ok := timeOfDayInterface.(string)
+			if !ok {
+				return nil, errors.New("Prewarm schedule time is not a string")
+			}
+
+			if _, err := ParseTimeOfDay(timeOfDay); err != nil {
+				return nil, errors.Wrap(err, "Failed to parse prewarm schedule time")
+			}
+
+			prewarm.Schedule = append(prewarm.Schedule, timeOfDay)
+		}
+	}
+
+	if timezoneInterface, found := prewarmSpec["timezone"]; found {
+		prewarm.Timezone, ok = timezoneInterface.(string)
+		if !ok {
+			return nil, errors.New("Prewarm timezone is not a string")
+		}
+
+		if _, err := time.LoadLocation(prewarm.Timezone); err != nil {
+			return nil, errors.Wrap(err, "Failed to load prewarm timezone")
+		}
+	}
+
+	if predictInterface, found := prewarmSpec["predict"]; found {
+		prewarm.Predict, ok = predictInterface.(bool)
+		if !ok {
+			return nil, errors.New("Prewarm predict is not a boolean")
+		}
+	}
+
+	return prewarm, nil
+}
+
+// ParseTimeOfDay parses a time of day, as HH:MM, returning its offset from midnight
+func ParseTimeOfDay(timeOfDay string) (time.Duration, error) {
+	parsedTime, err := time.Parse("15:04", timeOfDay)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Invalid time of day %q, expected HH:MM", timeOfDay)
+	}
+
+	return time.Duration(parsedTime.Hour())*time.Hour + time.Duration(parsedTime.Minute())*time.Minute, nil
+}
+
+// GetScaledToZeroServices returns the services taking part in scale to zero that are currently scaled to zero
+func (s *AppResourceScaler) GetScaledToZeroServices(ctx context.Context) ([]ScaledToZeroService, error) {
+	serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get iguazio tenant app service sets")
+	}
+
+	options := s.getOptions()
+	scaledToZeroServices := make([]ScaledToZeroService, 0)
+	for serviceName, serviceStatus := range serviceSet.statusServices {
+		if serviceName == "nuclio" || stringSliceContainsString(options.ExcludedServices, serviceName) {
+			continue
+		}
+
+		if state, err := s.parseServiceState(serviceStatus); err != nil || state != "scaledToZero" {
+			continue
+		}
+
+		serviceSpec, found := serviceSet.specServices[serviceName]
+		if !found {
+			continue
+		}
+
+		prewarm, err := ParsePrewarmSpec(serviceSpec)
+		if err != nil {
+			s.logger.WarnWith("Failed parsing the service prewarm schedule, continuing",
+				"namespace", s.namespace,
+				"services", []string{serviceName},
+				"err", errors.GetErrorStackString(err, 10))
+			continue
+		}
+
+		scaledToZeroServices = append(scaledToZeroServices, ScaledToZeroService{
+			Name:    serviceName,
+			Prewarm: prewarm,
+		})
+	}
+
+	return scaledToZeroServices, nil
+}
+
+// PrewarmService scales a service from zero ahead of expected usage, pinning it for the grace period first so the
+// autoscaler doesn't scale it back to zero before it's used. A longer pin is kept as is. The operation is triggered
+// by PrewarmTrigger unless the context says otherwise, and keeps the replica count the service declares. Manually
+// controlled services are refused, as they are by any other scale from zero
+func (s *AppResourceScaler) PrewarmService(ctx context.Context, serviceName string, gracePeriod time.Duration) error {
+	if GetOperationID(ctx) == "" {
+		ctx = WithOperationID(ctx, newOperationID())
+	}
+
+	if GetTrigger(ctx) == "" {
+		ctx = WithTrigger(ctx, PrewarmTrigger)
+	}
+
+	serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get iguazio tenant app service sets")
+	}
+
+	// checked before pinning as well, so manually controlled services aren't pinned for nothing
+	if err := s.checkManuallyControlledServices(ctx, serviceSet, []string{serviceName}); err != nil {
+		return err
+	}
+
+	pinnedUntil, err := ParsePinnedUntil(serviceSet.specServices[serviceName])
+	if err != nil {
+		return errors.Wrap(err, "Failed to parse pinned until")
+	}
+
+	graceUntil := time.Now().Add(gracePeriod)
+	if pinnedUntil.Before(graceUntil) {
+		if err := s.PinService(ctx, serviceName, graceUntil); err != nil {
+			return errors.Wrap(err, "Failed to pin service for the grace period")
+		}
+	}
+
+	return s.SetScaleCtx(WithDeclaredReplicas(ctx), []scalertypes.Resource{{Name: serviceName}}, 1)
+}
+
+// ScaleEvents returns the recorded scale events between from and to, by service
+func (s *AppResourceScaler) ScaleEvents(ctx context.Context,
+	from time.Time,
+	to time.Time) (map[string][]accounting.ScaleEvent, error) {
+	if s.ledger == nil {
+		return nil, ErrAccountingDisabled
+	}
+
+	return s.ledger.ScaleEvents(ctx, from, to)
+}
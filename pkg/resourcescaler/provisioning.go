@@ -0,0 +1,254 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/audit"
+
+	"github.com/nuclio/errors"
+	"github.com/v3io/scaler/pkg/scalertypes"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	stuckProvisioningEventReason          = "StuckProvisioning"
+	stuckProvisioningRecoveredEventReason = "StuckProvisioningRecovered"
+)
+
+// StuckProvisioningError is returned when the service set stays in the same provisioning state for longer than
+// the stuck provisioning timeout
+type StuckProvisioningError struct {
+	State string
+	Since time.Time
+
+	// whether the state is one written by the scaler itself, e.g. by a scaler that crashed mid operation
+	OwnState bool
+}
+
+func (e *StuckProvisioningError) Error() string {
+	return fmt.Sprintf("Service set is stuck in provisioning state %s since %s",
+		e.State,
+		e.Since.Format(time.RFC3339))
+}
+
+// provisioningStateTracker tracks for how long the service set has been in its current state
+type provisioningStateTracker struct {
+	lock     sync.Mutex
+	state    string
+	since    time.Time
+	reported bool
+}
+
+// observe records the current state, returning since when it's been in it - persistedSince if known from the
+// service set, otherwise when it was first observed by this process
+func (t *provisioningStateTracker) observe(namespace string, state string, persistedSince time.Time) time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	since := persistedSince
+	if since.IsZero() {
+		since = t.since
+		if state != t.state || since.IsZero() {
+			since = time.Now()
+		}
+	}
+
+	if state != t.state || !since.Equal(t.since) {
+		if t.reported {
+			stuckProvisioningGauge.WithLabelValues(namespace).Set(0)
+		}
+
+		t.state = state
+		t.since = since
+		t.reported = false
+	}
+
+	return t.since
+}
+
+// report returns true the first time it's called for the state observed since
+func (t *provisioningStateTracker) report(state string, since time.Time) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.reported || t.state != state || !t.since.Equal(since) {
+		return false
+	}
+
+	t.reported = true
+	return true
+}
+
+func isOwnProvisioningState(state string) bool {
+	return state == string(scaleFromZeroProvisioningState) || state == string(scaleToZeroProvisioningState)
+}
+
+// appendProvisioningStateJSONPatchOperations sets the service set's state to one of the scaler's own, recording
+// when it was set next to it, so its staleness is known across restarts of the scaler
+func appendProvisioningStateJSONPatchOperations(jsonPatchMapper []map[string]interface{},
+	provisioningState ProvisioningState,
+	marshaledTime []byte) []map[string]interface{} {
+
+	return append(jsonPatchMapper, map[string]interface{}{
+		"op":    "add",
+		"path":  "/status/state",
+		"value": string(provisioningState),
+	}, map[string]interface{}{
+		"op":    "add",
+		"path":  "/status/provisioning_state_since",
+		"value": string(marshaledTime),
+	})
+}
+
+// getPersistedStateSince returns since when the service set has been in one of the scaler's own states, as
+// recorded in the service set. Service sets patched before the time was recorded fall back to the latest matching
+// scale event of the services. A zero result means it isn't known
+func (s *AppResourceScaler) getPersistedStateSince(serviceSet *iguazioTenantAppServiceSet) time.Time {
+	if !isOwnProvisioningState(serviceSet.state) {
+		return time.Time{}
+	}
+
+	if !serviceSet.provisioningStateSince.IsZero() {
+		return serviceSet.provisioningStateSince
+	}
+
+	scaleEvent := scalertypes.ScaleToZeroStartedScaleEvent
+	if serviceSet.state == string(scaleFromZeroProvisioningState) {
+		scaleEvent = scalertypes.ScaleFromZeroStartedScaleEvent
+	}
+
+	var since time.Time
+	for _, serviceStatus := range serviceSet.statusServices {
+		lastScaleEvent, lastScaleEventTime, err := s.parseLastScaleEvent(serviceStatus)
+		if err != nil || lastScaleEvent == nil || *lastScaleEvent != scaleEvent {
+			continue
+		}
+
+		if lastScaleEventTime.After(since) {
+			since = *lastScaleEventTime
+		}
+	}
+
+	return since
+}
+
+// checkStuckProvisioning returns a StuckProvisioningError if the service set has been provisioning for too long,
+// alerting on it the first time it's detected. Only operations waiting on the scaler's own states fail on it
+func (s *AppResourceScaler) checkStuckProvisioning(ctx context.Context,
+	serviceSet *iguazioTenantAppServiceSet) *StuckProvisioningError {
+
+	stuckProvisioningTimeout := s.getOptions().StuckProvisioningTimeout.Duration
+	if stuckProvisioningTimeout == 0 || time.Since(serviceSet.stateSince) < stuckProvisioningTimeout {
+		return nil
+	}
+
+	stuckProvisioningErr := &StuckProvisioningError{
+		State:    serviceSet.state,
+		Since:    serviceSet.stateSince,
+		OwnState: isOwnProvisioningState(serviceSet.state),
+	}
+
+	if s.provisioningStateTracker.report(serviceSet.state, serviceSet.stateSince) {
+		s.logger.ErrorWithCtx(ctx, "Service set is stuck provisioning", s.operationLogVars(ctx,
+			"state", stuckProvisioningErr.State,
+			"since", stuckProvisioningErr.Since,
+			"ownState", stuckProvisioningErr.OwnState)...)
+
+		stuckProvisioningGauge.WithLabelValues(s.namespace).Set(1)
+		stuckProvisioningDetectionsCounter.WithLabelValues(s.namespace,
+			stuckProvisioningErr.State,
+			strconv.FormatBool(stuckProvisioningErr.OwnState)).Inc()
+		s.recordEvent(serviceSet, v1.EventTypeWarning, stuckProvisioningEventReason, stuckProvisioningErr.Error())
+	}
+
+	return stuckProvisioningErr
+}
+
+// recoverStuckProvisioning resets the state of a service set stuck in a state written by the scaler, if enabled.
+// Returns whether the service set was reset
+func (s *AppResourceScaler) recoverStuckProvisioning(ctx context.Context,
+	serviceSet *iguazioTenantAppServiceSet,
+	stuckProvisioningErr *StuckProvisioningError) bool {
+
+	if !s.getOptions().RecoverStuckProvisioning || !stuckProvisioningErr.OwnState {
+		return false
+	}
+
+	s.logger.WarnWithCtx(ctx, "Resetting stuck service set state", s.operationLogVars(ctx,
+		"state", stuckProvisioningErr.State,
+		"since", stuckProvisioningErr.Since)...)
+
+	if err := s.sendUnqueuedPatch(ctx,
+		s.namespace,
+		[]string{},
+		"",
+		[]map[string]interface{}{
+			{
+				"op":    "test",
+				"path":  "/status/state",
+				"value": stuckProvisioningErr.State,
+			},
+			{
+				"op":    "add",
+				"path":  "/status/state",
+				"value": "ready",
+			},
+		},
+		serviceSet); err != nil {
+		s.logger.ErrorWithCtx(ctx, "Failed to reset stuck service set state", s.operationLogVars(ctx,
+			"err", errors.GetErrorStackString(err, 10))...)
+		stuckProvisioningRecoveriesCounter.WithLabelValues(s.namespace, audit.FailedOutcome).Inc()
+		return false
+	}
+
+	stuckProvisioningRecoveriesCounter.WithLabelValues(s.namespace, audit.SucceededOutcome).Inc()
+	s.recordEvent(serviceSet,
+		v1.EventTypeNormal,
+		stuckProvisioningRecoveredEventReason,
+		fmt.Sprintf("Reset service set state %s to ready", stuckProvisioningErr.State))
+
+	return true
+}
+
+// recordEvent records a Kubernetes event on the service set, if an event recorder was set
+func (s *AppResourceScaler) recordEvent(serviceSet *iguazioTenantAppServiceSet,
+	eventType string,
+	reason string,
+	message string) {
+	if s.eventRecorder == nil {
+		return
+	}
+
+	s.eventRecorder.Event(&v1.ObjectReference{
+		APIVersion: "iguazio.com/v1beta1",
+		Kind:       "IguazioTenantAppServiceSet",
+		Namespace:  s.namespace,
+		Name:       s.namespace,
+		UID:        types.UID(serviceSet.uid),
+	}, eventType, reason, message)
+}
@@ -0,0 +1,323 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// newProvisioningServiceSetBody returns a service set in the given state, in which jupyter last started scaling to
+// zero at scaleToZeroAt and spark last started scaling from zero at scaleFromZeroAt. A zero provisioningStateSince
+// isn't recorded, like in service sets written by older versions
+func newProvisioningServiceSetBody(tb testing.TB,
+	state string,
+	provisioningStateSince time.Time,
+	scaleToZeroAt time.Time,
+	scaleFromZeroAt time.Time) []byte {
+
+	body := newServiceSetBody(map[string]interface{}{
+		"jupyter": map[string]interface{}{"desired_state": "scaledToZero"},
+		"spark":   map[string]interface{}{"desired_state": "ready"},
+	}, map[string]string{"jupyter": "ready", "spark": "scaledToZero"})
+
+	patch := `[
+		{"op": "add", "path": "/status/state", "value": "` + state + `"},
+		{"op": "add", "path": "/status/services/jupyter/scale_to_zero", "value": {
+			"last_scale_event": "scaleToZeroStarted", "last_scale_event_time": "` + scaleToZeroAt.Format(time.RFC3339Nano) + `"}},
+		{"op": "add", "path": "/status/services/spark/scale_to_zero", "value": {
+			"last_scale_event": "scaleFromZeroStarted", "last_scale_event_time": "` + scaleFromZeroAt.Format(time.RFC3339Nano) + `"}}`
+	if !provisioningStateSince.IsZero() {
+		patch += `,
+		{"op": "add", "path": "/status/provisioning_state_since", "value": "` + provisioningStateSince.Format(time.RFC3339Nano) + `"}`
+	}
+
+	body, err := applyJSONPatch(body, []byte(patch+"]"))
+	if err != nil {
+		tb.Fatalf("Failed to patch service set body: %v", err)
+	}
+
+	return body
+}
+
+func TestGetPersistedStateSince(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	scaleToZeroAt := now.Add(-2 * time.Hour)
+	scaleFromZeroAt := now.Add(-3 * time.Hour)
+
+	for _, testCase := range []struct {
+		name                   string
+		state                  string
+		provisioningStateSince time.Time
+		expectedSince          time.Time
+	}{
+		{
+			name:                   "recorded",
+			state:                  string(scaleToZeroProvisioningState),
+			provisioningStateSince: now.Add(-time.Hour),
+			expectedSince:          now.Add(-time.Hour),
+		},
+		{
+			name:          "scale to zero event fallback",
+			state:         string(scaleToZeroProvisioningState),
+			expectedSince: scaleToZeroAt,
+		},
+		{
+			name:          "scale from zero event fallback",
+			state:         string(scaleFromZeroProvisioningState),
+			expectedSince: scaleFromZeroAt,
+		},
+		{
+			name:                   "provisioner state",
+			state:                  "provisioning",
+			provisioningStateSince: now.Add(-time.Hour),
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			serviceSetAPI := newFakeServiceSetAPI(newProvisioningServiceSetBody(t,
+				testCase.state,
+				testCase.provisioningStateSince,
+				scaleToZeroAt,
+				scaleFromZeroAt))
+			resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, NewDefaultOptions())
+
+			serviceSet, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if since := resourceScaler.getPersistedStateSince(serviceSet); !since.Equal(testCase.expectedSince) {
+				t.Fatalf("Expected since %s, got %s", testCase.expectedSince, since)
+			}
+
+			// states not persisted are measured from when they were first seen
+			expectedStateSince := testCase.expectedSince
+			if expectedStateSince.IsZero() {
+				if time.Since(serviceSet.stateSince) > time.Minute {
+					t.Fatalf("Expected the state to be measured from when it was seen, got %s", serviceSet.stateSince)
+				}
+			} else if !serviceSet.stateSince.Equal(expectedStateSince) {
+				t.Fatalf("Expected state since %s, got %s", expectedStateSince, serviceSet.stateSince)
+			}
+		})
+	}
+}
+
+func TestStuckProvisioning(t *testing.T) {
+	hourAgo := time.Now().Add(-time.Hour)
+
+	for _, testCase := range []struct {
+		name                   string
+		state                  string
+		provisioningStateSince time.Time
+		recover                bool
+		expectedErr            bool
+		expectedOwnState       bool
+		expectedState          string
+	}{
+		{
+			name:                   "own state recovered",
+			state:                  string(scaleToZeroProvisioningState),
+			provisioningStateSince: hourAgo,
+			recover:                true,
+			expectedState:          "ready",
+		},
+		{
+			name:                   "own state without recovery",
+			state:                  string(scaleToZeroProvisioningState),
+			provisioningStateSince: hourAgo,
+			expectedErr:            true,
+			expectedOwnState:       true,
+			expectedState:          string(scaleToZeroProvisioningState),
+		},
+		{
+			name:          "own state recorded by older versions",
+			state:         string(scaleFromZeroProvisioningState),
+			recover:       true,
+			expectedState: "ready",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			serviceSetAPI := newFakeServiceSetAPI(newProvisioningServiceSetBody(t,
+				testCase.state,
+				testCase.provisioningStateSince,
+				hourAgo,
+				hourAgo))
+			serviceSetAPI.applyPatches = true
+			options := NewDefaultOptions()
+			options.ProvisioningPollInterval = scalertypes.Duration{Duration: time.Millisecond}
+			options.StuckProvisioningTimeout = scalertypes.Duration{Duration: 30 * time.Minute}
+			options.RecoverStuckProvisioning = testCase.recover
+			resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, options)
+
+			ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelFunc()
+			_, err := resourceScaler.waitForNoProvisioningInProcess(ctx)
+
+			var stuckProvisioningErr *StuckProvisioningError
+			if testCase.expectedErr {
+				if !errors.As(err, &stuckProvisioningErr) {
+					t.Fatalf("Expected a stuck provisioning error, got %v", err)
+				}
+
+				if stuckProvisioningErr.OwnState != testCase.expectedOwnState {
+					t.Fatalf("Expected own state %t, got %t", testCase.expectedOwnState, stuckProvisioningErr.OwnState)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if state := getJSONPath(serviceSetAPI.serviceSet(t), "/status/state"); state != testCase.expectedState {
+				t.Fatalf("Expected state %s, got %v", testCase.expectedState, state)
+			}
+		})
+	}
+}
+
+func TestStuckProvisioningNotDetectedInTime(t *testing.T) {
+	serviceSetAPI := newFakeServiceSetAPI(newProvisioningServiceSetBody(t,
+		"provisioning",
+		time.Time{},
+		time.Now().Add(-time.Hour),
+		time.Now().Add(-time.Hour)))
+	options := NewDefaultOptions()
+	options.ProvisioningPollInterval = scalertypes.Duration{Duration: time.Millisecond}
+	options.StuckProvisioningTimeout = scalertypes.Duration{Duration: 30 * time.Minute}
+	options.RecoverStuckProvisioning = true
+	resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, options)
+
+	// the provisioner's own state is measured from when it was first seen, so it's only waited for
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelFunc()
+	if _, err := resourceScaler.waitForNoProvisioningInProcess(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected to wait until the deadline, got %v", err)
+	}
+
+	if patches := serviceSetAPI.patchOperations(t); len(patches) != 0 {
+		t.Fatalf("Expected the provisioner's state not to be reset, got %d patches", len(patches))
+	}
+}
+
+func TestStuckProvisionerStateOnlyAlerted(t *testing.T) {
+	serviceSetAPI := newFakeServiceSetAPI(newProvisioningServiceSetBody(t,
+		"provisioning",
+		time.Time{},
+		time.Now().Add(-time.Hour),
+		time.Now().Add(-time.Hour)))
+	options := NewDefaultOptions()
+	options.ProvisioningPollInterval = scalertypes.Duration{Duration: time.Millisecond}
+	options.RecoverStuckProvisioning = true
+	resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, options)
+
+	// the provisioner's state was first seen longer than the default timeout ago
+	resourceScaler.provisioningStateTracker.observe("default-tenant", "provisioning", time.Now().Add(-time.Hour))
+	detections := testutil.ToFloat64(stuckProvisioningDetectionsCounter.WithLabelValues("default-tenant",
+		"provisioning",
+		"false"))
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelFunc()
+	if _, err := resourceScaler.waitForNoProvisioningInProcess(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected to wait until the deadline, got %v", err)
+	}
+
+	if detected := testutil.ToFloat64(stuckProvisioningDetectionsCounter.WithLabelValues("default-tenant",
+		"provisioning",
+		"false")) - detections; detected != 1 {
+		t.Fatalf("Expected the stuck state to be alerted on once, got %v", detected)
+	}
+
+	if patches := serviceSetAPI.patchOperations(t); len(patches) != 0 {
+		t.Fatalf("Expected the provisioner's state not to be reset, got %d patches", len(patches))
+	}
+}
+
+func TestRecoverStuckProvisioningPatch(t *testing.T) {
+	for _, testCase := range []struct {
+		name              string
+		currentState      string
+		expectedRecovered bool
+		expectedState     string
+	}{
+		{
+			name:              "still stuck",
+			currentState:      string(scaleToZeroProvisioningState),
+			expectedRecovered: true,
+			expectedState:     "ready",
+		},
+		{
+			name:          "taken over by the provisioner",
+			currentState:  "provisioning",
+			expectedState: "provisioning",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			serviceSetAPI := newFakeServiceSetAPI(newProvisioningServiceSetBody(t,
+				testCase.currentState,
+				time.Time{},
+				time.Now(),
+				time.Now()))
+			serviceSetAPI.applyPatches = true
+			options := NewDefaultOptions()
+			options.RecoverStuckProvisioning = true
+			resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, options)
+
+			serviceSet, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			// detected stuck in the scaler's own state, which may have changed since
+			recovered := resourceScaler.recoverStuckProvisioning(context.Background(), serviceSet, &StuckProvisioningError{
+				State:    string(scaleToZeroProvisioningState),
+				Since:    time.Now().Add(-time.Hour),
+				OwnState: true,
+			})
+			if recovered != testCase.expectedRecovered {
+				t.Fatalf("Expected recovered %t, got %t", testCase.expectedRecovered, recovered)
+			}
+
+			patches := serviceSetAPI.patchOperations(t)
+			if len(patches) != 1 {
+				t.Fatalf("Expected a single patch, got %d", len(patches))
+			}
+
+			testOperation, found := findPatchOperation(patches[0], "test", "/status/state")
+			if !found || testOperation["value"] != string(scaleToZeroProvisioningState) {
+				t.Fatalf("Expected the patch to test the stuck state, got %v", patches[0])
+			}
+
+			addOperation, found := findPatchOperation(patches[0], "add", "/status/state")
+			if !found || addOperation["value"] != "ready" {
+				t.Fatalf("Expected the patch to reset the state to ready, got %v", patches[0])
+			}
+
+			if state := getJSONPath(serviceSetAPI.serviceSet(t), "/status/state"); state != testCase.expectedState {
+				t.Fatalf("Expected state %s, got %v", testCase.expectedState, state)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nuclio/errors"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// ErrMutationCancelled is the cause of scale to zero operations cancelled by a scale from zero of the same service
+var ErrMutationCancelled = errors.New("Scale to zero cancelled by a scale from zero of the same service")
+
+// mutation is a service set mutation waiting for, or holding, its turn
+type mutation struct {
+	scaleEvent   scalertypes.ScaleEvent
+	serviceNames []string
+	operationID  string
+	trigger      string
+	enqueuedAt   time.Time
+	ctx          context.Context
+	turn         chan struct{}
+	cancel       context.CancelCauseFunc
+
+	// the per service patch operations, if the mutation may be coalesced into another of the same scale event
+	jsonPatchMapper []map[string]interface{}
+
+	// once committed, the patch is being sent and the mutation can no longer be cancelled
+	committed bool
+
+	// set once the mutation was patched along with the one holding the turn, with the error of that patch
+	coalesced       bool
+	coalescedErr    error
+	coalescedResult chan error
+}
+
+func (m *mutation) fromZero() bool {
+	return m.scaleEvent == scalertypes.ScaleFromZeroStartedScaleEvent
+}
+
+func (m *mutation) hasAnyService(serviceNames []string) bool {
+	for _, serviceName := range serviceNames {
+		if stringSliceContainsString(m.serviceNames, serviceName) {
+			return true
+		}
+	}
+	return false
+}
+
+// mutationQueue lets a single mutation of the service set at a time wait for provisioning to finish and patch it.
+// Scale from zero operations, which users are waiting on, take their turn before any other. Pending mutations of
+// the same scale event as the one committing are coalesced into its patch
+type mutationQueue struct {
+	namespace string
+	lock      sync.Mutex
+	pending   []*mutation
+	active    *mutation
+}
+
+// acquire waits for the turn of a mutation. The returned context is cancelled if the mutation is cancelled before
+// it's committed, and release must be called once the returned mutation is done. If the mutation has patch
+// operations it may instead be coalesced into the patch of another, in which case it returns as coalesced with the
+// result of that patch - even if ctx is done meanwhile, as the patch is sent regardless
+func (q *mutationQueue) acquire(ctx context.Context,
+	scaleEvent scalertypes.ScaleEvent,
+	serviceNames []string,
+	jsonPatchMapper []map[string]interface{}) (context.Context, *mutation, error) {
+
+	mutationCtx, cancel := context.WithCancelCause(ctx)
+	m := &mutation{
+		scaleEvent:      scaleEvent,
+		serviceNames:    serviceNames,
+		operationID:     GetOperationID(ctx),
+		trigger:         GetTrigger(ctx),
+		enqueuedAt:      time.Now(),
+		ctx:             mutationCtx,
+		turn:            make(chan struct{}),
+		cancel:          cancel,
+		jsonPatchMapper: jsonPatchMapper,
+		coalescedResult: make(chan error, 1),
+	}
+
+	q.lock.Lock()
+	if m.fromZero() {
+		q.cancelScaleToZero(serviceNames)
+	}
+	q.pending = append(q.pending, m)
+	q.dispatch()
+	q.lock.Unlock()
+
+	select {
+	case <-m.turn:
+		return mutationCtx, m, nil
+	case err := <-m.coalescedResult:
+		m.coalesced = true
+		m.coalescedErr = err
+		return mutationCtx, m, nil
+	case <-mutationCtx.Done():
+		q.lock.Lock()
+		committed := m.committed
+		q.lock.Unlock()
+
+		// coalesced into a patch that is already being sent, whose result is this mutation's too
+		if committed {
+			m.coalesced = true
+			m.coalescedErr = <-m.coalescedResult
+			return mutationCtx, m, nil
+		}
+
+		q.release(m)
+		return nil, nil, context.Cause(mutationCtx)
+	}
+}
+
+// commit marks the mutation as committed, unless it was already cancelled, along with the pending mutations
+// coalesced into it: those of the same scale event that have patch operations and that coalescable accepts. The
+// caller patches them all, and reports the result with complete
+func (q *mutationQueue) commit(m *mutation, coalescable func(*mutation) bool) ([]*mutation, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	select {
+	case <-m.turn:
+	default:
+		return nil, false
+	}
+
+	// cancelScaleToZero cancels under the lock, so a mutation can't be cancelled once it's committed
+	if q.active != m || m.ctx.Err() != nil {
+		return nil, false
+	}
+
+	m.committed = true
+	q.observeWait(m)
+
+	var coalescedMutations []*mutation
+	if m.jsonPatchMapper != nil {
+		for _, pendingMutation := range append([]*mutation(nil), q.pending...) {
+			if pendingMutation.scaleEvent != m.scaleEvent ||
+				pendingMutation.jsonPatchMapper == nil ||
+				pendingMutation.ctx.Err() != nil ||
+				!coalescable(pendingMutation) {
+				continue
+			}
+
+			q.remove(pendingMutation)
+			pendingMutation.committed = true
+			q.observeWait(pendingMutation)
+			coalescedMutations = append(coalescedMutations, pendingMutation)
+		}
+	}
+
+	if len(coalescedMutations) > 0 {
+		mutationsCoalescedCounter.WithLabelValues(q.namespace).Add(float64(len(coalescedMutations)))
+		q.updateDepth()
+	}
+
+	return coalescedMutations, true
+}
+
+// complete hands the result of a patch to the mutations coalesced into it
+func (q *mutationQueue) complete(coalescedMutations []*mutation, err error) {
+	for _, coalescedMutation := range coalescedMutations {
+		coalescedMutation.coalescedResult <- err
+	}
+}
+
+// release gives up the mutation's turn, or its place in the queue
+func (q *mutationQueue) release(m *mutation) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.active == m {
+		q.active = nil
+	} else {
+		q.remove(m)
+	}
+
+	m.cancel(nil)
+	q.dispatch()
+}
+
+// cancelScaleToZero cancels the uncommitted scale to zero mutations of any of the services
+func (q *mutationQueue) cancelScaleToZero(serviceNames []string) {
+	for _, m := range append([]*mutation{q.active}, q.pending...) {
+		if m == nil || m.committed || m.fromZero() || !m.hasAnyService(serviceNames) {
+			continue
+		}
+
+		m.cancel(ErrMutationCancelled)
+	}
+}
+
+// dispatch hands the turn to the next mutation, if none holds it
+func (q *mutationQueue) dispatch() {
+	defer q.updateDepth()
+
+	if q.active != nil || len(q.pending) == 0 {
+		return
+	}
+
+	next := q.pending[0]
+	for _, m := range q.pending {
+		if m.fromZero() && !next.fromZero() {
+			next = m
+			break
+		}
+	}
+
+	q.remove(next)
+	q.active = next
+	close(next.turn)
+}
+
+func (q *mutationQueue) remove(m *mutation) {
+	for index, pendingMutation := range q.pending {
+		if pendingMutation == m {
+			q.pending = append(q.pending[:index], q.pending[index+1:]...)
+			return
+		}
+	}
+}
+
+func (q *mutationQueue) updateDepth() {
+	mutationQueueDepthGauge.WithLabelValues(q.namespace).Set(float64(len(q.pending)))
+}
+
+func (q *mutationQueue) observeWait(m *mutation) {
+	mutationWaitSecondsHistogram.WithLabelValues(q.namespace, string(m.scaleEvent)).
+		Observe(time.Since(m.enqueuedAt).Seconds())
+}
+
+// mutationBudget limits how many patches of the service set are sent per minute
+type mutationBudget struct {
+	lock sync.Mutex
+
+	// when the patches of the last minute were sent, oldest first
+	patchedAt []time.Time
+}
+
+// wait blocks until fewer than limit patches were sent in the last minute, recording a patch as sent now if take is
+// set. A limit of 0 doesn't limit
+func (b *mutationBudget) wait(ctx context.Context, limit int, take bool) error {
+	for {
+		b.lock.Lock()
+		now := time.Now()
+		for len(b.patchedAt) > 0 && !b.patchedAt[0].After(now.Add(-time.Minute)) {
+			b.patchedAt = b.patchedAt[1:]
+		}
+
+		if limit <= 0 || len(b.patchedAt) < limit {
+			if take && limit > 0 {
+				b.patchedAt = append(b.patchedAt, now)
+			}
+			b.lock.Unlock()
+			return nil
+		}
+
+		// the limit may have been lowered, leaving more patches than it in the last minute
+		waitDuration := b.patchedAt[len(b.patchedAt)-limit].Add(time.Minute).Sub(now)
+		b.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(waitDuration):
+		}
+	}
+}
@@ -0,0 +1,312 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nuclio/errors"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+func TestMutationQueueScaleFromZeroFirst(t *testing.T) {
+	queue := &mutationQueue{namespace: "default-tenant"}
+
+	_, activeMutation, err := queue.acquire(context.Background(),
+		scalertypes.ScaleToZeroStartedScaleEvent,
+		[]string{"jupyter"},
+		nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// each mutation reports its turn before releasing it, so the reports come in dispatch order
+	dispatched := make(chan string, 4)
+	errs := make(chan error, 4)
+	enqueue := func(scaleEvent scalertypes.ScaleEvent, serviceName string) {
+		go func() {
+			_, m, err := queue.acquire(context.Background(), scaleEvent, []string{serviceName}, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			dispatched <- serviceName
+			queue.release(m)
+		}()
+	}
+
+	for pendingCount, serviceName := range []string{"spark", "presto", "zeppelin"} {
+		enqueue(scalertypes.ScaleToZeroStartedScaleEvent, serviceName)
+		waitForPendingMutations(t, queue, pendingCount+1)
+	}
+	enqueue(scalertypes.ScaleFromZeroStartedScaleEvent, "mlflow")
+	waitForPendingMutations(t, queue, 4)
+
+	queue.release(activeMutation)
+
+	for _, expectedServiceName := range []string{"mlflow", "spark", "presto", "zeppelin"} {
+		select {
+		case serviceName := <-dispatched:
+			if serviceName != expectedServiceName {
+				t.Fatalf("Expected %s to be dispatched, got %s", expectedServiceName, serviceName)
+			}
+		case err := <-errs:
+			t.Fatalf("Unexpected error: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s to be dispatched", expectedServiceName)
+		}
+	}
+}
+
+func TestMutationQueueCancelScaleToZero(t *testing.T) {
+	for _, testCase := range []struct {
+		name              string
+		commitActive      bool
+		expectActiveAlive bool
+	}{
+		{name: "uncommitted", commitActive: false, expectActiveAlive: false},
+		{name: "committed", commitActive: true, expectActiveAlive: true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			queue := &mutationQueue{namespace: "default-tenant"}
+
+			activeCtx, activeMutation, err := queue.acquire(context.Background(),
+				scalertypes.ScaleToZeroStartedScaleEvent,
+				[]string{"jupyter"},
+				nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if testCase.commitActive {
+				if _, committed := queue.commit(activeMutation, func(*mutation) bool { return true }); !committed {
+					t.Fatalf("Expected the active mutation to commit")
+				}
+			}
+
+			// a pending scale to zero of the same service is never committed, so it's always cancelled
+			pendingErrs := make(chan error, 1)
+			go func() {
+				_, _, err := queue.acquire(context.Background(),
+					scalertypes.ScaleToZeroStartedScaleEvent,
+					[]string{"jupyter"},
+					nil)
+				pendingErrs <- err
+			}()
+			waitForPendingMutations(t, queue, 1)
+
+			fromZeroAcquired := make(chan *mutation, 1)
+			go func() {
+				_, m, err := queue.acquire(context.Background(),
+					scalertypes.ScaleFromZeroStartedScaleEvent,
+					[]string{"jupyter"},
+					nil)
+				if err == nil {
+					fromZeroAcquired <- m
+				}
+			}()
+
+			select {
+			case err := <-pendingErrs:
+				if !errors.Is(err, ErrMutationCancelled) {
+					t.Fatalf("Expected the pending scale to zero to be cancelled, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for the pending scale to zero to be cancelled")
+			}
+
+			if testCase.expectActiveAlive {
+				if activeCtx.Err() != nil {
+					t.Fatalf("Expected the committed scale to zero not to be cancelled, got %v",
+						context.Cause(activeCtx))
+				}
+			} else {
+				if !errors.Is(context.Cause(activeCtx), ErrMutationCancelled) {
+					t.Fatalf("Expected the uncommitted scale to zero to be cancelled, got %v",
+						context.Cause(activeCtx))
+				}
+
+				if _, committed := queue.commit(activeMutation, func(*mutation) bool { return true }); committed {
+					t.Fatalf("Expected the cancelled scale to zero not to commit")
+				}
+			}
+
+			queue.release(activeMutation)
+			select {
+			case m := <-fromZeroAcquired:
+				queue.release(m)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for the scale from zero to take its turn")
+			}
+		})
+	}
+}
+
+func waitForPendingMutations(tb testing.TB, queue *mutationQueue, count int) {
+	tb.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		queue.lock.Lock()
+		pendingCount := len(queue.pending)
+		queue.lock.Unlock()
+		if pendingCount == count {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			tb.Fatalf("Expected %d pending mutations, got %d", count, pendingCount)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMutationQueueCoalescedResultAfterCancel(t *testing.T) {
+	queue := &mutationQueue{namespace: "default-tenant"}
+	jsonPatchMapper := []map[string]interface{}{{"op": "add", "path": "/spec/spec/tenants/0/spec/services/jupyter"}}
+
+	_, activeMutation, err := queue.acquire(context.Background(),
+		scalertypes.ScaleToZeroStartedScaleEvent,
+		[]string{"jupyter"},
+		jsonPatchMapper)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	type acquireResult struct {
+		mutation *mutation
+		err      error
+	}
+	pendingCtx, cancelPending := context.WithCancel(context.Background())
+	defer cancelPending()
+	pendingResult := make(chan acquireResult, 1)
+	go func() {
+		_, m, err := queue.acquire(pendingCtx,
+			scalertypes.ScaleToZeroStartedScaleEvent,
+			[]string{"spark"},
+			jsonPatchMapper)
+		pendingResult <- acquireResult{mutation: m, err: err}
+	}()
+	waitForPendingMutations(t, queue, 1)
+
+	coalescedMutations, committed := queue.commit(activeMutation, func(*mutation) bool { return true })
+	if !committed || len(coalescedMutations) != 1 {
+		t.Fatalf("Expected the pending mutation to be coalesced, got %d (committed %t)", len(coalescedMutations), committed)
+	}
+
+	// cancelled while the shared patch is being sent
+	cancelPending()
+	select {
+	case result := <-pendingResult:
+		t.Fatalf("Expected the coalesced mutation to wait for the patch, got %+v", result)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	patchErr := errors.New("Patch failed")
+	queue.complete(coalescedMutations, patchErr)
+	queue.release(activeMutation)
+
+	select {
+	case result := <-pendingResult:
+		if result.err != nil {
+			t.Fatalf("Expected the coalesced mutation to return the patch result, got %v", result.err)
+		}
+
+		if !result.mutation.coalesced || result.mutation.coalescedErr != patchErr {
+			t.Fatalf("Expected the coalesced patch error, got %v (coalesced %t)",
+				result.mutation.coalescedErr,
+				result.mutation.coalesced)
+		}
+		queue.release(result.mutation)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the coalesced mutation")
+	}
+}
+
+func TestMutationBudget(t *testing.T) {
+	t.Run("limit", func(t *testing.T) {
+		budget := &mutationBudget{}
+		for range []int{0, 1} {
+			if err := budget.wait(context.Background(), 2, true); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+
+		ctx, cancelFunc := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancelFunc()
+		if err := budget.wait(ctx, 2, true); err != context.DeadlineExceeded {
+			t.Fatalf("Expected waiting past the limit to block until the deadline, got %v", err)
+		}
+
+		// raising or disabling the limit lets patches through
+		for _, limit := range []int{3, 0} {
+			if err := budget.wait(ctx, limit, false); err != nil {
+				t.Fatalf("Expected limit %d not to block, got %v", limit, err)
+			}
+		}
+	})
+
+	t.Run("window expiry", func(t *testing.T) {
+		budget := &mutationBudget{
+			patchedAt: []time.Time{time.Now().Add(-time.Minute + 100*time.Millisecond), time.Now()},
+		}
+
+		// the oldest patch leaves the window, but the one sent now doesn't
+		startedAt := time.Now()
+		if err := budget.wait(context.Background(), 2, true); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if elapsed := time.Since(startedAt); elapsed < 50*time.Millisecond || elapsed > 5*time.Second {
+			t.Fatalf("Expected waiting until the oldest patch left the window, took %s", elapsed)
+		}
+
+		if len(budget.patchedAt) != 2 {
+			t.Fatalf("Expected 2 patches in the window, got %d", len(budget.patchedAt))
+		}
+	})
+
+	t.Run("take", func(t *testing.T) {
+		budget := &mutationBudget{}
+		for range []int{0, 1, 2} {
+			if err := budget.wait(context.Background(), 1, false); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		if len(budget.patchedAt) != 0 {
+			t.Fatalf("Expected waiting without taking to record no patch, got %d", len(budget.patchedAt))
+		}
+
+		if err := budget.wait(context.Background(), 1, true); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(budget.patchedAt) != 1 {
+			t.Fatalf("Expected taking to record a patch, got %d", len(budget.patchedAt))
+		}
+
+		ctx, cancelFunc := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancelFunc()
+		if err := budget.wait(ctx, 1, false); err != context.DeadlineExceeded {
+			t.Fatalf("Expected waiting without taking to still respect the limit, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,312 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nuclio/errors"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+const (
+	DefaultReadinessProbePeriod  = time.Second
+	DefaultReadinessProbeTimeout = time.Second
+)
+
+// ReadinessProbe checks that a service scaled from zero is serving, declared under scale_to_zero.readiness_probe.
+type ReadinessProbe struct {
+	HTTPGetURL       string
+	TCPSocketAddress string
+	Period           time.Duration
+	Timeout          time.Duration
+
+	// a probe with neither an HTTP url nor a TCP address probes the service's resolved endpoint once it's ready
+	FromServiceEndpoint bool
+}
+
+// ParseReadinessProbe parses the readiness probe of a single service spec, in monitor mode as well so it's validated
+// before the service is enabled. A nil result with no error means the service has no readiness probe, or doesn't
+// take part in scale to zero
+func ParseReadinessProbe(serviceSpecInterface interface{}) (*ReadinessProbe, error) {
+	serviceSpec, ok := serviceSpecInterface.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Service spec type assertion failed")
+	}
+
+	scaleToZeroSpec, ok := serviceSpec["scale_to_zero"].(map[string]interface{})
+	if !ok || !isScaleToZeroModeEvaluated(scaleToZeroSpec["mode"]) {
+		return nil, nil
+	}
+
+	readinessProbeInterface, found := scaleToZeroSpec["readiness_probe"]
+	if !found {
+		return nil, nil
+	}
+
+	readinessProbeSpec, ok := readinessProbeInterface.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Readiness probe is not an object")
+	}
+
+	readinessProbe := &ReadinessProbe{
+		Period:  DefaultReadinessProbePeriod,
+		Timeout: DefaultReadinessProbeTimeout,
+	}
+
+	if httpGetInterface, found := readinessProbeSpec["http_get"]; found {
+		httpGetSpec, ok := httpGetInterface.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Readiness probe http_get is not an object")
+		}
+
+		readinessProbe.HTTPGetURL, ok = httpGetSpec["url"].(string)
+		if !ok {
+			return nil, errors.New("Readiness probe http_get does not have url")
+		}
+
+		if err := validateHTTPURL(readinessProbe.HTTPGetURL); err != nil {
+			return nil, errors.Wrap(err, "Invalid readiness probe http_get url")
+		}
+	}
+
+	if tcpSocketInterface, found := readinessProbeSpec["tcp_socket"]; found {
+		tcpSocketSpec, ok := tcpSocketInterface.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Readiness probe tcp_socket is not an object")
+		}
+
+		readinessProbe.TCPSocketAddress, ok = tcpSocketSpec["address"].(string)
+		if !ok {
+			return nil, errors.New("Readiness probe tcp_socket does not have address")
+		}
+
+		if _, _, err := net.SplitHostPort(readinessProbe.TCPSocketAddress); err != nil {
+			return nil, errors.Wrap(err, "Invalid readiness probe tcp_socket address")
+		}
+	}
+
+	if readinessProbe.HTTPGetURL != "" && readinessProbe.TCPSocketAddress != "" {
+		return nil, errors.New("Readiness probe can't have both http_get and tcp_socket")
+	}
+	readinessProbe.FromServiceEndpoint = readinessProbe.HTTPGetURL == "" && readinessProbe.TCPSocketAddress == ""
+
+	for fieldName, duration := range map[string]*time.Duration{
+		"period":  &readinessProbe.Period,
+		"timeout": &readinessProbe.Timeout,
+	} {
+		durationInterface, found := readinessProbeSpec[fieldName]
+		if !found {
+			continue
+		}
+
+		durationString, ok := durationInterface.(string)
+		if !ok {
+			return nil, errors.Errorf("Readiness probe %s is not a string", fieldName)
+		}
+
+		parsedDuration, err := time.ParseDuration(durationString)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse readiness probe %s", fieldName)
+		}
+
+		if parsedDuration <= 0 {
+			return nil, errors.Errorf("Readiness probe %s must be positive", fieldName)
+		}
+
+		*duration = parsedDuration
+	}
+
+	return readinessProbe, nil
+}
+
+// parseServiceURLs returns the http(s) urls listed under "urls" in the service's spec, then its status. Each url
+// may be a string or an object with a "url" field
+func parseServiceURLs(serviceSpec interface{}, serviceStatus interface{}) []string {
+	var serviceURLs []string
+	for _, serviceObject := range []interface{}{serviceSpec, serviceStatus} {
+		serviceObjectMap, _ := serviceObject.(map[string]interface{})
+		urls, _ := serviceObjectMap["urls"].([]interface{})
+
+		for _, urlInterface := range urls {
+			urlString, ok := urlInterface.(string)
+			if !ok {
+				urlMap, _ := urlInterface.(map[string]interface{})
+				urlString, _ = urlMap["url"].(string)
+			}
+
+			if urlString != "" && validateHTTPURL(urlString) == nil {
+				serviceURLs = append(serviceURLs, urlString)
+			}
+		}
+	}
+
+	return serviceURLs
+}
+
+func validateHTTPURL(urlString string) error {
+	parsedURL, err := url.Parse(urlString)
+	if err != nil {
+		return errors.Wrap(err, "Failed to parse url")
+	}
+
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return errors.Errorf("Url must be http or https: %s", urlString)
+	}
+
+	return nil
+}
+
+// newReadinessProbeClient creates the client readiness probes are sent with. Like Kubernetes probes, it doesn't
+// follow redirects or verify certificates - it only checks that the service responds
+func newReadinessProbeClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // nolint: gosec
+		},
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// waitForServicesServing polls the readiness probes of the services, once the service set reports them ready.
+// On failure, returns the services that aren't serving
+func (s *AppResourceScaler) waitForServicesServing(ctx context.Context, serviceNames []string) ([]string, error) {
+	serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
+	if err != nil {
+		return serviceNames, errors.Wrap(err, "Failed to get iguazio tenant app service sets")
+	}
+
+	waitGroup := sync.WaitGroup{}
+	probeErrors := make([]error, len(serviceNames))
+	for serviceIndex, serviceName := range serviceNames {
+		readinessProbe, err := ParseReadinessProbe(serviceSet.specServices[serviceName])
+		if err != nil {
+			s.logger.WarnWithCtx(ctx, "Failed parsing the readiness probe, skipping it", s.operationLogVars(ctx,
+				"services", []string{serviceName},
+				"err", errors.GetErrorStackString(err, 10))...)
+			continue
+		}
+
+		if readinessProbe == nil {
+			continue
+		}
+
+		if readinessProbe.FromServiceEndpoint {
+			serviceEndpoint, err := s.ResolveServiceEndpoint(scalertypes.Resource{Name: serviceName})
+			if err != nil {
+				s.logger.WarnWithCtx(ctx, "Failed resolving the endpoint to probe, skipping it", s.operationLogVars(ctx,
+					"services", []string{serviceName},
+					"err", errors.GetErrorStackString(err, 10))...)
+				continue
+			}
+			readinessProbe.HTTPGetURL = serviceEndpoint.httpURL()
+		}
+
+		waitGroup.Add(1)
+		go func(serviceIndex int, serviceName string, readinessProbe *ReadinessProbe) {
+			defer waitGroup.Done()
+			probeErrors[serviceIndex] = s.waitForServiceServing(ctx, serviceName, readinessProbe)
+		}(serviceIndex, serviceName, readinessProbe)
+	}
+	waitGroup.Wait()
+
+	var notServingServiceNames []string
+	var firstProbeErr error
+	for serviceIndex, probeErr := range probeErrors {
+		if probeErr != nil {
+			notServingServiceNames = append(notServingServiceNames, serviceNames[serviceIndex])
+			if firstProbeErr == nil {
+				firstProbeErr = errors.Wrapf(probeErr, "Service %s is not serving", serviceNames[serviceIndex])
+			}
+		}
+	}
+
+	return notServingServiceNames, firstProbeErr
+}
+
+func (s *AppResourceScaler) waitForServiceServing(ctx context.Context,
+	serviceName string,
+	readinessProbe *ReadinessProbe) error {
+
+	s.logger.DebugWithCtx(ctx, "Waiting for service to serve", s.operationLogVars(ctx,
+		"services", []string{serviceName},
+		"httpGetURL", readinessProbe.HTTPGetURL,
+		"tcpSocketAddress", readinessProbe.TCPSocketAddress)...)
+
+	var lastErr error
+	for {
+		if lastErr = s.probe(ctx, readinessProbe); lastErr == nil {
+			s.logger.InfoWithCtx(ctx, "Service is serving", s.operationLogVars(ctx, "services", []string{serviceName})...)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(lastErr, "Readiness probe did not succeed before the deadline")
+		case <-time.After(readinessProbe.Period):
+		}
+	}
+}
+
+// probe succeeds if the tcp address accepts connections, or if the http url responds with a 2xx or 3xx status.
+// Probes of the service's endpoint succeed on any status below 500, as the service may require authentication
+func (s *AppResourceScaler) probe(ctx context.Context, readinessProbe *ReadinessProbe) error {
+	probeCtx, cancelFunc := context.WithTimeout(ctx, readinessProbe.Timeout)
+	defer cancelFunc()
+
+	if readinessProbe.TCPSocketAddress != "" {
+		connection, err := (&net.Dialer{}).DialContext(probeCtx, "tcp", readinessProbe.TCPSocketAddress)
+		if err != nil {
+			return errors.Wrap(err, "Failed to connect")
+		}
+		return connection.Close()
+	}
+
+	request, err := http.NewRequestWithContext(probeCtx, http.MethodGet, readinessProbe.HTTPGetURL, nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create probe request")
+	}
+
+	response, err := s.readinessProbeClient.Do(request)
+	if err != nil {
+		return errors.Wrap(err, "Failed to send probe request")
+	}
+	response.Body.Close() // nolint: errcheck
+
+	maxStatusCode := http.StatusBadRequest
+	if readinessProbe.FromServiceEndpoint {
+		maxStatusCode = http.StatusInternalServerError
+	}
+
+	if response.StatusCode < http.StatusOK || response.StatusCode >= maxStatusCode {
+		return errors.Errorf("Probe responded with status %d", response.StatusCode)
+	}
+
+	return nil
+}
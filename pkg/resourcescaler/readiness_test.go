@@ -0,0 +1,266 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+func TestParseReadinessProbe(t *testing.T) {
+	for _, testCase := range []struct {
+		name           string
+		scaleToZero    map[string]interface{}
+		expectedProbe  *ReadinessProbe
+		expectedFailed bool
+	}{
+		{
+			name:        "disabled",
+			scaleToZero: map[string]interface{}{"mode": "disabled", "readiness_probe": map[string]interface{}{}},
+		},
+		{
+			name:        "no probe",
+			scaleToZero: map[string]interface{}{"mode": "enabled"},
+		},
+		{
+			name:        "empty",
+			scaleToZero: map[string]interface{}{"mode": "enabled", "readiness_probe": map[string]interface{}{}},
+			expectedProbe: &ReadinessProbe{
+				Period:              DefaultReadinessProbePeriod,
+				Timeout:             DefaultReadinessProbeTimeout,
+				FromServiceEndpoint: true,
+			},
+		},
+		{
+			name: "http get",
+			scaleToZero: map[string]interface{}{"mode": "enabled", "readiness_probe": map[string]interface{}{
+				"http_get": map[string]interface{}{"url": "http://jupyter:8888/api/status"},
+				"period":   "2s",
+				"timeout":  "500ms",
+			}},
+			expectedProbe: &ReadinessProbe{
+				HTTPGetURL: "http://jupyter:8888/api/status",
+				Period:     2 * time.Second,
+				Timeout:    500 * time.Millisecond,
+			},
+		},
+		{
+			name: "tcp socket in monitor mode",
+			scaleToZero: map[string]interface{}{"mode": "monitor", "readiness_probe": map[string]interface{}{
+				"tcp_socket": map[string]interface{}{"address": "jupyter:8888"},
+			}},
+			expectedProbe: &ReadinessProbe{
+				TCPSocketAddress: "jupyter:8888",
+				Period:           DefaultReadinessProbePeriod,
+				Timeout:          DefaultReadinessProbeTimeout,
+			},
+		},
+		{
+			name: "invalid in monitor mode",
+			scaleToZero: map[string]interface{}{"mode": "monitor", "readiness_probe": map[string]interface{}{
+				"period": "0s",
+			}},
+			expectedFailed: true,
+		},
+		{
+			name: "both http get and tcp socket",
+			scaleToZero: map[string]interface{}{"mode": "enabled", "readiness_probe": map[string]interface{}{
+				"http_get":   map[string]interface{}{"url": "http://jupyter:8888"},
+				"tcp_socket": map[string]interface{}{"address": "jupyter:8888"},
+			}},
+			expectedFailed: true,
+		},
+		{
+			name: "non http url",
+			scaleToZero: map[string]interface{}{"mode": "enabled", "readiness_probe": map[string]interface{}{
+				"http_get": map[string]interface{}{"url": "ftp://jupyter"},
+			}},
+			expectedFailed: true,
+		},
+		{
+			name: "address without port",
+			scaleToZero: map[string]interface{}{"mode": "enabled", "readiness_probe": map[string]interface{}{
+				"tcp_socket": map[string]interface{}{"address": "jupyter"},
+			}},
+			expectedFailed: true,
+		},
+		{
+			name: "unparsable timeout",
+			scaleToZero: map[string]interface{}{"mode": "enabled", "readiness_probe": map[string]interface{}{
+				"timeout": "soon",
+			}},
+			expectedFailed: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			readinessProbe, err := ParseReadinessProbe(map[string]interface{}{"scale_to_zero": testCase.scaleToZero})
+			if testCase.expectedFailed {
+				if err == nil {
+					t.Fatalf("Expected parsing to fail, got %+v", readinessProbe)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if testCase.expectedProbe == nil {
+				if readinessProbe != nil {
+					t.Fatalf("Expected no probe, got %+v", readinessProbe)
+				}
+				return
+			}
+
+			if readinessProbe == nil || *readinessProbe != *testCase.expectedProbe {
+				t.Fatalf("Expected probe %+v, got %+v", testCase.expectedProbe, readinessProbe)
+			}
+		})
+	}
+}
+
+func TestProbeStatusCodes(t *testing.T) {
+	resourceScaler := newTestAppResourceScaler(t, newFakeServiceSetAPI(newServiceSetBody(nil, nil)), NewDefaultOptions())
+
+	for _, testCase := range []struct {
+		name                string
+		statusCode          int
+		fromServiceEndpoint bool
+		expectedSucceeded   bool
+	}{
+		{name: "ok", statusCode: http.StatusOK, expectedSucceeded: true},
+		{name: "redirect", statusCode: http.StatusFound, expectedSucceeded: true},
+		{name: "unauthorized", statusCode: http.StatusUnauthorized, expectedSucceeded: false},
+		{name: "unauthorized from endpoint", statusCode: http.StatusUnauthorized, fromServiceEndpoint: true,
+			expectedSucceeded: true},
+		{name: "server error from endpoint", statusCode: http.StatusServiceUnavailable, fromServiceEndpoint: true,
+			expectedSucceeded: false},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				writer.Header().Set("Location", "/elsewhere")
+				writer.WriteHeader(testCase.statusCode)
+			}))
+			defer server.Close()
+
+			err := resourceScaler.probe(context.Background(), &ReadinessProbe{
+				HTTPGetURL:          server.URL,
+				Timeout:             time.Second,
+				FromServiceEndpoint: testCase.fromServiceEndpoint,
+			})
+			if (err == nil) != testCase.expectedSucceeded {
+				t.Fatalf("Expected succeeded %t, got %v", testCase.expectedSucceeded, err)
+			}
+		})
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	resourceScaler := newTestAppResourceScaler(t, newFakeServiceSetAPI(newServiceSetBody(nil, nil)), NewDefaultOptions())
+
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case <-unblock:
+		case <-request.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	readinessProbe := &ReadinessProbe{
+		HTTPGetURL: server.URL,
+		Period:     10 * time.Millisecond,
+		Timeout:    20 * time.Millisecond,
+	}
+
+	startedAt := time.Now()
+	if err := resourceScaler.probe(context.Background(), readinessProbe); err == nil {
+		t.Fatalf("Expected a probe of a hanging server to time out")
+	}
+	if elapsed := time.Since(startedAt); elapsed > time.Second {
+		t.Fatalf("Expected the probe to time out after its timeout, took %s", elapsed)
+	}
+
+	// the probe keeps being retried until the operation's deadline
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelFunc()
+	if err := resourceScaler.waitForServiceServing(ctx, "jupyter", readinessProbe); err == nil {
+		t.Fatalf("Expected waiting for a hanging server to fail at the deadline")
+	}
+	if ctx.Err() == nil {
+		t.Fatalf("Expected waiting to last until the deadline")
+	}
+}
+
+func TestWaitForServicesServingProbesResolvedEndpoint(t *testing.T) {
+	var rootProbes atomic.Int64
+	var failuresLeft atomic.Int64
+	failuresLeft.Store(2)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/" {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		rootProbes.Add(1)
+		if failuresLeft.Add(-1) >= 0 {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writer.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	// the first url isn't in-cluster, so the endpoint is resolved from the second
+	resourceScaler := newTestAppResourceScaler(t, newFakeServiceSetAPI(newServiceSetBody(map[string]interface{}{
+		"jupyter": map[string]interface{}{
+			"urls": []interface{}{"https://jupyter.apps.example.com/lab", server.URL + "/lab"},
+			"scale_to_zero": map[string]interface{}{
+				"mode":            "enabled",
+				"readiness_probe": map[string]interface{}{"period": "10ms"},
+			},
+		},
+	}, map[string]string{"jupyter": "ready"})), NewDefaultOptions())
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+
+	notServingServiceNames, err := resourceScaler.waitForServicesServing(ctx, []string{"jupyter"})
+	if err != nil || len(notServingServiceNames) != 0 {
+		t.Fatalf("Expected the service to serve, got %v (%v)", notServingServiceNames, err)
+	}
+
+	if probes := rootProbes.Load(); probes != 3 {
+		t.Fatalf("Expected the endpoint's root to be probed 3 times until it succeeded, got %d", probes)
+	}
+
+	endpoint, err := resourceScaler.ResolveServiceEndpoint(scalertypes.Resource{Name: "jupyter"})
+	if err != nil || endpoint.httpURL() != server.URL+"/" {
+		t.Fatalf("Expected the probed endpoint %s/, got %+v (%v)", server.URL, endpoint, err)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/audit"
+
+	"github.com/nuclio/errors"
+	"github.com/v3io/scaler/pkg/scalertypes"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	errorRecoveryAttemptEventReason   = "ErrorRecoveryAttempt"
+	errorRecoverySucceededEventReason = "ErrorRecoverySucceeded"
+	errorRecoveryFailedEventReason    = "ErrorRecoveryFailed"
+)
+
+// ErrServicesInError is the cause of scale from zero operations whose services stayed in error after every
+// recovery attempt
+var ErrServicesInError = errors.New("Services are in error")
+
+// waitForServicesReady waits for the services to be ready. With error recovery enabled, services that land in error
+// are restarted up to ErrorRecoveryAttempts times, waiting ErrorRecoveryBackoff before the first attempt and twice
+// as long before every next one
+func (s *AppResourceScaler) waitForServicesReady(ctx context.Context, serviceNames []string) error {
+	options := s.getOptions()
+	if options.ErrorRecoveryAttempts == 0 {
+		return s.waitForServicesState(ctx, serviceNames, "ready")
+	}
+
+	var recoveredServiceNames []string
+	backoff := options.ErrorRecoveryBackoff.Duration
+	for attempt := 1; ; attempt++ {
+		errorServiceNames, err := s.waitForServicesReadyOrError(ctx, serviceNames)
+		if err != nil {
+			return err
+		}
+
+		if len(errorServiceNames) == 0 {
+			if len(recoveredServiceNames) > 0 {
+				s.recordErrorRecoveryOutcome(ctx, recoveredServiceNames, attempt-1, nil)
+			}
+			return nil
+		}
+
+		recoveredServiceNames = appendMissingStrings(recoveredServiceNames, errorServiceNames)
+		if attempt > options.ErrorRecoveryAttempts {
+			err := errors.Wrapf(ErrServicesInError, "Services %v are still in error after %d recovery attempts",
+				errorServiceNames,
+				options.ErrorRecoveryAttempts)
+			s.recordErrorRecoveryOutcome(ctx, errorServiceNames, options.ErrorRecoveryAttempts, err)
+			return err
+		}
+
+		s.logger.WarnWithCtx(ctx, "Services are in error after scaling from zero, restarting", s.operationLogVars(ctx,
+			"services", errorServiceNames,
+			"attempt", attempt,
+			"backoff", backoff)...)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		if err := s.restartServices(ctx, errorServiceNames, attempt); err != nil {
+			return errors.Wrap(err, "Failed to restart services in error")
+		}
+	}
+}
+
+// waitForServicesReadyOrError waits for the controller to be done with the service set and for the services to be
+// ready, returning early with the services in error
+func (s *AppResourceScaler) waitForServicesReadyOrError(ctx context.Context, serviceNames []string) ([]string, error) {
+	pollInterval := s.getOptions().ServiceStatePollInterval.Duration
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pollInterval):
+			serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
+			if err != nil {
+				return nil, errors.Wrap(err, "Failed to get iguazio tenant app service sets")
+			}
+
+			// until the controller picks the patch up, the services may still report their previous state
+			if serviceSet.state == string(scaleFromZeroProvisioningState) {
+				continue
+			}
+
+			var errorServiceNames []string
+			ready := true
+			for _, serviceName := range serviceNames {
+				switch getServiceStatusState(serviceSet.statusServices[serviceName]) {
+				case "ready":
+				case "error":
+					errorServiceNames = append(errorServiceNames, serviceName)
+				default:
+					ready = false
+				}
+			}
+
+			if len(errorServiceNames) > 0 {
+				return errorServiceNames, nil
+			}
+
+			if ready {
+				s.logger.InfoWithCtx(ctx, "Services reached desired state", s.operationLogVars(ctx,
+					"services", serviceNames,
+					"desiredState", "ready")...)
+				return nil, nil
+			}
+		}
+	}
+}
+
+// restartServices scales the services from zero again, marking them for restart
+func (s *AppResourceScaler) restartServices(ctx context.Context, serviceNames []string, attempt int) error {
+	ctx = WithTrigger(ctx, RecoveryTrigger)
+
+	errorRecoveryAttemptsCounter.WithLabelValues(s.namespace).Add(float64(len(serviceNames)))
+	if serviceSet, err := s.getIguazioTenantAppServiceSets(ctx); err == nil {
+		s.recordEvent(serviceSet,
+			v1.EventTypeWarning,
+			errorRecoveryAttemptEventReason,
+			fmt.Sprintf("Restarting services %v in error after scaling from zero, attempt %d", serviceNames, attempt))
+	}
+
+	marshaledTime, err := time.Now().MarshalText()
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal time")
+	}
+
+	var jsonPatchMapper []map[string]interface{}
+	for _, serviceName := range serviceNames {
+		jsonPatchMapper, err = s.appendServiceStateChangeJSONPatchOperations(jsonPatchMapper,
+			serviceName,
+			"ready",
+			true,
+			scalertypes.ScaleFromZeroStartedScaleEvent,
+			marshaledTime)
+		if err != nil {
+			return errors.Wrap(err, "Failed appending service state change json patch operations")
+		}
+	}
+
+	return s.patchIguazioTenantAppServiceSets(ctx,
+		s.namespace,
+		serviceNames,
+		scalertypes.ScaleFromZeroStartedScaleEvent,
+		jsonPatchMapper,
+		scaleFromZeroProvisioningState)
+}
+
+// recordErrorRecoveryOutcome records whether the services recovered from error, after how many attempts
+func (s *AppResourceScaler) recordErrorRecoveryOutcome(ctx context.Context,
+	serviceNames []string,
+	attempts int,
+	recoveryErr error) {
+
+	ctx = WithTrigger(ctx, RecoveryTrigger)
+	outcome, eventType, reason := audit.SucceededOutcome, v1.EventTypeNormal, errorRecoverySucceededEventReason
+	message := fmt.Sprintf("Services %v recovered from error after %d attempts", serviceNames, attempts)
+	if recoveryErr != nil {
+		outcome, eventType, reason = audit.FailedOutcome, v1.EventTypeWarning, errorRecoveryFailedEventReason
+		message = fmt.Sprintf("Services %v are still in error after %d recovery attempts", serviceNames, attempts)
+	}
+
+	s.logger.InfoWithCtx(ctx, "Error recovery finished", s.operationLogVars(ctx,
+		"services", serviceNames,
+		"attempts", attempts,
+		"outcome", outcome)...)
+	errorRecoveriesCounter.WithLabelValues(s.namespace, outcome).Add(float64(len(serviceNames)))
+
+	if serviceSet, err := s.getIguazioTenantAppServiceSets(ctx); err == nil {
+		s.recordEvent(serviceSet, eventType, reason, message)
+	}
+
+	if err := s.auditLog.Write(&audit.Entry{
+		OperationID: GetOperationID(ctx),
+		Namespace:   s.namespace,
+		Trigger:     GetTrigger(ctx),
+		Services:    serviceNames,
+		ScaleEvent:  string(scalertypes.ScaleFromZeroStartedScaleEvent),
+		Outcome:     outcome,
+		Reason:      message,
+	}); err != nil {
+		s.logger.ErrorWithCtx(ctx, "Failed to write audit log entry", s.operationLogVars(ctx,
+			"services", serviceNames,
+			"err", errors.GetErrorStackString(err, 10))...)
+	}
+}
+
+func appendMissingStrings(slice []string, values []string) []string {
+	for _, value := range values {
+		if !stringSliceContainsString(slice, value) {
+			slice = append(slice, value)
+		}
+	}
+
+	return slice
+}
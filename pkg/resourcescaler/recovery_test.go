@@ -0,0 +1,207 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nuclio/errors"
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+// recoveryTestController plays the controller of a service set whose jupyter service lands in error when scaled
+// from zero, until it was restarted recoverAfter times. Patches are timed as they're received
+type recoveryTestController struct {
+	serviceSetAPI *fakeServiceSetAPI
+	recoverAfter  int
+
+	lock      sync.Mutex
+	patchedAt []time.Time
+
+	// reads of the service set while waiting for the scale from zero, still reporting the previous service state
+	waitingReads int
+}
+
+func newRecoveryTestController(serviceSetState string, recoverAfter int) *recoveryTestController {
+	body := newServiceSetBody(map[string]interface{}{
+		"jupyter": map[string]interface{}{"desired_state": "ready"},
+	}, map[string]string{"jupyter": "error"})
+	body, _ = applyJSONPatch(body, []byte(fmt.Sprintf(`[{"op": "replace", "path": "/status/state", "value": %q}]`,
+		serviceSetState)))
+
+	controller := &recoveryTestController{
+		serviceSetAPI: newFakeServiceSetAPI(body),
+		recoverAfter:  recoverAfter,
+	}
+	controller.serviceSetAPI.applyPatches = true
+	controller.serviceSetAPI.beforeRead = controller.provision
+
+	return controller
+}
+
+func (c *recoveryTestController) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodPatch {
+		c.lock.Lock()
+		c.patchedAt = append(c.patchedAt, time.Now())
+		c.lock.Unlock()
+	}
+
+	c.serviceSetAPI.ServeHTTP(responseWriter, request)
+}
+
+// provision finishes the scale from zero after a couple of reads, leaving jupyter in error until it was restarted
+// enough times
+func (c *recoveryTestController) provision() {
+	c.serviceSetAPI.lock.Lock()
+	defer c.serviceSetAPI.lock.Unlock()
+
+	serviceSet := map[string]interface{}{}
+	if err := json.Unmarshal(c.serviceSetAPI.body, &serviceSet); err != nil {
+		return
+	}
+
+	if getJSONPath(serviceSet, "/status/state") != string(scaleFromZeroProvisioningState) {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.waitingReads++
+	if c.waitingReads < 2 {
+		return
+	}
+	c.waitingReads = 0
+
+	serviceState := "error"
+	if len(c.patchedAt) >= c.recoverAfter {
+		serviceState = "ready"
+	}
+
+	c.serviceSetAPI.body, _ = applyJSONPatch(c.serviceSetAPI.body, []byte(fmt.Sprintf(`[
+		{"op": "replace", "path": "/status/state", "value": "ready"},
+		{"op": "replace", "path": "/status/services/jupyter/state", "value": %q}]`, serviceState)))
+}
+
+func (c *recoveryTestController) getPatchedAt() []time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([]time.Time(nil), c.patchedAt...)
+}
+
+func newRecoveryTestOptions(attempts int, backoff time.Duration) Options {
+	options := NewDefaultOptions()
+	options.ProvisioningPollInterval = scalertypes.Duration{Duration: 5 * time.Millisecond}
+	options.ServiceStatePollInterval = scalertypes.Duration{Duration: 5 * time.Millisecond}
+	options.ServiceSetCacheTTL = scalertypes.Duration{}
+	options.ErrorRecoveryAttempts = attempts
+	options.ErrorRecoveryBackoff = scalertypes.Duration{Duration: backoff}
+	return options
+}
+
+func TestErrorRecovery(t *testing.T) {
+	for _, testCase := range []struct {
+		name             string
+		attempts         int
+		recoverAfter     int
+		expectedRestarts int
+		expectedErr      error
+	}{
+		{name: "recovered on the second attempt", attempts: 3, recoverAfter: 2, expectedRestarts: 2},
+		{name: "still in error", attempts: 2, recoverAfter: 3, expectedRestarts: 2, expectedErr: ErrServicesInError},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			backoff := 30 * time.Millisecond
+			controller := newRecoveryTestController("ready", testCase.recoverAfter)
+			resourceScaler := newTestAppResourceScaler(t,
+				controller,
+				newRecoveryTestOptions(testCase.attempts, backoff))
+
+			ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancelFunc()
+
+			startedAt := time.Now()
+			err := resourceScaler.waitForServicesReady(ctx, []string{"jupyter"})
+			if testCase.expectedErr == nil && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if testCase.expectedErr != nil && !errors.Is(err, testCase.expectedErr) {
+				t.Fatalf("Expected %v, got %v", testCase.expectedErr, err)
+			}
+
+			patchedAt := controller.getPatchedAt()
+			if len(patchedAt) != testCase.expectedRestarts {
+				t.Fatalf("Expected %d restarts, got %d", testCase.expectedRestarts, len(patchedAt))
+			}
+
+			// every attempt waits twice as long as the one before it
+			previousAttemptAt := startedAt
+			for restartIndex, restartedAt := range patchedAt {
+				expectedBackoff := backoff << restartIndex
+				if waited := restartedAt.Sub(previousAttemptAt); waited < expectedBackoff {
+					t.Fatalf("Expected restart %d to wait at least %s, waited %s", restartIndex+1, expectedBackoff, waited)
+				}
+				previousAttemptAt = restartedAt
+			}
+
+			for restartIndex, operations := range controller.serviceSetAPI.patchOperations(t) {
+				for path, expectedValue := range map[string]interface{}{
+					"/spec/spec/tenants/0/spec/services/jupyter/mark_for_restart": true,
+					"/spec/spec/tenants/0/spec/services/jupyter/desired_state":    "ready",
+					"/status/state": string(scaleFromZeroProvisioningState),
+				} {
+					operation, found := findPatchOperation(operations, "add", path)
+					if !found || operation["value"] != expectedValue {
+						t.Fatalf("Expected restart %d to set %s to %v, got %v", restartIndex+1, path, expectedValue, operations)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestErrorRecoveryWaitsForScaleFromZero(t *testing.T) {
+
+	// the service set is still waiting for the scale from zero, so the service's error is from before it
+	controller := newRecoveryTestController(string(scaleFromZeroProvisioningState), 0)
+	resourceScaler := newTestAppResourceScaler(t, controller, newRecoveryTestOptions(1, time.Millisecond))
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+	if err := resourceScaler.waitForServicesReady(ctx, []string{"jupyter"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if patchedAt := controller.getPatchedAt(); len(patchedAt) != 0 {
+		t.Fatalf("Expected no restarts of the service in error before the scale from zero, got %d", len(patchedAt))
+	}
+
+	if reads := controller.serviceSetAPI.reads.Load(); reads < 2 {
+		t.Fatalf("Expected reading until the scale from zero finished, got %d reads", reads)
+	}
+}
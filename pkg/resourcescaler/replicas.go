@@ -0,0 +1,160 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/nuclio/errors"
+)
+
+// ParseReplicas parses the replica count of a single service spec, or its status, under replicas. found is false
+// if the service doesn't declare one, in which case it doesn't support scales other than 0 and 1
+func ParseReplicas(serviceInterface interface{}) (int, bool, error) {
+	serviceMap, ok := serviceInterface.(map[string]interface{})
+	if !ok {
+		return 0, false, errors.New("Service type assertion failed")
+	}
+
+	replicasInterface, found := serviceMap["replicas"]
+	if !found {
+		return 0, false, nil
+	}
+
+	replicas, ok := replicasInterface.(float64)
+	if !ok || replicas < 0 || replicas != math.Trunc(replicas) {
+		return 0, false, errors.New("Replicas is not a non-negative integer")
+	}
+
+	return int(replicas), true, nil
+}
+
+// appendReplicasJSONPatchOperations sets the replica count of the services that declare one to scale, returning
+// the services it was set for. Operations whose context keeps the declared replicas leave the count as is
+func (s *AppResourceScaler) appendReplicasJSONPatchOperations(ctx context.Context,
+	jsonPatchMapper []map[string]interface{},
+	serviceNames []string,
+	scale int) ([]map[string]interface{}, []string, error) {
+
+	if KeepsDeclaredReplicas(ctx) {
+		return jsonPatchMapper, nil, nil
+	}
+
+	serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to get iguazio tenant app service sets")
+	}
+
+	var replicaServiceNames []string
+	for _, serviceName := range serviceNames {
+		serviceSpec, found := serviceSet.specServices[serviceName]
+		if !found {
+			continue
+		}
+
+		_, found, err := ParseReplicas(serviceSpec)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Failed to parse replicas of service %s", serviceName)
+		}
+
+		if !found {
+			s.logger.DebugWithCtx(ctx, "Service doesn't declare replicas, ignoring scale", s.operationLogVars(ctx,
+				"services", []string{serviceName},
+				"scale", scale)...)
+			continue
+		}
+
+		jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
+			"op":    "add",
+			"path":  fmt.Sprintf("/spec/spec/tenants/0/spec/services/%s/replicas", serviceName),
+			"value": scale,
+		})
+		replicaServiceNames = append(replicaServiceNames, serviceName)
+	}
+
+	return jsonPatchMapper, replicaServiceNames, nil
+}
+
+// servicesReplicasReached returns the scaleFromZeroStageDone of waiting for services to report replicas
+func servicesReplicasReached(replicas int) scaleFromZeroStageDone {
+	return func(serviceSet *iguazioTenantAppServiceSet, serviceName string) bool {
+		serviceStatus, found := serviceSet.statusServices[serviceName]
+		if !found {
+			return false
+		}
+
+		currentReplicas, found, err := ParseReplicas(serviceStatus)
+		return err == nil && found && currentReplicas == replicas
+	}
+}
+
+// waitForServicesReplicas waits for the services to report the given replica count in their status
+func (s *AppResourceScaler) waitForServicesReplicas(ctx context.Context, serviceNames []string, replicas int) error {
+	pollInterval := s.getOptions().ServiceStatePollInterval.Duration
+	s.logger.DebugWithCtx(ctx, "Waiting for services to reach replicas", s.operationLogVars(ctx,
+		"services", serviceNames,
+		"replicas", replicas)...)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+			serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
+			if err != nil {
+				return errors.Wrap(err, "Failed to get iguazio tenant app service sets")
+			}
+
+			reached := true
+			for _, serviceName := range serviceNames {
+				serviceStatus, found := serviceSet.statusServices[serviceName]
+				if !found {
+					reached = false
+					break
+				}
+
+				currentReplicas, found, err := ParseReplicas(serviceStatus)
+				if err != nil {
+					return errors.Wrapf(err, "Failed to parse reported replicas of service %s", serviceName)
+				}
+
+				if !found || currentReplicas != replicas {
+					s.logger.DebugWithCtx(ctx, "Service did not reach replicas yet", s.operationLogVars(ctx,
+						"services", []string{serviceName},
+						"currentReplicas", currentReplicas,
+						"replicas", replicas)...)
+					reached = false
+					break
+				}
+			}
+
+			if reached {
+				s.logger.InfoWithCtx(ctx, "Services reached replicas", s.operationLogVars(ctx,
+					"services", serviceNames,
+					"replicas", replicas)...)
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+const jupyterReplicasPath = "/spec/spec/tenants/0/spec/services/jupyter/replicas"
+
+func newReplicasTestOptions() Options {
+	options := NewDefaultOptions()
+	options.ProvisioningPollInterval = scalertypes.Duration{Duration: time.Millisecond}
+	options.ServiceStatePollInterval = scalertypes.Duration{Duration: time.Millisecond}
+	options.ServiceSetCacheTTL = scalertypes.Duration{}
+	return options
+}
+
+func TestParseReplicas(t *testing.T) {
+	for _, testCase := range []struct {
+		name             string
+		service          interface{}
+		expectedReplicas int
+		expectedFound    bool
+		expectedFailed   bool
+	}{
+		{name: "undeclared", service: map[string]interface{}{}},
+		{name: "declared", service: map[string]interface{}{"replicas": float64(2)}, expectedReplicas: 2, expectedFound: true},
+		{name: "zero", service: map[string]interface{}{"replicas": float64(0)}, expectedFound: true},
+		{name: "negative", service: map[string]interface{}{"replicas": float64(-1)}, expectedFailed: true},
+		{name: "fractional", service: map[string]interface{}{"replicas": 1.5}, expectedFailed: true},
+		{name: "string", service: map[string]interface{}{"replicas": "2"}, expectedFailed: true},
+		{name: "not an object", service: "jupyter", expectedFailed: true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			replicas, found, err := ParseReplicas(testCase.service)
+			if (err != nil) != testCase.expectedFailed {
+				t.Fatalf("Expected failed %t, got %v", testCase.expectedFailed, err)
+			}
+
+			if replicas != testCase.expectedReplicas || found != testCase.expectedFound {
+				t.Fatalf("Expected %d and %t, got %d and %t",
+					testCase.expectedReplicas,
+					testCase.expectedFound,
+					replicas,
+					found)
+			}
+		})
+	}
+}
+
+func TestReplicasJSONPatchOperations(t *testing.T) {
+	resourceScaler := newTestAppResourceScaler(t, newFakeServiceSetAPI(newServiceSetBody(map[string]interface{}{
+		"jupyter": map[string]interface{}{"replicas": 3},
+		"spark":   map[string]interface{}{},
+	}, nil)), newReplicasTestOptions())
+
+	for _, testCase := range []struct {
+		name                  string
+		ctx                   context.Context
+		scale                 int
+		expectedServiceNames  []string
+		expectedNumOperations int
+	}{
+		{name: "scale of 1",
+			ctx:                   context.Background(),
+			scale:                 1,
+			expectedServiceNames:  []string{"jupyter"},
+			expectedNumOperations: 1},
+		{name: "scale above 1",
+			ctx:                   context.Background(),
+			scale:                 5,
+			expectedServiceNames:  []string{"jupyter"},
+			expectedNumOperations: 1},
+		{name: "declared replicas",
+			ctx:   WithDeclaredReplicas(context.Background()),
+			scale: 1},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			jsonPatchMapper, replicaServiceNames, err := resourceScaler.appendReplicasJSONPatchOperations(testCase.ctx,
+				nil,
+				[]string{"jupyter", "spark", "missing"},
+				testCase.scale)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if fmt.Sprint(replicaServiceNames) != fmt.Sprint(testCase.expectedServiceNames) {
+				t.Fatalf("Expected replicas set for %v, got %v", testCase.expectedServiceNames, replicaServiceNames)
+			}
+
+			if len(jsonPatchMapper) != testCase.expectedNumOperations {
+				t.Fatalf("Expected %d operations, got %v", testCase.expectedNumOperations, jsonPatchMapper)
+			}
+
+			if testCase.expectedNumOperations == 0 {
+				return
+			}
+
+			if _, found := findPatchOperation(jsonPatchMapper, "add", jupyterReplicasPath); !found ||
+				jsonPatchMapper[0]["value"] != testCase.scale {
+				t.Fatalf("Expected jupyter's replicas to be set to %d, got %v", testCase.scale, jsonPatchMapper)
+			}
+		})
+	}
+}
+
+func TestScaleFromZeroReplicas(t *testing.T) {
+	for _, testCase := range []struct {
+		name             string
+		ctx              context.Context
+		scale            int
+		expectedReplicas interface{}
+	}{
+		{name: "scale of 1", ctx: context.Background(), scale: 1, expectedReplicas: float64(1)},
+		{name: "scale above 1", ctx: context.Background(), scale: 2, expectedReplicas: float64(2)},
+		{name: "declared replicas", ctx: WithDeclaredReplicas(context.Background()), scale: 1, expectedReplicas: float64(3)},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			serviceSetAPI := newFakeServiceSetAPI(newServiceSetBody(map[string]interface{}{
+				"jupyter": map[string]interface{}{"desired_state": "scaledToZero", "replicas": 3},
+			}, map[string]string{"jupyter": "scaledToZero"}))
+			serviceSetAPI.applyPatches = true
+
+			// plays the controller, which provisions the service with its spec's replicas
+			serviceSetAPI.beforeRead = func() {
+				serviceSetAPI.lock.Lock()
+				defer serviceSetAPI.lock.Unlock()
+
+				var serviceSet map[string]interface{}
+				if err := json.Unmarshal(serviceSetAPI.body, &serviceSet); err != nil {
+					return
+				}
+
+				if getJSONPath(serviceSet, "/spec/spec/tenants/0/spec/services/jupyter/desired_state") != "ready" {
+					return
+				}
+
+				serviceSetAPI.body, _ = applyJSONPatch(serviceSetAPI.body, []byte(fmt.Sprintf(`[
+					{"op": "replace", "path": "/status/state", "value": "ready"},
+					{"op": "replace", "path": "/status/services/jupyter/state", "value": "ready"},
+					{"op": "add", "path": "/status/services/jupyter/replicas", "value": %v}]`,
+					getJSONPath(serviceSet, jupyterReplicasPath))))
+			}
+			resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, newReplicasTestOptions())
+
+			ctx, cancelFunc := context.WithTimeout(testCase.ctx, 5*time.Second)
+			defer cancelFunc()
+			if err := resourceScaler.SetScaleCtx(ctx, []scalertypes.Resource{{Name: "jupyter"}}, testCase.scale); err != nil {
+				t.Fatalf("Failed to scale from zero: %v", err)
+			}
+
+			serviceSet := serviceSetAPI.serviceSet(t)
+			if replicas := getJSONPath(serviceSet, jupyterReplicasPath); replicas != testCase.expectedReplicas {
+				t.Fatalf("Expected spec replicas %v, got %v", testCase.expectedReplicas, replicas)
+			}
+
+			if replicas := getJSONPath(serviceSet, "/status/services/jupyter/replicas"); replicas != testCase.expectedReplicas {
+				t.Fatalf("Expected reported replicas %v, got %v", testCase.expectedReplicas, replicas)
+			}
+		})
+	}
+}
+
+func TestWaitForServicesReplicas(t *testing.T) {
+	body := newServiceSetBody(map[string]interface{}{
+		"jupyter": map[string]interface{}{"replicas": 2},
+		"spark":   map[string]interface{}{"replicas": 2},
+	}, map[string]string{"jupyter": "ready", "spark": "ready"})
+	body, err := applyJSONPatch(body, []byte(`[
+		{"op": "add", "path": "/status/services/jupyter/replicas", "value": 1},
+		{"op": "add", "path": "/status/services/spark/replicas", "value": 2}]`))
+	if err != nil {
+		t.Fatalf("Failed to patch service set body: %v", err)
+	}
+
+	serviceSetAPI := newFakeServiceSetAPI(body)
+	serviceSetAPI.beforeRead = func() {
+		if serviceSetAPI.reads.Load() != 3 {
+			return
+		}
+
+		serviceSetAPI.lock.Lock()
+		defer serviceSetAPI.lock.Unlock()
+		serviceSetAPI.body, _ = applyJSONPatch(serviceSetAPI.body,
+			[]byte(`[{"op": "replace", "path": "/status/services/jupyter/replicas", "value": 2}]`))
+	}
+
+	// polled slowly enough to stay within the client's rate limit until the deadline
+	options := newReplicasTestOptions()
+	options.ServiceStatePollInterval = scalertypes.Duration{Duration: 10 * time.Millisecond}
+	resourceScaler := newTestAppResourceScaler(t, serviceSetAPI, options)
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	if err := resourceScaler.waitForServicesReplicas(ctx, []string{"jupyter", "spark"}, 2); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if reads := serviceSetAPI.reads.Load(); reads != 3 {
+		t.Fatalf("Expected waiting until the third read reported the replicas, got %d reads", reads)
+	}
+
+	// a count that is never reported is waited for until the deadline. A read in flight may fail on the deadline
+	// before the context is marked done
+	ctx, cancelFunc = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelFunc()
+	deadline, _ := ctx.Deadline()
+	if err := resourceScaler.waitForServicesReplicas(ctx, []string{"jupyter"}, 3); err == nil || time.Now().Before(deadline) {
+		t.Fatalf("Expected waiting to last until the deadline, got %v", err)
+	}
+
+	reached := servicesReplicasReached(2)
+	serviceSet, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get service set: %v", err)
+	}
+	if !reached(serviceSet, "jupyter") || reached(serviceSet, "missing") || servicesReplicasReached(3)(serviceSet, "jupyter") {
+		t.Fatalf("Expected only the services reporting 2 replicas to have reached them")
+	}
+}
@@ -24,13 +24,20 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"sync"
 	"time"
 
+	"github.com/v3io/app-resource-scaler/pkg/accounting"
+	"github.com/v3io/app-resource-scaler/pkg/audit"
+	"github.com/v3io/app-resource-scaler/pkg/notification"
+
 	"github.com/nuclio/errors"
 	"github.com/nuclio/logger"
 	"github.com/v3io/scaler/pkg/scalertypes"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 )
 
 type ProvisioningState string
@@ -40,34 +47,200 @@ const (
 	scaleToZeroProvisioningState   ProvisioningState = "waitingForScalingToZero"
 )
 
+// Options are the app resource scaler settings, on top of the DLX and autoscaler options
+type Options struct {
+
+	// services that are never offered for scale to zero (nuclio is always excluded)
+	ExcludedServices []string `json:"excludedServices,omitempty"`
+
+	// how often to check whether the service set finished provisioning before patching it
+	ProvisioningPollInterval scalertypes.Duration `json:"provisioningPollInterval,omitempty"`
+
+	// how often to check whether the services reached their desired state after patching
+	ServiceStatePollInterval scalertypes.Duration `json:"serviceStatePollInterval,omitempty"`
+
+	// the timeout of SetScale, which isn't given a context by its callers
+	SetScaleTimeout scalertypes.Duration `json:"setScaleTimeout,omitempty"`
+
+	// what to do with services that didn't become ready before a scale from zero timed out
+	ScaleFromZeroTimeoutPolicy string `json:"scaleFromZeroTimeoutPolicy,omitempty"`
+
+	// how long the service set may stay in the same provisioning state before it's considered stuck, 0 disables the
+	// detection. Operations only fail on stuck states written by the scaler itself
+	StuckProvisioningTimeout scalertypes.Duration `json:"stuckProvisioningTimeout,omitempty"`
+
+	// whether to reset a service set stuck in a provisioning state written by the scaler itself
+	RecoverStuckProvisioning bool `json:"recoverStuckProvisioning,omitempty"`
+
+	// the label holding the app service name on its Kubernetes service, empty disables resolving services by label
+	ServiceLabel string `json:"serviceLabel,omitempty"`
+
+	// how long resolved service endpoints and routes are cached, unless the service's spec changes
+	ServiceEndpointCacheTTL scalertypes.Duration `json:"serviceEndpointCacheTTL,omitempty"`
+
+	// how long a read service set is shared by all callers, unless this process patches it, 0 disables caching
+	ServiceSetCacheTTL scalertypes.Duration `json:"serviceSetCacheTTL,omitempty"`
+
+	// how long services whose desired state was changed outside the scaler are left alone, 0 only records changes
+	ManualChangeWindow scalertypes.Duration `json:"manualChangeWindow,omitempty"`
+
+	// how many times services that land in error after scaling from zero are restarted, 0 disables recovery
+	ErrorRecoveryAttempts int `json:"errorRecoveryAttempts,omitempty"`
+
+	// how long to wait before the first restart, doubled before every next one
+	ErrorRecoveryBackoff scalertypes.Duration `json:"errorRecoveryBackoff,omitempty"`
+
+	// the most patches of the service set sent per minute, 0 for no limit. Mutations beyond it wait their turn
+	MutationsPerMinute int `json:"mutationsPerMinute,omitempty"`
+}
+
+func NewDefaultOptions() Options {
+	return Options{
+		ExcludedServices:           []string{},
+		ProvisioningPollInterval:   scalertypes.Duration{Duration: 10 * time.Second},
+		ServiceStatePollInterval:   scalertypes.Duration{Duration: 5 * time.Second},
+		SetScaleTimeout:            scalertypes.Duration{Duration: 15 * time.Minute},
+		ScaleFromZeroTimeoutPolicy: NoneTimeoutPolicy,
+		StuckProvisioningTimeout:   scalertypes.Duration{Duration: 30 * time.Minute},
+		ServiceEndpointCacheTTL:    scalertypes.Duration{Duration: time.Minute},
+		ServiceSetCacheTTL:         scalertypes.Duration{Duration: time.Second},
+		ErrorRecoveryBackoff:       scalertypes.Duration{Duration: 30 * time.Second},
+	}
+}
+
+func (o *Options) Validate() error {
+	if o.ProvisioningPollInterval.Duration <= 0 {
+		return errors.New("Provisioning poll interval must be positive")
+	}
+
+	if o.ServiceStatePollInterval.Duration <= 0 {
+		return errors.New("Service state poll interval must be positive")
+	}
+
+	if o.SetScaleTimeout.Duration <= 0 {
+		return errors.New("Set scale timeout must be positive")
+	}
+
+	if o.ServiceEndpointCacheTTL.Duration < 0 {
+		return errors.New("Service endpoint cache TTL must not be negative")
+	}
+
+	if o.ServiceSetCacheTTL.Duration < 0 {
+		return errors.New("Service set cache TTL must not be negative")
+	}
+
+	if o.StuckProvisioningTimeout.Duration < 0 {
+		return errors.New("Stuck provisioning timeout must not be negative")
+	}
+
+	if o.ManualChangeWindow.Duration < 0 {
+		return errors.New("Manual change window must not be negative")
+	}
+
+	if o.ErrorRecoveryAttempts < 0 {
+		return errors.New("Error recovery attempts must not be negative")
+	}
+
+	if o.ErrorRecoveryAttempts > 0 && o.ErrorRecoveryBackoff.Duration <= 0 {
+		return errors.New("Error recovery backoff must be positive")
+	}
+
+	if o.MutationsPerMinute < 0 {
+		return errors.New("Mutations per minute must not be negative")
+	}
+
+	switch o.ScaleFromZeroTimeoutPolicy {
+	case NoneTimeoutPolicy, RevertTimeoutPolicy, ResetStateTimeoutPolicy, MarkFailedTimeoutPolicy:
+	default:
+		return errors.Errorf("Unknown scale from zero timeout policy: %s", o.ScaleFromZeroTimeoutPolicy)
+	}
+
+	return nil
+}
+
 type AppResourceScaler struct {
 	logger        logger.Logger
 	namespace     string
 	kubeClientSet kubernetes.Interface
-
+	auditLog      *audit.Log
+	eventRecorder record.EventRecorder
+	notifier      *notification.Notifier
+	ledger        *accounting.Ledger
+
+	// the clients veto hooks and readiness probes are called with
+	vetoHookClient       *http.Client
+	readinessProbeClient *http.Client
+
+	provisioningStateTracker provisioningStateTracker
+	mutationQueue            mutationQueue
+	mutationBudget           mutationBudget
+	serviceSetCache          serviceSetCache
+	monitorDecisionTracker   monitorDecisionTracker
+	serviceEndpointCache     serviceEndpointCache
+	serviceRouteCache        serviceRouteCache
+	manualChangeRecorder     manualChangeRecorder
+
+	// guards the options below, which may be replaced while running by SetConfig
+	configLock        sync.RWMutex
 	autoScalerOptions scalertypes.AutoScalerOptions
 	dlxOptions        scalertypes.DLXOptions
+	options           Options
+}
+
+// iguazioTenantAppServiceSet is the parsed IguazioTenantAppServiceSet object
+type iguazioTenantAppServiceSet struct {
+	uid             string
+	resourceVersion string
+	state           string
+	specServices    map[string]interface{}
+	statusServices  map[string]interface{}
+
+	// when the scaler last set the service set to one of its own states, as recorded in the service set
+	provisioningStateSince time.Time
+
+	// since when the service set has been in its current state, as recorded or as first seen by this process
+	stateSince time.Time
 }
 
 func New(logger logger.Logger,
 	kubeClientSet kubernetes.Interface,
 	namespace string,
 	dlxOptions scalertypes.DLXOptions,
-	autoScalerOptions scalertypes.AutoScalerOptions) (scalertypes.ResourceScaler, error) { // nolint: deadcode
+	autoScalerOptions scalertypes.AutoScalerOptions,
+	options Options) (*AppResourceScaler, error) { // nolint: deadcode
+
+	if err := options.Validate(); err != nil {
+		return nil, errors.Wrap(err, "Invalid resource scaler options")
+	}
 
 	return &AppResourceScaler{
-		logger:            logger.GetChild("resourcescaler"),
-		namespace:         namespace,
-		kubeClientSet:     kubeClientSet,
-		autoScalerOptions: autoScalerOptions,
-		dlxOptions:        dlxOptions,
+		logger:               logger.GetChild("resourcescaler"),
+		namespace:            namespace,
+		kubeClientSet:        kubeClientSet,
+		vetoHookClient:       &http.Client{},
+		readinessProbeClient: newReadinessProbeClient(),
+		mutationQueue:        mutationQueue{namespace: namespace},
+		autoScalerOptions:    autoScalerOptions,
+		dlxOptions:           dlxOptions,
+		options:              options,
 	}, nil
 }
 
+// SetAuditLog sets the log every mutation of the service set is recorded in. Must be called before use
+func (s *AppResourceScaler) SetAuditLog(auditLog *audit.Log) {
+	s.auditLog = auditLog
+}
+
+// SetEventRecorder sets the recorder of Kubernetes events on the service set. Must be called before use
+func (s *AppResourceScaler) SetEventRecorder(eventRecorder record.EventRecorder) {
+	s.eventRecorder = eventRecorder
+}
+
 // SetScale scales a service
 // Deprecated: use SetScaleCtx instead
 func (s *AppResourceScaler) SetScale(resources []scalertypes.Resource, scale int) error {
-	setScaleContext, cancelFunc := context.WithTimeout(context.Background(), 15*time.Minute)
+	setScaleContext, cancelFunc := context.WithTimeout(WithTrigger(context.Background(), AutoScalerTrigger),
+		s.getOptions().SetScaleTimeout.Duration)
 	defer cancelFunc()
 
 	return s.SetScaleCtx(setScaleContext, resources, scale)
@@ -75,6 +248,14 @@ func (s *AppResourceScaler) SetScale(resources []scalertypes.Resource, scale int
 
 // SetScaleCtx scales a service
 func (s *AppResourceScaler) SetScaleCtx(ctx context.Context, resources []scalertypes.Resource, scale int) error {
+	if GetOperationID(ctx) == "" {
+		ctx = WithOperationID(ctx, newOperationID())
+	}
+
+	if GetTrigger(ctx) == "" {
+		ctx = WithTrigger(ctx, DLXTrigger)
+	}
+
 	serviceNames := make([]string, 0)
 	for _, resource := range resources {
 		serviceNames = append(serviceNames, resource.Name)
@@ -82,17 +263,27 @@ func (s *AppResourceScaler) SetScaleCtx(ctx context.Context, resources []scalert
 	if scale == 0 {
 		return s.scaleServicesToZero(ctx, s.namespace, serviceNames)
 	}
-	return s.scaleServicesFromZero(ctx, s.namespace, serviceNames)
+	return s.scaleServicesFromZero(ctx, s.namespace, serviceNames, scale)
 }
 
 func (s *AppResourceScaler) GetResources() ([]scalertypes.Resource, error) {
 	resources := make([]scalertypes.Resource, 0)
 
-	specServicesMap, statusServicesMap, _, err := s.getIguazioTenantAppServiceSets(context.Background())
+	ctx := WithTrigger(context.Background(), AutoScalerTrigger)
+	serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to get iguazio tenant app service sets")
 	}
+	specServicesMap := serviceSet.specServices
+	statusServicesMap := serviceSet.statusServices
+
+	statusServiceNames := make([]string, 0, len(statusServicesMap))
+	for statusServiceName := range statusServicesMap {
+		statusServiceNames = append(statusServiceNames, statusServiceName)
+	}
+	controlledServices := s.getManuallyControlledServices(ctx, serviceSet, statusServiceNames)
 
+	options := s.getOptions()
 	for statusServiceName, serviceStatus := range statusServicesMap {
 
 		// Nuclio is a special service since it's a controller itself, so its scale to zero spec is configuring
@@ -101,9 +292,15 @@ func (s *AppResourceScaler) GetResources() ([]scalertypes.Resource, error) {
 			continue
 		}
 
+		if stringSliceContainsString(options.ExcludedServices, statusServiceName) {
+			continue
+		}
+
 		stateString, err := s.parseServiceState(serviceStatus)
 		if err != nil {
 			s.logger.WarnWith("Failed parsing the service state, continuing",
+				"namespace", s.namespace,
+				"services", []string{statusServiceName},
 				"err", errors.GetErrorStackString(err, 10),
 				"serviceStatus", serviceStatus)
 			continue
@@ -113,9 +310,11 @@ func (s *AppResourceScaler) GetResources() ([]scalertypes.Resource, error) {
 
 		if stateString == "ready" && serviceSpecExists {
 
-			scaleResources, err := s.parseScaleResources(specServicesMap[statusServiceName])
+			scaleResources, err := ParseScaleResources(specServicesMap[statusServiceName])
 			if err != nil {
 				s.logger.WarnWith("Failed parsing the scale resources, continuing",
+					"namespace", s.namespace,
+					"services", []string{statusServiceName},
 					"err", errors.GetErrorStackString(err, 10),
 					"serviceSpec", specServicesMap[statusServiceName])
 				continue
@@ -123,6 +322,33 @@ func (s *AppResourceScaler) GetResources() ([]scalertypes.Resource, error) {
 
 			if len(scaleResources) != 0 {
 
+				pinned, err := isPinned(specServicesMap[statusServiceName], time.Now())
+				if err != nil {
+					s.logger.WarnWith("Failed parsing the service pin, continuing",
+						"namespace", s.namespace,
+						"services", []string{statusServiceName},
+						"err", errors.GetErrorStackString(err, 10),
+						"serviceSpec", specServicesMap[statusServiceName])
+					continue
+				}
+
+				// pinned services are kept awake, so they aren't offered for scale to zero
+				if pinned {
+					s.logger.DebugWith("Service is pinned, skipping",
+						"namespace", s.namespace,
+						"services", []string{statusServiceName})
+					continue
+				}
+
+				// manually controlled services are left as they were set, so they aren't offered either
+				if reason, controlled := controlledServices[statusServiceName]; controlled {
+					s.logger.DebugWith("Service is manually controlled, skipping",
+						"namespace", s.namespace,
+						"services", []string{statusServiceName},
+						"reason", reason)
+					continue
+				}
+
 				lastScaleEvent, lastScaleEventTime, err := s.parseLastScaleEvent(serviceStatus)
 				if err != nil {
 					return nil, errors.Wrap(err, "Failed to parse last scale event")
@@ -139,26 +365,81 @@ func (s *AppResourceScaler) GetResources() ([]scalertypes.Resource, error) {
 	}
 
 	if len(resources) != 0 {
-		s.logger.DebugWith("Found services", "services", resources)
+		s.logger.DebugWith("Found services", "namespace", s.namespace, "resources", resources)
 	}
 
 	return resources, nil
 }
 
+// GetConfig returns the current effective configuration
 func (s *AppResourceScaler) GetConfig() (*scalertypes.ResourceScalerConfig, error) {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
 	return &scalertypes.ResourceScalerConfig{
 		AutoScalerOptions: s.autoScalerOptions,
 		DLXOptions:        s.dlxOptions,
 	}, nil
 }
 
-func (s *AppResourceScaler) ResolveServiceName(resource scalertypes.Resource) (string, error) {
-	return resource.Name, nil
+// SetConfig replaces the configuration while running. Operations in progress keep the options they started with
+func (s *AppResourceScaler) SetConfig(dlxOptions scalertypes.DLXOptions,
+	autoScalerOptions scalertypes.AutoScalerOptions,
+	options Options) error {
+
+	if err := options.Validate(); err != nil {
+		return errors.Wrap(err, "Invalid resource scaler options")
+	}
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	s.dlxOptions = dlxOptions
+	s.autoScalerOptions = autoScalerOptions
+	s.options = options
+
+	s.logger.InfoWith("Configuration updated", "options", options)
+
+	return nil
+}
+
+func (s *AppResourceScaler) getOptions() Options {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	return s.options
 }
 
-func (s *AppResourceScaler) scaleServicesFromZero(ctx context.Context, namespace string, serviceNames []string) error {
+// scaleServicesFromZero scales the services to ready, and those that declare replicas to scale
+func (s *AppResourceScaler) scaleServicesFromZero(ctx context.Context,
+	namespace string,
+	serviceNames []string,
+	scale int) (err error) {
 	var jsonPatchMapper []map[string]interface{}
-	s.logger.DebugWithCtx(ctx, "Scaling from zero", "namespace", namespace, "serviceNames", serviceNames)
+
+	serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get iguazio tenant app service sets")
+	}
+
+	if err := s.checkManuallyControlledServices(ctx, serviceSet, serviceNames); err != nil {
+		return err
+	}
+
+	startedAt := time.Now()
+	s.publishScaleEvents(ctx, notification.ScaleFromZeroStartedEventType, serviceNames, time.Time{}, nil)
+	defer func() {
+		s.publishScaleResultEvents(ctx,
+			notification.ScaleFromZeroSucceededEventType,
+			notification.ScaleFromZeroFailedEventType,
+			serviceNames,
+			startedAt,
+			err)
+	}()
+
+	s.logger.InfoWithCtx(ctx, "Scaling from zero", s.operationLogVars(ctx,
+		"services", serviceNames,
+		"scaleEvent", scalertypes.ScaleFromZeroStartedScaleEvent)...)
 	marshaledTime, err := time.Now().MarshalText()
 	if err != nil {
 		return errors.Wrap(err, "Failed to marshal time")
@@ -167,6 +448,7 @@ func (s *AppResourceScaler) scaleServicesFromZero(ctx context.Context, namespace
 		jsonPatchMapper, err = s.appendServiceStateChangeJSONPatchOperations(jsonPatchMapper,
 			serviceName,
 			"ready",
+			false,
 			scalertypes.ScaleFromZeroStartedScaleEvent,
 			marshaledTime)
 		if err != nil {
@@ -174,23 +456,78 @@ func (s *AppResourceScaler) scaleServicesFromZero(ctx context.Context, namespace
 		}
 	}
 
+	jsonPatchMapper, replicaServiceNames, err := s.appendReplicasJSONPatchOperations(ctx,
+		jsonPatchMapper,
+		serviceNames,
+		scale)
+	if err != nil {
+		return errors.Wrap(err, "Failed appending replicas json patch operations")
+	}
+
 	if err := s.patchIguazioTenantAppServiceSets(ctx,
 		namespace,
+		serviceNames,
+		scalertypes.ScaleFromZeroStartedScaleEvent,
 		jsonPatchMapper,
 		scaleFromZeroProvisioningState); err != nil {
 		return errors.Wrap(err, "Failed to patch iguazio tenant app service sets")
 	}
 
-	if err := s.waitForServicesState(ctx, serviceNames, "ready"); err != nil {
+	s.recordWake(ctx, serviceNames)
+
+	// whichever stage the deadline passes in, the services that didn't complete it are compensated for
+	if err := s.waitForServicesReady(ctx, serviceNames); err != nil {
+		s.compensateScaleFromZeroTimeout(ctx, serviceNames, isServiceReady)
 		return errors.Wrap(err, "Failed to wait for services readiness")
 	}
 
+	if len(replicaServiceNames) > 0 {
+		if err := s.waitForServicesReplicas(ctx, replicaServiceNames, scale); err != nil {
+			s.compensateScaleFromZeroTimeout(ctx, replicaServiceNames, servicesReplicasReached(scale))
+			return errors.Wrap(err, "Failed to wait for services replicas")
+		}
+	}
+
+	if notServingServiceNames, err := s.waitForServicesServing(ctx, serviceNames); err != nil {
+		s.compensateScaleFromZeroTimeout(ctx, notServingServiceNames, nil)
+		return errors.Wrap(err, "Failed to wait for services to serve")
+	}
+
 	return nil
 }
 
-func (s *AppResourceScaler) scaleServicesToZero(ctx context.Context, namespace string, serviceNames []string) error {
+func (s *AppResourceScaler) scaleServicesToZero(ctx context.Context,
+	namespace string,
+	serviceNames []string) (err error) {
 	var jsonPatchMapper []map[string]interface{}
-	s.logger.DebugWithCtx(ctx, "Scaling to zero", "namespace", namespace, "serviceNames", serviceNames)
+
+	serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get iguazio tenant app service sets")
+	}
+
+	serviceNames = s.filterManuallyControlledServices(ctx, serviceSet, serviceNames)
+	serviceNames = s.filterVetoedServices(ctx, serviceSet, serviceNames)
+	serviceNames = s.filterMonitoredServices(ctx, serviceSet, serviceNames)
+	serviceNames = s.filterPinnedServices(ctx, serviceSet, serviceNames)
+	if len(serviceNames) == 0 {
+		return nil
+	}
+
+	startedAt := time.Now()
+	s.publishScaleEvents(ctx, notification.ScaleToZeroStartedEventType, serviceNames, time.Time{}, nil)
+	defer func() {
+		s.publishScaleResultEvents(ctx,
+			notification.ScaleToZeroSucceededEventType,
+			notification.ScaleToZeroFailedEventType,
+			serviceNames,
+			startedAt,
+			err)
+	}()
+
+	s.logger.InfoWithCtx(ctx, "Scaling to zero", s.operationLogVars(ctx,
+		"services", serviceNames,
+		"scaleEvent", scalertypes.ScaleToZeroStartedScaleEvent)...)
 	marshaledTime, err := time.Now().MarshalText()
 	if err != nil {
 		return errors.Wrap(err, "Failed to marshal time")
@@ -200,6 +537,7 @@ func (s *AppResourceScaler) scaleServicesToZero(ctx context.Context, namespace s
 		jsonPatchMapper, err = s.appendServiceStateChangeJSONPatchOperations(jsonPatchMapper,
 			serviceName,
 			"scaledToZero",
+			false,
 			scalertypes.ScaleToZeroStartedScaleEvent,
 			marshaledTime)
 		if err != nil {
@@ -209,11 +547,15 @@ func (s *AppResourceScaler) scaleServicesToZero(ctx context.Context, namespace s
 
 	if err := s.patchIguazioTenantAppServiceSets(ctx,
 		namespace,
+		serviceNames,
+		scalertypes.ScaleToZeroStartedScaleEvent,
 		jsonPatchMapper,
 		scaleToZeroProvisioningState); err != nil {
 		return errors.Wrap(err, "Failed to patch iguazio tenant app service sets")
 	}
 
+	s.recordSleep(ctx, serviceSet, serviceNames)
+
 	if err := s.waitForServicesState(ctx, serviceNames, "scaledToZero"); err != nil {
 		return errors.Wrap(err, "Failed to wait for services to scale to zero")
 	}
@@ -224,6 +566,7 @@ func (s *AppResourceScaler) scaleServicesToZero(ctx context.Context, namespace s
 func (s *AppResourceScaler) appendServiceStateChangeJSONPatchOperations(jsonPatchMapper []map[string]interface{},
 	serviceName string,
 	desiredState string,
+	markForRestart bool,
 	scaleEvent scalertypes.ScaleEvent,
 	marshaledTime []byte) ([]map[string]interface{}, error) {
 
@@ -243,13 +586,18 @@ func (s *AppResourceScaler) appendServiceStateChangeJSONPatchOperations(jsonPatc
 	jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
 		"op":    "add",
 		"path":  markForRestartPath,
-		"value": false,
+		"value": markForRestart,
 	})
 	jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
 		"op":    "add",
 		"path":  markAsChangedPath,
 		"value": true,
 	})
+	jsonPatchMapper = appendLastChangeJSONPatchOperations(jsonPatchMapper,
+		serviceName,
+		ScalerChangedBy,
+		desiredState,
+		string(marshaledTime))
 	jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
 		"op":    "add",
 		"path":  scaleToZeroStatusPath,
@@ -271,83 +619,239 @@ func (s *AppResourceScaler) appendServiceStateChangeJSONPatchOperations(jsonPatc
 
 func (s *AppResourceScaler) patchIguazioTenantAppServiceSets(ctx context.Context,
 	namespace string,
+	serviceNames []string,
+	scaleEvent scalertypes.ScaleEvent,
 	jsonPatchMapper []map[string]interface{},
 	provisioningState ProvisioningState) error {
-	jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
-		"op":    "add",
-		"path":  "/status/state",
-		"value": string(provisioningState),
-	})
-	jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
-		"op":    "add",
-		"path":  "/spec/spec/tenants/0/spec/force_apply_all_mode",
-		"value": "disabled",
-	})
-	if err := s.waitForNoProvisioningInProcess(ctx); err != nil {
+	mutationCtx, ownMutation, err := s.mutationQueue.acquire(ctx, scaleEvent, serviceNames, jsonPatchMapper)
+	if err != nil {
+		return errors.Wrap(err, "Failed waiting for turn to patch IguazioTenantAppServiceSet")
+	}
+	defer s.mutationQueue.release(ownMutation)
+
+	// patched along with the mutation holding the turn
+	if ownMutation.coalesced {
+		if ownMutation.coalescedErr != nil {
+			return errors.Wrap(ownMutation.coalescedErr, "Failed to patch coalesced IguazioTenantAppServiceSet mutation")
+		}
+		return nil
+	}
+
+	// wait for the budget before reading the service set, so it's still fresh when patched
+	if err := s.mutationBudget.wait(mutationCtx, s.getOptions().MutationsPerMinute, false); err != nil {
+		if mutationCtx.Err() != nil {
+			err = context.Cause(mutationCtx)
+		}
+		return errors.Wrap(err, "Failed waiting for mutation budget")
+	}
+
+	serviceSetBefore, err := s.waitForNoProvisioningInProcess(mutationCtx)
+	if err != nil {
+		if mutationCtx.Err() != nil {
+			err = context.Cause(mutationCtx)
+		}
 		return errors.Wrap(err, "Failed waiting for IguazioTenantAppServiceSet to finish provisioning")
 	}
 
+	// another process (i.e. the dlx) may have started waking up the services while this one was waiting
+	if !ownMutation.fromZero() && s.scaledFromZeroSince(serviceSetBefore, serviceNames, ownMutation.enqueuedAt) {
+		return errors.Wrap(ErrMutationCancelled, "Services are being scaled from zero")
+	}
+
+	coalescedMutations, committed := s.mutationQueue.commit(ownMutation, func(pendingMutation *mutation) bool {
+		return pendingMutation.fromZero() ||
+			!s.scaledFromZeroSince(serviceSetBefore, pendingMutation.serviceNames, pendingMutation.enqueuedAt)
+	})
+	if !committed {
+		return errors.Wrap(context.Cause(mutationCtx), "Patch was cancelled")
+	}
+
+	patchServiceNames := append([]string(nil), serviceNames...)
+	patchJSONPatchMapper := append([]map[string]interface{}(nil), jsonPatchMapper...)
+	if len(coalescedMutations) > 0 {
+		var coalescedOperationIDs []string
+		for _, coalescedMutation := range coalescedMutations {
+			patchServiceNames = append(patchServiceNames, coalescedMutation.serviceNames...)
+			patchJSONPatchMapper = append(patchJSONPatchMapper, coalescedMutation.jsonPatchMapper...)
+			coalescedOperationIDs = append(coalescedOperationIDs, coalescedMutation.operationID)
+		}
+
+		s.logger.InfoWithCtx(ctx, "Coalescing pending mutations into patch", s.operationLogVars(ctx,
+			"services", patchServiceNames,
+			"coalescedOperationIDs", coalescedOperationIDs)...)
+	}
+
+	// mutations of the status alone have nothing for the controller to provision
+	if provisioningState != "" {
+		marshaledTime, err := time.Now().MarshalText()
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal time")
+		}
+		patchJSONPatchMapper = appendProvisioningStateJSONPatchOperations(patchJSONPatchMapper,
+			provisioningState,
+			marshaledTime)
+		patchJSONPatchMapper = append(patchJSONPatchMapper, map[string]interface{}{
+			"op":    "add",
+			"path":  "/spec/spec/tenants/0/spec/force_apply_all_mode",
+			"value": "disabled",
+		})
+	}
+
+	err = s.sendIguazioTenantAppServiceSetPatch(mutationCtx,
+		namespace,
+		serviceNames,
+		scaleEvent,
+		patchJSONPatchMapper,
+		serviceSetBefore,
+		coalescedMutations)
+	s.mutationQueue.complete(coalescedMutations, err)
+
+	return err
+}
+
+// scaledFromZeroSince returns whether a scale from zero of any of the services started after the given time
+func (s *AppResourceScaler) scaledFromZeroSince(serviceSet *iguazioTenantAppServiceSet,
+	serviceNames []string,
+	since time.Time) bool {
+	for _, serviceName := range serviceNames {
+		serviceStatus, found := serviceSet.statusServices[serviceName]
+		if !found {
+			continue
+		}
+
+		lastScaleEvent, lastScaleEventTime, err := s.parseLastScaleEvent(serviceStatus)
+		if err != nil || lastScaleEvent == nil {
+			continue
+		}
+
+		if *lastScaleEvent == scalertypes.ScaleFromZeroStartedScaleEvent && lastScaleEventTime.After(since) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sendUnqueuedPatch patches the service set as is, serviceSetBefore being the last observed service set. Unlike
+// patchIguazioTenantAppServiceSets it neither takes a turn in the mutation queue nor waits for provisioning to
+// finish, though it still counts against the mutation budget. It's only for patches that mustn't wait behind scale
+// operations or for provisioning to finish:
+//   - pins, which only touch pinned_until and test the resource version, retrying if the service set changed
+//   - reverting timed out scales from zero, as the service set is still provisioning the scale being reverted
+//   - monitor mode decisions, which only record would_scale_to_zero_at in the status
+//   - resetting a stuck provisioning state, which is what everything else waits for
+func (s *AppResourceScaler) sendUnqueuedPatch(ctx context.Context,
+	namespace string,
+	serviceNames []string,
+	scaleEvent scalertypes.ScaleEvent,
+	jsonPatchMapper []map[string]interface{},
+	serviceSetBefore *iguazioTenantAppServiceSet) error {
+	return s.sendIguazioTenantAppServiceSetPatch(ctx,
+		namespace,
+		serviceNames,
+		scaleEvent,
+		jsonPatchMapper,
+		serviceSetBefore,
+		nil)
+}
+
+// sendIguazioTenantAppServiceSetPatch patches the service set with the patch of the operation of the context over
+// serviceNames, which may include the patches of coalescedMutations. Each is audited under its own operation
+func (s *AppResourceScaler) sendIguazioTenantAppServiceSetPatch(ctx context.Context,
+	namespace string,
+	serviceNames []string,
+	scaleEvent scalertypes.ScaleEvent,
+	jsonPatchMapper []map[string]interface{},
+	serviceSetBefore *iguazioTenantAppServiceSet,
+	coalescedMutations []*mutation) error {
+
+	if err := s.mutationBudget.wait(ctx, s.getOptions().MutationsPerMinute, true); err != nil {
+		return errors.Wrap(err, "Failed waiting for mutation budget")
+	}
+
 	body, err := json.Marshal(jsonPatchMapper)
 	if err != nil {
 		return errors.Wrap(err, "Could not marshal json patch mapper")
 	}
 
-	s.logger.DebugWithCtx(ctx, "Patching iguazio tenant app service sets", "body", string(body))
+	s.logger.DebugWithCtx(ctx, "Patching iguazio tenant app service sets", s.operationLogVars(ctx,
+		"body", string(body))...)
 	absPath := []string{"apis", "iguazio.com", "v1beta1", "namespaces", namespace, "iguaziotenantappservicesets", namespace}
-	if _, err := s.kubeClientSet.
+	patchedServiceSetBody, err := s.kubeClientSet.
 		Discovery().
 		RESTClient().
 		Patch(types.JSONPatchType).
 		Body(body).
 		AbsPath(absPath...).
 		Do(ctx).
-		Raw(); err != nil {
+		Raw()
+	s.serviceSetCache.invalidate()
+	s.auditPatch(ctx, serviceNames, scaleEvent, body, serviceSetBefore, patchedServiceSetBody, err, coalescedMutations)
+	if err != nil {
 		return errors.Wrap(err, "Failed to patch iguazio tenant app service sets")
 	}
 	return nil
 }
 
-func (s *AppResourceScaler) waitForNoProvisioningInProcess(ctx context.Context) error {
-	s.logger.DebugWithCtx(ctx, "Waiting for IguazioTenantAppServiceSet to finish provisioning")
+// waitForNoProvisioningInProcess returns the service set once it isn't provisioning
+func (s *AppResourceScaler) waitForNoProvisioningInProcess(ctx context.Context) (*iguazioTenantAppServiceSet, error) {
+	pollInterval := s.getOptions().ProvisioningPollInterval.Duration
+	s.logger.DebugWithCtx(ctx, "Waiting for IguazioTenantAppServiceSet to finish provisioning", s.operationLogVars(ctx)...)
 	for {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			return nil, ctx.Err()
 
-		case <-time.After(10 * time.Second):
-			_, _, state, err := s.getIguazioTenantAppServiceSets(ctx)
+		case <-time.After(pollInterval):
+			serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
 			if err != nil {
-				return errors.Wrap(err, "Failed to get iguazio tenant app service sets")
+				return nil, errors.Wrap(err, "Failed to get iguazio tenant app service sets")
 			}
 
-			if state == "ready" || state == "error" {
-				s.logger.DebugWithCtx(ctx, "IguazioTenantAppServiceSet finished provisioning")
-				return nil
+			if serviceSet.state == "ready" || serviceSet.state == "error" {
+				s.logger.DebugWithCtx(ctx, "IguazioTenantAppServiceSet finished provisioning", s.operationLogVars(ctx,
+					"state", serviceSet.state)...)
+				return serviceSet, nil
 			}
 
-			s.logger.DebugWithCtx(ctx, "IguazioTenantAppServiceSet is still provisioning", "state", state)
+			if stuckProvisioningErr := s.checkStuckProvisioning(ctx, serviceSet); stuckProvisioningErr != nil {
+				if s.recoverStuckProvisioning(ctx, serviceSet, stuckProvisioningErr) {
+					continue
+				}
+
+				// the provisioner's states are only alerted on, it may legitimately take long and is waited for
+				// as before
+				if stuckProvisioningErr.OwnState {
+					return nil, stuckProvisioningErr
+				}
+			}
+
+			s.logger.DebugWithCtx(ctx, "IguazioTenantAppServiceSet is still provisioning", s.operationLogVars(ctx,
+				"state", serviceSet.state)...)
 		}
 
 	}
 }
 
 func (s *AppResourceScaler) waitForServicesState(ctx context.Context, serviceNames []string, desiredState string) error {
+	pollInterval := s.getOptions().ServiceStatePollInterval.Duration
 	s.logger.DebugWithCtx(ctx,
 		"Waiting for services to reach desired state",
-		"serviceNames", serviceNames,
-		"desiredState", desiredState)
+		s.operationLogVars(ctx,
+			"services", serviceNames,
+			"desiredState", desiredState)...)
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-time.After(5 * time.Second):
+		case <-time.After(pollInterval):
 			servicesToCheck := append([]string(nil), serviceNames...)
-			_, statusServicesMap, _, err := s.getIguazioTenantAppServiceSets(ctx)
+			serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
 			if err != nil {
 				return errors.Wrap(err, "Failed to get iguazio tenant app service sets")
 			}
 
-			for serviceName, serviceStatus := range statusServicesMap {
+			for serviceName, serviceStatus := range serviceSet.statusServices {
 				if !stringSliceContainsString(servicesToCheck, serviceName) {
 					continue
 				}
@@ -360,16 +864,18 @@ func (s *AppResourceScaler) waitForServicesState(ctx context.Context, serviceNam
 				if currentState != desiredState {
 					s.logger.DebugWithCtx(ctx,
 						"Service did not reach desired state yet",
-						"serviceName", serviceName,
-						"currentState", currentState,
-						"desiredState", desiredState)
+						s.operationLogVars(ctx,
+							"services", []string{serviceName},
+							"currentState", currentState,
+							"desiredState", desiredState)...)
 					break
 				}
 
-				s.logger.DebugWithCtx(ctx,
+				s.logger.InfoWithCtx(ctx,
 					"Service reached desired state",
-					"serviceName", serviceName,
-					"desiredState", desiredState)
+					s.operationLogVars(ctx,
+						"services", []string{serviceName},
+						"desiredState", desiredState)...)
 				servicesToCheck = removeStringFromSlice(serviceName, servicesToCheck)
 
 				if len(servicesToCheck) == 0 {
@@ -380,10 +886,16 @@ func (s *AppResourceScaler) waitForServicesState(ctx context.Context, serviceNam
 	}
 }
 
-func (s *AppResourceScaler) getIguazioTenantAppServiceSets(ctx context.Context) (
-	map[string]interface{}, map[string]interface{}, string, error) {
-	var iguazioTenantAppServicesSetMap map[string]interface{}
+// getIguazioTenantAppServiceSets returns the service set, which may be shared with other callers and must not be
+// modified
+func (s *AppResourceScaler) getIguazioTenantAppServiceSets(ctx context.Context) (*iguazioTenantAppServiceSet, error) {
+	return s.serviceSetCache.get(ctx,
+		s.namespace,
+		s.getOptions().ServiceSetCacheTTL.Duration,
+		s.readIguazioTenantAppServiceSets)
+}
 
+func (s *AppResourceScaler) readIguazioTenantAppServiceSets(ctx context.Context) (*iguazioTenantAppServiceSet, error) {
 	absPath := []string{"apis", "iguazio.com", "v1beta1", "namespaces", s.namespace, "iguaziotenantappservicesets", s.namespace}
 	iguazioTenantAppServicesSet, err := s.kubeClientSet.
 		Discovery().
@@ -394,59 +906,60 @@ func (s *AppResourceScaler) getIguazioTenantAppServiceSets(ctx context.Context)
 		Raw()
 
 	if err != nil {
-		return nil, nil, "", errors.Wrap(err, "Failed to get iguazio tenant app service sets")
-	}
-
-	if err := json.Unmarshal(iguazioTenantAppServicesSet, &iguazioTenantAppServicesSetMap); err != nil {
-		return nil, nil, "", errors.Wrap(err, "Failed to unmarshal response")
+		return nil, errors.Wrap(err, "Failed to get iguazio tenant app service sets")
 	}
 
-	statusServicesMap, state, err := s.parseStatus(iguazioTenantAppServicesSetMap)
+	serviceSet, err := s.parseIguazioTenantAppServiceSet(iguazioTenantAppServicesSet)
 	if err != nil {
-		return nil, nil, "", errors.Wrap(err, "Failed to parse iguazio tenant app service sets status")
+		return nil, errors.Wrap(err, "Failed to parse iguazio tenant app service sets")
 	}
-	specServicesMap := s.parseSpecServices(iguazioTenantAppServicesSetMap)
 
-	return specServicesMap, statusServicesMap, state, nil
+	serviceSet.stateSince = s.provisioningStateTracker.observe(s.namespace,
+		serviceSet.state,
+		s.getPersistedStateSince(serviceSet))
+	s.serviceEndpointCache.invalidateChanged(serviceSet.specServices)
+	s.serviceRouteCache.invalidateChanged(serviceSet.specServices)
+
+	return serviceSet, nil
 }
 
-func (s *AppResourceScaler) parseSpecServices(iguazioTenantAppServicesSetMap map[string]interface{}) map[string]interface{} {
-	var servicesMap map[string]interface{}
+func (s *AppResourceScaler) parseIguazioTenantAppServiceSet(body []byte) (*iguazioTenantAppServiceSet, error) {
+	var iguazioTenantAppServicesSetMap map[string]interface{}
 
-	spec, ok := iguazioTenantAppServicesSetMap["spec"].(map[string]interface{})
-	if !ok {
-		s.logger.WarnWith("Service set does not have spec", "serviceSet", iguazioTenantAppServicesSetMap)
-		return servicesMap
+	if err := json.Unmarshal(body, &iguazioTenantAppServicesSetMap); err != nil {
+		return nil, errors.Wrap(err, "Failed to unmarshal response")
 	}
 
-	internalSpec, ok := spec["spec"].(map[string]interface{})
-	if !ok {
-		s.logger.WarnWith("Spec does not have internal spec", "spec", spec)
-		return servicesMap
+	statusServicesMap, state, err := s.parseStatus(iguazioTenantAppServicesSetMap)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse iguazio tenant app service sets status")
 	}
 
-	tenants, ok := internalSpec["tenants"].([]interface{})
-	if !ok || len(tenants) != 1 {
-		s.logger.WarnWith("Internal spec does not have tenants or its length is invalid", "internalSpec", internalSpec)
-		return servicesMap
+	serviceSet := &iguazioTenantAppServiceSet{
+		state:          state,
+		specServices:   s.parseSpecServices(iguazioTenantAppServicesSetMap),
+		statusServices: statusServicesMap,
 	}
 
-	tenant, ok := tenants[0].(map[string]interface{})
-	if !ok {
-		s.logger.WarnWith("Tenant is not an object", "tenants", tenants)
-		return servicesMap
+	// written by the scaler along with its own states
+	if status, ok := iguazioTenantAppServicesSetMap["status"].(map[string]interface{}); ok {
+		if provisioningStateSince, ok := status["provisioning_state_since"].(string); ok {
+			serviceSet.provisioningStateSince, _ = time.Parse(time.RFC3339Nano, provisioningStateSince)
+		}
 	}
 
-	tenantSpec, ok := tenant["spec"].(map[string]interface{})
-	if !ok {
-		s.logger.WarnWith("Tenant does not have spec", "tenant", tenant)
-		return servicesMap
+	if metadata, ok := iguazioTenantAppServicesSetMap["metadata"].(map[string]interface{}); ok {
+		serviceSet.uid, _ = metadata["uid"].(string)
+		serviceSet.resourceVersion, _ = metadata["resourceVersion"].(string)
 	}
 
-	servicesMap, ok = tenantSpec["services"].(map[string]interface{})
-	if !ok {
-		s.logger.WarnWith("Tenant spec does not have services", "tenantSpec", tenantSpec)
-		return servicesMap
+	return serviceSet, nil
+}
+
+func (s *AppResourceScaler) parseSpecServices(iguazioTenantAppServicesSetMap map[string]interface{}) map[string]interface{} {
+	servicesMap, err := ParseSpecServices(iguazioTenantAppServicesSetMap)
+	if err != nil {
+		s.logger.WarnWith("Failed parsing service set spec services", "err", err.Error())
 	}
 
 	return servicesMap
@@ -530,7 +1043,44 @@ func (s *AppResourceScaler) parseServiceState(serviceStatus interface{}) (string
 	return stateString, nil
 }
 
-func (s *AppResourceScaler) parseScaleResources(serviceSpecInterface interface{}) ([]scalertypes.ScaleResource, error) {
+// ParseSpecServices returns the services map of the (single) tenant in an IguazioTenantAppServiceSet object
+func ParseSpecServices(iguazioTenantAppServicesSetMap map[string]interface{}) (map[string]interface{}, error) {
+	spec, ok := iguazioTenantAppServicesSetMap["spec"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Service set does not have spec")
+	}
+
+	internalSpec, ok := spec["spec"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Spec does not have internal spec")
+	}
+
+	tenants, ok := internalSpec["tenants"].([]interface{})
+	if !ok || len(tenants) != 1 {
+		return nil, errors.New("Internal spec does not have tenants or its length is invalid")
+	}
+
+	tenant, ok := tenants[0].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Tenant is not an object")
+	}
+
+	tenantSpec, ok := tenant["spec"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Tenant does not have spec")
+	}
+
+	servicesMap, ok := tenantSpec["services"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Tenant spec does not have services")
+	}
+
+	return servicesMap, nil
+}
+
+// ParseScaleResources parses the scale_to_zero block of a single service spec. A nil result with no error means
+// the service does not take part in scale to zero
+func ParseScaleResources(serviceSpecInterface interface{}) ([]scalertypes.ScaleResource, error) {
 	var parsedScaleResources []scalertypes.ScaleResource
 	serviceSpec, ok := serviceSpecInterface.(map[string]interface{})
 	if !ok {
@@ -549,8 +1099,8 @@ func (s *AppResourceScaler) parseScaleResources(serviceSpecInterface interface{}
 		return nil, errors.New("Scale to zero spec does not have mode")
 	}
 
-	// if it's not enabled there's no reason to parse the rest
-	if scaleToZeroMode != "enabled" {
+	// if it's not evaluated there's no reason to parse the rest
+	if !isScaleToZeroModeEvaluated(scaleToZeroMode) {
 		return nil, nil
 	}
 
@@ -0,0 +1,240 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/nuclio/logger"
+	nucliozap "github.com/nuclio/zap"
+	"github.com/v3io/scaler/pkg/scalertypes"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fakeServiceSetAPI serves a service set over the Kubernetes API, counting reads and recording patches as is
+type fakeServiceSetAPI struct {
+	lock    sync.Mutex
+	body    []byte
+	patches [][]byte
+
+	// whether patches are applied to the served service set, failing like the API server does if they don't apply
+	applyPatches bool
+
+	// called before every read is served, once it's counted
+	beforeRead func()
+	reads      atomic.Int64
+}
+
+func newFakeServiceSetAPI(body []byte) *fakeServiceSetAPI {
+	return &fakeServiceSetAPI{body: body}
+}
+
+func (a *fakeServiceSetAPI) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if !strings.HasSuffix(request.URL.Path, "/iguaziotenantappservicesets/default-tenant") {
+		responseWriter.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		a.reads.Add(1)
+		if a.beforeRead != nil {
+			a.beforeRead()
+		}
+	case http.MethodPatch:
+		patch, _ := io.ReadAll(request.Body)
+		a.lock.Lock()
+		a.patches = append(a.patches, patch)
+		if a.applyPatches {
+			patchedBody, err := applyJSONPatch(a.body, patch)
+			if err != nil {
+				a.lock.Unlock()
+				responseWriter.WriteHeader(http.StatusUnprocessableEntity)
+				return
+			}
+			a.body = patchedBody
+		}
+		a.lock.Unlock()
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Write(a.body) // nolint: errcheck
+}
+
+// patchOperations returns the operations of every patch sent so far
+func (a *fakeServiceSetAPI) patchOperations(tb testing.TB) [][]map[string]interface{} {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var patchOperations [][]map[string]interface{}
+	for _, patch := range a.patches {
+		var operations []map[string]interface{}
+		if err := json.Unmarshal(patch, &operations); err != nil {
+			tb.Fatalf("Failed to unmarshal patch: %v", err)
+		}
+		patchOperations = append(patchOperations, operations)
+	}
+
+	return patchOperations
+}
+
+// serviceSet returns the served service set, as patched so far
+func (a *fakeServiceSetAPI) serviceSet(tb testing.TB) map[string]interface{} {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	serviceSet := map[string]interface{}{}
+	if err := json.Unmarshal(a.body, &serviceSet); err != nil {
+		tb.Fatalf("Failed to unmarshal service set: %v", err)
+	}
+
+	return serviceSet
+}
+
+func applyJSONPatch(body []byte, patch []byte) ([]byte, error) {
+	decodedPatch, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodedPatch.Apply(body)
+}
+
+// findPatchOperation returns the first operation of the given op on path, if any
+func findPatchOperation(operations []map[string]interface{}, op string, path string) (map[string]interface{}, bool) {
+	for _, operation := range operations {
+		if operation["op"] == op && operation["path"] == path {
+			return operation, true
+		}
+	}
+
+	return nil, false
+}
+
+// getJSONPath returns the value under the slash delimited path of a decoded JSON object
+func getJSONPath(object map[string]interface{}, path string) interface{} {
+	var value interface{} = object
+	for _, key := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		valueMap, ok := value.(map[string]interface{})
+		if !ok {
+			valueList, ok := value.([]interface{})
+			index, err := strconv.Atoi(key)
+			if !ok || err != nil || index >= len(valueList) {
+				return nil
+			}
+			value = valueList[index]
+			continue
+		}
+		value = valueMap[key]
+	}
+
+	return value
+}
+
+// newServiceSetBody returns a ready service set whose services have the given specs and states
+func newServiceSetBody(serviceSpecs map[string]interface{}, serviceStates map[string]string) []byte {
+	statusServices := map[string]interface{}{}
+	for serviceName, serviceState := range serviceStates {
+		statusServices[serviceName] = map[string]interface{}{"state": serviceState}
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"uid": "uid", "resourceVersion": "1"},
+		"spec": map[string]interface{}{
+			"spec": map[string]interface{}{
+				"tenants": []interface{}{
+					map[string]interface{}{"spec": map[string]interface{}{"services": serviceSpecs}},
+				},
+			},
+		},
+		"status": map[string]interface{}{"state": "ready", "services": statusServices},
+	})
+
+	return body
+}
+
+// newLargeServiceSetBody returns a service set of the given number of ready services taking part in scale to zero
+func newLargeServiceSetBody(numServices int) []byte {
+	serviceSpecs := map[string]interface{}{}
+	serviceStates := map[string]string{}
+	for serviceIndex := 0; serviceIndex < numServices; serviceIndex++ {
+		serviceName := fmt.Sprintf("service-%d", serviceIndex)
+		serviceSpecs[serviceName] = map[string]interface{}{
+			"desired_state": "ready",
+			"scale_to_zero": map[string]interface{}{
+				"mode": "enabled",
+				"scale_resources": []interface{}{
+					map[string]interface{}{"metric_name": "num_of_requests", "threshold": 0, "window_size": "30m"},
+				},
+			},
+		}
+		serviceStates[serviceName] = "ready"
+	}
+
+	return newServiceSetBody(serviceSpecs, serviceStates)
+}
+
+func newTestLogger(tb testing.TB) logger.Logger {
+	loggerInstance, err := nucliozap.NewNuclioZap("test", "console", nil, os.Stdout, os.Stderr, nucliozap.InfoLevel)
+	if err != nil {
+		tb.Fatalf("Failed to create logger: %v", err)
+	}
+
+	return loggerInstance
+}
+
+// newTestAppResourceScaler returns a resource scaler of the default-tenant namespace, reading the service set from
+// the given handler
+func newTestAppResourceScaler(tb testing.TB, handler http.Handler, options Options) *AppResourceScaler {
+	server := httptest.NewServer(handler)
+	tb.Cleanup(server.Close)
+
+	kubeClientSet, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		tb.Fatalf("Failed to create kube clientset: %v", err)
+	}
+
+	resourceScaler, err := New(newTestLogger(tb),
+		kubeClientSet,
+		"default-tenant",
+		scalertypes.DLXOptions{},
+		scalertypes.AutoScalerOptions{},
+		options)
+	if err != nil {
+		tb.Fatalf("Failed to create resource scaler: %v", err)
+	}
+
+	return resourceScaler
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nuclio/errors"
+)
+
+// ServiceRoute maps requests to a host, under a path prefix, to an app service
+type ServiceRoute struct {
+	Service    string
+	Host       string
+	PathPrefix string
+}
+
+func (r *ServiceRoute) matches(host string, path string) bool {
+	if r.Host != host {
+		return false
+	}
+
+	if r.PathPrefix == "/" || path == r.PathPrefix {
+		return true
+	}
+
+	return strings.HasPrefix(path, r.PathPrefix+"/")
+}
+
+// serviceRouteCache caches the routes of all services until they expire, or the spec of any service changes
+type serviceRouteCache struct {
+	lock      sync.Mutex
+	routes    []ServiceRoute
+	specHash  [sha256.Size]byte
+	expiresAt time.Time
+}
+
+func (c *serviceRouteCache) get() ([]ServiceRoute, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.routes == nil || time.Now().After(c.expiresAt) {
+		return nil, false
+	}
+
+	return c.routes, true
+}
+
+func (c *serviceRouteCache) set(specServices map[string]interface{}, routes []ServiceRoute, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.routes = routes
+	c.specHash = hashServiceSpecs(specServices)
+	c.expiresAt = time.Now().Add(ttl)
+}
+
+func (c *serviceRouteCache) invalidateChanged(specServices map[string]interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.routes != nil && hashServiceSpecs(specServices) != c.specHash {
+		c.routes = nil
+	}
+}
+
+// hashServiceSpecs hashes the fields of every service spec the routes are derived from
+func hashServiceSpecs(specServices map[string]interface{}) [sha256.Size]byte {
+	addressFields := map[string]interface{}{}
+	for serviceName, serviceSpec := range specServices {
+		addressFields[serviceName] = getServiceAddressFields(serviceSpec)
+	}
+
+	marshalledAddressFields, _ := json.Marshal(addressFields)
+	return sha256.Sum256(marshalledAddressFields)
+}
+
+// ResolveServiceRoute returns the app service requests to the host and path are routed to, by the urls and ingress
+// entries of the services in the service set. The route with the longest matching path prefix wins
+func (s *AppResourceScaler) ResolveServiceRoute(host string, path string) (string, bool, error) {
+	routes, err := s.getServiceRoutes()
+	if err != nil {
+		return "", false, errors.Wrap(err, "Failed to get service routes")
+	}
+
+	host = normalizeHost(host)
+	if path == "" {
+		path = "/"
+	}
+
+	var matchingRoute *ServiceRoute
+	for routeIndex := range routes {
+		route := &routes[routeIndex]
+		if route.matches(host, path) && (matchingRoute == nil || len(route.PathPrefix) > len(matchingRoute.PathPrefix)) {
+			matchingRoute = route
+		}
+	}
+
+	if matchingRoute == nil {
+		return "", false, nil
+	}
+
+	return matchingRoute.Service, true, nil
+}
+
+func (s *AppResourceScaler) getServiceRoutes() ([]ServiceRoute, error) {
+	if routes, found := s.serviceRouteCache.get(); found {
+		return routes, nil
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), resolveServiceEndpointTimeout)
+	defer cancelFunc()
+
+	serviceSet, err := s.getIguazioTenantAppServiceSets(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get iguazio tenant app service sets")
+	}
+
+	routes := s.buildServiceRoutes(serviceSet)
+	s.logger.DebugWith("Built service routes", "namespace", s.namespace, "routes", routes)
+
+	s.serviceRouteCache.set(serviceSet.specServices, routes, s.getOptions().ServiceEndpointCacheTTL.Duration)
+
+	return routes, nil
+}
+
+// buildServiceRoutes returns a route per url and ingress entry of each service. If multiple services have the same
+// host and path, the first by name gets it
+func (s *AppResourceScaler) buildServiceRoutes(serviceSet *iguazioTenantAppServiceSet) []ServiceRoute {
+	routes := []ServiceRoute{}
+	routeServices := map[ServiceRoute]string{}
+
+	serviceNames := make([]string, 0, len(serviceSet.specServices))
+	for serviceName := range serviceSet.specServices {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+
+	for _, serviceName := range serviceNames {
+		serviceSpec := serviceSet.specServices[serviceName]
+		serviceStatus := serviceSet.statusServices[serviceName]
+
+		var routeKeys []ServiceRoute
+		for _, serviceURL := range parseServiceURLs(serviceSpec, serviceStatus) {
+			parsedURL, err := url.Parse(serviceURL)
+			if err != nil {
+				continue
+			}
+
+			routeKeys = append(routeKeys, newServiceRouteKey(parsedURL.Host, parsedURL.Path))
+		}
+		routeKeys = append(routeKeys, parseServiceIngressRoutes(serviceSpec, serviceStatus)...)
+
+		for _, routeKey := range routeKeys {
+			if existingServiceName, found := routeServices[routeKey]; found {
+				if existingServiceName != serviceName {
+					s.logger.WarnWith("Route is shared by multiple services, routing it to the first",
+						"namespace", s.namespace,
+						"host", routeKey.Host,
+						"pathPrefix", routeKey.PathPrefix,
+						"services", []string{existingServiceName},
+						"ignoredService", serviceName)
+				}
+				continue
+			}
+
+			routeServices[routeKey] = serviceName
+			routes = append(routes, ServiceRoute{
+				Service:    serviceName,
+				Host:       routeKey.Host,
+				PathPrefix: routeKey.PathPrefix,
+			})
+		}
+	}
+
+	return routes
+}
+
+// parseServiceIngressRoutes returns the hosts and paths listed under "ingresses" in the service's spec, then its
+// status. Each entry has a host and optionally paths, each a string or an object with a "path" field - an entry
+// without paths routes the host's root
+func parseServiceIngressRoutes(serviceSpec interface{}, serviceStatus interface{}) []ServiceRoute {
+	var routeKeys []ServiceRoute
+	for _, serviceObject := range []interface{}{serviceSpec, serviceStatus} {
+		serviceObjectMap, _ := serviceObject.(map[string]interface{})
+		ingresses, _ := serviceObjectMap["ingresses"].([]interface{})
+
+		for _, ingressInterface := range ingresses {
+			ingress, _ := ingressInterface.(map[string]interface{})
+			host, _ := ingress["host"].(string)
+			if host == "" {
+				continue
+			}
+
+			paths, _ := ingress["paths"].([]interface{})
+			if len(paths) == 0 {
+				paths = []interface{}{"/"}
+			}
+
+			for _, pathInterface := range paths {
+				path, ok := pathInterface.(string)
+				if !ok {
+					pathMap, _ := pathInterface.(map[string]interface{})
+					path, ok = pathMap["path"].(string)
+					if !ok {
+						continue
+					}
+				}
+
+				routeKeys = append(routeKeys, newServiceRouteKey(host, path))
+			}
+		}
+	}
+
+	return routeKeys
+}
+
+// newServiceRouteKey returns the serviceless route of the host and path, as routes are matched
+func newServiceRouteKey(host string, path string) ServiceRoute {
+	return ServiceRoute{
+		Host:       normalizeHost(host),
+		PathPrefix: "/" + strings.Trim(path, "/"),
+	}
+}
+
+// normalizeHost lower cases the host and strips its port
+func normalizeHost(host string) string {
+	if hostWithoutPort, _, err := net.SplitHostPort(host); err == nil {
+		host = hostWithoutPort
+	}
+
+	return strings.ToLower(host)
+}
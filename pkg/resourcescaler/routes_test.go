@@ -0,0 +1,88 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"testing"
+)
+
+func TestResolveServiceRoute(t *testing.T) {
+	resourceScaler := newTestAppResourceScaler(t, newFakeServiceSetAPI(newServiceSetBody(map[string]interface{}{
+		"jupyter": map[string]interface{}{
+			"urls": []interface{}{"https://apps.example.com/jupyter/"},
+		},
+		"mlflow": map[string]interface{}{
+			"ingresses": []interface{}{
+				map[string]interface{}{"host": "mlflow.example.com"},
+				map[string]interface{}{
+					"host":  "apps.example.com",
+					"paths": []interface{}{"/mlflow", map[string]interface{}{"path": "/jupyter/mlflow"}},
+				},
+			},
+		},
+		"spark": map[string]interface{}{
+			"ingresses": []interface{}{
+				map[string]interface{}{"host": "Apps.Example.com:443", "paths": []interface{}{"/"}},
+				map[string]interface{}{"paths": []interface{}{"/hostless"}},
+			},
+		},
+		"zeppelin": map[string]interface{}{
+			"ingresses": []interface{}{
+				map[string]interface{}{"host": "mlflow.example.com"},
+			},
+		},
+	}, nil)), NewDefaultOptions())
+
+	for _, testCase := range []struct {
+		host            string
+		path            string
+		expectedService string
+	}{
+		{host: "apps.example.com", path: "/jupyter/lab", expectedService: "jupyter"},
+		{host: "apps.example.com", path: "/jupyter/mlflow/runs", expectedService: "mlflow"},
+		{host: "apps.example.com", path: "/mlflow", expectedService: "mlflow"},
+		{host: "apps.example.com", path: "/mlflowx", expectedService: "spark"},
+		{host: "apps.example.com:443", path: "/", expectedService: "spark"},
+
+		// the host is shared, so it's routed to the first service by name
+		{host: "mlflow.example.com", path: "/anything", expectedService: "mlflow"},
+
+		{host: "other.example.com", path: "/hostless"},
+	} {
+		t.Run(testCase.host+testCase.path, func(t *testing.T) {
+			serviceName, found, err := resourceScaler.ResolveServiceRoute(testCase.host, testCase.path)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if testCase.expectedService == "" {
+				if found {
+					t.Fatalf("Expected no route, got %s", serviceName)
+				}
+				return
+			}
+
+			if !found || serviceName != testCase.expectedService {
+				t.Fatalf("Expected route to %s, got %s (found %t)", testCase.expectedService, serviceName, found)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sources a service set read is served from
+const (
+	apiServiceSetReadSource    = "api"
+	cacheServiceSetReadSource  = "cache"
+	sharedServiceSetReadSource = "shared"
+)
+
+// serviceSetRead is a read of the service set in flight, shared by the callers that missed the cache meanwhile
+type serviceSetRead struct {
+	done       chan struct{}
+	generation uint64
+	serviceSet *iguazioTenantAppServiceSet
+	err        error
+
+	// whether the read failed because the context of the caller that read ended
+	readerCancelled bool
+}
+
+// serviceSetCache shares the parsed service set between all callers until it expires or is invalidated, and a
+// single read between the callers that miss it at the same time. The cached service set must not be modified
+type serviceSetCache struct {
+	lock       sync.Mutex
+	serviceSet *iguazioTenantAppServiceSet
+	readAt     time.Time
+	inFlight   *serviceSetRead
+
+	// bumped on every invalidation, so reads that started before it aren't cached
+	generation uint64
+}
+
+// get returns the cached service set if it's younger than ttl, or the result of read otherwise. A ttl of 0 always
+// reads
+func (c *serviceSetCache) get(ctx context.Context,
+	namespace string,
+	ttl time.Duration,
+	read func(context.Context) (*iguazioTenantAppServiceSet, error)) (*iguazioTenantAppServiceSet, error) {
+
+	if ttl <= 0 {
+		serviceSetReadsCounter.WithLabelValues(namespace, apiServiceSetReadSource).Inc()
+		return read(ctx)
+	}
+
+	for {
+		c.lock.Lock()
+		if c.serviceSet != nil && time.Since(c.readAt) < ttl {
+			serviceSet := c.serviceSet
+			c.lock.Unlock()
+
+			serviceSetReadsCounter.WithLabelValues(namespace, cacheServiceSetReadSource).Inc()
+			return serviceSet, nil
+		}
+
+		if c.inFlight == nil || c.inFlight.generation != c.generation {
+			break
+		}
+
+		inFlight := c.inFlight
+		c.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-inFlight.done:
+		}
+
+		// the reading caller's context ending says nothing of this one's, so try again
+		if inFlight.readerCancelled {
+			continue
+		}
+
+		serviceSetReadsCounter.WithLabelValues(namespace, sharedServiceSetReadSource).Inc()
+		return inFlight.serviceSet, inFlight.err
+	}
+
+	serviceSetRead := &serviceSetRead{
+		done:       make(chan struct{}),
+		generation: c.generation,
+	}
+	c.inFlight = serviceSetRead
+	c.lock.Unlock()
+
+	serviceSetReadsCounter.WithLabelValues(namespace, apiServiceSetReadSource).Inc()
+	serviceSetRead.serviceSet, serviceSetRead.err = read(ctx)
+	serviceSetRead.readerCancelled = serviceSetRead.err != nil && ctx.Err() != nil
+
+	c.lock.Lock()
+	if c.inFlight == serviceSetRead {
+		c.inFlight = nil
+	}
+
+	if serviceSetRead.err == nil && serviceSetRead.generation == c.generation {
+		c.serviceSet = serviceSetRead.serviceSet
+		c.readAt = time.Now()
+	}
+	c.lock.Unlock()
+	close(serviceSetRead.done)
+
+	return serviceSetRead.serviceSet, serviceSetRead.err
+}
+
+// invalidate drops the cached service set, and keeps reads in flight from being cached or shared further
+func (c *serviceSetCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.serviceSet = nil
+	c.generation++
+}
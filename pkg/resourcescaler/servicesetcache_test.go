@@ -0,0 +1,215 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/v3io/scaler/pkg/scalertypes"
+)
+
+func newTestCachingAppResourceScaler(tb testing.TB, serviceSetAPI *fakeServiceSetAPI) *AppResourceScaler {
+	options := NewDefaultOptions()
+	options.ServiceSetCacheTTL = scalertypes.Duration{Duration: time.Hour}
+	return newTestAppResourceScaler(tb, serviceSetAPI, options)
+}
+
+func TestServiceSetCacheSharedRead(t *testing.T) {
+	serviceSetAPI := newFakeServiceSetAPI(newLargeServiceSetBody(10))
+
+	// hold the first read until every caller is waiting on it
+	reading := make(chan struct{})
+	release := make(chan struct{})
+	var readOnce sync.Once
+	serviceSetAPI.beforeRead = func() {
+		readOnce.Do(func() {
+			close(reading)
+			<-release
+		})
+	}
+	resourceScaler := newTestCachingAppResourceScaler(t, serviceSetAPI)
+
+	serviceSets := make(chan *iguazioTenantAppServiceSet, 10)
+	for callerIndex := 0; callerIndex < cap(serviceSets); callerIndex++ {
+		go func() {
+			serviceSet, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background())
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			serviceSets <- serviceSet
+		}()
+	}
+
+	<-reading
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	firstServiceSet := <-serviceSets
+	for callerIndex := 1; callerIndex < cap(serviceSets); callerIndex++ {
+		if serviceSet := <-serviceSets; serviceSet != firstServiceSet {
+			t.Fatalf("Expected every caller to get the shared service set")
+		}
+	}
+
+	if _, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if reads := serviceSetAPI.reads.Load(); reads != 1 {
+		t.Fatalf("Expected a single read, got %d", reads)
+	}
+}
+
+func TestServiceSetCacheInvalidatedInFlight(t *testing.T) {
+	serviceSetAPI := newFakeServiceSetAPI(newLargeServiceSetBody(10))
+
+	// hold the first read in flight while the cache is invalidated, letting later reads through
+	reading := make(chan struct{})
+	release := make(chan struct{})
+	var readHeld atomic.Bool
+	serviceSetAPI.beforeRead = func() {
+		if readHeld.CompareAndSwap(false, true) {
+			close(reading)
+			<-release
+		}
+	}
+	resourceScaler := newTestCachingAppResourceScaler(t, serviceSetAPI)
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background())
+		readErr <- err
+	}()
+	<-reading
+
+	// e.g. the service set was patched while it was being read
+	resourceScaler.serviceSetCache.invalidate()
+
+	// a read after the invalidation doesn't share the one in flight
+	if _, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if reads := serviceSetAPI.reads.Load(); reads != 2 {
+		t.Fatalf("Expected a read of its own after the invalidation, got %d reads", reads)
+	}
+
+	close(release)
+	if err := <-readErr; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// the read that was in flight across the invalidation isn't cached, the one after it is
+	resourceScaler.serviceSetCache.lock.Lock()
+	cachedServiceSet := resourceScaler.serviceSetCache.serviceSet
+	resourceScaler.serviceSetCache.lock.Unlock()
+	if cachedServiceSet == nil {
+		t.Fatalf("Expected the read after the invalidation to be cached")
+	}
+
+	if _, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if reads := serviceSetAPI.reads.Load(); reads != 2 {
+		t.Fatalf("Expected the cached service set to be served, got %d reads", reads)
+	}
+
+	// the read in flight across an invalidation alone isn't cached either
+	resourceScaler.serviceSetCache.invalidate()
+	serviceSetAPI.beforeRead = func() {
+		resourceScaler.serviceSetCache.invalidate()
+	}
+	if _, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	resourceScaler.serviceSetCache.lock.Lock()
+	cachedServiceSet = resourceScaler.serviceSetCache.serviceSet
+	resourceScaler.serviceSetCache.lock.Unlock()
+	if cachedServiceSet != nil {
+		t.Fatalf("Expected a read in flight across an invalidation not to be cached")
+	}
+}
+
+// the benchmarks read a service set of a large tenant
+const benchmarkServiceSetSize = 250
+
+func BenchmarkServiceSetCacheCached(b *testing.B) {
+	serviceSetAPI := newFakeServiceSetAPI(newLargeServiceSetBody(benchmarkServiceSetSize))
+	resourceScaler := newTestCachingAppResourceScaler(b, serviceSetAPI)
+	if _, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background()); err != nil {
+		b.Fatalf("Unexpected error: %v", err)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background()); err != nil {
+				b.Errorf("Unexpected error: %v", err)
+			}
+		}
+	})
+	b.ReportMetric(float64(serviceSetAPI.reads.Load()-1)/float64(b.N), "reads/op")
+}
+
+func BenchmarkServiceSetCacheSharedInFlight(b *testing.B) {
+	const callers = 16
+	serviceSetAPI := newFakeServiceSetAPI(newLargeServiceSetBody(benchmarkServiceSetSize))
+	resourceScaler := newTestCachingAppResourceScaler(b, serviceSetAPI)
+
+	// every iteration is a burst of callers missing the cache at once, e.g. right after a patch
+	b.ResetTimer()
+	for iteration := 0; iteration < b.N; iteration++ {
+		resourceScaler.serviceSetCache.invalidate()
+
+		waitGroup := sync.WaitGroup{}
+		waitGroup.Add(callers)
+		for callerIndex := 0; callerIndex < callers; callerIndex++ {
+			go func() {
+				defer waitGroup.Done()
+				if _, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background()); err != nil {
+					b.Errorf("Unexpected error: %v", err)
+				}
+			}()
+		}
+		waitGroup.Wait()
+	}
+	b.ReportMetric(float64(serviceSetAPI.reads.Load())/float64(b.N), "reads/op")
+}
+
+func BenchmarkServiceSetCacheInvalidated(b *testing.B) {
+	serviceSetAPI := newFakeServiceSetAPI(newLargeServiceSetBody(benchmarkServiceSetSize))
+	resourceScaler := newTestCachingAppResourceScaler(b, serviceSetAPI)
+
+	b.ResetTimer()
+	for iteration := 0; iteration < b.N; iteration++ {
+		resourceScaler.serviceSetCache.invalidate()
+		if _, err := resourceScaler.getIguazioTenantAppServiceSets(context.Background()); err != nil {
+			b.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	b.ReportMetric(float64(serviceSetAPI.reads.Load())/float64(b.N), "reads/op")
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/audit"
+
+	"github.com/nuclio/errors"
+	"github.com/v3io/scaler/pkg/scalertypes"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+
+	// skip the service if the veto hook can't be reached, fails or times out
+	VetoOnFailure = "veto"
+
+	// scale the service to zero if the veto hook can't be reached, fails or times out
+	AllowOnFailure = "allow"
+
+	DefaultVetoHookTimeout = 5 * time.Second
+
+	scaleToZeroVetoedEventReason = "ScaleToZeroVetoed"
+)
+
+// VetoHook is an HTTP endpoint asked before a service is scaled to zero, declared under scale_to_zero.veto_hook
+type VetoHook struct {
+	URL       string
+	Timeout   time.Duration
+	OnFailure string
+}
+
+// VetoRequest is posted to the veto hook as JSON
+type VetoRequest struct {
+	Namespace  string `json:"namespace"`
+	Service    string `json:"service"`
+	ScaleEvent string `json:"scaleEvent"`
+}
+
+// VetoResponse is the JSON response expected from the veto hook, with a 2xx status code
+type VetoResponse struct {
+	Busy   bool   `json:"busy"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// ParseVetoHook parses the veto hook of a single service spec. A nil result with no error means the service has
+// no veto hook, or doesn't take part in scale to zero
+func ParseVetoHook(serviceSpecInterface interface{}) (*VetoHook, error) {
+	serviceSpec, ok := serviceSpecInterface.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Service spec type assertion failed")
+	}
+
+	scaleToZeroSpec, ok := serviceSpec["scale_to_zero"].(map[string]interface{})
+	if !ok || !isScaleToZeroModeEvaluated(scaleToZeroSpec["mode"]) {
+		return nil, nil
+	}
+
+	vetoHookInterface, found := scaleToZeroSpec["veto_hook"]
+	if !found {
+		return nil, nil
+	}
+
+	vetoHookSpec, ok := vetoHookInterface.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Veto hook is not an object")
+	}
+
+	vetoHook := &VetoHook{
+		Timeout:   DefaultVetoHookTimeout,
+		OnFailure: VetoOnFailure,
+	}
+
+	vetoHook.URL, ok = vetoHookSpec["url"].(string)
+	if !ok {
+		return nil, errors.New("Veto hook does not have url")
+	}
+
+	parsedURL, err := url.Parse(vetoHook.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse veto hook url")
+	}
+
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return nil, errors.Errorf("Veto hook url must be http or https: %s", vetoHook.URL)
+	}
+
+	if timeoutInterface, found := vetoHookSpec["timeout"]; found {
+		timeoutString, ok := timeoutInterface.(string)
+		if !ok {
+			return nil, errors.New("Veto hook timeout is not a string")
+		}
+
+		vetoHook.Timeout, err = time.ParseDuration(timeoutString)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to parse veto hook timeout")
+		}
+
+		if vetoHook.Timeout <= 0 {
+			return nil, errors.New("Veto hook timeout must be positive")
+		}
+	}
+
+	if onFailureInterface, found := vetoHookSpec["on_failure"]; found {
+		vetoHook.OnFailure, _ = onFailureInterface.(string)
+		if vetoHook.OnFailure != VetoOnFailure && vetoHook.OnFailure != AllowOnFailure {
+			return nil, errors.Errorf("Unknown veto hook on_failure: %v", onFailureInterface)
+		}
+	}
+
+	return vetoHook, nil
+}
+
+// filterVetoedServices asks the veto hooks of the services whether they may be scaled to zero, all at once, and
+// returns the ones that may. Vetoes are logged, recorded as events and written to the audit log
+func (s *AppResourceScaler) filterVetoedServices(ctx context.Context,
+	serviceSet *iguazioTenantAppServiceSet,
+	serviceNames []string) []string {
+
+	vetoReasons := make([]string, len(serviceNames))
+
+	waitGroup := sync.WaitGroup{}
+	for serviceIndex, serviceName := range serviceNames {
+		vetoHook, err := ParseVetoHook(serviceSet.specServices[serviceName])
+		if err != nil {
+			s.logger.WarnWithCtx(ctx, "Failed parsing the veto hook", s.operationLogVars(ctx,
+				"services", []string{serviceName},
+				"err", errors.GetErrorStackString(err, 10))...)
+			vetoReasons[serviceIndex] = "Invalid veto hook"
+			continue
+		}
+
+		if vetoHook == nil {
+			continue
+		}
+
+		waitGroup.Add(1)
+		go func(serviceIndex int, serviceName string) {
+			defer waitGroup.Done()
+			vetoReasons[serviceIndex] = s.callVetoHook(ctx, vetoHook, serviceName)
+		}(serviceIndex, serviceName)
+	}
+	waitGroup.Wait()
+
+	var allowedServiceNames []string
+	for serviceIndex, serviceName := range serviceNames {
+		vetoReason := vetoReasons[serviceIndex]
+		if vetoReason == "" {
+			allowedServiceNames = append(allowedServiceNames, serviceName)
+			continue
+		}
+
+		s.logger.InfoWithCtx(ctx, "Scale to zero vetoed", s.operationLogVars(ctx,
+			"services", []string{serviceName},
+			"reason", vetoReason)...)
+		s.recordEvent(serviceSet,
+			v1.EventTypeNormal,
+			scaleToZeroVetoedEventReason,
+			fmt.Sprintf("Scale to zero of service %s vetoed: %s", serviceName, vetoReason))
+
+		if err := s.auditLog.Write(&audit.Entry{
+			OperationID: GetOperationID(ctx),
+			Namespace:   s.namespace,
+			Trigger:     GetTrigger(ctx),
+			Services:    []string{serviceName},
+			ScaleEvent:  string(scalertypes.ScaleToZeroStartedScaleEvent),
+			Outcome:     audit.VetoedOutcome,
+			Reason:      vetoReason,
+		}); err != nil {
+			s.logger.ErrorWithCtx(ctx, "Failed to write audit log entry", s.operationLogVars(ctx,
+				"services", []string{serviceName},
+				"err", errors.GetErrorStackString(err, 10))...)
+		}
+	}
+
+	return allowedServiceNames
+}
+
+// callVetoHook returns the reason the service may not be scaled to zero, or an empty string if it may
+func (s *AppResourceScaler) callVetoHook(ctx context.Context, vetoHook *VetoHook, serviceName string) string {
+	vetoResponse, err := s.requestVetoHook(ctx, vetoHook, serviceName)
+	if err != nil {
+		s.logger.WarnWithCtx(ctx, "Veto hook failed", s.operationLogVars(ctx,
+			"services", []string{serviceName},
+			"url", vetoHook.URL,
+			"onFailure", vetoHook.OnFailure,
+			"err", errors.GetErrorStackString(err, 10))...)
+
+		if vetoHook.OnFailure == AllowOnFailure {
+			return ""
+		}
+		return fmt.Sprintf("Veto hook failed: %s", errors.RootCause(err).Error())
+	}
+
+	if !vetoResponse.Busy {
+		return ""
+	}
+
+	if vetoResponse.Reason == "" {
+		return "Service is busy"
+	}
+	return vetoResponse.Reason
+}
+
+func (s *AppResourceScaler) requestVetoHook(ctx context.Context,
+	vetoHook *VetoHook,
+	serviceName string) (*VetoResponse, error) {
+
+	requestCtx, cancelFunc := context.WithTimeout(ctx, vetoHook.Timeout)
+	defer cancelFunc()
+
+	requestBody, err := json.Marshal(VetoRequest{
+		Namespace:  s.namespace,
+		Service:    serviceName,
+		ScaleEvent: string(scalertypes.ScaleToZeroStartedScaleEvent),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal veto request")
+	}
+
+	request, err := http.NewRequestWithContext(requestCtx, http.MethodPost, vetoHook.URL, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create veto request")
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := s.vetoHookClient.Do(request)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to send veto request")
+	}
+	defer response.Body.Close() // nolint: errcheck
+
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read veto response")
+	}
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, errors.Errorf("Veto hook responded with status %d: %s", response.StatusCode, string(responseBody))
+	}
+
+	vetoResponse := &VetoResponse{}
+	if err := json.Unmarshal(responseBody, vetoResponse); err != nil {
+		return nil, errors.Wrap(err, "Failed to unmarshal veto response")
+	}
+
+	return vetoResponse, nil
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package resourcescaler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/audit"
+)
+
+// vetoHookStandIn plays the veto hooks of services, responding by path, and records the requests it's sent
+type vetoHookStandIn struct {
+	lock     sync.Mutex
+	requests []VetoRequest
+}
+
+func (h *vetoHookStandIn) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	vetoRequest := VetoRequest{}
+	json.NewDecoder(request.Body).Decode(&vetoRequest) // nolint: errcheck
+
+	h.lock.Lock()
+	h.requests = append(h.requests, vetoRequest)
+	h.lock.Unlock()
+
+	switch request.URL.Path {
+	case "/busy":
+		json.NewEncoder(responseWriter).Encode(VetoResponse{Busy: true, Reason: "Training a model"}) // nolint: errcheck
+	case "/busy-without-reason":
+		json.NewEncoder(responseWriter).Encode(VetoResponse{Busy: true}) // nolint: errcheck
+	case "/idle":
+		json.NewEncoder(responseWriter).Encode(VetoResponse{Busy: false}) // nolint: errcheck
+	case "/slow":
+		select {
+		case <-request.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	case "/error":
+		responseWriter.WriteHeader(http.StatusInternalServerError)
+	case "/malformed":
+		responseWriter.Write([]byte("busy")) // nolint: errcheck
+	}
+}
+
+// recordedRequests returns the requests recorded so far, waiting up to timeout for at least count of them, since
+// the handlers of hooks that timed out may still be running
+func (h *vetoHookStandIn) recordedRequests(count int, timeout time.Duration) []VetoRequest {
+	deadline := time.Now().Add(timeout)
+	for {
+		h.lock.Lock()
+		requests := append([]VetoRequest(nil), h.requests...)
+		h.lock.Unlock()
+
+		if len(requests) >= count || time.Now().After(deadline) {
+			return requests
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func vetoHookServiceSpec(url string, timeout string, onFailure string) map[string]interface{} {
+	vetoHook := map[string]interface{}{"url": url}
+	if timeout != "" {
+		vetoHook["timeout"] = timeout
+	}
+	if onFailure != "" {
+		vetoHook["on_failure"] = onFailure
+	}
+
+	return map[string]interface{}{
+		"desired_state": "ready",
+		"scale_to_zero": map[string]interface{}{
+			"mode":            "enabled",
+			"scale_resources": []interface{}{},
+			"veto_hook":       vetoHook,
+		},
+	}
+}
+
+func TestFilterVetoedServices(t *testing.T) {
+	standIn := &vetoHookStandIn{}
+	standInServer := httptest.NewServer(standIn)
+	defer standInServer.Close()
+
+	resourceScaler := newTestAppResourceScaler(t, http.NotFoundHandler(), NewDefaultOptions())
+	auditBuffer := &bytes.Buffer{}
+	resourceScaler.SetAuditLog(audit.NewLogWithWriter(auditBuffer))
+
+	serviceSet := &iguazioTenantAppServiceSet{
+		specServices: map[string]interface{}{
+			"busy":                vetoHookServiceSpec(standInServer.URL+"/busy", "", ""),
+			"busy-without-reason": vetoHookServiceSpec(standInServer.URL+"/busy-without-reason", "", ""),
+			"idle":                vetoHookServiceSpec(standInServer.URL+"/idle", "", ""),
+			"timeout-veto":        vetoHookServiceSpec(standInServer.URL+"/slow", "50ms", "veto"),
+			"timeout-allow":       vetoHookServiceSpec(standInServer.URL+"/slow", "50ms", "allow"),
+			"error-default":       vetoHookServiceSpec(standInServer.URL+"/error", "", ""),
+			"error-allow":         vetoHookServiceSpec(standInServer.URL+"/error", "", "allow"),
+			"malformed-veto":      vetoHookServiceSpec(standInServer.URL+"/malformed", "", "veto"),
+			"unreachable-allow":   vetoHookServiceSpec("http://127.0.0.1:1/veto", "", "allow"),
+			"no-hook": map[string]interface{}{
+				"desired_state": "ready",
+				"scale_to_zero": map[string]interface{}{"mode": "enabled", "scale_resources": []interface{}{}},
+			},
+		},
+	}
+
+	var serviceNames []string
+	for serviceName := range serviceSet.specServices {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+
+	startedAt := time.Now()
+	allowedServiceNames := resourceScaler.filterVetoedServices(WithOperationID(context.Background(), "operation"),
+		serviceSet,
+		serviceNames)
+
+	// the hooks are called all at once, so a slow hook doesn't hold back the others
+	if elapsed := time.Since(startedAt); elapsed > time.Second {
+		t.Fatalf("Expected hooks to be called concurrently, took %s", elapsed)
+	}
+
+	expectedAllowedServiceNames := []string{"error-allow", "idle", "no-hook", "timeout-allow", "unreachable-allow"}
+	sort.Strings(allowedServiceNames)
+	if !stringSlicesEqual(allowedServiceNames, expectedAllowedServiceNames) {
+		t.Fatalf("Expected allowed services %v, got %v", expectedAllowedServiceNames, allowedServiceNames)
+	}
+
+	// every hook is sent the service it's asked about
+	vetoRequests := standIn.recordedRequests(len(serviceNames)-2, time.Second)
+	if len(vetoRequests) != len(serviceNames)-2 {
+		t.Fatalf("Expected %d veto requests, got %v", len(serviceNames)-2, vetoRequests)
+	}
+	for _, vetoRequest := range vetoRequests {
+		if vetoRequest.Namespace != "default-tenant" || vetoRequest.ScaleEvent != "scaleToZeroStarted" ||
+			!stringSliceContainsString(serviceNames, vetoRequest.Service) {
+			t.Fatalf("Unexpected veto request %v", vetoRequest)
+		}
+	}
+
+	// vetoes are written to the audit log with their reason
+	expectedReasons := map[string]string{
+		"busy":                "Training a model",
+		"busy-without-reason": "Service is busy",
+		"timeout-veto":        "",
+		"error-default":       "",
+		"malformed-veto":      "",
+	}
+	scanner := bufio.NewScanner(auditBuffer)
+	for scanner.Scan() {
+		entry := audit.Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Failed to decode audit entry: %v", err)
+		}
+
+		if entry.Outcome != audit.VetoedOutcome || entry.OperationID != "operation" || len(entry.Services) != 1 {
+			t.Fatalf("Unexpected audit entry %v", entry)
+		}
+
+		expectedReason, found := expectedReasons[entry.Services[0]]
+		if !found {
+			t.Fatalf("Unexpected veto of %s", entry.Services[0])
+		}
+
+		if expectedReason != "" && entry.Reason != expectedReason {
+			t.Fatalf("Expected veto reason %s of %s, got %s", expectedReason, entry.Services[0], entry.Reason)
+		}
+
+		if entry.Reason == "" {
+			t.Fatalf("Expected a veto reason of %s", entry.Services[0])
+		}
+
+		delete(expectedReasons, entry.Services[0])
+	}
+
+	if len(expectedReasons) != 0 {
+		t.Fatalf("Expected vetoes of %v to be audited", expectedReasons)
+	}
+}
+
+func TestParseVetoHook(t *testing.T) {
+	for _, testCase := range []struct {
+		name             string
+		vetoHook         interface{}
+		mode             string
+		expectedVetoHook *VetoHook
+		expectedError    bool
+	}{
+		{
+			name:             "defaults",
+			vetoHook:         map[string]interface{}{"url": "http://jupyter:8888/veto"},
+			expectedVetoHook: &VetoHook{URL: "http://jupyter:8888/veto", Timeout: DefaultVetoHookTimeout, OnFailure: VetoOnFailure},
+		},
+		{
+			name:             "explicit",
+			vetoHook:         map[string]interface{}{"url": "https://jupyter/veto", "timeout": "1s", "on_failure": "allow"},
+			expectedVetoHook: &VetoHook{URL: "https://jupyter/veto", Timeout: time.Second, OnFailure: AllowOnFailure},
+		},
+		{
+			name:     "disabled mode",
+			vetoHook: map[string]interface{}{"url": "http://jupyter:8888/veto"},
+			mode:     "disabled",
+		},
+		{name: "not an object", vetoHook: "http://jupyter:8888/veto", expectedError: true},
+		{name: "no url", vetoHook: map[string]interface{}{}, expectedError: true},
+		{name: "unsupported scheme", vetoHook: map[string]interface{}{"url": "ftp://jupyter/veto"}, expectedError: true},
+		{name: "invalid timeout", vetoHook: map[string]interface{}{"url": "http://j/veto", "timeout": "soon"}, expectedError: true},
+		{name: "negative timeout", vetoHook: map[string]interface{}{"url": "http://j/veto", "timeout": "-1s"}, expectedError: true},
+		{name: "unknown on_failure", vetoHook: map[string]interface{}{"url": "http://j/veto", "on_failure": "retry"}, expectedError: true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			mode := testCase.mode
+			if mode == "" {
+				mode = EnabledScaleToZeroMode
+			}
+
+			vetoHook, err := ParseVetoHook(map[string]interface{}{
+				"scale_to_zero": map[string]interface{}{"mode": mode, "veto_hook": testCase.vetoHook},
+			})
+			if testCase.expectedError {
+				if err == nil {
+					t.Fatalf("Expected an error, got %v", vetoHook)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if (vetoHook == nil) != (testCase.expectedVetoHook == nil) ||
+				(vetoHook != nil && *vetoHook != *testCase.expectedVetoHook) {
+				t.Fatalf("Expected veto hook %v, got %v", testCase.expectedVetoHook, vetoHook)
+			}
+		})
+	}
+}
+
+func stringSlicesEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+
+	return true
+}
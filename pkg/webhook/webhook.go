@@ -0,0 +1,449 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/v3io/app-resource-scaler/pkg/resourcescaler"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const iguazioTenantAppServiceSetKind = "IguazioTenantAppServiceSet"
+
+type Options struct {
+	ListenAddress string
+	TLSCertFile   string
+	TLSKeyFile    string
+
+	// when enabled, the mutating endpoint fills missing scale_to_zero fields with defaults
+	DefaultMissingFields bool
+	DefaultWindowSize    time.Duration
+}
+
+// Server serves admission reviews for IguazioTenantAppServiceSet objects, rejecting broken scale_to_zero blocks
+// before they reach the autoscaler
+type Server struct {
+	logger  logger.Logger
+	options Options
+	mux     *http.ServeMux
+	server  *http.Server
+}
+
+func NewServer(parentLogger logger.Logger, options Options) (*Server, error) {
+	if options.DefaultMissingFields && options.DefaultWindowSize <= 0 {
+		return nil, errors.New("Default window size must be positive when defaulting missing fields")
+	}
+
+	s := &Server{
+		logger:  parentLogger.GetChild("webhook"),
+		options: options,
+		mux:     http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/validate", s.handleValidate)
+	s.mux.HandleFunc("/mutate", s.handleMutate)
+	s.mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	s.server = &http.Server{
+		Addr:              options.ListenAddress,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return s, nil
+}
+
+// Handler returns the http handler serving the admission endpoints
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+func (s *Server) Start() error {
+	s.logger.InfoWith("Starting",
+		"listenAddress", s.options.ListenAddress,
+		"tls", s.options.TLSCertFile != "",
+		"defaultMissingFields", s.options.DefaultMissingFields)
+
+	go func() {
+		var err error
+		if s.options.TLSCertFile != "" {
+			err = s.server.ListenAndServeTLS(s.options.TLSCertFile, s.options.TLSKeyFile)
+		} else {
+			err = s.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			s.logger.ErrorWith("Webhook server stopped unexpectedly", "err", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	s.logger.DebugWith("Stopping", "listenAddress", s.options.ListenAddress)
+	return s.server.Shutdown(ctx)
+}
+
+func (s *Server) handleValidate(w http.ResponseWriter, r *http.Request) {
+	s.serveAdmissionReview(w, r, s.validate)
+}
+
+func (s *Server) handleMutate(w http.ResponseWriter, r *http.Request) {
+	s.serveAdmissionReview(w, r, s.mutate)
+}
+
+func (s *Server) serveAdmissionReview(w http.ResponseWriter,
+	r *http.Request,
+	reviewFunc func(*admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) {
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.logger.WarnWith("Failed reading admission review body", "err", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	admissionReview := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, &admissionReview); err != nil {
+		s.logger.WarnWith("Failed decoding admission review", "err", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if admissionReview.Request == nil {
+		s.logger.WarnWith("Admission review has no request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	response := reviewFunc(admissionReview.Request)
+	response.UID = admissionReview.Request.UID
+
+	encodedResponse, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Response: response,
+	})
+	if err != nil {
+		s.logger.WarnWith("Failed encoding admission review response", "err", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encodedResponse) // nolint: errcheck
+}
+
+func (s *Server) validate(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	specServicesMap, skip := s.getSpecServices(request)
+	if skip {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	oldSpecServicesMap := s.getOldSpecServices(request)
+
+	var validationErrors, warnings []string
+	for _, serviceName := range sortedServiceNames(specServicesMap) {
+		err := validateServiceSpec(specServicesMap[serviceName])
+		if err == nil {
+			continue
+		}
+
+		message := fmt.Sprintf("service %s: %s", serviceName, flattenErrorMessage(err))
+
+		// services that were already invalid are let through, so they don't block unrelated updates of the
+		// service set, e.g. the scaler's own patches
+		if oldServiceSpec, found := oldSpecServicesMap[serviceName]; found &&
+			!validatedFieldsChanged(specServicesMap[serviceName], oldServiceSpec) {
+			warnings = append(warnings, "Unchanged invalid scale_to_zero configuration of "+message)
+			continue
+		}
+
+		validationErrors = append(validationErrors, message)
+	}
+
+	if len(warnings) > 0 {
+		s.logger.InfoWith("Admitting service set with unchanged invalid scale_to_zero configuration",
+			"namespace", request.Namespace,
+			"name", request.Name,
+			"warnings", warnings)
+	}
+
+	if len(validationErrors) == 0 {
+		return &admissionv1.AdmissionResponse{Allowed: true, Warnings: warnings}
+	}
+
+	s.logger.InfoWith("Rejecting service set with invalid scale_to_zero configuration",
+		"namespace", request.Namespace,
+		"name", request.Name,
+		"errors", validationErrors)
+
+	return &admissionv1.AdmissionResponse{
+		Allowed:  false,
+		Warnings: warnings,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+			Message: "Invalid scale_to_zero configuration: " + strings.Join(validationErrors, "; "),
+		},
+	}
+}
+
+func (s *Server) mutate(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if !s.options.DefaultMissingFields {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	specServicesMap, skip := s.getSpecServices(request)
+	if skip {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	var jsonPatchMapper []map[string]interface{}
+	for _, serviceName := range sortedServiceNames(specServicesMap) {
+		jsonPatchMapper = s.appendScaleToZeroDefaultsJSONPatchOperations(jsonPatchMapper,
+			serviceName,
+			specServicesMap[serviceName])
+	}
+
+	if len(jsonPatchMapper) == 0 {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	patch, err := json.Marshal(jsonPatchMapper)
+	if err != nil {
+		s.logger.WarnWith("Failed marshalling defaults json patch, admitting as is", "err", err.Error())
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	s.logger.DebugWith("Defaulting missing scale_to_zero fields",
+		"namespace", request.Namespace,
+		"name", request.Name,
+		"patch", string(patch))
+
+	patchType := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patch,
+		PatchType: &patchType,
+	}
+}
+
+// getSpecServices returns the services of the reviewed service set, or skip=true if the request
+// is not something this webhook has an opinion on
+func (s *Server) getSpecServices(request *admissionv1.AdmissionRequest) (map[string]interface{}, bool) {
+	if request.Kind.Kind != iguazioTenantAppServiceSetKind {
+		return nil, true
+	}
+
+	if request.Operation != admissionv1.Create && request.Operation != admissionv1.Update {
+		return nil, true
+	}
+
+	return s.parseSpecServices(request, request.Object.Raw)
+}
+
+// getOldSpecServices returns the services of the service set before the update, or none if there's no such
+func (s *Server) getOldSpecServices(request *admissionv1.AdmissionRequest) map[string]interface{} {
+	if request.Operation != admissionv1.Update || len(request.OldObject.Raw) == 0 {
+		return nil
+	}
+
+	oldSpecServicesMap, _ := s.parseSpecServices(request, request.OldObject.Raw)
+	return oldSpecServicesMap
+}
+
+func (s *Server) parseSpecServices(request *admissionv1.AdmissionRequest,
+	raw []byte) (map[string]interface{}, bool) {
+
+	var iguazioTenantAppServicesSetMap map[string]interface{}
+	if err := json.Unmarshal(raw, &iguazioTenantAppServicesSetMap); err != nil {
+		s.logger.WarnWith("Failed decoding reviewed object, admitting as is",
+			"namespace", request.Namespace,
+			"name", request.Name,
+			"err", err.Error())
+		return nil, true
+	}
+
+	// only the services are reviewed, the rest of the service set is admitted as is
+	specServicesMap, err := resourcescaler.ParseSpecServices(iguazioTenantAppServicesSetMap)
+	if err != nil {
+		s.logger.DebugWith("Service set has no services to review",
+			"namespace", request.Namespace,
+			"name", request.Name,
+			"reason", err.Error())
+		return nil, true
+	}
+
+	return specServicesMap, false
+}
+
+func (s *Server) appendScaleToZeroDefaultsJSONPatchOperations(jsonPatchMapper []map[string]interface{},
+	serviceName string,
+	serviceSpecInterface interface{}) []map[string]interface{} {
+
+	serviceSpec, ok := serviceSpecInterface.(map[string]interface{})
+	if !ok {
+		return jsonPatchMapper
+	}
+
+	scaleToZeroSpec, ok := serviceSpec["scale_to_zero"].(map[string]interface{})
+	if !ok {
+		return jsonPatchMapper
+	}
+
+	scaleToZeroPath := fmt.Sprintf("/spec/spec/tenants/0/spec/services/%s/scale_to_zero", serviceName)
+
+	if _, found := scaleToZeroSpec["mode"]; !found {
+		jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
+			"op":    "add",
+			"path":  scaleToZeroPath + "/mode",
+			"value": "disabled",
+		})
+	}
+
+	scaleResourcesList, ok := scaleToZeroSpec["scale_resources"].([]interface{})
+	if !ok {
+		return jsonPatchMapper
+	}
+
+	for scaleResourceIndex, scaleResourceInterface := range scaleResourcesList {
+		scaleResource, ok := scaleResourceInterface.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		scaleResourcePath := fmt.Sprintf("%s/scale_resources/%d", scaleToZeroPath, scaleResourceIndex)
+		if _, found := scaleResource["window_size"]; !found {
+			jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
+				"op":    "add",
+				"path":  scaleResourcePath + "/window_size",
+				"value": s.options.DefaultWindowSize.String(),
+			})
+		}
+
+		if _, found := scaleResource["threshold"]; !found {
+			jsonPatchMapper = append(jsonPatchMapper, map[string]interface{}{
+				"op":    "add",
+				"path":  scaleResourcePath + "/threshold",
+				"value": 0,
+			})
+		}
+	}
+
+	return jsonPatchMapper
+}
+
+// validateServiceSpec validates the scale_to_zero block of a single service spec
+func validateServiceSpec(serviceSpec interface{}) error {
+	if _, err := resourcescaler.ParseScaleResources(serviceSpec); err != nil {
+		return err
+	}
+
+	if _, err := resourcescaler.ParseVetoHook(serviceSpec); err != nil {
+		return err
+	}
+
+	if _, err := resourcescaler.ParseReadinessProbe(serviceSpec); err != nil {
+		return err
+	}
+
+	if _, err := resourcescaler.ParsePinnedUntil(serviceSpec); err != nil {
+		return err
+	}
+
+	if _, err := resourcescaler.ParsePrewarmSpec(serviceSpec); err != nil {
+		return err
+	}
+
+	if _, _, err := resourcescaler.ParseReplicas(serviceSpec); err != nil {
+		return err
+	}
+
+	if _, err := resourcescaler.ParseHold(serviceSpec); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validatedFieldsChanged returns whether any of the service spec fields validated by the webhook changed
+func validatedFieldsChanged(serviceSpecInterface interface{}, oldServiceSpecInterface interface{}) bool {
+	serviceSpec, _ := serviceSpecInterface.(map[string]interface{})
+	oldServiceSpec, ok := oldServiceSpecInterface.(map[string]interface{})
+	if !ok {
+		return true
+	}
+
+	for _, fieldName := range []string{"scale_to_zero", "replicas"} {
+		if !reflect.DeepEqual(serviceSpec[fieldName], oldServiceSpec[fieldName]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortedServiceNames(specServicesMap map[string]interface{}) []string {
+	serviceNames := make([]string, 0, len(specServicesMap))
+	for serviceName := range specServicesMap {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+	return serviceNames
+}
+
+// flattenErrorMessage joins the messages of an error chain, outermost first, so it can be returned to the user
+func flattenErrorMessage(err error) string {
+	var messages []string
+	for {
+		messages = append(messages, err.Error())
+		cause := errors.Cause(err)
+		if cause == err {
+			break
+		}
+		err = cause
+	}
+	return strings.Join(messages, ": ")
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2019 Iguazio Systems Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License") with
+an addition restriction as set forth herein. You may not use this
+file except in compliance with the License. You may obtain a copy of
+the License at http://www.apache.org/licenses/LICENSE-2.0.
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing
+permissions and limitations under the License.
+
+In addition, you may not use the software for any purposes that are
+illegal under applicable law, and the grant of the foregoing license
+under the Apache 2.0 license is conditioned upon your compliance with
+such restriction.
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	nucliozap "github.com/nuclio/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	validScaleToZero = `{"mode": "enabled", "scale_resources": [{"metric_name": "num_of_requests", ` +
+		`"threshold": 0, "window_size": "30m"}]}`
+	invalidScaleToZero             = `{"mode": "enabled"}`
+	partialScaleToZero             = `{"scale_resources": [{"metric_name": "num_of_requests"}]}`
+	invalidProbeMonitorScaleToZero = `{"mode": "monitor", "scale_resources": [{"metric_name": "num_of_requests", ` +
+		`"threshold": 0, "window_size": "30m"}], "readiness_probe": {"period": "-1s"}}`
+)
+
+func newTestServer(t *testing.T, options Options) *httptest.Server {
+	loggerInstance, err := nucliozap.NewNuclioZap("test", "console", nil, os.Stdout, os.Stderr, nucliozap.DebugLevel)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	server, err := NewServer(loggerInstance, options)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	httpServer := httptest.NewServer(server.Handler())
+	t.Cleanup(httpServer.Close)
+
+	return httpServer
+}
+
+// serviceSet returns a raw service set whose services have the given scale_to_zero blocks
+func serviceSet(scaleToZeroBlocks map[string]string) []byte {
+	services := map[string]json.RawMessage{}
+	for serviceName, scaleToZeroBlock := range scaleToZeroBlocks {
+		services[serviceName] = json.RawMessage(`{"desired_state": "ready", "scale_to_zero": ` + scaleToZeroBlock + `}`)
+	}
+
+	encodedServices, _ := json.Marshal(services)
+	return []byte(`{"kind": "IguazioTenantAppServiceSet", "spec": {"spec": {"tenants": [{"spec": {"services": ` +
+		string(encodedServices) + `}}]}}}`)
+}
+
+func review(t *testing.T,
+	httpServer *httptest.Server,
+	path string,
+	request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  request,
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode admission review: %v", err)
+	}
+
+	response, err := http.Post(httpServer.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to post admission review: %v", err)
+	}
+	defer response.Body.Close() // nolint: errcheck
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", response.StatusCode)
+	}
+
+	admissionReview := admissionv1.AdmissionReview{}
+	if err := json.NewDecoder(response.Body).Decode(&admissionReview); err != nil {
+		t.Fatalf("Failed to decode admission review: %v", err)
+	}
+
+	if admissionReview.Response == nil {
+		t.Fatal("Admission review has no response")
+	}
+
+	if admissionReview.Response.UID != request.UID {
+		t.Fatalf("Expected response UID %s, got %s", request.UID, admissionReview.Response.UID)
+	}
+
+	return admissionReview.Response
+}
+
+func newRequest(operation admissionv1.Operation, kind string, object []byte, oldObject []byte) *admissionv1.AdmissionRequest {
+	return &admissionv1.AdmissionRequest{
+		UID:       types.UID("test-uid"),
+		Kind:      metav1.GroupVersionKind{Group: "iguazio.com", Version: "v1beta1", Kind: kind},
+		Namespace: "default-tenant",
+		Name:      "default-tenant",
+		Operation: operation,
+		Object:    runtime.RawExtension{Raw: object},
+		OldObject: runtime.RawExtension{Raw: oldObject},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	httpServer := newTestServer(t, Options{})
+
+	for _, testCase := range []struct {
+		name             string
+		request          *admissionv1.AdmissionRequest
+		expectedAllowed  bool
+		expectedWarnings int
+	}{
+		{
+			name: "valid",
+			request: newRequest(admissionv1.Update,
+				iguazioTenantAppServiceSetKind,
+				serviceSet(map[string]string{"jupyter": validScaleToZero}),
+				serviceSet(map[string]string{"jupyter": invalidScaleToZero})),
+			expectedAllowed: true,
+		},
+		{
+			name: "invalid on create",
+			request: newRequest(admissionv1.Create,
+				iguazioTenantAppServiceSetKind,
+				serviceSet(map[string]string{"jupyter": invalidScaleToZero}),
+				nil),
+			expectedAllowed: false,
+		},
+		{
+			name: "changed to invalid",
+			request: newRequest(admissionv1.Update,
+				iguazioTenantAppServiceSetKind,
+				serviceSet(map[string]string{"jupyter": invalidScaleToZero}),
+				serviceSet(map[string]string{"jupyter": validScaleToZero})),
+			expectedAllowed: false,
+		},
+		{
+			name: "added invalid",
+			request: newRequest(admissionv1.Update,
+				iguazioTenantAppServiceSetKind,
+				serviceSet(map[string]string{"jupyter": validScaleToZero, "spark": invalidScaleToZero}),
+				serviceSet(map[string]string{"jupyter": validScaleToZero})),
+			expectedAllowed: false,
+		},
+		{
+			name: "unchanged invalid",
+			request: newRequest(admissionv1.Update,
+				iguazioTenantAppServiceSetKind,
+				serviceSet(map[string]string{"jupyter": invalidScaleToZero, "spark": validScaleToZero}),
+				serviceSet(map[string]string{"jupyter": invalidScaleToZero})),
+			expectedAllowed:  true,
+			expectedWarnings: 1,
+		},
+		{
+			name: "invalid readiness probe in monitor mode",
+			request: newRequest(admissionv1.Create,
+				iguazioTenantAppServiceSetKind,
+				serviceSet(map[string]string{"jupyter": invalidProbeMonitorScaleToZero}),
+				nil),
+			expectedAllowed: false,
+		},
+		{
+			name: "wrong kind",
+			request: newRequest(admissionv1.Update,
+				"ConfigMap",
+				serviceSet(map[string]string{"jupyter": invalidScaleToZero}),
+				nil),
+			expectedAllowed: true,
+		},
+		{
+			name: "delete",
+			request: newRequest(admissionv1.Delete,
+				iguazioTenantAppServiceSetKind,
+				nil,
+				serviceSet(map[string]string{"jupyter": invalidScaleToZero})),
+			expectedAllowed: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			response := review(t, httpServer, "/validate", testCase.request)
+
+			if response.Allowed != testCase.expectedAllowed {
+				t.Fatalf("Expected allowed %t, got %t (%v)", testCase.expectedAllowed, response.Allowed, response.Result)
+			}
+
+			if !response.Allowed && (response.Result == nil || response.Result.Code != http.StatusUnprocessableEntity) {
+				t.Fatalf("Expected an unprocessable entity result, got %v", response.Result)
+			}
+
+			if len(response.Warnings) != testCase.expectedWarnings {
+				t.Fatalf("Expected %d warnings, got %v", testCase.expectedWarnings, response.Warnings)
+			}
+		})
+	}
+}
+
+func TestMutate(t *testing.T) {
+	httpServer := newTestServer(t, Options{DefaultMissingFields: true, DefaultWindowSize: 10 * time.Minute})
+
+	t.Run("defaulted", func(t *testing.T) {
+		response := review(t, httpServer, "/mutate", newRequest(admissionv1.Update,
+			iguazioTenantAppServiceSetKind,
+			serviceSet(map[string]string{"jupyter": partialScaleToZero}),
+			nil))
+
+		if !response.Allowed {
+			t.Fatalf("Expected request to be allowed, got %v", response.Result)
+		}
+
+		if response.PatchType == nil || *response.PatchType != admissionv1.PatchTypeJSONPatch {
+			t.Fatalf("Expected a json patch, got %v", response.PatchType)
+		}
+
+		var jsonPatchMapper []map[string]interface{}
+		if err := json.Unmarshal(response.Patch, &jsonPatchMapper); err != nil {
+			t.Fatalf("Failed to decode patch: %v", err)
+		}
+
+		scaleToZeroPath := "/spec/spec/tenants/0/spec/services/jupyter/scale_to_zero"
+		expectedValues := map[string]interface{}{
+			scaleToZeroPath + "/mode":                          "disabled",
+			scaleToZeroPath + "/scale_resources/0/window_size": "10m0s",
+			scaleToZeroPath + "/scale_resources/0/threshold":   float64(0),
+		}
+		if len(jsonPatchMapper) != len(expectedValues) {
+			t.Fatalf("Expected %d operations, got %v", len(expectedValues), jsonPatchMapper)
+		}
+
+		for _, operation := range jsonPatchMapper {
+			expectedValue, found := expectedValues[operation["path"].(string)]
+			if !found || operation["op"] != "add" || operation["value"] != expectedValue {
+				t.Fatalf("Unexpected operation %v", operation)
+			}
+		}
+	})
+
+	t.Run("complete", func(t *testing.T) {
+		response := review(t, httpServer, "/mutate", newRequest(admissionv1.Update,
+			iguazioTenantAppServiceSetKind,
+			serviceSet(map[string]string{"jupyter": validScaleToZero}),
+			nil))
+
+		if !response.Allowed || response.Patch != nil {
+			t.Fatalf("Expected request to be allowed as is, got %v", response)
+		}
+	})
+
+	t.Run("skipped", func(t *testing.T) {
+		for _, request := range []*admissionv1.AdmissionRequest{
+			newRequest(admissionv1.Update, "ConfigMap", serviceSet(map[string]string{"jupyter": partialScaleToZero}), nil),
+			newRequest(admissionv1.Delete, iguazioTenantAppServiceSetKind, nil, nil),
+		} {
+			response := review(t, httpServer, "/mutate", request)
+			if !response.Allowed || response.Patch != nil {
+				t.Fatalf("Expected %s of %s to be allowed as is, got %v", request.Operation, request.Kind.Kind, response)
+			}
+		}
+	})
+}
+
+func TestServeAdmissionReviewMethodNotAllowed(t *testing.T) {
+	httpServer := newTestServer(t, Options{})
+
+	response, err := http.Get(httpServer.URL + "/validate")
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	response.Body.Close() // nolint: errcheck
+
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status code %d, got %d", http.StatusMethodNotAllowed, response.StatusCode)
+	}
+}